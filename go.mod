@@ -4,8 +4,10 @@ go 1.24.1
 
 require (
 	github.com/stretchr/testify v1.10.0
+	go.etcd.io/bbolt v1.4.3
 	golang.org/x/oauth2 v0.30.0
 	golang.org/x/term v0.32.0
+	golang.org/x/text v0.25.0
 	google.golang.org/api v0.233.0
 )
 
@@ -30,7 +32,6 @@ require (
 	golang.org/x/crypto v0.38.0 // indirect
 	golang.org/x/net v0.40.0 // indirect
 	golang.org/x/sys v0.33.0 // indirect
-	golang.org/x/text v0.25.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20250505200425-f936aa4a68b2 // indirect
 	google.golang.org/grpc v1.72.0 // indirect
 	google.golang.org/protobuf v1.36.6 // indirect
@@ -1,16 +1,18 @@
 package internal
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
 	"extract-email-attachments/internal/config"
 
+	bolt "go.etcd.io/bbolt"
 	"google.golang.org/api/gmail/v1"
 )
 
@@ -28,12 +30,39 @@ type ActivityManagerInterface interface {
 	StoreAttachmentMeta(string, string, string) error
 	ReadLastFetchTime() (string, error)
 	StoreLastFetchTime() error
-	UpdateAttachmentStatus(string, string) error
+	UpdateAttachmentStatus(string, string, string) error
+	UpdateAttachmentInvoice(string, string, InvoiceFields) error
+	UpdateAttachmentPath(string, string, string) error
 	GetEmailByID(string) (*EmailData, error)
+	GetAttachment(string) (AttachmentData, error)
+	GetAttachmentByFilename(string) (AttachmentData, error)
+	StoreDiscoveredEmail(string) error
+	UpdateEmailState(string, string, error) error
+	GetRetryableEmailIDs() []string
 }
 
-// ActivityData represents the structure of the activity.json file.
+// Message states. A message goes from discovered to downloading, then to
+// downloaded once all its attachments are on disk, and to processed once
+// ProcessAttachments has handled them. A message that failed is retried on
+// later runs until it reaches config.MaxMessageAttempts.
+const (
+	MessageStateDiscovered  = "discovered"
+	MessageStateDownloading = "downloading"
+	MessageStateDownloaded  = "downloaded"
+	MessageStateProcessed   = "processed"
+	MessageStateFailed      = "failed"
+)
+
+// Attachment statuses. An encrypted PDF that none of the passwords of
+// passwords.json opens requires a password, and is retried on later runs.
+const (
+	AttachmentStatusProcessed        = "processed"
+	AttachmentStatusPasswordRequired = "password-required"
+)
+
+// ActivityData represents the activity data, as stored in the legacy activity.json file.
 type ActivityData struct {
+	SchemaVersion int              `json:"schemaVersion"`
 	LastFetchTime string           `json:"lastFetchTime"`
 	Emails        []EmailData      `json:"emails"`
 	Attachments   []AttachmentData `json:"attachments"`
@@ -46,104 +75,248 @@ type EmailData struct {
 	Subject     string `json:"subject"`
 	SenderName  string `json:"senderName"`
 	SenderEmail string `json:"senderEmail"`
+	State       string `json:"state,omitempty"`
+	Attempts    int    `json:"attempts,omitempty"`
+	LastError   string `json:"lastError,omitempty"`
+	// Mailbox is the outcome applied to the message in Gmail, see LabelMessages
+	Mailbox string `json:"mailbox,omitempty"`
 }
 
 // AttachmentData represents the structure for storing attachment metadata.
 type AttachmentData struct {
-	Filename   string `json:"filename"`
-	EmailID    string `json:"emailId"`
-	Status     string `json:"status,omitempty"`
-	Sha256Hash string `json:"sha256Hash,omitempty"`
+	Filename   string         `json:"filename"`
+	EmailID    string         `json:"emailId"`
+	Status     string         `json:"status,omitempty"`
+	Sha256Hash string         `json:"sha256Hash,omitempty"`
+	Invoice    *InvoiceFields `json:"invoice,omitempty"`
+	// Path is where the document was filed by a rule
+	Path string `json:"path,omitempty"`
 }
 
 // ActivityManager manages the activity data operations.
+// Data is persisted in an embedded database and kept in memory with indexes
+// for lookups; Save writes only the records changed since the last save.
 type ActivityManager struct {
 	mu       sync.RWMutex
 	data     ActivityData
-	filePath string
+	dbPath   string
+	filePath string // legacy activity.json, imported once into the database
+
+	// Indexes on data, rebuilt by Load
+	emailsByID        map[string]int
+	attachmentsByName map[string][]int
+	attachmentsByHash map[string][]int
+	changes           activityChanges
+	// readOnly is set by LoadReadOnly: Save writes nothing
+	readOnly bool
 }
 
+// GetAttachment returns the attachment with the given SHA-256 hash
 func (am *ActivityManager) GetAttachment(sha256Hash string) (AttachmentData, error) {
 	am.mu.RLock()
 	defer am.mu.RUnlock()
 
-	for _, attachment := range am.data.Attachments {
-		if attachment.Sha256Hash == sha256Hash {
-			return attachment, nil
-		}
+	if indexes := am.attachmentsByHash[sha256Hash]; len(indexes) > 0 {
+		return am.data.Attachments[indexes[0]], nil
 	}
 
 	return AttachmentData{}, fmt.Errorf("attachment not found: %s", sha256Hash)
 }
 
+// GetAttachmentByFilename returns the first attachment stored with the given filename
+func (am *ActivityManager) GetAttachmentByFilename(filename string) (AttachmentData, error) {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	if indexes := am.attachmentsByName[filename]; len(indexes) > 0 {
+		return am.data.Attachments[indexes[0]], nil
+	}
+
+	return AttachmentData{}, fmt.Errorf("attachment not found: %s", filename)
+}
+
+// Attachments returns the stored attachments, in storage order
+func (am *ActivityManager) Attachments() []AttachmentData {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	return slices.Clone(am.data.Attachments)
+}
+
+// Emails returns the stored emails, in storage order
+func (am *ActivityManager) Emails() []EmailData {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	return slices.Clone(am.data.Emails)
+}
+
 // NewActivityManager creates a new ActivityManager instance.
 func NewActivityManager() *ActivityManager {
-	return &ActivityManager{
-		data:     ActivityData{},
-		filePath: config.AppConfigDir + "/activity.json",
+	am := &ActivityManager{
+		dbPath:   filepath.Join(config.AppConfigDir, "activity.db"),
+		filePath: filepath.Join(config.AppConfigDir, "activity.json"),
+	}
+	am.setData(ActivityData{
+		Emails:      []EmailData{},
+		Attachments: []AttachmentData{},
+	})
+	return am
+}
+
+// setData replaces the in-memory data and rebuilds the indexes.
+func (am *ActivityManager) setData(data ActivityData) {
+	am.data = data
+	am.emailsByID = make(map[string]int, len(data.Emails))
+	am.attachmentsByName = make(map[string][]int, len(data.Attachments))
+	am.attachmentsByHash = make(map[string][]int, len(data.Attachments))
+	am.changes = newActivityChanges()
+
+	for i, email := range data.Emails {
+		am.emailsByID[email.ID] = i
+	}
+	for i := range data.Attachments {
+		am.indexAttachment(i)
 	}
 }
 
-// Load loads the activity data from the file into memory.
+// indexAttachment adds the attachment at position i to the indexes.
+func (am *ActivityManager) indexAttachment(i int) {
+	attachment := am.data.Attachments[i]
+	am.attachmentsByName[attachment.Filename] = append(am.attachmentsByName[attachment.Filename], i)
+	if attachment.Sha256Hash != "" {
+		am.attachmentsByHash[attachment.Sha256Hash] = append(am.attachmentsByHash[attachment.Sha256Hash], i)
+	}
+}
+
+// Load loads the activity data from the database into memory.
+// On first use, the legacy activity.json file is imported into the database.
+// Data written by an older version is backed up, then migrated to the current schema.
 func (am *ActivityManager) Load() error {
 	am.mu.Lock()
 	defer am.mu.Unlock()
 
-	file, err := os.Open(am.filePath)
+	db, err := openActivityDB(am.dbPath, am.filePath)
 	if err != nil {
-		// If the file does not exist, initialize the data structure
-		if os.IsNotExist(err) {
-			am.data = ActivityData{
-				Emails:      []EmailData{},
-				Attachments: []AttachmentData{},
-			}
-			return nil
+		return err
+	}
+	defer db.Close()
+
+	data, err := readActivityDB(db)
+	if err != nil {
+		return fmt.Errorf("error reading activity database: %v", err)
+	}
+
+	if data.SchemaVersion < currentSchemaVersion {
+		backupPath, err := backupActivityDB(db, data.SchemaVersion)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Backed up activity database to", backupPath)
+
+		if _, err := migrateActivityData(&data); err != nil {
+			return err
 		}
-		return fmt.Errorf("error opening activity file: %v", err)
+		err = db.Update(func(tx *bolt.Tx) error {
+			return writeAllActivityData(tx, &data)
+		})
+		if err != nil {
+			return fmt.Errorf("error writing migrated activity data: %v", err)
+		}
+	} else if data.SchemaVersion > currentSchemaVersion {
+		return fmt.Errorf("activity data schema version %d is newer than supported version %d", data.SchemaVersion, currentSchemaVersion)
 	}
-	defer file.Close()
 
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&am.data); err != nil {
-		return fmt.Errorf("error decoding activity data: %v", err)
+	am.setData(data)
+	return nil
+}
+
+// Backup keeps a snapshot of the activity database before a run modifies
+// it, as activity.db.1, the previous snapshots being shifted up to
+// config.ActivityBackupCount. A database which can no longer be opened is
+// replaced by the newest valid snapshot on load.
+func (am *ActivityManager) Backup() error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	return backupActivityDBSnapshot(am.dbPath)
+}
+
+// LoadReadOnly loads the activity data like Load, without writing anything:
+// the legacy activity.json file is read but not imported, data written by an
+// older version is migrated in memory only, and Save does nothing. It is used
+// by dry runs and the commands which only read it.
+func (am *ActivityManager) LoadReadOnly() error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	var data ActivityData
+	if _, err := os.Stat(am.dbPath); os.IsNotExist(err) {
+		data, err = readLegacyActivityFile(am.filePath)
+		if os.IsNotExist(err) {
+			data = ActivityData{SchemaVersion: currentSchemaVersion, Emails: []EmailData{}, Attachments: []AttachmentData{}}
+		} else if err != nil {
+			return err
+		}
+	} else {
+		db, err := bolt.Open(am.dbPath, defaultFilePerm, &bolt.Options{Timeout: 10 * time.Second, ReadOnly: true})
+		if err != nil {
+			return fmt.Errorf("error opening activity database: %v", err)
+		}
+		defer db.Close()
+
+		data, err = readActivityDB(db)
+		if err != nil {
+			return fmt.Errorf("error reading activity database: %v", err)
+		}
 	}
 
+	if _, err := migrateActivityData(&data); err != nil {
+		return err
+	}
+	am.setData(data)
+	am.readOnly = true
 	return nil
 }
 
-// Save writes the in-memory activity data back to the file.
+// Save writes the records changed in memory back to the database,
+// in a single transaction.
 func (am *ActivityManager) Save() error {
 	am.mu.Lock()
 	defer am.mu.Unlock()
 
-	// Marshal the data with indentation
-	data, err := json.MarshalIndent(am.data, "", "    ")
-	if err != nil {
-		return fmt.Errorf("error encoding activity data: %v", err)
+	if am.readOnly {
+		return nil
 	}
 
-	// Write the formatted data to the file
-	file, err := os.Create(am.filePath)
+	db, err := openActivityDB(am.dbPath, am.filePath)
 	if err != nil {
-		return fmt.Errorf("error creating activity file: %v", err)
+		return err
 	}
-	defer file.Close()
-
-	if _, err := file.Write(data); err != nil {
-		return fmt.Errorf("error writing to activity file: %v", err)
+	defer db.Close()
+
+	if !am.changes.empty() {
+		err = db.Update(func(tx *bolt.Tx) error {
+			return writeActivityChanges(tx, &am.data, am.changes)
+		})
+		if err != nil {
+			return fmt.Errorf("error writing activity data: %v", err)
+		}
+		am.changes = newActivityChanges()
 	}
 
-	fmt.Println("Saved activity data to", am.filePath)
+	fmt.Println("Saved activity data to", am.dbPath)
 	return nil
 }
 
 // ReadLastFetchTime reads the last fetch time from the in-memory activity data and formats it as '2006/01/02'.
+// Before the first run, it is lookbackDays days ago.
 func (am *ActivityManager) ReadLastFetchTime() (string, error) {
 	am.mu.RLock()
 	defer am.mu.RUnlock()
 
 	if am.data.LastFetchTime == "" {
-		return time.Now().AddDate(0, 0, -30).Format(config.DefaultDateFormat), nil
+		return initialFetchTime(), nil
 	}
 
 	t, err := time.Parse(time.RFC3339, am.data.LastFetchTime)
@@ -160,6 +333,7 @@ func (am *ActivityManager) StoreLastFetchTime() error {
 	defer am.mu.Unlock()
 
 	am.data.LastFetchTime = time.Now().Format(time.RFC3339)
+	am.changes.meta = true
 	fmt.Println("Updated last fetch time in memory.")
 	return nil
 }
@@ -176,11 +350,6 @@ func (am *ActivityManager) StoreEmailMeta(emailID string, msg *gmail.Message) er
 	am.mu.Lock()
 	defer am.mu.Unlock()
 
-	// Initialize EmailData if it doesn't exist
-	if am.data.Emails == nil {
-		am.data.Emails = []EmailData{}
-	}
-
 	// Extract the time from the email message
 	var emailDate string
 	var subject string
@@ -206,20 +375,52 @@ func (am *ActivityManager) StoreEmailMeta(emailID string, msg *gmail.Message) er
 		}
 	}
 
-	// Append the new email metadata
-	am.data.Emails = append(am.data.Emails, EmailData{
+	email := EmailData{
 		ID:          emailID,
 		Date:        emailDate,
 		Subject:     subject,
 		SenderName:  senderName,
 		SenderEmail: senderEmail,
-	})
+		State:       MessageStateDiscovered,
+	}
+
+	// Replace the existing metadata, keeping the processing state, or append the new one
+	if i, exists := am.emailsByID[emailID]; exists {
+		email.State = am.data.Emails[i].State
+		email.Attempts = am.data.Emails[i].Attempts
+		email.LastError = am.data.Emails[i].LastError
+		email.Mailbox = am.data.Emails[i].Mailbox
+		am.data.Emails[i] = email
+	} else {
+		am.data.Emails = append(am.data.Emails, email)
+		am.emailsByID[emailID] = len(am.data.Emails) - 1
+	}
+	am.changes.emails[emailID] = true
 
 	fmt.Printf("Stored email ID %s with date %s, subject: %s, sender: %s <%s> in memory.\n",
 		emailID, emailDate, subject, senderName, senderEmail)
 	return nil
 }
 
+// StoreDiscoveredEmail records a message known only by its ID, before it is fetched.
+func (am *ActivityManager) StoreDiscoveredEmail(emailID string) error {
+	if emailID == "" {
+		return fmt.Errorf("email ID cannot be empty")
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	if _, exists := am.emailsByID[emailID]; exists {
+		return nil
+	}
+
+	am.data.Emails = append(am.data.Emails, EmailData{ID: emailID, State: MessageStateDiscovered})
+	am.emailsByID[emailID] = len(am.data.Emails) - 1
+	am.changes.emails[emailID] = true
+	return nil
+}
+
 // StoreAttachmentMeta stores the metadata of an attachment into the in-memory activity data.
 func (am *ActivityManager) StoreAttachmentMeta(filename string, emailID string, sha256Hash string) error {
 	if filename == "" {
@@ -232,17 +433,15 @@ func (am *ActivityManager) StoreAttachmentMeta(filename string, emailID string,
 	am.mu.Lock()
 	defer am.mu.Unlock()
 
-	// Initialize Attachments if it doesn't exist
-	if am.data.Attachments == nil {
-		am.data.Attachments = []AttachmentData{}
-	}
-
 	// Append the new attachment metadata
 	am.data.Attachments = append(am.data.Attachments, AttachmentData{
 		EmailID:    emailID,
 		Filename:   filename,
 		Sha256Hash: sha256Hash,
 	})
+	i := len(am.data.Attachments) - 1
+	am.indexAttachment(i)
+	am.changes.attachments[i] = true
 
 	fmt.Printf("Stored attachment %s for email ID %s in memory.\n", filename, emailID)
 	return nil
@@ -271,30 +470,151 @@ func (am *ActivityManager) HasEmailID(emailID string) bool {
 	am.mu.RLock()
 	defer am.mu.RUnlock()
 
+	_, exists := am.emailsByID[emailID]
+	return exists
+}
+
+// isRetryableEmail checks if a known message must be downloaded again.
+func isRetryableEmail(email EmailData) bool {
+	switch email.State {
+	case MessageStateDiscovered, MessageStateDownloading, MessageStateFailed:
+		return email.Attempts < config.MaxMessageAttempts
+	default:
+		return false
+	}
+}
+
+// UpdateEmailState records a state transition of a message. Entering the
+// downloading state counts as a new attempt; cause is the reason of a failure.
+func (am *ActivityManager) UpdateEmailState(emailID string, state string, cause error) error {
+	if emailID == "" {
+		return fmt.Errorf("email ID cannot be empty")
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	i, exists := am.emailsByID[emailID]
+	if !exists {
+		return fmt.Errorf("email not found: %s", emailID)
+	}
+
+	email := &am.data.Emails[i]
+	email.State = state
+	switch {
+	case state == MessageStateDownloading:
+		email.Attempts++
+	case cause != nil:
+		email.LastError = cause.Error()
+	case state == MessageStateDownloaded:
+		email.LastError = ""
+	}
+	am.changes.emails[emailID] = true
+	return nil
+}
+
+// UpdateEmailMailbox records the outcome applied to a message in Gmail
+func (am *ActivityManager) UpdateEmailMailbox(emailID string, mailbox string) error {
+	if emailID == "" {
+		return fmt.Errorf("email ID cannot be empty")
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	i, exists := am.emailsByID[emailID]
+	if !exists {
+		return fmt.Errorf("email not found: %s", emailID)
+	}
+	am.data.Emails[i].Mailbox = mailbox
+	am.changes.emails[emailID] = true
+	return nil
+}
+
+// GetRetryableEmailIDs returns the IDs of the messages to download again, in storage order
+func (am *ActivityManager) GetRetryableEmailIDs() []string {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	var ids []string
 	for _, email := range am.data.Emails {
-		if email.ID == emailID {
+		if isRetryableEmail(email) {
+			ids = append(ids, email.ID)
+		}
+	}
+	return ids
+}
+
+// HasAttachment checks if an attachment of the given message is already stored.
+func (am *ActivityManager) HasAttachment(emailID string, filename string) bool {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	for _, i := range am.attachmentsByName[filename] {
+		if am.data.Attachments[i].EmailID == emailID {
 			return true
 		}
 	}
 	return false
 }
 
-// UpdateAttachmentStatus updates the status of an attachment
-func (am *ActivityManager) UpdateAttachmentStatus(filename string, status string) error {
+// attachmentIndex returns the position of the attachment filename of the
+// message emailID. The caller holds the lock.
+func (am *ActivityManager) attachmentIndex(emailID string, filename string) (int, error) {
 	if filename == "" {
-		return fmt.Errorf("filename cannot be empty")
+		return 0, fmt.Errorf("filename cannot be empty")
+	}
+	for _, i := range am.attachmentsByName[filename] {
+		if am.data.Attachments[i].EmailID == emailID {
+			return i, nil
+		}
 	}
+	return 0, fmt.Errorf("attachment not found: %s of email ID %s", filename, emailID)
+}
 
+// UpdateAttachmentStatus updates the status of an attachment of a message
+func (am *ActivityManager) UpdateAttachmentStatus(emailID string, filename string, status string) error {
 	am.mu.Lock()
 	defer am.mu.Unlock()
 
-	for i, attachment := range am.data.Attachments {
-		if attachment.Filename == filename {
-			am.data.Attachments[i].Status = status
-			return nil
-		}
+	i, err := am.attachmentIndex(emailID, filename)
+	if err != nil {
+		return err
+	}
+
+	am.data.Attachments[i].Status = status
+	am.changes.attachments[i] = true
+	return nil
+}
+
+// UpdateAttachmentInvoice stores the invoice fields extracted from an attachment of a message
+func (am *ActivityManager) UpdateAttachmentInvoice(emailID string, filename string, fields InvoiceFields) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	i, err := am.attachmentIndex(emailID, filename)
+	if err != nil {
+		return err
 	}
-	return fmt.Errorf("attachment not found: %s", filename)
+
+	am.data.Attachments[i].Invoice = &fields
+	am.changes.attachments[i] = true
+	return nil
+}
+
+// UpdateAttachmentPath records where an attachment of a message was filed
+func (am *ActivityManager) UpdateAttachmentPath(emailID string, filename string, path string) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	i, err := am.attachmentIndex(emailID, filename)
+	if err != nil {
+		return err
+	}
+
+	am.data.Attachments[i].Path = path
+	am.changes.attachments[i] = true
+	return nil
 }
 
 // GetEmailByID returns the email data for a given ID
@@ -306,10 +626,9 @@ func (am *ActivityManager) GetEmailByID(emailID string) (*EmailData, error) {
 	am.mu.RLock()
 	defer am.mu.RUnlock()
 
-	for _, email := range am.data.Emails {
-		if email.ID == emailID {
-			return &email, nil
-		}
+	if i, exists := am.emailsByID[emailID]; exists {
+		email := am.data.Emails[i]
+		return &email, nil
 	}
 	return nil, fmt.Errorf("email not found: %s", emailID)
 }
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"extract-email-attachments/internal/config"
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
@@ -69,7 +70,7 @@ func TestActivityManager(t *testing.T) {
 	assert.Equal(t, emailID, attachment.EmailID)
 
 	// Tester la mise à jour du statut de la pièce jointe
-	err = am.UpdateAttachmentStatus(filename, "processed")
+	err = am.UpdateAttachmentStatus(emailID, filename, "processed")
 	assert.NoError(t, err)
 
 	// Vérifier que le statut a été mis à jour
@@ -91,8 +92,8 @@ func TestActivityManager(t *testing.T) {
 	err = am.Save()
 	assert.NoError(t, err)
 
-	// Vérifier que le fichier de données a été créé
-	dataFile := filepath.Join(tempDir, "activity.json")
+	// Vérifier que la base de données a été créée
+	dataFile := filepath.Join(tempDir, "activity.db")
 	_, err = os.Stat(dataFile)
 	assert.NoError(t, err)
 }
@@ -122,6 +123,234 @@ func TestActivityManagerErrors(t *testing.T) {
 	assert.Error(t, err)
 
 	// Tester la mise à jour du statut d'une pièce jointe inexistante
-	err = am.UpdateAttachmentStatus("non-existent.pdf", "processed")
+	err = am.UpdateAttachmentStatus("non-existent", "non-existent.pdf", "processed")
 	assert.Error(t, err)
 }
+
+func TestActivityManagerPersistence(t *testing.T) {
+	// Créer un dossier temporaire pour les tests
+	tempDir, err := os.MkdirTemp("", "activity-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	// Sauvegarder les valeurs originales
+	originalConfigDir := config.AppConfigDir
+	config.AppConfigDir = tempDir
+	defer func() {
+		config.AppConfigDir = originalConfigDir
+	}()
+
+	am := NewActivityManager()
+	assert.NoError(t, am.Load())
+
+	msg := &gmail.Message{
+		Id: "email-1",
+		Payload: &gmail.MessagePart{
+			Headers: []*gmail.MessagePartHeader{
+				{Name: "Subject", Value: "Facture"},
+				{Name: "From", Value: "Vendor <billing@vendor.com>"},
+			},
+		},
+	}
+	assert.NoError(t, am.StoreEmailMeta("email-1", msg))
+	assert.NoError(t, am.StoreAttachmentMeta("first.pdf", "email-1", "hash-1"))
+	assert.NoError(t, am.Save())
+
+	// Seules les modifications sont écrites lors des sauvegardes suivantes
+	assert.NoError(t, am.StoreAttachmentMeta("second.pdf", "email-1", "hash-2"))
+	assert.NoError(t, am.UpdateAttachmentStatus("email-1", "first.pdf", "processed"))
+	assert.NoError(t, am.StoreLastFetchTime())
+	assert.NoError(t, am.Save())
+
+	// Recharger les données depuis la base
+	reloaded := NewActivityManager()
+	assert.NoError(t, reloaded.Load())
+	assert.True(t, reloaded.HasEmailID("email-1"))
+	email, err := reloaded.GetEmailByID("email-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "billing@vendor.com", email.SenderEmail)
+
+	attachment, err := reloaded.GetAttachmentByFilename("first.pdf")
+	assert.NoError(t, err)
+	assert.Equal(t, "processed", attachment.Status)
+	attachment, err = reloaded.GetAttachment("hash-2")
+	assert.NoError(t, err)
+	assert.Equal(t, "second.pdf", attachment.Filename)
+
+	lastFetchTime, err := reloaded.ReadLastFetchTime()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Now().Format(config.DefaultDateFormat), lastFetchTime)
+}
+
+func TestActivityManagerLegacyImport(t *testing.T) {
+	// Créer un dossier temporaire pour les tests
+	tempDir, err := os.MkdirTemp("", "activity-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	// Sauvegarder les valeurs originales
+	originalConfigDir := config.AppConfigDir
+	config.AppConfigDir = tempDir
+	defer func() {
+		config.AppConfigDir = originalConfigDir
+	}()
+
+	// Fichier activity.json corrompu, avec une sauvegarde valide
+	legacyFile := filepath.Join(tempDir, "activity.json")
+	err = os.WriteFile(legacyFile, []byte(`{"emails": [`), 0644)
+	assert.NoError(t, err)
+	backup := `{
+		"lastFetchTime": "2025-05-01T10:00:00+02:00",
+		"emails": [{"id": "email-1", "subject": "Facture", "senderEmail": "billing@vendor.com"}],
+		"attachments": [{"filename": "invoice.pdf", "emailId": "email-1", "sha256Hash": "hash-1", "status": "processed"}]
+	}`
+	err = os.WriteFile(legacyFile+".1", []byte(backup), 0644)
+	assert.NoError(t, err)
+
+	// Le premier chargement importe la sauvegarde la plus récente
+	am := NewActivityManager()
+	assert.NoError(t, am.Load())
+	assert.True(t, am.HasEmailID("email-1"))
+	attachment, err := am.GetAttachment("hash-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "invoice.pdf", attachment.Filename)
+	assert.Equal(t, "processed", attachment.Status)
+	lastFetchTime, err := am.ReadLastFetchTime()
+	assert.NoError(t, err)
+	assert.Equal(t, "2025/05/01", lastFetchTime)
+
+	// Le fichier importé est renommé pour ne pas être importé à nouveau
+	_, err = os.Stat(legacyFile)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(legacyFile + ".migrated")
+	assert.NoError(t, err)
+
+	err = os.WriteFile(legacyFile, []byte(`{"emails": [{"id": "email-2"}]}`), 0644)
+	assert.NoError(t, err)
+	reloaded := NewActivityManager()
+	assert.NoError(t, reloaded.Load())
+	assert.False(t, reloaded.HasEmailID("email-2"))
+	assert.True(t, reloaded.HasEmailID("email-1"))
+}
+
+func TestActivityManagerMessageStates(t *testing.T) {
+	// Créer un dossier temporaire pour les tests
+	tempDir, err := os.MkdirTemp("", "activity-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	// Sauvegarder les valeurs originales
+	originalConfigDir := config.AppConfigDir
+	config.AppConfigDir = tempDir
+	defer func() {
+		config.AppConfigDir = originalConfigDir
+	}()
+
+	am := NewActivityManager()
+	assert.NoError(t, am.Load())
+
+	// Les nouveaux messages sont à traiter
+	assert.NoError(t, am.StoreDiscoveredEmail("email-1"))
+	assert.NoError(t, am.StoreDiscoveredEmail("email-2"))
+	assert.Equal(t, []string{"email-1", "email-2"}, am.GetRetryableEmailIDs())
+
+	// Un message téléchargé n'est plus à traiter
+	assert.NoError(t, am.UpdateEmailState("email-1", MessageStateDownloading, nil))
+	assert.NoError(t, am.UpdateEmailState("email-1", MessageStateDownloaded, nil))
+	assert.Equal(t, []string{"email-2"}, am.GetRetryableEmailIDs())
+
+	// Un message en échec est retenté jusqu'au nombre maximal de tentatives
+	for i := 0; i < config.MaxMessageAttempts; i++ {
+		assert.Equal(t, []string{"email-2"}, am.GetRetryableEmailIDs())
+		assert.NoError(t, am.UpdateEmailState("email-2", MessageStateDownloading, nil))
+		assert.NoError(t, am.UpdateEmailState("email-2", MessageStateFailed, fmt.Errorf("attempt %d failed", i+1)))
+	}
+	assert.Empty(t, am.GetRetryableEmailIDs())
+
+	// Les états sont persistés
+	assert.NoError(t, am.Save())
+	reloaded := NewActivityManager()
+	assert.NoError(t, reloaded.Load())
+	email, err := reloaded.GetEmailByID("email-2")
+	assert.NoError(t, err)
+	assert.Equal(t, MessageStateFailed, email.State)
+	assert.Equal(t, config.MaxMessageAttempts, email.Attempts)
+	assert.Equal(t, fmt.Sprintf("attempt %d failed", config.MaxMessageAttempts), email.LastError)
+
+	// Les métadonnées complètes ne réinitialisent pas l'état
+	msg := &gmail.Message{
+		Id:      "email-1",
+		Payload: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{{Name: "Subject", Value: "Facture"}}},
+	}
+	assert.NoError(t, reloaded.StoreEmailMeta("email-1", msg))
+	email, err = reloaded.GetEmailByID("email-1")
+	assert.NoError(t, err)
+	assert.Equal(t, MessageStateDownloaded, email.State)
+	assert.Equal(t, 1, email.Attempts)
+}
+
+func TestActivityManagerLoadReadOnly(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "activity-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	originalConfigDir := config.AppConfigDir
+	config.AppConfigDir = tempDir
+	defer func() {
+		config.AppConfigDir = originalConfigDir
+	}()
+
+	// L'ancien fichier activity.json est lu sans être importé
+	legacy, err := os.ReadFile(filepath.Join("testdata", "activity-v0.json"))
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(tempDir, "activity.json"), legacy, 0644))
+
+	am := NewActivityManager()
+	assert.NoError(t, am.LoadReadOnly())
+	assert.NotEmpty(t, am.data.Emails)
+	assert.Equal(t, currentSchemaVersion, am.data.SchemaVersion)
+	assert.NoError(t, am.StoreLastFetchTime())
+	assert.NoError(t, am.Save())
+	assert.NoFileExists(t, filepath.Join(tempDir, "activity.db"))
+	assert.FileExists(t, filepath.Join(tempDir, "activity.json"))
+}
+
+func TestActivityManagerBackup(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "activity-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	originalConfigDir := config.AppConfigDir
+	config.AppConfigDir = tempDir
+	defer func() {
+		config.AppConfigDir = originalConfigDir
+	}()
+	dbPath := filepath.Join(tempDir, "activity.db")
+
+	// Sans base, rien n'est sauvegardé
+	am := NewActivityManager()
+	assert.NoError(t, am.Backup())
+	assert.NoFileExists(t, dbPath+".1")
+
+	// Une copie est conservée avant chaque exécution, les plus anciennes étant décalées
+	assert.NoError(t, am.Load())
+	for i := 1; i <= config.ActivityBackupCount+2; i++ {
+		assert.NoError(t, am.Backup())
+		assert.NoError(t, am.StoreDiscoveredEmail(fmt.Sprintf("email-%d", i)))
+		assert.NoError(t, am.Save())
+	}
+	for i := 1; i <= config.ActivityBackupCount; i++ {
+		assert.FileExists(t, fmt.Sprintf("%s.%d", dbPath, i))
+	}
+	assert.NoFileExists(t, fmt.Sprintf("%s.%d", dbPath, config.ActivityBackupCount+1))
+
+	// Une base corrompue est remplacée par la copie la plus récente
+	assert.NoError(t, os.WriteFile(dbPath, []byte("corrompu"), 0644))
+	recovered := NewActivityManager()
+	assert.NoError(t, recovered.Load())
+	assert.True(t, recovered.HasEmailID(fmt.Sprintf("email-%d", config.ActivityBackupCount+1)))
+	assert.False(t, recovered.HasEmailID(fmt.Sprintf("email-%d", config.ActivityBackupCount+2)))
+	corrupted, err := filepath.Glob(dbPath + ".corrupt-*")
+	assert.NoError(t, err)
+	assert.Len(t, corrupted, 1)
+}
@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Schema versions of the persisted activity data:
+//   - 0: activity.json file, without schemaVersion field
+//   - 1: activity database, emails keyed by ID
+//   - 2: processing state and attempt count per message
+const currentSchemaVersion = 2
+
+// activityMigration upgrades the activity data from version-1 to version.
+type activityMigration struct {
+	version     int
+	description string
+	migrate     func(*ActivityData) error
+}
+
+// activityMigrations lists the migrations in order. A migration must never be
+// modified once released: add a new one instead.
+var activityMigrations = []activityMigration{
+	{
+		version:     1,
+		description: "remove emails without ID and duplicated email IDs",
+		migrate:     migrateDeduplicateEmails,
+	},
+	{
+		version:     2,
+		description: "initialize message processing states",
+		migrate:     migrateMessageStates,
+	},
+}
+
+// migrateActivityData applies the migrations needed to bring data to the
+// current schema version. It returns true if data was modified.
+func migrateActivityData(data *ActivityData) (bool, error) {
+	if data.SchemaVersion > currentSchemaVersion {
+		return false, fmt.Errorf("activity data schema version %d is newer than supported version %d", data.SchemaVersion, currentSchemaVersion)
+	}
+
+	migrated := false
+	for _, m := range activityMigrations {
+		if m.version <= data.SchemaVersion {
+			continue
+		}
+		if err := m.migrate(data); err != nil {
+			return migrated, fmt.Errorf("error migrating activity data to version %d (%s): %v", m.version, m.description, err)
+		}
+		data.SchemaVersion = m.version
+		migrated = true
+		fmt.Printf("Migrated activity data to version %d: %s\n", m.version, m.description)
+	}
+
+	return migrated, nil
+}
+
+// backupActivityDB copies the database to a file named after its schema version,
+// before a migration rewrites it.
+func backupActivityDB(db *bolt.DB, version int) (string, error) {
+	backupPath := fmt.Sprintf("%s.v%d-%s.bak", db.Path(), version, time.Now().Format("20060102-150405"))
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(backupPath, defaultFilePerm)
+	})
+	if err != nil {
+		return "", fmt.Errorf("error backing up activity database: %v", err)
+	}
+	return backupPath, nil
+}
+
+// migrateDeduplicateEmails keeps a single record per email ID, as the
+// database keys emails by ID.
+func migrateDeduplicateEmails(data *ActivityData) error {
+	seen := make(map[string]bool, len(data.Emails))
+	emails := make([]EmailData, 0, len(data.Emails))
+	for _, email := range data.Emails {
+		if email.ID == "" || seen[email.ID] {
+			continue
+		}
+		seen[email.ID] = true
+		emails = append(emails, email)
+	}
+	data.Emails = emails
+	return nil
+}
+
+// migrateMessageStates derives the state of each message from its attachments.
+// Messages were stored before their attachments were downloaded, so a message
+// without any attachment may have failed: it is marked as failed to be retried.
+func migrateMessageStates(data *ActivityData) error {
+	downloaded := make(map[string]bool)
+	processed := make(map[string]bool)
+	for _, attachment := range data.Attachments {
+		downloaded[attachment.EmailID] = true
+		if attachment.Status == "processed" {
+			processed[attachment.EmailID] = true
+		}
+	}
+
+	for i := range data.Emails {
+		email := &data.Emails[i]
+		if email.State != "" {
+			continue
+		}
+		switch {
+		case processed[email.ID]:
+			email.State = MessageStateProcessed
+		case downloaded[email.ID]:
+			email.State = MessageStateDownloaded
+		default:
+			email.State = MessageStateFailed
+			email.Attempts = 1
+			email.LastError = "no attachment recorded before message states were introduced"
+		}
+	}
+	return nil
+}
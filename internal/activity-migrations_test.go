@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"encoding/json"
+	"extract-email-attachments/internal/config"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+// installActivityFixture installs testdata/activity-v<version>.json in dir,
+// in the storage format used by that version.
+func installActivityFixture(t *testing.T, dir string, version int) {
+	content, err := os.ReadFile(filepath.Join("testdata", fmt.Sprintf("activity-v%d.json", version)))
+	assert.NoError(t, err)
+
+	// Version 0 is the legacy activity.json file
+	if version == 0 {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "activity.json"), content, 0644))
+		return
+	}
+
+	var data ActivityData
+	assert.NoError(t, json.Unmarshal(content, &data))
+
+	db, err := bolt.Open(filepath.Join(dir, "activity.db"), 0644, nil)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{metaBucket, emailsBucket, attachmentsBucket} {
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		meta := tx.Bucket(metaBucket)
+		if err := meta.Put(lastFetchTimeKey, []byte(data.LastFetchTime)); err != nil {
+			return err
+		}
+		// Version 1 databases have no schema version key
+		if version > 1 {
+			if err := meta.Put(schemaVersionKey, []byte(strconv.Itoa(version))); err != nil {
+				return err
+			}
+		}
+		for _, email := range data.Emails {
+			value, _ := json.Marshal(email)
+			if err := tx.Bucket(emailsBucket).Put([]byte(email.ID), value); err != nil {
+				return err
+			}
+		}
+		for i, attachment := range data.Attachments {
+			value, _ := json.Marshal(attachment)
+			if err := tx.Bucket(attachmentsBucket).Put(attachmentKey(i), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestActivityMigrations(t *testing.T) {
+	// Les migrations doivent être ordonnées et mener à la version courante
+	for i, m := range activityMigrations {
+		assert.Equal(t, i+1, m.version)
+	}
+	assert.Equal(t, currentSchemaVersion, activityMigrations[len(activityMigrations)-1].version)
+
+	for version := 0; version <= currentSchemaVersion; version++ {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			// Créer un dossier temporaire pour les tests
+			tempDir, err := os.MkdirTemp("", "migration-test")
+			assert.NoError(t, err)
+			defer os.RemoveAll(tempDir)
+
+			// Sauvegarder les valeurs originales
+			originalConfigDir := config.AppConfigDir
+			config.AppConfigDir = tempDir
+			defer func() {
+				config.AppConfigDir = originalConfigDir
+			}()
+
+			installActivityFixture(t, tempDir, version)
+
+			am := NewActivityManager()
+			assert.NoError(t, am.Load())
+			assert.Equal(t, currentSchemaVersion, am.data.SchemaVersion)
+
+			// Les données de la fixture sont conservées
+			assert.Len(t, am.data.Emails, 3)
+			email, err := am.GetEmailByID("email-1")
+			assert.NoError(t, err)
+			assert.Equal(t, "IKUTO", email.SenderName)
+			assert.Equal(t, MessageStateProcessed, email.State)
+			email, err = am.GetEmailByID("email-2")
+			assert.NoError(t, err)
+			assert.Equal(t, MessageStateDownloaded, email.State)
+
+			// Le message sans pièce jointe sera retenté
+			assert.Equal(t, []string{"email-3"}, am.GetRetryableEmailIDs())
+
+			assert.Len(t, am.data.Attachments, 2)
+			attachment, err := am.GetAttachmentByFilename("facture.pdf")
+			assert.NoError(t, err)
+			assert.Equal(t, "processed", attachment.Status)
+			assert.Equal(t, "email-1", attachment.EmailID)
+
+			lastFetchTime, err := am.ReadLastFetchTime()
+			assert.NoError(t, err)
+			assert.Equal(t, "2025/05/01", lastFetchTime)
+
+			// Une sauvegarde est faite avant toute migration
+			if version < currentSchemaVersion {
+				backups, err := filepath.Glob(filepath.Join(tempDir, "activity.*.bak"))
+				assert.NoError(t, err)
+				if version == 0 {
+					backups, err = filepath.Glob(filepath.Join(tempDir, "activity.json.migrated"))
+					assert.NoError(t, err)
+				}
+				assert.Len(t, backups, 1)
+			}
+
+			// La version migrée est persistée
+			reloaded := NewActivityManager()
+			assert.NoError(t, reloaded.Load())
+			assert.Equal(t, currentSchemaVersion, reloaded.data.SchemaVersion)
+			assert.Len(t, reloaded.data.Emails, 3)
+		})
+	}
+}
+
+func TestActivityMigrationsNewerVersion(t *testing.T) {
+	data := ActivityData{SchemaVersion: currentSchemaVersion + 1}
+	_, err := migrateActivityData(&data)
+	assert.Error(t, err)
+}
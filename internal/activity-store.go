@@ -0,0 +1,340 @@
+package internal
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"extract-email-attachments/internal/config"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets and keys of the activity database.
+// Emails are keyed by Gmail message ID, attachments by their position in
+// ActivityData.Attachments (records are never deleted, so positions are stable).
+var (
+	metaBucket        = []byte("meta")
+	emailsBucket      = []byte("emails")
+	attachmentsBucket = []byte("attachments")
+	lastFetchTimeKey  = []byte("lastFetchTime")
+	schemaVersionKey  = []byte("schemaVersion")
+)
+
+// activityChanges lists the records modified in memory since the last save.
+type activityChanges struct {
+	emails      map[string]bool
+	attachments map[int]bool
+	meta        bool
+}
+
+func newActivityChanges() activityChanges {
+	return activityChanges{
+		emails:      map[string]bool{},
+		attachments: map[int]bool{},
+	}
+}
+
+func (c activityChanges) empty() bool {
+	return len(c.emails) == 0 && len(c.attachments) == 0 && !c.meta
+}
+
+// openActivityDB opens the activity database, creating it if needed.
+// When the database is created, the legacy JSON file at legacyPath is migrated
+// to the current schema and imported in the same transaction, then renamed so
+// it is imported only once.
+func openActivityDB(dbPath, legacyPath string) (*bolt.DB, error) {
+	db, err := bolt.Open(dbPath, defaultFilePerm, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil && !errors.Is(err, bolt.ErrTimeout) {
+		if _, statErr := os.Stat(dbPath); statErr == nil {
+			log.Printf("Warning: error opening activity database: %v, trying backups", err)
+			db, err = recoverActivityDB(dbPath)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening activity database: %v", err)
+	}
+
+	imported := false
+	err = db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(metaBucket) != nil {
+			return nil
+		}
+
+		for _, name := range [][]byte{metaBucket, emailsBucket, attachmentsBucket} {
+			if _, err := tx.CreateBucket(name); err != nil {
+				return fmt.Errorf("error creating bucket %s: %v", name, err)
+			}
+		}
+
+		legacy, err := readLegacyActivityFile(legacyPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return tx.Bucket(metaBucket).Put(schemaVersionKey, []byte(strconv.Itoa(currentSchemaVersion)))
+			}
+			return err
+		}
+
+		if _, err := migrateActivityData(&legacy); err != nil {
+			return err
+		}
+		imported = true
+		return writeAllActivityData(tx, &legacy)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if imported {
+		migratedPath := legacyPath + ".migrated"
+		if err := os.Rename(legacyPath, migratedPath); err != nil {
+			log.Printf("Warning: Error renaming imported activity file: %v", err)
+		} else {
+			fmt.Printf("Imported %s into %s, original kept as %s\n", legacyPath, dbPath, migratedPath)
+		}
+	}
+
+	return db, nil
+}
+
+// activityBackupPath returns the path of the n-th snapshot of the activity
+// database, 1 being the most recent.
+func activityBackupPath(dbPath string, n int) string {
+	return fmt.Sprintf("%s.%d", dbPath, n)
+}
+
+// backupActivityDBSnapshot shifts the existing snapshots of the database by
+// one and copies the database as the most recent snapshot, keeping
+// config.ActivityBackupCount snapshots.
+func backupActivityDBSnapshot(dbPath string) error {
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	db, err := bolt.Open(dbPath, defaultFilePerm, &bolt.Options{Timeout: 10 * time.Second, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("error opening activity database: %v", err)
+	}
+	defer db.Close()
+
+	for i := config.ActivityBackupCount - 1; i >= 1; i-- {
+		if err := os.Rename(activityBackupPath(dbPath, i), activityBackupPath(dbPath, i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error rotating activity backups: %v", err)
+		}
+	}
+
+	// Copy to a temporary file first, so that the latest snapshot is never partial
+	latest := activityBackupPath(dbPath, 1)
+	tmpPath := latest + ".tmp"
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(tmpPath, defaultFilePerm)
+	})
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error backing up activity database: %v", err)
+	}
+	if err := os.Rename(tmpPath, latest); err != nil {
+		return fmt.Errorf("error backing up activity database: %v", err)
+	}
+	return nil
+}
+
+// recoverActivityDB replaces a database which cannot be opened by its newest
+// snapshot which opens, and moves the corrupted database aside.
+func recoverActivityDB(dbPath string) (*bolt.DB, error) {
+	for i := 1; i <= config.ActivityBackupCount; i++ {
+		backupPath := activityBackupPath(dbPath, i)
+		if _, err := os.Stat(backupPath); err != nil {
+			continue
+		}
+		backup, err := bolt.Open(backupPath, defaultFilePerm, &bolt.Options{Timeout: 10 * time.Second, ReadOnly: true})
+		if err != nil {
+			log.Printf("Warning: skipping backup %s: %v", backupPath, err)
+			continue
+		}
+		backup.Close()
+
+		corruptPath := fmt.Sprintf("%s.corrupt-%s", dbPath, time.Now().Format("20060102-150405"))
+		if err := os.Rename(dbPath, corruptPath); err != nil {
+			return nil, fmt.Errorf("error moving corrupted activity database aside: %v", err)
+		}
+		if err := copyFile(backupPath, dbPath); err != nil {
+			return nil, fmt.Errorf("error restoring activity database from %s: %v", backupPath, err)
+		}
+
+		log.Printf("Warning: recovered activity data from %s, corrupted database moved to %s", backupPath, corruptPath)
+		return bolt.Open(dbPath, defaultFilePerm, &bolt.Options{Timeout: 10 * time.Second})
+	}
+	return nil, fmt.Errorf("no valid backup was found")
+}
+
+// readActivityDB reads every record of the activity database.
+func readActivityDB(db *bolt.DB) (ActivityData, error) {
+	data := ActivityData{
+		Emails:      []EmailData{},
+		Attachments: []AttachmentData{},
+	}
+
+	err := db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		data.LastFetchTime = string(meta.Get(lastFetchTimeKey))
+
+		// Databases created before schema versioning have no version key
+		data.SchemaVersion = 1
+		if version := meta.Get(schemaVersionKey); version != nil {
+			v, err := strconv.Atoi(string(version))
+			if err != nil {
+				return fmt.Errorf("error decoding schema version: %v", err)
+			}
+			data.SchemaVersion = v
+		}
+
+		err := tx.Bucket(emailsBucket).ForEach(func(k, v []byte) error {
+			var email EmailData
+			if err := json.Unmarshal(v, &email); err != nil {
+				return fmt.Errorf("error decoding email %s: %v", k, err)
+			}
+			data.Emails = append(data.Emails, email)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(attachmentsBucket).ForEach(func(k, v []byte) error {
+			var attachment AttachmentData
+			if err := json.Unmarshal(v, &attachment); err != nil {
+				return fmt.Errorf("error decoding attachment %x: %v", k, err)
+			}
+			if int(binary.BigEndian.Uint64(k)) != len(data.Attachments) {
+				return fmt.Errorf("unexpected attachment key %x", k)
+			}
+			data.Attachments = append(data.Attachments, attachment)
+			return nil
+		})
+	})
+
+	return data, err
+}
+
+// writeActivityChanges writes the modified records of data within tx.
+func writeActivityChanges(tx *bolt.Tx, data *ActivityData, changes activityChanges) error {
+	if changes.meta {
+		meta := tx.Bucket(metaBucket)
+		if err := meta.Put(lastFetchTimeKey, []byte(data.LastFetchTime)); err != nil {
+			return err
+		}
+		if err := meta.Put(schemaVersionKey, []byte(strconv.Itoa(data.SchemaVersion))); err != nil {
+			return err
+		}
+	}
+
+	emails := tx.Bucket(emailsBucket)
+	for _, email := range data.Emails {
+		if !changes.emails[email.ID] {
+			continue
+		}
+		value, err := json.Marshal(email)
+		if err != nil {
+			return fmt.Errorf("error encoding email %s: %v", email.ID, err)
+		}
+		if err := emails.Put([]byte(email.ID), value); err != nil {
+			return err
+		}
+	}
+
+	attachments := tx.Bucket(attachmentsBucket)
+	for i := range changes.attachments {
+		value, err := json.Marshal(data.Attachments[i])
+		if err != nil {
+			return fmt.Errorf("error encoding attachment %s: %v", data.Attachments[i].Filename, err)
+		}
+		if err := attachments.Put(attachmentKey(i), value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeAllActivityData replaces every record of the database with data within tx.
+func writeAllActivityData(tx *bolt.Tx, data *ActivityData) error {
+	for _, name := range [][]byte{emailsBucket, attachmentsBucket} {
+		if err := tx.DeleteBucket(name); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return fmt.Errorf("error clearing bucket %s: %v", name, err)
+		}
+		if _, err := tx.CreateBucket(name); err != nil {
+			return fmt.Errorf("error creating bucket %s: %v", name, err)
+		}
+	}
+
+	changes := newActivityChanges()
+	for _, email := range data.Emails {
+		changes.emails[email.ID] = true
+	}
+	for i := range data.Attachments {
+		changes.attachments[i] = true
+	}
+	changes.meta = true
+	return writeActivityChanges(tx, data, changes)
+}
+
+// attachmentKey returns the database key of the attachment at position i.
+func attachmentKey(i int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(i))
+	return key
+}
+
+// errActivityDecode signals that an activity file exists but is not valid JSON.
+var errActivityDecode = errors.New("error decoding activity data")
+
+// readLegacyActivityFile reads the activity.json file used before the database.
+// If it cannot be decoded, the newest valid backup is used instead.
+func readLegacyActivityFile(path string) (ActivityData, error) {
+	data, err := readActivityFile(path)
+	if err == nil || !errors.Is(err, errActivityDecode) {
+		return data, err
+	}
+
+	log.Printf("Warning: %v, trying backups", err)
+	for i := 1; i <= config.ActivityBackupCount; i++ {
+		backupPath := fmt.Sprintf("%s.%d", path, i)
+		data, err := readActivityFile(backupPath)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Warning: skipping backup %s: %v", backupPath, err)
+			}
+			continue
+		}
+
+		log.Printf("Warning: recovered activity data from %s", backupPath)
+		return data, nil
+	}
+
+	return ActivityData{}, fmt.Errorf("%w in %s and no valid backup was found", errActivityDecode, path)
+}
+
+// readActivityFile reads and decodes an activity file.
+func readActivityFile(path string) (ActivityData, error) {
+	var data ActivityData
+
+	file, err := os.Open(path)
+	if err != nil {
+		return data, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(&data); err != nil {
+		return data, fmt.Errorf("%w in %s: %v", errActivityDecode, path, err)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic writes data to a temporary file in the same directory as path,
+// syncs it to disk and renames it over path. Readers never observe a partially
+// written file: after a crash, path holds either the old or the new content.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %v", err)
+	}
+	tmpPath := tmp.Name()
+
+	// Remove the temporary file if anything goes wrong before the rename
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		return fmt.Errorf("error writing temporary file: %v", err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		return fmt.Errorf("error setting permissions on temporary file: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("error syncing temporary file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing temporary file: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("error renaming temporary file: %v", err)
+	}
+	committed = true
+
+	// Persist the rename itself
+	syncDir(dir)
+	return nil
+}
+
+// syncDir flushes a directory entry to disk. Some platforms do not support
+// syncing directories, in which case the error is ignored.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	d.Sync()
+}
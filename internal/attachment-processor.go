@@ -1,112 +1,308 @@
 package internal
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
-	"strings"
-	"time"
+	"reflect"
 
 	"extract-email-attachments/internal/config"
 )
 
-// ProcessAttachments processes each attachment in the attachments directory
-// and performs specific actions based on the sender and filename
-func ProcessAttachments() error {
+// ProcessAttachments processes each downloaded attachment not processed yet:
+// it extracts the invoice fields of the document, then renames it and files it
+// in the destination of the first matching rule.
+// When ctx is cancelled, the current file is completed and the activity data is saved.
+// The files written are recorded in journal, unless nil.
+func ProcessAttachments(ctx context.Context, journal *Journal) error {
 	activityManager := NewActivityManager()
 	if err := activityManager.Load(); err != nil {
 		return NewError("ProcessAttachments", err, "failed to load activity data")
 	}
 
-	var processingErrors []error
+	return processAttachments(ctx, activityManager, nil, journal)
+}
 
-	// Walk through all files in the attachments directory
-	err := filepath.Walk(config.AppAttachmentsDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return NewError("ProcessAttachments", err, fmt.Sprintf("failed to access path %s", path))
+// attachmentProcessor applies the rules to the downloaded attachments.
+type attachmentProcessor struct {
+	activityManager *ActivityManager
+	rules           *RuleSet
+	reader          *documentReader
+	// plan records the renames and filings instead of making them, nil
+	// unless in a dry run
+	plan *Plan
+	// journal records the files written, nil unless in a run
+	journal *Journal
+	errors  []error
+}
+
+// processAttachments processes the attachments of the activity data which
+// are not processed yet, found in the attachments directory or, in a dry
+// run, among the attachments of the plan which would be downloaded.
+// When plan is not nil, nothing is written: the renames and filings are
+// recorded in the plan, and activityManager is expected to be read-only.
+// Otherwise the files written are recorded in journal, unless nil.
+func processAttachments(ctx context.Context, activityManager *ActivityManager, plan *Plan, journal *Journal) error {
+	rules, err := LoadRules()
+	if err != nil {
+		return NewError("ProcessAttachments", err, "failed to load rules")
+	}
+
+	passwords, err := LoadPasswords()
+	if err != nil {
+		return NewError("ProcessAttachments", err, "failed to load PDF passwords")
+	}
+
+	classifier, err := LoadClassifier()
+	if err != nil {
+		return NewError("ProcessAttachments", err, "failed to load document classifier")
+	}
+
+	p := &attachmentProcessor{
+		activityManager: activityManager,
+		rules:           rules,
+		reader:          newDocumentReader(rules, passwords, classifier),
+		plan:            plan,
+		journal:         journal,
+	}
+	p.reader.readOnly = plan != nil
+
+	if _, err := os.Stat(config.AppAttachmentsDir); err != nil {
+		return NewError("ProcessAttachments", err, "failed to access attachments directory")
+	}
+
+	// The pending attachments, downloaded or which a dry run would download
+	read := os.ReadFile
+	if plan != nil {
+		read = plan.readDocument
+	}
+	for _, attachment := range activityManager.Attachments() {
+		if ctx.Err() != nil {
+			break
+		}
+		p.process(ctx, attachment, read)
+	}
+
+	if plan != nil {
+		plan.NotExtracted = p.reader.notExtracted
+	}
+
+	// Save the updated activity data
+	if err := activityManager.Save(); err != nil {
+		return NewError("ProcessAttachments", err, "failed to save activity data")
+	}
+
+	if ctx.Err() != nil {
+		return NewError("ProcessAttachments", ctx.Err(), "interrupted, remaining attachments will be processed on next run")
+	}
+
+	// Si des erreurs de traitement se sont produites, les retourner
+	if len(p.errors) > 0 {
+		return NewError("ProcessAttachments", ErrAttachmentProcessing, fmt.Sprintf("encountered %d errors while processing attachments", len(p.errors)))
+	}
+
+	return nil
+}
+
+// process processes an attachment which is not processed yet, found in the
+// attachments directory by its content since several messages may carry
+// attachments of the same name. read returns the content of a file.
+func (p *attachmentProcessor) process(ctx context.Context, attachment AttachmentData, read func(string) ([]byte, error)) {
+	// Skip the processed attachments, such as the files left in place after
+	// being copied or linked to their destination, and other documents than PDF and XML
+	if attachment.Status == AttachmentStatusProcessed || !isPDFDocument(attachment.Filename) && !isXMLDocument(attachment.Filename) {
+		return
+	}
+
+	// Attachments stored without a hash are found by their name
+	var path string
+	var data []byte
+	if attachment.Sha256Hash == "" {
+		path = filepath.Join(config.AppAttachmentsDir, attachment.Filename)
+		data, _ = read(path)
+	} else {
+		path, data = attachmentPath(attachment.EmailID, attachment.Filename, attachment.Sha256Hash, read)
+	}
+	if data == nil {
+		return
+	}
+
+	p.processAttachment(ctx, path, data, attachment)
+}
+
+// processAttachment applies the rules to the attachment, whose file is at
+// path, possibly renamed and filed by a previous run.
+func (p *attachmentProcessor) processAttachment(ctx context.Context, path string, data []byte, attachment AttachmentData) {
+	activityManager := p.activityManager
+	filename := attachment.Filename
+
+	// Get the associated email
+	email, err := activityManager.GetEmailByID(attachment.EmailID)
+	if err != nil {
+		p.fail(filename, NewError("ProcessAttachments", err, fmt.Sprintf("failed to find email for attachment %s", filename)))
+		return
+	}
+
+	// Extract the text and the invoice fields of the document
+	var doc *Document
+	if data != nil {
+		doc = p.reader.readData(ctx, data, attachment, *email)
+	} else {
+		doc = p.reader.read(ctx, path, attachment, *email)
+	}
+	if !doc.Invoice.IsEmpty() && (attachment.Invoice == nil || !reflect.DeepEqual(*attachment.Invoice, doc.Invoice)) {
+		if err := activityManager.UpdateAttachmentInvoice(email.ID, filename, doc.Invoice); err != nil {
+			log.Printf("Warning: Error storing invoice fields for %s: %v", filename, err)
 		}
+	}
 
-		// Skip directories
-		if info.IsDir() {
-			return nil
+	// Leave encrypted documents in place until the user supplies their password
+	if doc.Locked {
+		if attachment.Status != AttachmentStatusPasswordRequired {
+			if err := activityManager.UpdateAttachmentStatus(email.ID, filename, AttachmentStatusPasswordRequired); err != nil {
+				log.Printf("Warning: Error updating attachment status for %s: %v", filename, err)
+			}
+		}
+		if p.plan != nil {
+			p.plan.add(PlanAction{Action: PlanActionPasswordRequired, EmailID: email.ID, File: filename, From: path}, "")
+			return
 		}
+		log.Printf("Warning: %s is encrypted, add its password to passwords.json", filename)
+		return
+	}
+	if attachment.Status == AttachmentStatusPasswordRequired {
+		if err := activityManager.UpdateAttachmentStatus(email.ID, filename, ""); err != nil {
+			log.Printf("Warning: Error updating attachment status for %s: %v", filename, err)
+		}
+	}
 
-		// Skip non-PDF files
-		if !strings.HasSuffix(strings.ToLower(info.Name()), ".pdf") {
-			return nil
+	// Rename and file the document according to the first matching rule
+	currentPath := path
+	rule := p.rules.Match(doc)
+	if rule == nil && p.plan != nil {
+		p.plan.add(PlanAction{Action: PlanActionNoRule, EmailID: email.ID, File: filename, From: path}, "")
+		return
+	}
+	if rule != nil {
+		newFilename, err := rule.NewFilename(doc)
+		if err != nil {
+			p.fail(filename, NewError("ProcessAttachments", err, fmt.Sprintf("failed to compute new name of %s", filename)))
+			return
 		}
 
-		// Get the filename
-		filename := info.Name()
+		destDir, err := rule.DestinationDir(doc)
+		if err != nil {
+			p.fail(filename, NewError("ProcessAttachments", err, fmt.Sprintf("failed to compute destination of %s", filename)))
+			return
+		}
 
-		// Find the attachment in the activity manager
-		for _, attachment := range activityManager.data.Attachments {
-			if attachment.Filename == filename {
-				// Get the associated email
-				email, err := activityManager.GetEmailByID(attachment.EmailID)
-				if err != nil {
-					err = NewError("ProcessAttachments", err, fmt.Sprintf("failed to find email for attachment %s", filename))
-					log.Printf("Error: %v", err)
-					processingErrors = append(processingErrors, err)
-					continue
+		// Record what a run would do, instead of doing it
+		newPath := filepath.Join(destDir, newFilename)
+		if p.plan != nil {
+			action := PlanAction{Action: PlanActionRename, EmailID: email.ID, File: filename, From: path, To: newPath, Rule: rule.Name}
+			if destDir != config.AppAttachmentsDir || rule.Mode != "" {
+				action.Action = PlanActionFile
+				action.Mode = rule.Mode
+				if action.Mode == "" {
+					action.Mode = DestinationModeMove
 				}
+			}
+			p.plan.add(action, newPath)
+			return
+		}
 
-				// Check if the sender is IKUTO and the filename contains "facture"
-				if strings.EqualFold(email.SenderName, "IKUTO") &&
-					strings.Contains(strings.ToLower(email.Subject), "facture") {
-
-					// Parse the email date
-					emailDate, err := time.Parse(time.RFC3339, email.Date)
-					if err != nil {
-						err = NewError("ProcessAttachments", err, fmt.Sprintf("failed to parse email date for %s", filename))
-						log.Printf("Error: %v", err)
-						processingErrors = append(processingErrors, err)
-						continue
-					}
-
-					// Create new filename
-					newFilename := fmt.Sprintf("%s-facture-IKUTO.pdf",
-						emailDate.Format("2006-01"))
-
-					// Rename the file
-					oldPath := filepath.Join(config.AppAttachmentsDir, filename)
-					newPath := filepath.Join(config.AppAttachmentsDir, newFilename)
-
-					if err := os.Rename(oldPath, newPath); err != nil {
-						err = NewError("ProcessAttachments", err, fmt.Sprintf("failed to rename file %s to %s", filename, newFilename))
-						log.Printf("Error: %v", err)
-						processingErrors = append(processingErrors, err)
-						continue
-					}
-
-					// Update attachment status
-					if err := activityManager.UpdateAttachmentStatus(filename, "processed"); err != nil {
-						log.Printf("Warning: Error updating attachment status for %s: %v", filename, err)
-						// Ne pas retourner l'erreur car ce n'est pas critique
-					}
-
-					fmt.Printf("Renamed %s to %s\n", filename, newFilename)
-				}
-				break
+		// Move, copy or link the file to its destination, unless already there
+		if newPath != path {
+			if err := fileDocument(path, newPath, rule.Mode); err != nil {
+				p.fail(filename, NewError("ProcessAttachments", err, fmt.Sprintf("failed to file %s as %s", filename, newPath)))
+				return
+			}
+			op := rule.Mode
+			if op == "" {
+				op = DestinationModeMove
 			}
+			p.journal.record(JournalEntry{Op: op, Path: newPath, From: path, EmailID: email.ID, Attachment: filename})
 		}
-		return nil
-	})
 
-	if err != nil {
-		return NewError("ProcessAttachments", err, "failed to walk through attachments directory")
+		// Update attachment status
+		if err := activityManager.UpdateAttachmentStatus(email.ID, filename, AttachmentStatusProcessed); err != nil {
+			log.Printf("Warning: Error updating attachment status for %s: %v", filename, err)
+			// Ne pas retourner l'erreur car ce n'est pas critique
+		}
+		if err := activityManager.UpdateAttachmentPath(email.ID, filename, newPath); err != nil {
+			log.Printf("Warning: Error recording path of %s: %v", filename, err)
+		}
+
+		if destDir == config.AppAttachmentsDir && rule.Mode == "" {
+			fmt.Printf("Renamed %s to %s (rule %s)\n", filename, newFilename, rule.Name)
+		} else {
+			fmt.Printf("Filed %s as %s (rule %s)\n", filename, newPath, rule.Name)
+		}
+		currentPath = newPath
+
+		// Write the vendor, invoice number and origin into the PDF itself,
+		// except into hard links, which share the content of the downloaded file
+		if config.AppSettings.WriteMetadata && doc.pdf != nil && !doc.Encrypted && rule.Mode != DestinationModeLink {
+			if err := p.writePDFMetadata(doc, rule, currentPath); err != nil {
+				log.Printf("Warning: Error writing metadata of %s: %v", newFilename, err)
+			}
+		}
 	}
 
-	// Save the updated activity data
-	if err := activityManager.Save(); err != nil {
-		return NewError("ProcessAttachments", err, "failed to save activity data")
+	// Store a decrypted copy of password-protected PDFs
+	if config.AppSettings.DecryptedCopy && doc.Encrypted && doc.pdf != nil {
+		copyPath, err := writeDecryptedCopy(doc, currentPath)
+		if err != nil {
+			log.Printf("Warning: Error writing decrypted copy of %s: %v", filename, err)
+		} else if copyPath != "" {
+			p.journal.record(JournalEntry{Op: JournalOpCreate, Path: copyPath, From: currentPath, EmailID: email.ID, Attachment: filename})
+		}
 	}
 
-	// Si des erreurs de traitement se sont produites, les retourner
-	if len(processingErrors) > 0 {
-		return NewError("ProcessAttachments", ErrAttachmentProcessing, fmt.Sprintf("encountered %d errors while processing attachments", len(processingErrors)))
+	// Write a human-readable summary next to XML invoices
+	if config.AppSettings.XMLSummary && isXMLDocument(filename) && !doc.Invoice.IsEmpty() {
+		summaryPath, err := writeInvoiceSummary(doc, currentPath)
+		if err != nil {
+			log.Printf("Warning: Error writing summary of %s: %v", filename, err)
+		} else {
+			p.journal.record(JournalEntry{Op: JournalOpCreate, Path: summaryPath, From: currentPath, EmailID: email.ID, Attachment: filename})
+		}
+	}
+
+	// The attachments of the message have been handled
+	if email.State == MessageStateDownloaded {
+		if err := activityManager.UpdateEmailState(email.ID, MessageStateProcessed, nil); err != nil {
+			log.Printf("Warning: Error updating message state for %s: %v", email.ID, err)
+		}
 	}
+}
 
+// writePDFMetadata writes the metadata into the PDF at path, keeping its
+// previous content in the journal
+func (p *attachmentProcessor) writePDFMetadata(doc *Document, rule *Rule, path string) error {
+	backup, err := p.journal.backup(path)
+	if err != nil {
+		return fmt.Errorf("error keeping previous content: %v", err)
+	}
+	if err := writePDFMetadata(doc, rule, path); err != nil {
+		if backup != "" {
+			os.Remove(backup)
+		}
+		return err
+	}
+	if backup != "" {
+		p.journal.record(JournalEntry{Op: JournalOpUpdate, Path: path, Backup: backup})
+	}
 	return nil
 }
+
+// fail records an error on a document, in the plan during a dry run
+func (p *attachmentProcessor) fail(filename string, err error) {
+	log.Printf("Error: %v", err)
+	p.errors = append(p.errors, err)
+	if p.plan != nil {
+		p.plan.add(PlanAction{Action: PlanActionError, File: filename, Error: err.Error()}, "")
+	}
+}
@@ -1,11 +1,15 @@
 package internal
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"extract-email-attachments/internal/config"
+	"extract-email-attachments/internal/pdf"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -63,7 +67,7 @@ func TestProcessAttachments(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Tester le traitement des pièces jointes
-	err = ProcessAttachments()
+	err = ProcessAttachments(context.Background(), nil)
 	assert.NoError(t, err)
 
 	// Vérifier que le fichier a été renommé
@@ -95,7 +99,7 @@ func TestProcessAttachmentsErrors(t *testing.T) {
 
 	// Tester avec un dossier de pièces jointes inexistant
 	config.AppAttachmentsDir = filepath.Join(tempDir, "non-existent")
-	err = ProcessAttachments()
+	err = ProcessAttachments(context.Background(), nil)
 	assert.Error(t, err)
 
 	// Créer le dossier de pièces jointes
@@ -107,7 +111,7 @@ func TestProcessAttachmentsErrors(t *testing.T) {
 	err = os.WriteFile(nonPdfFile, []byte("test content"), 0644)
 	assert.NoError(t, err)
 
-	err = ProcessAttachments()
+	err = ProcessAttachments(context.Background(), nil)
 	assert.NoError(t, err) // Ne devrait pas retourner d'erreur car les fichiers non-PDF sont ignorés
 
 	// Tester avec un fichier PDF sans métadonnées associées
@@ -115,6 +119,500 @@ func TestProcessAttachmentsErrors(t *testing.T) {
 	err = os.WriteFile(pdfFile, []byte("test content"), 0644)
 	assert.NoError(t, err)
 
-	err = ProcessAttachments()
+	err = ProcessAttachments(context.Background(), nil)
 	assert.NoError(t, err) // Ne devrait pas retourner d'erreur car les fichiers sans métadonnées sont ignorés
 }
+
+func TestProcessAttachmentsTextRule(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "attachments-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	originalAttachmentsDir := config.AppAttachmentsDir
+	originalConfigDir := config.AppConfigDir
+	config.AppAttachmentsDir = tempDir
+	config.AppConfigDir = tempDir
+	defer func() {
+		config.AppAttachmentsDir = originalAttachmentsDir
+		config.AppConfigDir = originalConfigDir
+	}()
+
+	// Une règle sur le texte du document, l'expéditeur ne permettant pas de reconnaître le fournisseur
+	err = os.WriteFile(filepath.Join(tempDir, "rules.json"), []byte(`{"rules": [
+		{"name": "ACME", "vendor": "ACME", "match": {"textContains": "acme fournitures"}, "filename": "{{.Year}}-{{.Month}}-facture-{{.Vendor}}-{{.InvoiceNumber}}.pdf"}
+	]}`), 0644)
+	assert.NoError(t, err)
+
+	// Copier la facture de test
+	fileContent, err := os.ReadFile(filepath.Join("testdata", "invoice.pdf"))
+	assert.NoError(t, err)
+	filename := "document.pdf"
+	err = os.WriteFile(filepath.Join(tempDir, filename), fileContent, 0644)
+	assert.NoError(t, err)
+	sha256Hash := fmt.Sprintf("%x", sha256.Sum256(fileContent))
+
+	am := NewActivityManager()
+	assert.NoError(t, am.Load())
+	emailID := "test-email-456"
+	err = am.StoreEmailMeta(emailID, &gmail.Message{
+		Id: emailID,
+		Payload: &gmail.MessagePart{
+			Headers: []*gmail.MessagePartHeader{
+				{Name: "Date", Value: "Mon, 06 Apr 2026 09:30:00 +0200"},
+				{Name: "Subject", Value: "Votre document"},
+				{Name: "From", Value: "Service client <noreply@mailer.example.com>"},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, am.StoreAttachmentMeta(filename, emailID, sha256Hash))
+	assert.NoError(t, am.Save())
+
+	err = ProcessAttachments(context.Background(), nil)
+	assert.NoError(t, err)
+
+	// Le nom utilise la date et le numéro de la facture, et non la date de l'email
+	_, err = os.Stat(filepath.Join(tempDir, "2026-03-facture-ACME-FA-2026-0042.pdf"))
+	assert.NoError(t, err)
+
+	// Les champs extraits sont enregistrés
+	am = NewActivityManager()
+	assert.NoError(t, am.Load())
+	attachment, err := am.GetAttachment(sha256Hash)
+	assert.NoError(t, err)
+	assert.Equal(t, "processed", attachment.Status)
+	assert.Equal(t, &InvoiceFields{
+		Number:    "FA-2026-0042",
+		IssueDate: "2026-03-15",
+		Total:     "120.00",
+		Currency:  "EUR",
+		VATNumber: "FR40123456789",
+		Source:    FieldSourceText,
+	}, attachment.Invoice)
+}
+
+func TestProcessAttachmentsXMLInvoice(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "attachments-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	originalAttachmentsDir := config.AppAttachmentsDir
+	originalConfigDir := config.AppConfigDir
+	originalSettings := config.AppSettings
+	config.AppAttachmentsDir = tempDir
+	config.AppConfigDir = tempDir
+	config.AppSettings.XMLSummary = true
+	defer func() {
+		config.AppAttachmentsDir = originalAttachmentsDir
+		config.AppConfigDir = originalConfigDir
+		config.AppSettings = originalSettings
+	}()
+
+	// Une règle sur le n° de TVA du vendeur, dont le nom est utilisé comme fournisseur
+	err = os.WriteFile(filepath.Join(tempDir, "rules.json"), []byte(`{"rules": [
+		{"name": "Nordlicht", "match": {"vatNumber": "DE123456789"}, "filename": "{{.Year}}-{{.Month}}-facture-{{.Vendor}}-{{.InvoiceNumber}}.pdf"}
+	]}`), 0644)
+	assert.NoError(t, err)
+
+	fileContent, err := os.ReadFile(filepath.Join("testdata", "ubl-invoice.xml"))
+	assert.NoError(t, err)
+	filename := "invoice.xml"
+	err = os.WriteFile(filepath.Join(tempDir, filename), fileContent, 0644)
+	assert.NoError(t, err)
+	sha256Hash := fmt.Sprintf("%x", sha256.Sum256(fileContent))
+
+	am := NewActivityManager()
+	assert.NoError(t, am.Load())
+	emailID := "test-email-789"
+	err = am.StoreEmailMeta(emailID, &gmail.Message{
+		Id: emailID,
+		Payload: &gmail.MessagePart{
+			Headers: []*gmail.MessagePartHeader{
+				{Name: "Date", Value: "Thu, 02 Apr 2026 11:00:00 +0200"},
+				{Name: "Subject", Value: "Invoice INV-2026-0315"},
+				{Name: "From", Value: "Nordlicht <billing@nordlicht.example>"},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, am.StoreAttachmentMeta(filename, emailID, sha256Hash))
+	assert.NoError(t, am.Save())
+
+	err = ProcessAttachments(context.Background(), nil)
+	assert.NoError(t, err)
+
+	// La facture XML garde son extension, et son résumé est écrit à côté
+	newFilename := "2026-04-facture-Nordlicht Software GmbH-INV-2026-0315"
+	assert.FileExists(t, filepath.Join(tempDir, newFilename+".xml"))
+	summary, err := os.ReadFile(filepath.Join(tempDir, newFilename+".html"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(summary), "Nordlicht Software GmbH")
+
+	am = NewActivityManager()
+	assert.NoError(t, am.Load())
+	attachment, err := am.GetAttachment(sha256Hash)
+	assert.NoError(t, err)
+	assert.Equal(t, "processed", attachment.Status)
+	if assert.NotNil(t, attachment.Invoice) {
+		assert.Equal(t, FieldSourceUBL, attachment.Invoice.Source)
+		assert.Equal(t, "238.00", attachment.Invoice.Total)
+	}
+}
+
+func TestProcessAttachmentsEncrypted(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "attachments-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	originalAttachmentsDir := config.AppAttachmentsDir
+	originalConfigDir := config.AppConfigDir
+	originalSettings := config.AppSettings
+	config.AppAttachmentsDir = tempDir
+	config.AppConfigDir = tempDir
+	config.AppSettings.DecryptedCopy = true
+	defer func() {
+		config.AppAttachmentsDir = originalAttachmentsDir
+		config.AppConfigDir = originalConfigDir
+		config.AppSettings = originalSettings
+	}()
+
+	err = os.WriteFile(filepath.Join(tempDir, "rules.json"), []byte(`{"rules": [
+		{"name": "Banque", "vendor": "Banque", "match": {"senderEmail": "@banque.fr", "textContains": "relevé"}, "filename": "{{.Year}}-{{.Month}}-releve-{{.Vendor}}.pdf"}
+	]}`), 0644)
+	assert.NoError(t, err)
+
+	fileContent, err := os.ReadFile(filepath.Join("testdata", "encrypted.pdf"))
+	assert.NoError(t, err)
+	filename := "releve.pdf"
+	err = os.WriteFile(filepath.Join(tempDir, filename), fileContent, 0644)
+	assert.NoError(t, err)
+	sha256Hash := fmt.Sprintf("%x", sha256.Sum256(fileContent))
+
+	am := NewActivityManager()
+	assert.NoError(t, am.Load())
+	emailID := "test-email-encrypted"
+	err = am.StoreEmailMeta(emailID, &gmail.Message{
+		Id: emailID,
+		Payload: &gmail.MessagePart{
+			Headers: []*gmail.MessagePartHeader{
+				{Name: "Date", Value: "Tue, 05 May 2026 08:00:00 +0200"},
+				{Name: "Subject", Value: "Votre relevé"},
+				{Name: "From", Value: "Ma Banque <releves@banque.fr>"},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, am.StoreAttachmentMeta(filename, emailID, sha256Hash))
+	assert.NoError(t, am.Save())
+
+	// Sans mot de passe, le document reste en place et est signalé
+	err = ProcessAttachments(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(tempDir, filename))
+
+	am = NewActivityManager()
+	assert.NoError(t, am.Load())
+	attachment, err := am.GetAttachment(sha256Hash)
+	assert.NoError(t, err)
+	assert.Equal(t, AttachmentStatusPasswordRequired, attachment.Status)
+
+	// Le mot de passe fourni par l'utilisateur est essayé au passage suivant
+	err = os.WriteFile(filepath.Join(tempDir, "passwords.json"), []byte(`{"passwords": [
+		{"rule": "Banque", "passwords": ["0042137"]}
+	]}`), 0600)
+	assert.NoError(t, err)
+
+	err = ProcessAttachments(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(tempDir, "2026-05-releve-Banque.pdf"))
+	assert.FileExists(t, filepath.Join(tempDir, "2026-05-releve-Banque-decrypted.pdf"))
+
+	am = NewActivityManager()
+	assert.NoError(t, am.Load())
+	attachment, err = am.GetAttachment(sha256Hash)
+	assert.NoError(t, err)
+	assert.Equal(t, AttachmentStatusProcessed, attachment.Status)
+}
+
+func TestProcessAttachmentsMetadata(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "attachments-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	originalAttachmentsDir := config.AppAttachmentsDir
+	originalConfigDir := config.AppConfigDir
+	originalSettings := config.AppSettings
+	config.AppAttachmentsDir = tempDir
+	config.AppConfigDir = tempDir
+	config.AppSettings.WriteMetadata = true
+	defer func() {
+		config.AppAttachmentsDir = originalAttachmentsDir
+		config.AppConfigDir = originalConfigDir
+		config.AppSettings = originalSettings
+	}()
+
+	err = os.WriteFile(filepath.Join(tempDir, "rules.json"), []byte(`{"rules": [
+		{"name": "Papeterie", "match": {"vatNumber": "FR12345678901"}, "filename": "{{.Year}}-{{.Month}}-facture-{{.Vendor}}.pdf"}
+	]}`), 0644)
+	assert.NoError(t, err)
+
+	fileContent, err := os.ReadFile(filepath.Join("testdata", "facturx.pdf"))
+	assert.NoError(t, err)
+	filename := "FX-2026-0007.pdf"
+	err = os.WriteFile(filepath.Join(tempDir, filename), fileContent, 0644)
+	assert.NoError(t, err)
+
+	am := NewActivityManager()
+	assert.NoError(t, am.Load())
+	emailID := "test-email-metadata"
+	err = am.StoreEmailMeta(emailID, &gmail.Message{
+		Id: emailID,
+		Payload: &gmail.MessagePart{
+			Headers: []*gmail.MessagePartHeader{
+				{Name: "Date", Value: "Fri, 20 Mar 2026 10:00:00 +0100"},
+				{Name: "Subject", Value: "Facture FX-2026-0007"},
+				{Name: "From", Value: "Papeterie Martin <factures@papeterie.example>"},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, am.StoreAttachmentMeta(filename, emailID, fmt.Sprintf("%x", sha256.Sum256(fileContent))))
+	assert.NoError(t, am.Save())
+
+	err = ProcessAttachments(context.Background(), nil)
+	assert.NoError(t, err)
+
+	// Les métadonnées sont ajoutées sans modifier le document d'origine
+	data, err := os.ReadFile(filepath.Join(tempDir, "2026-03-facture-Papeterie Martin SARL.pdf"))
+	assert.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(data, fileContent))
+
+	doc, err := pdf.Open(data)
+	assert.NoError(t, err)
+	info, _ := doc.Resolve(doc.Trailer()["Info"]).(pdf.Dict)
+	assert.Equal(t, pdf.String("2026-03-facture-Papeterie Martin SARL"), info["Title"])
+	assert.Equal(t, pdf.String("Papeterie Martin SARL"), info["Author"])
+	assert.Equal(t, pdf.String("Invoice FX-2026-0007 from Papeterie Martin SARL, 2026-03"), info["Subject"])
+	assert.Equal(t, pdf.String("Papeterie Martin SARL, FX-2026-0007, 2026-03, email:test-email-metadata, original:FX-2026-0007.pdf"), info["Keywords"])
+
+	files, err := doc.EmbeddedFiles()
+	assert.NoError(t, err)
+	fields, err := facturXFields(files)
+	assert.NoError(t, err)
+	assert.Equal(t, "FX-2026-0007", fields.Number)
+}
+
+func TestProcessAttachmentsDestination(t *testing.T) {
+	fileContent, err := os.ReadFile(filepath.Join("testdata", "ubl-invoice.xml"))
+	assert.NoError(t, err)
+	sha256Hash := fmt.Sprintf("%x", sha256.Sum256(fileContent))
+
+	for _, mode := range []string{DestinationModeMove, DestinationModeCopy, DestinationModeLink} {
+		t.Run(mode, func(t *testing.T) {
+			tempDir, err := os.MkdirTemp("", "attachments-test")
+			assert.NoError(t, err)
+			defer os.RemoveAll(tempDir)
+			filingDir := filepath.Join(tempDir, "Compta")
+
+			originalAttachmentsDir := config.AppAttachmentsDir
+			originalConfigDir := config.AppConfigDir
+			config.AppAttachmentsDir = filepath.Join(tempDir, "attachments")
+			config.AppConfigDir = tempDir
+			defer func() {
+				config.AppAttachmentsDir = originalAttachmentsDir
+				config.AppConfigDir = originalConfigDir
+			}()
+			assert.NoError(t, os.MkdirAll(config.AppAttachmentsDir, 0755))
+
+			err = os.WriteFile(filepath.Join(tempDir, "rules.json"), []byte(fmt.Sprintf(`{"rules": [
+				{"name": "Nordlicht", "match": {"vatNumber": "DE123456789"}, "filename": "{{.Year}}-{{.Month}}-{{.InvoiceNumber}}.pdf",
+				 "destination": %q, "mode": %q}
+			]}`, filingDir+"/Factures/{{.Year}}/{{.Vendor}}/", mode)), 0644)
+			assert.NoError(t, err)
+
+			downloadPath := filepath.Join(config.AppAttachmentsDir, "invoice.xml")
+			assert.NoError(t, os.WriteFile(downloadPath, fileContent, 0644))
+
+			am := NewActivityManager()
+			assert.NoError(t, am.Load())
+			emailID := "test-email-destination"
+			err = am.StoreEmailMeta(emailID, &gmail.Message{
+				Id: emailID,
+				Payload: &gmail.MessagePart{
+					Headers: []*gmail.MessagePartHeader{
+						{Name: "Date", Value: "Thu, 02 Apr 2026 11:00:00 +0200"},
+						{Name: "From", Value: "Nordlicht <billing@nordlicht.example>"},
+					},
+				},
+			})
+			assert.NoError(t, err)
+			assert.NoError(t, am.StoreAttachmentMeta("invoice.xml", emailID, sha256Hash))
+			assert.NoError(t, am.Save())
+
+			// Le dossier de destination est créé, et le fichier téléchargé conservé sauf en déplacement
+			assert.NoError(t, ProcessAttachments(context.Background(), nil))
+			newPath := filepath.Join(filingDir, "Factures", "2026", "Nordlicht Software GmbH", "2026-04-INV-2026-0315.xml")
+			assert.FileExists(t, newPath)
+			if mode == DestinationModeMove {
+				assert.NoFileExists(t, downloadPath)
+			} else {
+				assert.FileExists(t, downloadPath)
+			}
+
+			am = NewActivityManager()
+			assert.NoError(t, am.Load())
+			attachment, err := am.GetAttachment(sha256Hash)
+			assert.NoError(t, err)
+			assert.Equal(t, AttachmentStatusProcessed, attachment.Status)
+			assert.Equal(t, newPath, attachment.Path)
+
+			// Un fichier conservé n'est pas classé de nouveau
+			assert.NoError(t, os.Remove(newPath))
+			assert.NoError(t, ProcessAttachments(context.Background(), nil))
+			assert.NoFileExists(t, newPath)
+		})
+	}
+}
+
+func TestProcessAttachmentsDestinationConflict(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "attachments-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+	filingDir := filepath.Join(tempDir, "Compta")
+
+	originalAttachmentsDir := config.AppAttachmentsDir
+	originalConfigDir := config.AppConfigDir
+	config.AppAttachmentsDir = filepath.Join(tempDir, "attachments")
+	config.AppConfigDir = tempDir
+	defer func() {
+		config.AppAttachmentsDir = originalAttachmentsDir
+		config.AppConfigDir = originalConfigDir
+	}()
+	assert.NoError(t, os.MkdirAll(config.AppAttachmentsDir, 0755))
+
+	// Deux factures du même mois produisent le même nom
+	err = os.WriteFile(filepath.Join(tempDir, "rules.json"), []byte(fmt.Sprintf(`{"rules": [
+		{"name": "Nordlicht", "match": {"vatNumber": "DE123456789"}, "filename": "{{.Year}}-{{.Month}}-facture-{{.Vendor}}.xml", "destination": %q}
+	]}`, filingDir+"/")), 0644)
+	assert.NoError(t, err)
+
+	fileContent, err := os.ReadFile(filepath.Join("testdata", "ubl-invoice.xml"))
+	assert.NoError(t, err)
+	am := NewActivityManager()
+	assert.NoError(t, am.Load())
+	for i := 1; i <= 2; i++ {
+		emailID := fmt.Sprintf("nordlicht-%d", i)
+		assert.NoError(t, am.StoreEmailMeta(emailID, &gmail.Message{Id: emailID, Payload: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{
+			{Name: "Date", Value: "Thu, 02 Apr 2026 11:00:00 +0200"},
+			{Name: "From", Value: "Nordlicht <billing@nordlicht.example>"},
+		}}}))
+		filename := fmt.Sprintf("facture-%d.xml", i)
+		content := append(bytes.Clone(fileContent), fmt.Sprintf("<!-- %d -->\n", i)...)
+		assert.NoError(t, os.WriteFile(filepath.Join(config.AppAttachmentsDir, filename), content, 0644))
+		assert.NoError(t, am.StoreAttachmentMeta(filename, emailID, fmt.Sprintf("%x", sha256.Sum256(content))))
+	}
+	assert.NoError(t, am.Save())
+
+	// Le premier document est classé, le second reste en place sans écraser le premier
+	err = ProcessAttachments(context.Background(), nil)
+	assert.ErrorIs(t, err, ErrAttachmentProcessing)
+	newPath := filepath.Join(filingDir, "2026-04-facture-Nordlicht Software GmbH.xml")
+	filed, err := os.ReadFile(newPath)
+	assert.NoError(t, err)
+	assert.Contains(t, string(filed), "<!-- 1 -->")
+	assert.NoFileExists(t, filepath.Join(config.AppAttachmentsDir, "facture-1.xml"))
+	assert.FileExists(t, filepath.Join(config.AppAttachmentsDir, "facture-2.xml"))
+
+	am = NewActivityManager()
+	assert.NoError(t, am.Load())
+	attachment, err := am.GetAttachmentByFilename("facture-2.xml")
+	assert.NoError(t, err)
+	assert.Empty(t, attachment.Status)
+	assert.Empty(t, attachment.Path)
+}
+
+func TestProcessAttachmentsSameFilename(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "same-filename-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+	filingDir := filepath.Join(tempDir, "Compta")
+
+	originalAttachmentsDir := config.AppAttachmentsDir
+	originalConfigDir := config.AppConfigDir
+	config.AppAttachmentsDir = filepath.Join(tempDir, "attachments")
+	config.AppConfigDir = tempDir
+	defer func() {
+		config.AppAttachmentsDir = originalAttachmentsDir
+		config.AppConfigDir = originalConfigDir
+	}()
+
+	err = os.WriteFile(filepath.Join(tempDir, "rules.json"), []byte(fmt.Sprintf(`{"rules": [
+		{"name": "Nordlicht", "match": {"vatNumber": "DE123456789"}, "filename": "{{.InvoiceNumber}}.xml", "destination": %q}
+	]}`, filingDir+"/")), 0644)
+	assert.NoError(t, err)
+
+	fileContent, err := os.ReadFile(filepath.Join("testdata", "ubl-invoice.xml"))
+	assert.NoError(t, err)
+
+	// Chaque message porte une facture différente nommée invoice.xml
+	download := func(am *ActivityManager, number string) {
+		emailID := "msg-" + number
+		assert.NoError(t, am.StoreEmailMeta(emailID, &gmail.Message{Id: emailID, Payload: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{
+			{Name: "From", Value: "Nordlicht <billing@nordlicht.example>"},
+		}}}))
+		content := bytes.ReplaceAll(fileContent, []byte("INV-2026-0315"), []byte("INV-2026-"+number))
+		assert.NoError(t, saveAttachment(emailID, &gmail.MessagePart{Filename: "invoice.xml"}, content, am, nil))
+		assert.NoError(t, am.UpdateEmailState(emailID, MessageStateDownloaded, nil))
+	}
+
+	// Deux messages téléchargés lors du même passage ne s'écrasent pas
+	am := NewActivityManager()
+	assert.NoError(t, am.Load())
+	download(am, "0001")
+	download(am, "0002")
+	assert.NoError(t, am.Save())
+	assert.FileExists(t, filepath.Join(config.AppAttachmentsDir, "invoice.xml"))
+	assert.FileExists(t, filepath.Join(config.AppAttachmentsDir, "invoice-msg-0002.xml"))
+	assert.NoError(t, ProcessAttachments(context.Background(), nil))
+
+	// Un message suivant reprend le nom d'une pièce jointe déjà classée
+	am = NewActivityManager()
+	assert.NoError(t, am.Load())
+	download(am, "0003")
+	assert.NoError(t, am.Save())
+	assert.NoError(t, ProcessAttachments(context.Background(), nil))
+
+	am = NewActivityManager()
+	assert.NoError(t, am.Load())
+	for _, number := range []string{"0001", "0002", "0003"} {
+		filed, err := os.ReadFile(filepath.Join(filingDir, "INV-2026-"+number+".xml"))
+		assert.NoError(t, err)
+		assert.Contains(t, string(filed), "INV-2026-"+number)
+
+		email, err := am.GetEmailByID("msg-" + number)
+		assert.NoError(t, err)
+		assert.Equal(t, MessageStateProcessed, email.State)
+	}
+	for _, attachment := range am.Attachments() {
+		assert.Equal(t, AttachmentStatusProcessed, attachment.Status)
+		assert.Equal(t, filepath.Join(filingDir, "INV-2026-"+strings.TrimPrefix(attachment.EmailID, "msg-")+".xml"), attachment.Path)
+	}
+	entries, err := os.ReadDir(config.AppAttachmentsDir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// Une copie identique déjà classée sous le dossier de téléchargement n'est pas prise pour la pièce jointe
+	am = NewActivityManager()
+	assert.NoError(t, am.Load())
+	download(am, "0004")
+	assert.NoError(t, am.Save())
+	downloaded, err := os.ReadFile(filepath.Join(config.AppAttachmentsDir, "invoice.xml"))
+	assert.NoError(t, err)
+	archived := filepath.Join(config.AppAttachmentsDir, "Archives", "INV-2026-0004.xml")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(archived), 0755))
+	assert.NoError(t, os.WriteFile(archived, downloaded, 0644))
+	assert.NoError(t, ProcessAttachments(context.Background(), nil))
+	assert.FileExists(t, archived)
+	assert.FileExists(t, filepath.Join(filingDir, "INV-2026-0004.xml"))
+	assert.NoFileExists(t, filepath.Join(config.AppAttachmentsDir, "invoice.xml"))
+}
@@ -0,0 +1,230 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"extract-email-attachments/internal/config"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	// defaultMinConfidence is the confidence required by the documentType
+	// condition of the rules when minConfidence is not set
+	defaultMinConfidence = 0.6
+	// classifierMinWordLength is the length of the shortest words used to
+	// classify documents, shorter ones being mostly articles and abbreviations
+	classifierMinWordLength = 3
+)
+
+// Classifier predicts the type of a document, such as an invoice, a quote or
+// a tax certificate, from its text. It is a naive Bayes classifier trained
+// from the documents already filed in the archive, the type of a document
+// being the top-level folder where it is filed.
+type Classifier struct {
+	Types map[string]*documentTypeModel `json:"types"`
+	// Vocabulary is the number of distinct words of the training documents
+	Vocabulary int `json:"vocabulary"`
+}
+
+// documentTypeModel counts, for the documents of a type, the documents
+// containing each word.
+type documentTypeModel struct {
+	Documents int            `json:"documents"`
+	Words     int            `json:"words"` // sum of Counts
+	Counts    map[string]int `json:"counts"`
+}
+
+// classifierPath is where the trained classifier is stored
+func classifierPath() string {
+	return filepath.Join(config.AppCacheDir, "classifier.json")
+}
+
+// LoadClassifier reads the classifier trained by TrainClassifier, or returns
+// nil if it has not been trained.
+func LoadClassifier() (*Classifier, error) {
+	data, err := os.ReadFile(classifierPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading classifier: %w", err)
+	}
+
+	var c Classifier
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("error decoding classifier: %w", err)
+	}
+	return &c, nil
+}
+
+// Save writes the classifier to the cache directory
+func (c *Classifier) Save() error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("error encoding classifier: %w", err)
+	}
+	return writeFileAtomic(classifierPath(), data, defaultFilePerm)
+}
+
+// TrainClassifier trains a classifier from the PDF and XML documents filed in
+// the subfolders of archiveRoot, each top-level folder being a document type,
+// such as "Factures", "Devis" or "Impôts". Documents without text, such as
+// encrypted PDFs, are skipped.
+func TrainClassifier(ctx context.Context, archiveRoot string) (*Classifier, error) {
+	root, err := expandHome(archiveRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	// Filed documents have no email to select the passwords of encrypted PDFs
+	reader := newDocumentReader(nil, nil, nil)
+	c := &Classifier{Types: map[string]*documentTypeModel{}}
+
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != root {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !isPDFDocument(path) && !isXMLDocument(path) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		docType, _, ok := strings.Cut(filepath.ToSlash(rel), "/")
+		if !ok {
+			return nil // not filed in a folder
+		}
+		doc := reader.read(ctx, path, AttachmentData{Filename: d.Name()}, EmailData{})
+		c.add(docType, doc.Text)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading archive %s: %w", archiveRoot, err)
+	}
+
+	if len(c.Types) < 2 {
+		return nil, fmt.Errorf("%w: %s must contain documents of at least two types, one folder per type", ErrInvalidConfig, archiveRoot)
+	}
+	return c, nil
+}
+
+// add trains the classifier with a document of the given type
+func (c *Classifier) add(docType, text string) {
+	words := classifierWords(text)
+	if len(words) == 0 {
+		return
+	}
+
+	model := c.Types[docType]
+	if model == nil {
+		model = &documentTypeModel{Counts: map[string]int{}}
+		c.Types[docType] = model
+	}
+	model.Documents++
+	for _, word := range words {
+		if !c.known(word) {
+			c.Vocabulary++
+		}
+		model.Counts[word]++
+		model.Words++
+	}
+}
+
+// known reports whether a word appears in the training documents
+func (c *Classifier) known(word string) bool {
+	for _, model := range c.Types {
+		if model.Counts[word] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Classify returns the most probable type of a document and its probability,
+// or an empty type if the text has no word seen in training.
+func (c *Classifier) Classify(text string) (string, float64) {
+	var words []string
+	for _, word := range classifierWords(text) {
+		if c.known(word) {
+			words = append(words, word)
+		}
+	}
+	if len(words) == 0 {
+		return "", 0
+	}
+
+	var documents int
+	for _, model := range c.Types {
+		documents += model.Documents
+	}
+
+	// Log-probabilities of the types, with Laplace smoothing
+	scores := map[string]float64{}
+	best, bestScore := "", math.Inf(-1)
+	for _, docType := range sortedKeys(c.Types) {
+		model := c.Types[docType]
+		score := math.Log(float64(model.Documents) / float64(documents))
+		for _, word := range words {
+			score += math.Log(float64(model.Counts[word]+1) / float64(model.Words+c.Vocabulary))
+		}
+		scores[docType] = score
+		if score > bestScore {
+			best, bestScore = docType, score
+		}
+	}
+
+	var sum float64
+	for _, score := range scores {
+		sum += math.Exp(score - bestScore)
+	}
+	return best, 1 / sum
+}
+
+// classify sets the type of the document predicted by the classifier
+func (r *documentReader) classify(doc *Document) {
+	if r.classifier == nil || doc.Text == "" {
+		return
+	}
+	doc.Type, doc.TypeConfidence = r.classifier.Classify(doc.Text)
+}
+
+// classifierWords returns the distinct words of a text, in lowercase and
+// without accents, so that each document counts once per word whatever its length.
+func classifierWords(text string) []string {
+	folded, _, err := transform.String(transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC), text)
+	if err != nil {
+		folded = text
+	}
+
+	seen := map[string]bool{}
+	var words []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(folded), func(r rune) bool { return !unicode.IsLetter(r) }) {
+		if len([]rune(word)) >= classifierMinWordLength && !seen[word] {
+			seen[word] = true
+			words = append(words, word)
+		}
+	}
+	return words
+}
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"extract-email-attachments/internal/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifier(t *testing.T) {
+	c := &Classifier{Types: map[string]*documentTypeModel{}}
+	c.add("Factures", "Facture n° FA-001. Montant total TTC à payer : 120,00 €. Date d'échéance : 15/03/2025")
+	c.add("Factures", "FACTURE FA-002 - Net à payer 80,00 € TTC, échéance le 15/04/2025")
+	c.add("Devis", "Devis n° D-12, valable 30 jours. Bon pour accord, signature du client. Total TTC 1 200,00 €")
+	c.add("Devis", "Proposition commerciale : devis D-13 valable jusqu'au 30/06/2025, bon pour accord")
+	c.add("Attestations", "Attestation fiscale : nous certifions avoir reçu la somme de 300 € au titre de l'année 2024")
+	c.add("Attestations", "Attestation destinée à l'administration fiscale, crédit d'impôt année 2024")
+	c.add("Vide", "12 34")
+
+	assert.Len(t, c.Types, 3)
+	assert.Equal(t, 2, c.Types["Devis"].Documents)
+
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{"Facture FA-003 : 95,00 € TTC à payer avant l'échéance", "Factures"},
+		{"DEVIS D-14 valable 30 jours, bon pour accord", "Devis"},
+		{"Attestation fiscale pour l'année 2025", "Attestations"},
+		{"12/03/2025", ""},
+	}
+	for _, tt := range tests {
+		docType, confidence := c.Classify(tt.text)
+		assert.Equal(t, tt.expected, docType, tt.text)
+		if tt.expected != "" {
+			assert.Greater(t, confidence, defaultMinConfidence, tt.text)
+			assert.LessOrEqual(t, confidence, 1.0, tt.text)
+		}
+	}
+}
+
+func TestTrainClassifier(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "classifier-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	originalCacheDir := config.AppCacheDir
+	config.AppCacheDir = tempDir
+	defer func() {
+		config.AppCacheDir = originalCacheDir
+	}()
+
+	// Sans modèle entraîné, aucun type n'est prédit
+	classifier, err := LoadClassifier()
+	assert.NoError(t, err)
+	assert.Nil(t, classifier)
+
+	// Un dossier par type de document
+	root := filepath.Join(tempDir, "Compta")
+	for path, text := range map[string]string{
+		"Factures/2025/EDF/facture-1.xml": "Facture d'électricité, montant à payer",
+		"Factures/2025/EDF/facture-2.xml": "Facture de gaz, montant à payer",
+		"Devis/devis-toiture.xml":         "Devis de travaux, bon pour accord",
+		"Devis/devis-peinture.xml":        "Devis de peinture, bon pour accord",
+		"Devis/notes.txt":                 "Facture",
+		".Trash/facture-3.xml":            "Devis",
+		"non-classe.xml":                  "Devis",
+	} {
+		path = filepath.Join(root, path)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, os.WriteFile(path, []byte("<document>"+text+"</document>"), 0644))
+	}
+
+	classifier, err = TrainClassifier(context.Background(), root)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, classifier.Types["Factures"].Documents)
+	assert.Equal(t, 2, classifier.Types["Devis"].Documents)
+	assert.Len(t, classifier.Types, 2)
+	assert.NoError(t, classifier.Save())
+
+	// Le modèle enregistré classe les documents lus
+	classifier, err = LoadClassifier()
+	assert.NoError(t, err)
+	path := filepath.Join(tempDir, "devis.xml")
+	assert.NoError(t, os.WriteFile(path, []byte("<document>Devis pour accord</document>"), 0644))
+	doc := newDocumentReader(nil, nil, classifier).read(context.Background(), path, AttachmentData{Filename: "devis.xml"}, EmailData{})
+	assert.Equal(t, "Devis", doc.Type)
+	assert.Greater(t, doc.TypeConfidence, defaultMinConfidence)
+
+	// Un seul type de document ne suffit pas
+	assert.NoError(t, os.RemoveAll(filepath.Join(root, "Devis")))
+	_, err = TrainClassifier(context.Background(), root)
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+}
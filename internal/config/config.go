@@ -2,4 +2,10 @@ package config
 
 const (
 	DefaultDateFormat = "2006/01/02"
+
+	// ActivityBackupCount is the number of previous versions of the activity data kept on disk
+	ActivityBackupCount = 5
+
+	// MaxMessageAttempts is the number of runs trying to download a message before giving up
+	MaxMessageAttempts = 5
 )
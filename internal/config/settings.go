@@ -0,0 +1,220 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// Settings holds the user settings, read from settings.json in the
+// configuration directory. Missing fields keep their default value.
+type Settings struct {
+	// Workers is the number of messages and attachments fetched concurrently
+	Workers int `json:"workers"`
+	// LookbackDays is the number of days of messages fetched by the first
+	// run; the next runs fetch the messages received since the previous one
+	LookbackDays int `json:"lookbackDays"`
+	// Gmail configures the search of the messages in the mailbox
+	Gmail GmailSettings `json:"gmail"`
+	// QuotaUnitsPerSecond limits the Gmail API usage, per-user quota being 250 units per second
+	QuotaUnitsPerSecond int `json:"quotaUnitsPerSecond"`
+	// OCR recognizes the text of scanned PDFs, which have no text layer
+	OCR OCRSettings `json:"ocr"`
+	// XMLSummary writes a human-readable HTML summary next to XML invoices
+	XMLSummary bool `json:"xmlSummary"`
+	// DecryptedCopy writes a copy without password of the encrypted PDFs
+	// opened with passwords.json, next to the original
+	DecryptedCopy bool `json:"decryptedCopy"`
+	// WriteMetadata writes the vendor, invoice number, period and origin of
+	// the renamed PDFs into their document information and XMP metadata
+	WriteMetadata bool `json:"writeMetadata"`
+	// ArchiveRoot is the root of the existing filing tree, analysed by the
+	// learn command, such as "~/Documents/Compta"
+	ArchiveRoot string `json:"archiveRoot,omitempty"`
+	// Extraction sends the documents whose invoice fields are not found to an
+	// AI model. It is disabled unless a provider is set, so that documents
+	// never leave the machine by default.
+	Extraction ExtractionSettings `json:"extraction"`
+}
+
+// GmailSettings configures the Gmail account.
+type GmailSettings struct {
+	// Query is a Gmail search fragment restricting the messages fetched, such
+	// as "label:Factures -category:promotions". The attachment filter and the
+	// dates are added to it.
+	Query string `json:"query,omitempty"`
+	// Modify requests the gmail.modify scope instead of gmail.readonly, which
+	// the labels, the archiving and the read marks require. Changing it asks
+	// for the consent again on the next run.
+	Modify bool `json:"modify"`
+	// Label is added to the messages whose attachments were extracted, such
+	// as "extracted" or "invoices/{{.Year}}-{{.Month}}", the fields being the
+	// date of the message
+	Label string `json:"label,omitempty"`
+	// FailureLabel is added to the messages whose download failed or which
+	// have a PDF no password opens, and removed once they are extracted
+	FailureLabel string `json:"failureLabel,omitempty"`
+	// Archive removes the extracted messages from the inbox
+	Archive bool `json:"archive"`
+	// MarkRead marks the extracted messages as read
+	MarkRead bool `json:"markRead"`
+}
+
+// ModifiesMailbox reports whether the messages are labelled, archived or
+// marked as read once processed
+func (g GmailSettings) ModifiesMailbox() bool {
+	return g.Label != "" || g.FailureLabel != "" || g.Archive || g.MarkRead
+}
+
+// LabelData is the data of the gmail.label template: the date of the message
+type LabelData struct {
+	Year, Month, Day string
+}
+
+// gmailDateOperators are the Gmail search operators on dates, which the
+// queries must not contain since the dates of the search are added to them
+var gmailDateOperators = regexp.MustCompile(`(?i)(^|[\s(-])(after|before|older|newer|older_than|newer_than):`)
+
+// CheckGmailQuery validates a Gmail search fragment
+func CheckGmailQuery(query string) error {
+	if gmailDateOperators.MatchString(query) {
+		return fmt.Errorf("must not contain dates, which are added to it")
+	}
+	if strings.Count(query, "(") != strings.Count(query, ")") || strings.Count(query, "{") != strings.Count(query, "}") {
+		return fmt.Errorf("has unbalanced parentheses or braces")
+	}
+	return nil
+}
+
+// Extraction providers
+const (
+	ExtractionProviderOpenAI = "openai" // OpenAI-compatible chat completions API, such as a local model server
+)
+
+// ExtractionSettings configures the AI extraction of the invoice fields.
+type ExtractionSettings struct {
+	// Provider is "openai", or empty to disable the extraction
+	Provider string `json:"provider,omitempty"`
+	// Endpoint is the base URL of the API, such as "http://localhost:11434/v1"
+	Endpoint string `json:"endpoint,omitempty"`
+	Model    string `json:"model,omitempty"`
+	// APIKeyEnv is the environment variable holding the API key, if the
+	// endpoint requires one
+	APIKeyEnv string `json:"apiKeyEnv,omitempty"`
+	// MinConfidence is the confidence below which an extracted field is ignored
+	MinConfidence float64 `json:"minConfidence"`
+}
+
+// OCRSettings configures the local OCR engine: pages are rendered to images
+// by pdftoppm (poppler), then recognized by tesseract. It is disabled by
+// default, since the tools have to be installed.
+type OCRSettings struct {
+	Enabled bool `json:"enabled"`
+	// Languages are the tesseract languages, such as "fra+eng"
+	Languages string `json:"languages"`
+	// DPI is the resolution of the rendered pages
+	DPI int `json:"dpi"`
+	// MaxPages is the number of pages recognized per document
+	MaxPages int `json:"maxPages"`
+	// TesseractPath and PdftoppmPath default to the commands found in the
+	// PATH or in the Homebrew directories
+	TesseractPath string `json:"tesseractPath,omitempty"`
+	PdftoppmPath  string `json:"pdftoppmPath,omitempty"`
+}
+
+// ocrLanguages are tesseract language codes joined by "+"
+var ocrLanguages = regexp.MustCompile(`^[a-z_]+(\+[a-z_]+)*$`)
+
+// AppSettings holds the current settings
+var AppSettings = DefaultSettings()
+
+// DefaultSettings returns the settings used when settings.json is missing
+func DefaultSettings() Settings {
+	return Settings{
+		Workers:             4,
+		LookbackDays:        30,
+		QuotaUnitsPerSecond: 200,
+		OCR: OCRSettings{
+			Languages: "fra+eng",
+			DPI:       300,
+			MaxPages:  5,
+		},
+		Extraction: ExtractionSettings{
+			MinConfidence: 0.5,
+		},
+	}
+}
+
+// LoadSettings reads settings.json, if it exists, into AppSettings
+func LoadSettings() error {
+	settings := DefaultSettings()
+
+	data, err := os.ReadFile(filepath.Join(AppConfigDir, "settings.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			AppSettings = settings
+			return nil
+		}
+		return fmt.Errorf("error reading settings: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("error decoding settings: %w", err)
+	}
+
+	if settings.Workers < 1 {
+		return fmt.Errorf("invalid settings: workers must be at least 1")
+	}
+	if settings.LookbackDays < 1 {
+		return fmt.Errorf("invalid settings: lookbackDays must be at least 1")
+	}
+	if err := CheckGmailQuery(settings.Gmail.Query); err != nil {
+		return fmt.Errorf("invalid settings: gmail.query %v", err)
+	}
+	if settings.Gmail.ModifiesMailbox() && !settings.Gmail.Modify {
+		return fmt.Errorf("invalid settings: gmail.label, gmail.failureLabel, gmail.archive and gmail.markRead require gmail.modify")
+	}
+	label, err := template.New("label").Option("missingkey=error").Parse(settings.Gmail.Label)
+	if err == nil {
+		err = label.Execute(io.Discard, LabelData{Year: "2006", Month: "01", Day: "02"})
+	}
+	if err != nil {
+		return fmt.Errorf("invalid settings: gmail.label %v", err)
+	}
+	if settings.QuotaUnitsPerSecond < 1 {
+		return fmt.Errorf("invalid settings: quotaUnitsPerSecond must be at least 1")
+	}
+	if !ocrLanguages.MatchString(settings.OCR.Languages) {
+		return fmt.Errorf("invalid settings: ocr.languages must be tesseract languages such as fra+eng")
+	}
+	if settings.OCR.DPI < 72 || settings.OCR.DPI > 1200 {
+		return fmt.Errorf("invalid settings: ocr.dpi must be between 72 and 1200")
+	}
+	if settings.OCR.MaxPages < 1 {
+		return fmt.Errorf("invalid settings: ocr.maxPages must be at least 1")
+	}
+	switch settings.Extraction.Provider {
+	case "":
+	case ExtractionProviderOpenAI:
+		if u, err := url.Parse(settings.Extraction.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid settings: extraction.endpoint must be an http or https URL")
+		}
+		if settings.Extraction.Model == "" {
+			return fmt.Errorf("invalid settings: extraction.model is required")
+		}
+	default:
+		return fmt.Errorf("invalid settings: extraction.provider must be openai")
+	}
+	if settings.Extraction.MinConfidence < 0 || settings.Extraction.MinConfidence > 1 {
+		return fmt.Errorf("invalid settings: extraction.minConfidence must be between 0 and 1")
+	}
+
+	AppSettings = settings
+	return nil
+}
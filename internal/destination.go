@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"extract-email-attachments/internal/config"
+)
+
+// Destination modes of the rules: the document is moved to its destination,
+// or copied or hard-linked there, the downloaded file being kept.
+const (
+	DestinationModeMove = "move"
+	DestinationModeCopy = "copy"
+	DestinationModeLink = "link"
+)
+
+// DestinationDir computes the directory where the document is filed: the
+// destination template of the rule, relative to the attachments directory
+// unless absolute or starting with "~/", or the attachments directory itself.
+func (r *Rule) DestinationDir(doc *Document) (string, error) {
+	if r.destination == nil {
+		return config.AppAttachmentsDir, nil
+	}
+
+	data, err := r.filenameData(doc)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := r.destination.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("error executing destination template of rule %s: %v", r.Name, err)
+	}
+
+	dir, err := expandHome(strings.TrimSpace(buf.String()))
+	if err != nil {
+		return "", err
+	}
+	if dir == "" || slices.Contains(strings.Split(filepath.ToSlash(dir), "/"), "..") {
+		return "", fmt.Errorf("%w: rule %s produced destination %q", ErrInvalidFilename, r.Name, dir)
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(config.AppAttachmentsDir, dir)
+	}
+	return filepath.Clean(dir), nil
+}
+
+// expandHome replaces a leading "~/" by the home directory
+func expandHome(path string) (string, error) {
+	rest, ok := strings.CutPrefix(path, "~/")
+	if !ok {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, rest), nil
+}
+
+// ErrDestinationExists is returned when filing a document would overwrite
+// another file, such as when two documents get the same name
+var ErrDestinationExists = errors.New("destination already exists")
+
+// fileDocument moves, copies or hard-links the file at src to dst, creating
+// the directories of dst. It never overwrites an existing dst: the document
+// is then left at src, and ErrDestinationExists is returned.
+func fileDocument(src, dst, mode string) error {
+	// The same file under another case, on a case-insensitive volume, is renamed
+	if existing, err := os.Lstat(dst); err == nil {
+		if info, err := os.Lstat(src); err != nil || !os.SameFile(existing, info) {
+			return fmt.Errorf("%w: %s", ErrDestinationExists, dst)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), defaultDirPerm); err != nil {
+		return fmt.Errorf("error creating directory: %v", err)
+	}
+
+	switch mode {
+	case DestinationModeCopy:
+		return copyFile(src, dst)
+	case DestinationModeLink:
+		return os.Link(src, dst)
+	}
+
+	err := os.Rename(src, dst)
+	// Destinations on another volume, such as a synchronized drive
+	if errors.Is(err, syscall.EXDEV) {
+		if err := copyFile(src, dst); err != nil {
+			return err
+		}
+		return os.Remove(src)
+	}
+	return err
+}
+
+// copyFile copies the file at src to dst, atomically.
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(dst, data, defaultFilePerm)
+}
@@ -0,0 +1,196 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"extract-email-attachments/internal/config"
+	"extract-email-attachments/internal/pdf"
+)
+
+// documentReader extracts the text and the invoice fields of the attachments.
+type documentReader struct {
+	// ocr recognizes scanned documents, nil if OCR is disabled or not installed
+	ocr *ocrEngine
+	// passwords open encrypted PDFs, the rules selecting passwords by rule
+	passwords *PasswordList
+	rules     *RuleSet
+	// classifier predicts the type of the documents, nil if not trained
+	classifier *Classifier
+	// extractor completes the invoice fields, nil unless enabled in the settings
+	extractor ExtractionProvider
+	// readOnly is set for dry runs: the OCR and extraction caches are left
+	// untouched, and no document is sent to the extractor
+	readOnly bool
+	// notExtracted counts the documents not sent to the extractor in read-only mode
+	notExtracted int
+}
+
+// ocrWarning logs once per run that the enabled OCR cannot be used
+var ocrWarning sync.Once
+
+// newDocumentReader prepares a reader according to the settings.
+func newDocumentReader(rules *RuleSet, passwords *PasswordList, classifier *Classifier) *documentReader {
+	r := &documentReader{rules: rules, passwords: passwords, classifier: classifier}
+	if config.AppSettings.OCR.Enabled {
+		ocr, err := newOCREngine(config.AppSettings.OCR)
+		if err != nil {
+			ocrWarning.Do(func() { log.Printf("Warning: OCR disabled: %v", err) })
+		} else {
+			r.ocr = ocr
+		}
+	}
+	r.extractor = newExtractionProvider(config.AppSettings.Extraction)
+	return r
+}
+
+// read reads an attachment file and extracts its text and invoice fields,
+// and predicts its type when a classifier has been trained.
+// The fields of XML invoices, sent as attachments or embedded in Factur-X
+// documents, are authoritative; otherwise they are searched in the text, scanned documents
+// without a text layer being recognized by OCR, and the missing fields
+// extracted by the AI provider when one is enabled.
+// A document whose content cannot be read is returned without text, so that
+// rules on the email headers still apply. An encrypted PDF is opened with the
+// passwords of its sender or rules, and is Locked if none works.
+func (r *documentReader) read(ctx context.Context, path string, attachment AttachmentData, email EmailData) *Document {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("Warning: Error reading %s: %v", attachment.Filename, err)
+		return &Document{Attachment: attachment, Email: email}
+	}
+	return r.readData(ctx, data, attachment, email)
+}
+
+// readData reads the content of an attachment, like read, the type of the
+// document being given by the name of the attachment.
+func (r *documentReader) readData(ctx context.Context, data []byte, attachment AttachmentData, email EmailData) *Document {
+	doc := &Document{Attachment: attachment, Email: email}
+
+	if isXMLDocument(attachment.Filename) {
+		var err error
+		doc.Text = xmlText(data)
+		doc.Invoice, err = parseXMLInvoice(data)
+		if err != nil {
+			log.Printf("Warning: Error reading XML invoice %s: %v", attachment.Filename, err)
+		}
+		r.classify(doc)
+		return doc
+	}
+
+	pdfDoc, err := pdf.Open(data)
+	if errors.Is(err, pdf.ErrEncrypted) {
+		doc.Encrypted = true
+		pdfDoc, err = r.unlock(ctx, doc, data)
+	}
+	if err != nil {
+		log.Printf("Warning: Error reading PDF %s: %v", attachment.Filename, err)
+		return doc
+	}
+	doc.Encrypted = pdfDoc.Encrypted()
+	doc.pdf = pdfDoc
+
+	files, err := pdfDoc.EmbeddedFiles()
+	if err != nil {
+		log.Printf("Warning: Error reading embedded files of %s: %v", attachment.Filename, err)
+	}
+	doc.Invoice, err = facturXFields(files)
+	if err != nil {
+		log.Printf("Warning: Error reading XML invoice of %s: %v", attachment.Filename, err)
+	}
+
+	text, err := pdfDoc.Text()
+	if err != nil {
+		log.Printf("Warning: Error extracting text from %s: %v", attachment.Filename, err)
+		return doc
+	}
+
+	if doc.Invoice.IsEmpty() {
+		source := FieldSourceText
+		if !hasTextLayer(text) && r.ocr != nil {
+			ocrText, err := r.ocr.Recognize(ctx, data, attachment.Sha256Hash, r.readOnly)
+			if err != nil {
+				log.Printf("Warning: Error recognizing text of %s: %v", attachment.Filename, err)
+			} else {
+				text = ocrText
+				source = FieldSourceOCR
+			}
+		}
+		doc.Invoice = extractInvoiceFields(text, source)
+		r.extract(ctx, doc, r.plainData(doc, data), attachment.Sha256Hash)
+	}
+
+	doc.Text = text
+	r.classify(doc)
+	return doc
+}
+
+// plainData returns the content of the PDF to send to the extraction
+// provider: decrypted if the document is encrypted.
+func (r *documentReader) plainData(doc *Document, data []byte) []byte {
+	if r.extractor == nil || !doc.Encrypted {
+		return data
+	}
+	plain, err := doc.pdf.Rewrite()
+	if err != nil {
+		log.Printf("Warning: Error decrypting %s: %v", doc.Attachment.Filename, err)
+		return data
+	}
+	return plain
+}
+
+// unlock opens an encrypted PDF with the candidate passwords of the document.
+// The document is Locked if none of them works.
+func (r *documentReader) unlock(ctx context.Context, doc *Document, data []byte) (*pdf.Document, error) {
+	var candidates []string
+	if r.passwords != nil {
+		candidates = r.passwords.Candidates(ctx, doc, r.rules)
+	}
+	for _, password := range candidates {
+		pdfDoc, err := pdf.OpenWithPassword(data, password)
+		if err == nil {
+			return pdfDoc, nil
+		}
+		if !errors.Is(err, pdf.ErrEncrypted) {
+			return nil, err
+		}
+	}
+	doc.Locked = true
+	return nil, fmt.Errorf("%w (%d passwords tried)", pdf.ErrEncrypted, len(candidates))
+}
+
+// writeDecryptedCopy writes a copy without password of the encrypted PDF at
+// path, named with the "-decrypted" suffix, and returns its path. An existing
+// copy is kept, and the path returned is empty.
+func writeDecryptedCopy(doc *Document, path string) (string, error) {
+	copyPath := strings.TrimSuffix(path, filepath.Ext(path)) + "-decrypted.pdf"
+	if _, err := os.Stat(copyPath); err == nil {
+		return "", nil
+	}
+	data, err := doc.pdf.Rewrite()
+	if err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(copyPath, data, defaultFilePerm); err != nil {
+		return "", err
+	}
+	fmt.Printf("Wrote decrypted copy %s\n", copyPath)
+	return copyPath, nil
+}
+
+// isPDFDocument reports whether a file is a PDF document, from its name
+func isPDFDocument(name string) bool {
+	return strings.EqualFold(filepath.Ext(name), ".pdf")
+}
+
+// isXMLDocument reports whether a file is an XML document, such as an XML
+// e-invoice, from its name
+func isXMLDocument(name string) bool {
+	return strings.EqualFold(filepath.Ext(name), ".xml")
+}
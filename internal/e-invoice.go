@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// newXMLDecoder returns a decoder of XML documents, which may declare an
+// encoding other than UTF-8.
+func newXMLDecoder(data []byte) *xml.Decoder {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		enc, err := htmlindex.Get(charset)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported charset %s", charset)
+		}
+		return enc.NewDecoder().Reader(input), nil
+	}
+	return decoder
+}
+
+// parseXMLInvoice reads the fields of an XML e-invoice sent as an
+// attachment: a UN/CEFACT Cross Industry Invoice or a UBL invoice or credit note.
+func parseXMLInvoice(data []byte) (InvoiceFields, error) {
+	root, err := xmlRoot(data)
+	if err != nil {
+		return InvoiceFields{}, err
+	}
+
+	switch root {
+	case "CrossIndustryInvoice":
+		fields, err := parseCII(data)
+		if err != nil {
+			return InvoiceFields{}, err
+		}
+		fields.Source = FieldSourceCII
+		return fields, nil
+	case "Invoice", "CreditNote":
+		return parseUBL(data)
+	}
+	return InvoiceFields{}, fmt.Errorf("unknown XML document %s", root)
+}
+
+// xmlRoot returns the local name of the root element of an XML document
+func xmlRoot(data []byte) (string, error) {
+	decoder := newXMLDecoder(data)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start.Name.Local, nil
+		}
+	}
+}
+
+// xmlText returns the text content of an XML document, one element per
+// line, so that the rules on the text of documents apply to XML invoices.
+func xmlText(data []byte) string {
+	var lines []string
+	decoder := newXMLDecoder(data)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		if text, ok := token.(xml.CharData); ok {
+			if line := strings.Join(strings.Fields(string(text)), " "); line != "" {
+				lines = append(lines, line)
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// xmlDecimal formats a decimal of an XML invoice with the given number of
+// decimal places, or with the minimal number if places is -1. It returns an
+// empty string if s is not a decimal.
+func xmlDecimal(s string, places int) string {
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return ""
+	}
+	return strconv.FormatFloat(v, 'f', places, 64)
+}
+
+// invoiceSummary is the human-readable summary written next to XML invoices
+var invoiceSummary = template.Must(template.New("summary").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Invoice {{.Invoice.Number}}{{with .Invoice.Seller}} - {{.}}{{end}}</title>
+<style>
+body { font-family: -apple-system, Helvetica, Arial, sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.3em 1em; text-align: left; border-bottom: 1px solid #ddd; }
+td.amount { text-align: right; }
+</style>
+</head>
+<body>
+<h1>Invoice {{.Invoice.Number}}</h1>
+<table>
+{{with .Invoice.Seller}}<tr><th>Seller</th><td>{{.}}</td></tr>
+{{end}}{{with .Invoice.VATNumber}}<tr><th>VAT number</th><td>{{.}}</td></tr>
+{{end}}{{with .Invoice.IssueDate}}<tr><th>Issue date</th><td>{{.}}</td></tr>
+{{end}}{{with .Invoice.DueDate}}<tr><th>Due date</th><td>{{.}}</td></tr>
+{{end}}{{with .Invoice.TotalExclVAT}}<tr><th>Total excluding VAT</th><td class="amount">{{.}} {{$.Invoice.Currency}}</td></tr>
+{{end}}{{with .Invoice.VATTotal}}<tr><th>VAT</th><td class="amount">{{.}} {{$.Invoice.Currency}}</td></tr>
+{{end}}{{with .Invoice.Total}}<tr><th>Total</th><td class="amount">{{.}} {{$.Invoice.Currency}}</td></tr>
+{{end}}</table>
+{{with .Invoice.VAT}}<h2>VAT breakdown</h2>
+<table>
+<tr><th>Category</th><th>Rate</th><th>Base</th><th>Amount</th></tr>
+{{range .}}<tr><td>{{.Category}}</td><td class="amount">{{.Rate}} %</td><td class="amount">{{.Base}}</td><td class="amount">{{.Amount}}</td></tr>
+{{end}}</table>
+{{end}}<p>Source: {{.Filename}}{{with .Email.SenderEmail}}, received from {{$.Email.SenderName}} &lt;{{.}}&gt;{{end}}</p>
+</body>
+</html>
+`))
+
+// writeInvoiceSummary writes the HTML summary of the XML invoice at path,
+// with the same name and the .html extension, and returns its path.
+func writeInvoiceSummary(doc *Document, path string) (string, error) {
+	data, err := renderInvoiceSummary(doc, filepath.Base(path))
+	if err != nil {
+		return "", err
+	}
+	summaryPath := strings.TrimSuffix(path, filepath.Ext(path)) + ".html"
+	if err := writeFileAtomic(summaryPath, data, defaultFilePerm); err != nil {
+		return "", err
+	}
+	fmt.Printf("Wrote summary %s\n", summaryPath)
+	return summaryPath, nil
+}
+
+// renderInvoiceSummary renders the HTML summary of the XML invoice filename.
+func renderInvoiceSummary(doc *Document, filename string) ([]byte, error) {
+	var buf bytes.Buffer
+	err := invoiceSummary.Execute(&buf, struct {
+		*Document
+		Filename string
+	}{doc, filename})
+	if err != nil {
+		return nil, fmt.Errorf("error rendering invoice summary: %v", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestParseXMLInvoice(t *testing.T) {
+	tests := []struct {
+		file     string
+		expected InvoiceFields
+	}{
+		{
+			file: "ubl-invoice.xml",
+			expected: InvoiceFields{
+				Number:       "INV-2026-0315",
+				IssueDate:    "2026-04-02",
+				DueDate:      "2026-05-02",
+				Seller:       "Nordlicht Software GmbH",
+				Total:        "238.00",
+				TotalExclVAT: "200.00",
+				VATTotal:     "38.00",
+				Currency:     "EUR",
+				VATNumber:    "DE123456789",
+				VAT:          []VATBreakdown{{Category: "S", Rate: "19", Base: "200.00", Amount: "38.00"}},
+				Source:       FieldSourceUBL,
+			},
+		},
+		{
+			file: "cii-invoice.xml",
+			expected: InvoiceFields{
+				Number:       "FX-2026-0007",
+				IssueDate:    "2026-03-20",
+				DueDate:      "2026-04-19",
+				Seller:       "Papeterie Martin SARL",
+				Total:        "162.20",
+				TotalExclVAT: "140.00",
+				VATTotal:     "22.20",
+				Currency:     "EUR",
+				VATNumber:    "FR12345678901",
+				VAT: []VATBreakdown{
+					{Category: "S", Rate: "20", Base: "100.00", Amount: "20.00"},
+					{Category: "S", Rate: "5.5", Base: "40.00", Amount: "2.20"},
+				},
+				Source: FieldSourceCII,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			assert.NoError(t, err)
+			fields, err := parseXMLInvoice(data)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, fields)
+		})
+	}
+}
+
+func TestParseUBLCreditNote(t *testing.T) {
+	// Avoir en ISO-8859-1, l'échéance étant celle du moyen de paiement
+	data := []byte("<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\n" +
+		`<CreditNote xmlns="urn:oasis:names:specification:ubl:schema:xsd:CreditNote-2" xmlns:cac="cac" xmlns:cbc="cbc">
+  <cbc:ID>AV-12</cbc:ID>
+  <cbc:IssueDate>2026-02-10</cbc:IssueDate>
+  <cbc:DocumentCurrencyCode>EUR</cbc:DocumentCurrencyCode>
+  <cac:PaymentMeans><cbc:PaymentDueDate>2026-03-10</cbc:PaymentDueDate></cac:PaymentMeans>
+  <cac:AccountingSupplierParty><cac:Party><cac:PartyName><cbc:Name>Soci` + "\xe9" + `t` + "\xe9" + ` G` + "\xe9" + `n` + "\xe9" + `rale</cbc:Name></cac:PartyName></cac:Party></cac:AccountingSupplierParty>
+  <cac:TaxTotal><cbc:TaxAmount currencyID="USD">-2.20</cbc:TaxAmount></cac:TaxTotal>
+  <cac:TaxTotal><cbc:TaxAmount currencyID="EUR">-2</cbc:TaxAmount></cac:TaxTotal>
+  <cac:LegalMonetaryTotal><cbc:PayableAmount currencyID="EUR">-12</cbc:PayableAmount></cac:LegalMonetaryTotal>
+</CreditNote>`)
+
+	fields, err := parseXMLInvoice(data)
+	assert.NoError(t, err)
+	assert.Equal(t, InvoiceFields{
+		Number:    "AV-12",
+		IssueDate: "2026-02-10",
+		DueDate:   "2026-03-10",
+		Seller:    "Société Générale",
+		Total:     "-12.00",
+		VATTotal:  "-2.00",
+		Currency:  "EUR",
+		Source:    FieldSourceUBL,
+	}, fields)
+	assert.Contains(t, xmlText(data), "Société Générale")
+
+	// Documents XML qui ne sont pas des factures
+	for _, content := range []string{
+		`<Order><ID>1</ID></Order>`,
+		`<Invoice><IssueDate>2026-02-10</IssueDate></Invoice>`,
+		`not XML`,
+	} {
+		_, err := parseXMLInvoice([]byte(content))
+		assert.Error(t, err, content)
+	}
+}
+
+func TestRenderInvoiceSummary(t *testing.T) {
+	doc := &Document{
+		Email: EmailData{SenderName: "Nordlicht", SenderEmail: "billing@nordlicht.example"},
+		Invoice: InvoiceFields{
+			Number:   "INV-<1>",
+			Seller:   "Nordlicht Software GmbH",
+			Total:    "238.00",
+			Currency: "EUR",
+			VAT:      []VATBreakdown{{Category: "S", Rate: "19", Base: "200.00", Amount: "38.00"}},
+		},
+	}
+
+	data, err := renderInvoiceSummary(doc, "facture.xml")
+	assert.NoError(t, err)
+	html := string(data)
+	assert.Contains(t, html, "<h1>Invoice INV-&lt;1&gt;</h1>")
+	assert.Contains(t, html, "<td class=\"amount\">238.00 EUR</td>")
+	assert.Contains(t, html, "<td class=\"amount\">19 %</td>")
+	assert.Contains(t, html, "Source: facture.xml, received from Nordlicht &lt;billing@nordlicht.example&gt;")
+	assert.NotContains(t, html, "Due date")
+}
+
+func TestIsDocumentPart(t *testing.T) {
+	tests := []struct {
+		part     *gmail.MessagePart
+		expected bool
+	}{
+		{&gmail.MessagePart{Filename: "facture.pdf", MimeType: "application/pdf"}, true},
+		{&gmail.MessagePart{Filename: "facture.xml", MimeType: "application/xml"}, true},
+		{&gmail.MessagePart{Filename: "facture.XML", MimeType: "text/xml"}, true},
+		{&gmail.MessagePart{Filename: "facture.xml", MimeType: "application/octet-stream"}, true},
+		{&gmail.MessagePart{Filename: "facture.zip", MimeType: "application/octet-stream"}, false},
+		{&gmail.MessagePart{Filename: "logo.png", MimeType: "image/png"}, false},
+		{&gmail.MessagePart{MimeType: "application/pdf"}, false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, isDocumentPart(tt.part), tt.part.Filename+" "+tt.part.MimeType)
+	}
+}
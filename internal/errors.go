@@ -23,6 +23,7 @@ var (
 	ErrAttachmentProcessing = errors.New("failed to process attachment")
 	ErrOAuth2Failed         = errors.New("OAuth2 authentication failed")
 	ErrGmailAPI             = errors.New("Gmail API error")
+	ErrAlreadyRunning       = errors.New("another instance is already running")
 )
 
 // Erreur enrichie avec contexte
@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"extract-email-attachments/internal/config"
+	"extract-email-attachments/internal/pdf"
+)
+
+// openAITimeout bounds a request to the model, which can take a while on a local server
+const openAITimeout = 2 * time.Minute
+
+// openAIPrompt asks the model for the invoice fields as a JSON object
+const openAIPrompt = `You extract the fields of invoices. Answer with a JSON object only, with the keys:
+"number" (invoice number), "issueDate" and "dueDate" (YYYY-MM-DD), "seller" (company name of the seller),
+"total" (amount to pay, such as 1234.56), "currency" (ISO 4217 code), "vatNumber" (intra-community VAT number of the seller),
+and "confidence", an object giving for each of these keys your confidence between 0 and 1.
+Use an empty string for the fields that are not in the document.`
+
+// openAIProvider extracts the invoice fields with a model served by an
+// OpenAI-compatible chat completions API, such as OpenAI, Mistral, or a
+// local server like Ollama or llama.cpp. The text layer of the PDF is sent
+// when it has one; scanned documents are sent as a PDF file, which requires
+// a model reading files.
+type openAIProvider struct {
+	endpoint string
+	model    string
+	apiKey   string
+	client   *http.Client
+}
+
+func newOpenAIProvider(settings config.ExtractionSettings) *openAIProvider {
+	p := &openAIProvider{
+		endpoint: strings.TrimSuffix(settings.Endpoint, "/"),
+		model:    settings.Model,
+		client:   &http.Client{Timeout: openAITimeout},
+	}
+	if settings.APIKeyEnv != "" {
+		p.apiKey = os.Getenv(settings.APIKeyEnv)
+	}
+	return p
+}
+
+func (p *openAIProvider) Name() string {
+	return config.ExtractionProviderOpenAI + ":" + p.model
+}
+
+// openAIMessage is a message of a chat completion request, whose content
+// is a string or a list of parts
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content any    `json:"content"`
+}
+
+type openAIPart struct {
+	Type string          `json:"type"`
+	Text string          `json:"text,omitempty"`
+	File *openAIFilePart `json:"file,omitempty"`
+}
+
+type openAIFilePart struct {
+	Filename string `json:"filename"`
+	FileData string `json:"file_data"` // data URL
+}
+
+// openAIFields is the answer of the model, whose amounts may be numbers
+type openAIFields struct {
+	Number     string             `json:"number"`
+	IssueDate  string             `json:"issueDate"`
+	DueDate    string             `json:"dueDate"`
+	Seller     string             `json:"seller"`
+	Total      json.RawMessage    `json:"total"`
+	Currency   string             `json:"currency"`
+	VATNumber  string             `json:"vatNumber"`
+	Confidence map[string]float64 `json:"confidence"`
+}
+
+func (p *openAIProvider) Extract(ctx context.Context, data []byte, email EmailData) (ExtractedFields, error) {
+	header := fmt.Sprintf("Email from %s <%s>, subject: %s", email.SenderName, email.SenderEmail, email.Subject)
+	var content any
+	if text := pdfText(data); hasTextLayer(text) {
+		content = header + "\n\nDocument:\n" + text
+	} else {
+		content = []openAIPart{
+			{Type: "text", Text: header + "\n\nThe document is attached."},
+			{Type: "file", File: &openAIFilePart{
+				Filename: "document.pdf",
+				FileData: "data:application/pdf;base64," + base64.StdEncoding.EncodeToString(data),
+			}},
+		}
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"model": p.model,
+		"messages": []openAIMessage{
+			{Role: "system", Content: openAIPrompt},
+			{Role: "user", Content: content},
+		},
+		"response_format": map[string]string{"type": "json_object"},
+		"temperature":     0,
+	})
+	if err != nil {
+		return ExtractedFields{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return ExtractedFields{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return ExtractedFields{}, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return ExtractedFields{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return ExtractedFields{}, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+
+	var completion struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(respBody, &completion); err != nil {
+		return ExtractedFields{}, fmt.Errorf("error decoding response: %v", err)
+	}
+	if len(completion.Choices) == 0 {
+		return ExtractedFields{}, fmt.Errorf("empty response")
+	}
+	return parseOpenAIFields(completion.Choices[0].Message.Content)
+}
+
+// pdfText returns the text layer of a PDF document, or an empty string
+func pdfText(data []byte) string {
+	doc, err := pdf.Open(data)
+	if err != nil {
+		return ""
+	}
+	text, err := doc.Text()
+	if err != nil {
+		return ""
+	}
+	return text
+}
+
+// parseOpenAIFields decodes the JSON object answered by the model, which
+// local models sometimes wrap in a Markdown code block, and normalizes the
+// fields like those found by the regular expressions. Invalid fields are dropped.
+func parseOpenAIFields(content string) (ExtractedFields, error) {
+	start, end := strings.Index(content, "{"), strings.LastIndex(content, "}")
+	if start < 0 || end < start {
+		return ExtractedFields{}, fmt.Errorf("no JSON object in response: %q", content)
+	}
+	var answer openAIFields
+	if err := json.Unmarshal([]byte(content[start:end+1]), &answer); err != nil {
+		return ExtractedFields{}, fmt.Errorf("error decoding fields: %v", err)
+	}
+
+	fields := InvoiceFields{
+		Number:    strings.TrimSpace(answer.Number),
+		Seller:    strings.TrimSpace(answer.Seller),
+		VATNumber: strings.ToUpper(strings.NewReplacer(" ", "", ".", "", "-", "").Replace(answer.VATNumber)),
+	}
+	if t, ok := parseDate(strings.TrimSpace(answer.IssueDate)); ok {
+		fields.IssueDate = t.Format(time.DateOnly)
+	}
+	if t, ok := parseDate(strings.TrimSpace(answer.DueDate)); ok {
+		fields.DueDate = t.Format(time.DateOnly)
+	}
+	if fields.Total = openAIAmount(answer.Total); fields.Total != "" {
+		fields.Currency = strings.ToUpper(strings.TrimSpace(answer.Currency))
+	}
+	return ExtractedFields{Fields: fields, Confidence: answer.Confidence}, nil
+}
+
+// openAIAmount normalizes an amount answered as a number or as a string
+func openAIAmount(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		s = string(raw)
+	}
+	s = strings.TrimSpace(s)
+	if amount, ok := parseAmount(s); ok {
+		return amount
+	}
+	if v, err := strconv.ParseFloat(s, 64); err == nil {
+		return strconv.FormatFloat(v, 'f', 2, 64)
+	}
+	return ""
+}
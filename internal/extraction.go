@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"extract-email-attachments/internal/config"
+)
+
+// FieldSourceAI is the source of invoice fields extracted by an AI model
+const FieldSourceAI = "ai"
+
+// ExtractionProvider extracts the invoice fields of a PDF document, such as
+// an AI model reading the document for the fields that the regular
+// expressions did not find.
+type ExtractionProvider interface {
+	// Name identifies the provider and its model in the cache
+	Name() string
+	Extract(ctx context.Context, data []byte, email EmailData) (ExtractedFields, error)
+}
+
+// ExtractedFields are the invoice fields extracted by a provider, with the
+// confidence of each field between 0 and 1, keyed by its JSON name such as
+// "number" or "issueDate".
+type ExtractedFields struct {
+	Fields     InvoiceFields      `json:"fields"`
+	Confidence map[string]float64 `json:"confidence,omitempty"`
+}
+
+// cachedExtraction is an extraction stored in the cache
+type cachedExtraction struct {
+	Provider string          `json:"provider"`
+	Result   ExtractedFields `json:"result"`
+}
+
+// newExtractionProvider returns the provider of the settings, or nil if the
+// extraction is disabled.
+func newExtractionProvider(settings config.ExtractionSettings) ExtractionProvider {
+	switch settings.Provider {
+	case config.ExtractionProviderOpenAI:
+		return newOpenAIProvider(settings)
+	}
+	return nil
+}
+
+// extract completes the invoice fields of a document with those extracted
+// by the provider, when the number or the issue date is missing. The
+// extractions are cached by the SHA-256 hash of the document, hash being
+// computed if empty, so a document is never sent twice. In read-only mode,
+// only the cached extractions are used.
+func (r *documentReader) extract(ctx context.Context, doc *Document, data []byte, hash string) {
+	if r.extractor == nil || doc.Invoice.Number != "" && doc.Invoice.IssueDate != "" {
+		return
+	}
+	if hash == "" {
+		sum := sha256.Sum256(data)
+		hash = hex.EncodeToString(sum[:])
+	}
+
+	cachePath := filepath.Join(config.AppCacheDir, "extraction", hash+".json")
+	var cached cachedExtraction
+	if content, err := os.ReadFile(cachePath); err != nil || json.Unmarshal(content, &cached) != nil || cached.Provider != r.extractor.Name() {
+		if r.readOnly {
+			r.notExtracted++
+			return
+		}
+		result, err := r.extractor.Extract(ctx, data, doc.Email)
+		if err != nil {
+			log.Printf("Warning: Error extracting invoice fields of %s with %s: %v", doc.Attachment.Filename, r.extractor.Name(), err)
+			return
+		}
+		cached = cachedExtraction{Provider: r.extractor.Name(), Result: result}
+
+		if err := writeExtractionCache(cachePath, cached); err != nil {
+			log.Printf("Warning: Error caching invoice fields of %s: %v", doc.Attachment.Filename, err)
+		}
+	}
+
+	doc.Invoice = mergeExtractedFields(doc.Invoice, cached.Result, config.AppSettings.Extraction.MinConfidence)
+}
+
+func writeExtractionCache(path string, cached cachedExtraction) error {
+	content, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), defaultDirPerm); err != nil {
+		return fmt.Errorf("error creating extraction cache directory: %v", err)
+	}
+	return writeFileAtomic(path, content, defaultFilePerm)
+}
+
+// mergeExtractedFields fills the missing fields with the extracted fields
+// whose confidence is at least minConfidence. The fields found in the
+// document are kept, and keep their source.
+func mergeExtractedFields(fields InvoiceFields, extracted ExtractedFields, minConfidence float64) InvoiceFields {
+	merged := false
+	fill := func(field *string, value, name string) {
+		if *field == "" && value != "" && extracted.Confidence[name] >= minConfidence {
+			*field = value
+			merged = true
+		}
+	}
+
+	e := extracted.Fields
+	fill(&fields.Number, e.Number, "number")
+	fill(&fields.IssueDate, e.IssueDate, "issueDate")
+	fill(&fields.DueDate, e.DueDate, "dueDate")
+	fill(&fields.Seller, e.Seller, "seller")
+	if fields.Total == "" {
+		fill(&fields.Total, e.Total, "total")
+		if fields.Total != "" {
+			fields.Currency = e.Currency
+		}
+	}
+	fill(&fields.VATNumber, e.VATNumber, "vatNumber")
+
+	if merged && fields.Source == "" {
+		fields.Source = FieldSourceAI
+	}
+	return fields
+}
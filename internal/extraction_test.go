@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"extract-email-attachments/internal/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeExtractionProvider imite un modèle de façon déterministe : le vendeur
+// est l'expéditeur, la date celle de l'email, et le numéro dérivé du contenu.
+type fakeExtractionProvider struct{}
+
+func (fakeExtractionProvider) Name() string {
+	return "fake"
+}
+
+func (fakeExtractionProvider) Extract(ctx context.Context, data []byte, email EmailData) (ExtractedFields, error) {
+	sum := sha256.Sum256(data)
+	result := ExtractedFields{
+		Fields: InvoiceFields{
+			Number: "FAKE-" + strings.ToUpper(hex.EncodeToString(sum[:4])),
+			Seller: email.SenderName,
+		},
+		Confidence: map[string]float64{"number": 1, "seller": 1},
+	}
+	if t, err := time.Parse(time.RFC3339, email.Date); err == nil {
+		result.Fields.IssueDate = t.Format(time.DateOnly)
+		result.Confidence["issueDate"] = 1
+	}
+	return result, nil
+}
+
+// countingProvider compte les documents envoyés au fournisseur d'extraction
+type countingProvider struct {
+	ExtractionProvider
+	calls int
+}
+
+func (p *countingProvider) Extract(ctx context.Context, data []byte, email EmailData) (ExtractedFields, error) {
+	p.calls++
+	return p.ExtractionProvider.Extract(ctx, data, email)
+}
+
+func TestDocumentReaderExtraction(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "extraction-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	originalCacheDir := config.AppCacheDir
+	config.AppCacheDir = tempDir
+	defer func() {
+		config.AppCacheDir = originalCacheDir
+	}()
+
+	// Désactivée par défaut : aucun document n'est envoyé
+	assert.Nil(t, newExtractionProvider(config.DefaultSettings().Extraction))
+
+	provider := &countingProvider{ExtractionProvider: fakeExtractionProvider{}}
+	reader := &documentReader{extractor: provider}
+	email := EmailData{ID: "email-1", Date: "2026-01-02T10:00:00+01:00", SenderName: "ACME"}
+
+	// En simulation, le document n'est pas envoyé
+	attachment := AttachmentData{Filename: "scan.pdf", Sha256Hash: "0123abcd"}
+	dryRunReader := &documentReader{extractor: provider, readOnly: true}
+	doc := dryRunReader.read(context.Background(), "testdata/scan.pdf", attachment, email)
+	assert.Empty(t, doc.Invoice.Number)
+	assert.Equal(t, 0, provider.calls)
+	assert.Equal(t, 1, dryRunReader.notExtracted)
+	assert.NoFileExists(t, filepath.Join(tempDir, "extraction", "0123abcd.json"))
+
+	// Un document scanné sans OCR est complété par le fournisseur
+	doc = reader.read(context.Background(), "testdata/scan.pdf", attachment, email)
+	assert.Equal(t, "2026-01-02", doc.Invoice.IssueDate)
+	assert.Equal(t, "ACME", doc.Invoice.Seller)
+	assert.True(t, strings.HasPrefix(doc.Invoice.Number, "FAKE-"), doc.Invoice.Number)
+	assert.Equal(t, FieldSourceAI, doc.Invoice.Source)
+	assert.Equal(t, 1, provider.calls)
+	assert.FileExists(t, filepath.Join(tempDir, "extraction", "0123abcd.json"))
+
+	// Le même fichier n'est jamais envoyé deux fois
+	number := doc.Invoice.Number
+	doc = reader.read(context.Background(), "testdata/scan.pdf", attachment, email)
+	assert.Equal(t, number, doc.Invoice.Number)
+	assert.Equal(t, 1, provider.calls)
+
+	// La simulation utilise les extractions en cache
+	doc = dryRunReader.read(context.Background(), "testdata/scan.pdf", attachment, email)
+	assert.Equal(t, number, doc.Invoice.Number)
+	assert.Equal(t, 1, provider.calls)
+
+	// Un document dont les champs sont trouvés n'est pas envoyé
+	doc = reader.read(context.Background(), "testdata/facturx.pdf", AttachmentData{Filename: "facturx.pdf"}, email)
+	assert.Equal(t, FieldSourceFacturX, doc.Invoice.Source)
+	assert.Equal(t, 1, provider.calls)
+}
+
+func TestMergeExtractedFields(t *testing.T) {
+	extracted := ExtractedFields{
+		Fields: InvoiceFields{Number: "FA-12", IssueDate: "2026-01-02", Seller: "ACME", Total: "10.00", Currency: "EUR"},
+		Confidence: map[string]float64{
+			"number":    0.9,
+			"issueDate": 0.3,
+			"seller":    0.8,
+			"total":     0.9,
+		},
+	}
+
+	// Les champs trouvés dans le document sont conservés, les champs peu sûrs ignorés
+	fields := mergeExtractedFields(InvoiceFields{Number: "FA-11", Source: FieldSourceText}, extracted, 0.5)
+	assert.Equal(t, InvoiceFields{
+		Number:   "FA-11",
+		Seller:   "ACME",
+		Total:    "10.00",
+		Currency: "EUR",
+		Source:   FieldSourceText,
+	}, fields)
+
+	fields = mergeExtractedFields(InvoiceFields{}, extracted, 0.95)
+	assert.True(t, fields.IsEmpty())
+	assert.Empty(t, fields.Source)
+}
+
+func TestOpenAIProvider(t *testing.T) {
+	var requests []map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/chat/completions", r.URL.Path)
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		var request map[string]any
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		requests = append(requests, request)
+
+		// Les modèles locaux entourent parfois la réponse d'un bloc de code
+		answer := "```json\n" + `{"number": "FA-2026-001", "issueDate": "02/01/2026", "dueDate": "", "seller": "ACME SAS",
+			"total": 1234.5, "currency": "eur", "vatNumber": "FR 12 345 678 901",
+			"confidence": {"number": 0.95, "issueDate": 0.9, "seller": 0.8, "total": 0.9, "vatNumber": 0.7}}` + "\n```"
+		json.NewEncoder(w).Encode(map[string]any{
+			"choices": []map[string]any{{"message": map[string]string{"role": "assistant", "content": answer}}},
+		})
+	}))
+	defer server.Close()
+
+	t.Setenv("EXTRACTION_API_KEY", "secret")
+	provider := newOpenAIProvider(config.ExtractionSettings{
+		Provider:  config.ExtractionProviderOpenAI,
+		Endpoint:  server.URL + "/v1/",
+		Model:     "mistral-small",
+		APIKeyEnv: "EXTRACTION_API_KEY",
+	})
+	assert.Equal(t, "openai:mistral-small", provider.Name())
+	email := EmailData{Subject: "Votre facture", SenderName: "ACME", SenderEmail: "factures@acme.fr"}
+
+	// Le texte d'un PDF avec une couche texte est envoyé
+	data, err := os.ReadFile(filepath.Join("testdata", "invoice.pdf"))
+	assert.NoError(t, err)
+	result, err := provider.Extract(context.Background(), data, email)
+	assert.NoError(t, err)
+	assert.Equal(t, InvoiceFields{
+		Number:    "FA-2026-001",
+		IssueDate: "2026-01-02",
+		Seller:    "ACME SAS",
+		Total:     "1234.50",
+		Currency:  "EUR",
+		VATNumber: "FR12345678901",
+	}, result.Fields)
+	assert.Equal(t, 0.95, result.Confidence["number"])
+
+	assert.Len(t, requests, 1)
+	assert.Equal(t, "mistral-small", requests[0]["model"])
+	messages := requests[0]["messages"].([]any)
+	content, ok := messages[1].(map[string]any)["content"].(string)
+	assert.True(t, ok)
+	assert.Contains(t, content, "factures@acme.fr")
+
+	// Un document scanné est joint au format PDF
+	data, err = os.ReadFile(filepath.Join("testdata", "scan.pdf"))
+	assert.NoError(t, err)
+	_, err = provider.Extract(context.Background(), data, email)
+	assert.NoError(t, err)
+	parts := requests[1]["messages"].([]any)[1].(map[string]any)["content"].([]any)
+	assert.Len(t, parts, 2)
+	file := parts[1].(map[string]any)["file"].(map[string]any)
+	assert.True(t, strings.HasPrefix(file["file_data"].(string), "data:application/pdf;base64,"))
+
+	// Une réponse sans objet JSON est une erreur
+	_, err = parseOpenAIFields("Je ne sais pas")
+	assert.Error(t, err)
+}
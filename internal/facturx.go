@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"encoding/xml"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"extract-email-attachments/internal/pdf"
+)
+
+// facturXNames are the names of the XML invoice embedded in Factur-X,
+// ZUGFeRD 2 and XRechnung documents
+var facturXNames = []string{"factur-x.xml", "zugferd-invoice.xml", "xrechnung.xml"}
+
+// ciiInvoice is the part of a UN/CEFACT Cross Industry Invoice used to fill
+// the invoice fields. Elements are matched by local name, whatever their
+// namespace prefix.
+type ciiInvoice struct {
+	XMLName  xml.Name `xml:"CrossIndustryInvoice"`
+	Document struct {
+		ID        string  `xml:"ID"`
+		IssueDate ciiDate `xml:"IssueDateTime>DateTimeString"`
+	} `xml:"ExchangedDocument"`
+	Transaction struct {
+		Agreement struct {
+			Seller ciiParty `xml:"SellerTradeParty"`
+		} `xml:"ApplicableHeaderTradeAgreement"`
+		Settlement struct {
+			Currency     string   `xml:"InvoiceCurrencyCode"`
+			Taxes        []ciiTax `xml:"ApplicableTradeTax"`
+			PaymentTerms []struct {
+				DueDate ciiDate `xml:"DueDateDateTime>DateTimeString"`
+			} `xml:"SpecifiedTradePaymentTerms"`
+			Summation struct {
+				TaxBasisTotal ciiAmount   `xml:"TaxBasisTotalAmount"`
+				TaxTotal      []ciiAmount `xml:"TaxTotalAmount"`
+				GrandTotal    ciiAmount   `xml:"GrandTotalAmount"`
+			} `xml:"SpecifiedTradeSettlementHeaderMonetarySummation"`
+		} `xml:"ApplicableHeaderTradeSettlement"`
+	} `xml:"SupplyChainTradeTransaction"`
+}
+
+type ciiParty struct {
+	Name             string `xml:"Name"`
+	TaxRegistrations []struct {
+		ID struct {
+			Value  string `xml:",chardata"`
+			Scheme string `xml:"schemeID,attr"`
+		} `xml:"ID"`
+	} `xml:"SpecifiedTaxRegistration"`
+}
+
+// ciiDate is a date, in the format 102 (20060102) required by Factur-X
+type ciiDate struct {
+	Value  string `xml:",chardata"`
+	Format string `xml:"format,attr"`
+}
+
+// ciiAmount is an amount, whose currency is only given for the tax total
+type ciiAmount struct {
+	Value    string `xml:",chardata"`
+	Currency string `xml:"currencyID,attr"`
+}
+
+type ciiTax struct {
+	Amount   ciiAmount `xml:"CalculatedAmount"`
+	TypeCode string    `xml:"TypeCode"`
+	Basis    ciiAmount `xml:"BasisAmount"`
+	Category string    `xml:"CategoryCode"`
+	Rate     string    `xml:"RateApplicablePercent"`
+}
+
+// facturXFields returns the invoice fields of the XML invoice found among
+// the files embedded in a PDF document. Empty fields are returned if the
+// document has no XML invoice.
+func facturXFields(files []pdf.EmbeddedFile) (InvoiceFields, error) {
+	var lastErr error
+	for _, file := range facturXCandidates(files) {
+		fields, err := parseCII(file.Data)
+		if err != nil {
+			lastErr = fmt.Errorf("error parsing %s: %v", file.Name, err)
+			continue
+		}
+		return fields, nil
+	}
+	return InvoiceFields{}, lastErr
+}
+
+// facturXCandidates returns the embedded XML files, those with a standard name first
+func facturXCandidates(files []pdf.EmbeddedFile) []pdf.EmbeddedFile {
+	var standard, others []pdf.EmbeddedFile
+	for _, file := range files {
+		name := strings.ToLower(file.Name)
+		switch {
+		case slices.Contains(facturXNames, name):
+			standard = append(standard, file)
+		case filepath.Ext(name) == ".xml" || strings.HasSuffix(file.MIMEType, "/xml"):
+			others = append(others, file)
+		}
+	}
+	return append(standard, others...)
+}
+
+// parseCII reads the fields of a Cross Industry Invoice.
+func parseCII(data []byte) (InvoiceFields, error) {
+	var invoice ciiInvoice
+	if err := newXMLDecoder(data).Decode(&invoice); err != nil {
+		return InvoiceFields{}, err
+	}
+
+	settlement := invoice.Transaction.Settlement
+	seller := invoice.Transaction.Agreement.Seller
+	fields := InvoiceFields{
+		Number:    strings.TrimSpace(invoice.Document.ID),
+		IssueDate: invoice.Document.IssueDate.date(),
+		Seller:    strings.Join(strings.Fields(seller.Name), " "),
+		Currency:  strings.ToUpper(strings.TrimSpace(settlement.Currency)),
+		Source:    FieldSourceFacturX,
+	}
+	if fields.Number == "" {
+		return InvoiceFields{}, fmt.Errorf("invoice has no number")
+	}
+
+	for _, terms := range settlement.PaymentTerms {
+		if date := terms.DueDate.date(); date != "" {
+			fields.DueDate = date
+			break
+		}
+	}
+
+	// VA is the scheme of VAT numbers, FC the one of national tax numbers
+	for _, registration := range seller.TaxRegistrations {
+		if registration.ID.Scheme == "VA" {
+			fields.VATNumber = strings.ToUpper(strings.Join(strings.Fields(registration.ID.Value), ""))
+			break
+		}
+	}
+
+	summation := settlement.Summation
+	fields.Total = xmlDecimal(summation.GrandTotal.Value, 2)
+	fields.TotalExclVAT = xmlDecimal(summation.TaxBasisTotal.Value, 2)
+	// The tax total may also be given in the accounting currency
+	for _, total := range summation.TaxTotal {
+		if total.Currency == "" || total.Currency == fields.Currency {
+			fields.VATTotal = xmlDecimal(total.Value, 2)
+			break
+		}
+	}
+
+	for _, tax := range settlement.Taxes {
+		if tax.TypeCode != "" && tax.TypeCode != "VAT" {
+			continue
+		}
+		fields.VAT = append(fields.VAT, VATBreakdown{
+			Category: strings.TrimSpace(tax.Category),
+			Rate:     xmlDecimal(tax.Rate, -1),
+			Base:     xmlDecimal(tax.Basis.Value, 2),
+			Amount:   xmlDecimal(tax.Amount.Value, 2),
+		})
+	}
+	return fields, nil
+}
+
+// date returns the date formatted as 2006-01-02, or an empty string
+func (d ciiDate) date() string {
+	if d.Format != "" && d.Format != "102" {
+		return ""
+	}
+	t, err := time.Parse("20060102", strings.TrimSpace(d.Value))
+	if err != nil {
+		return ""
+	}
+	return t.Format(time.DateOnly)
+}
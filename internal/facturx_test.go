@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"extract-email-attachments/internal/pdf"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDocumentReaderFacturX(t *testing.T) {
+	// Les champs de la facture XML priment sur ceux du texte
+	doc := (&documentReader{}).read(context.Background(), "testdata/facturx.pdf", AttachmentData{Filename: "facture.pdf"}, EmailData{})
+	assert.Contains(t, doc.Text, "Papeterie Martin SARL")
+	assert.Equal(t, InvoiceFields{
+		Number:       "FX-2026-0007",
+		IssueDate:    "2026-03-20",
+		DueDate:      "2026-04-19",
+		Seller:       "Papeterie Martin SARL",
+		Total:        "162.20",
+		TotalExclVAT: "140.00",
+		VATTotal:     "22.20",
+		Currency:     "EUR",
+		VATNumber:    "FR12345678901",
+		VAT: []VATBreakdown{
+			{Category: "S", Rate: "20", Base: "100.00", Amount: "20.00"},
+			{Category: "S", Rate: "5.5", Base: "40.00", Amount: "2.20"},
+		},
+		Source: FieldSourceFacturX,
+	}, doc.Invoice)
+}
+
+func TestParseCII(t *testing.T) {
+	// Profil MINIMUM, sans espace de noms par défaut
+	fields, err := parseCII([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<CrossIndustryInvoice>
+  <ExchangedDocument><ID> 2026-118 </ID><IssueDateTime><DateTimeString format="102">20260131</DateTimeString></IssueDateTime></ExchangedDocument>
+  <SupplyChainTradeTransaction>
+    <ApplicableHeaderTradeAgreement><SellerTradeParty><Name>IKUTO</Name></SellerTradeParty></ApplicableHeaderTradeAgreement>
+    <ApplicableHeaderTradeSettlement>
+      <InvoiceCurrencyCode>eur</InvoiceCurrencyCode>
+      <SpecifiedTradeSettlementHeaderMonetarySummation>
+        <TaxBasisTotalAmount>50</TaxBasisTotalAmount>
+        <TaxTotalAmount currencyID="USD">11.00</TaxTotalAmount>
+        <TaxTotalAmount currencyID="EUR">10</TaxTotalAmount>
+        <GrandTotalAmount>60</GrandTotalAmount>
+      </SpecifiedTradeSettlementHeaderMonetarySummation>
+    </ApplicableHeaderTradeSettlement>
+  </SupplyChainTradeTransaction>
+</CrossIndustryInvoice>`))
+	assert.NoError(t, err)
+	assert.Equal(t, InvoiceFields{
+		Number:       "2026-118",
+		IssueDate:    "2026-01-31",
+		Seller:       "IKUTO",
+		Total:        "60.00",
+		TotalExclVAT: "50.00",
+		VATTotal:     "10.00",
+		Currency:     "EUR",
+		Source:       FieldSourceFacturX,
+	}, fields)
+
+	// Fichiers XML qui ne sont pas des factures CII
+	for _, content := range []string{
+		`<Invoice xmlns="urn:oasis:names:specification:ubl:schema:xsd:Invoice-2"><ID>1</ID></Invoice>`,
+		`<CrossIndustryInvoice><ExchangedDocument/></CrossIndustryInvoice>`,
+		`<?xml version="1.0" encoding="x-unknown"?><CrossIndustryInvoice/>`,
+		`<CrossIndustryInvoice>`,
+	} {
+		_, err := parseCII([]byte(content))
+		assert.Error(t, err, content)
+	}
+}
+
+func TestFacturXFields(t *testing.T) {
+	invoice := []byte(`<CrossIndustryInvoice><ExchangedDocument><ID>A1</ID></ExchangedDocument></CrossIndustryInvoice>`)
+
+	// Le fichier au nom standard est retenu, même s'il n'est pas le premier
+	fields, err := facturXFields([]pdf.EmbeddedFile{
+		{Name: "notes.txt", Data: []byte("notes")},
+		{Name: "annexe.xml", Data: []byte(`<Annexe/>`)},
+		{Name: "Factur-X.xml", Data: invoice},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "A1", fields.Number)
+
+	// Un fichier XML invalide est signalé
+	fields, err = facturXFields([]pdf.EmbeddedFile{{Name: "factur-x.xml", Data: []byte(`<CrossIndustryInvoice>`)}})
+	assert.Error(t, err)
+	assert.True(t, fields.IsEmpty())
+
+	// Pas de fichier XML
+	fields, err = facturXFields([]pdf.EmbeddedFile{{Name: "notes.txt", Data: []byte("notes")}})
+	assert.NoError(t, err)
+	assert.True(t, fields.IsEmpty())
+}
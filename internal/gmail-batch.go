@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// batchPath is the Gmail batch endpoint, relative to the API base path
+	batchPath = "batch/gmail/v1"
+	// maxBatchSize is the number of calls per batch recommended by Gmail to avoid rate limiting
+	maxBatchSize = 50
+	// messagePartsFields restricts a full message to its headers and part tree.
+	// The metadata format would be lighter but omits the parts, which are
+	// needed to find attachments; inline bodies are skipped either way.
+	messagePartsFields = "id,payload(mimeType,filename,headers,body/attachmentId,body/size," +
+		"parts(mimeType,filename,headers,body/attachmentId,body/size," +
+		"parts(mimeType,filename,headers,body/attachmentId,body/size)))"
+)
+
+// getMessages retrieves messages with batch requests, batches being sent
+// concurrently. Results are returned in the order of ids.
+func (gs *GmailService) getMessages(ctx context.Context, ids []string) []*fetchedMessage {
+	fetched := make([]*fetchedMessage, len(ids))
+	for i, id := range ids {
+		fetched[i] = &fetchedMessage{id: id}
+	}
+
+	batches := (len(ids) + maxBatchSize - 1) / maxBatchSize
+	forEachParallel(gs.workers, batches, func(b int) {
+		start := b * maxBatchSize
+		end := min(start+maxBatchSize, len(ids))
+		gs.batchGetMessages(ctx, fetched[start:end])
+	})
+
+	return fetched
+}
+
+// batchGetMessages fills the messages of a batch. Calls failing with a
+// transient error are sent again in a smaller batch, following the retry policy.
+func (gs *GmailService) batchGetMessages(ctx context.Context, batch []*fetchedMessage) {
+	pending := batch
+	for attempt := 1; len(pending) > 0; attempt++ {
+		err := gs.call(ctx, "batchGetMessages", quotaUnitsMessagesGet*len(pending), func() error {
+			return gs.doBatch(ctx, pending)
+		})
+		if err != nil {
+			for _, f := range pending {
+				f.err = NewError("batchGetMessages", err, fmt.Sprintf("failed to get message %s", f.id))
+			}
+			return
+		}
+
+		var retry []*fetchedMessage
+		for _, f := range pending {
+			if f.err != nil && IsRetryableError(f.err) && attempt < gs.retry.MaxAttempts {
+				retry = append(retry, f)
+			}
+		}
+		if len(retry) > 0 {
+			if err := sleep(ctx, gs.retry.delay(attempt, retry[0].err)); err != nil {
+				return
+			}
+		}
+		pending = retry
+	}
+}
+
+// doBatch sends a single batch request getting the given messages. An error is
+// returned if the batch itself failed; errors of individual calls are stored
+// in each fetchedMessage.
+func (gs *GmailService) doBatch(ctx context.Context, batch []*fetchedMessage) error {
+	base, err := url.Parse(gs.service.BasePath)
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for i, f := range batch {
+		f.msg, f.err = nil, nil
+
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", "application/http")
+		header.Set("Content-ID", fmt.Sprintf("<item-%d>", i))
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return err
+		}
+
+		query := url.Values{"format": {"full"}, "fields": {messagePartsFields}}
+		path := base.JoinPath("gmail/v1/users", url.PathEscape(gs.user), "messages", url.PathEscape(f.id)).EscapedPath()
+		fmt.Fprintf(part, "GET %s?%s HTTP/1.1\r\n\r\n", path, query.Encode())
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base.JoinPath(batchPath).String(), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+writer.Boundary())
+
+	resp, err := gs.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return err
+	}
+
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return fmt.Errorf("unexpected batch response content type %q", resp.Header.Get("Content-Type"))
+	}
+
+	answered := make([]bool, len(batch))
+	reader := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading batch response: %v", err)
+		}
+
+		// Responses are identified by the Content-ID of the request, prefixed with "response-"
+		contentID := strings.Trim(part.Header.Get("Content-ID"), "<>")
+		i, err := strconv.Atoi(strings.TrimPrefix(contentID, "response-item-"))
+		if err != nil || i < 0 || i >= len(batch) {
+			return fmt.Errorf("unexpected batch response part %q", contentID)
+		}
+		answered[i] = true
+
+		batch[i].msg, batch[i].err = decodeBatchMessage(part)
+		if batch[i].err != nil {
+			batch[i].err = classifyGmailError("batchGetMessages", batch[i].err)
+		}
+	}
+
+	for i, ok := range answered {
+		if !ok {
+			batch[i].err = NewError("batchGetMessages", ErrGmailAPI, fmt.Sprintf("no response for message %s", batch[i].id))
+		}
+	}
+
+	return nil
+}
+
+// decodeBatchMessage decodes the HTTP response embedded in a batch response part.
+func decodeBatchMessage(part io.Reader) (*gmail.Message, error) {
+	resp, err := http.ReadResponse(bufio.NewReader(part), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error reading batch response part: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return nil, err
+	}
+
+	var msg gmail.Message
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+		return nil, fmt.Errorf("error decoding message: %v", err)
+	}
+	return &msg, nil
+}
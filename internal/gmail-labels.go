@@ -0,0 +1,259 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+
+	"extract-email-attachments/internal/config"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Outcomes applied to the messages in Gmail by LabelMessages
+const (
+	MailboxExtracted = "extracted"
+	MailboxFailed    = "failed"
+)
+
+// System labels removed to archive a message or to mark it as read
+const (
+	gmailLabelInbox  = "INBOX"
+	gmailLabelUnread = "UNREAD"
+)
+
+// maxBatchModify is the number of messages a batchModify call accepts
+const maxBatchModify = 1000
+
+// LabelMessages reflects the outcome of the runs in the mailbox, as
+// configured by the gmail settings: the messages whose attachments were
+// extracted are labelled, archived or marked as read, and the messages which
+// failed are labelled distinctly. Each message is changed once per outcome.
+// It does nothing unless the settings modify the mailbox.
+func LabelMessages(ctx context.Context) error {
+	if !config.AppSettings.Gmail.ModifiesMailbox() {
+		return nil
+	}
+
+	gmailService, err := NewGmailService(ctx)
+	if err != nil {
+		return NewError("LabelMessages", err, "failed to initialize Gmail service")
+	}
+
+	activityManager := NewActivityManager()
+	if err := activityManager.Load(); err != nil {
+		return NewError("LabelMessages", err, "failed to load activity data")
+	}
+
+	return gmailService.labelMessages(ctx, activityManager)
+}
+
+// mailboxChange is a change of labels applied to messages in a single call
+type mailboxChange struct {
+	outcome string
+	add     []string
+	remove  []string
+	ids     []string
+}
+
+// labelMessages applies the outcome of the messages which changed since it
+// was last applied, grouping the messages sharing the same change.
+func (gs *GmailService) labelMessages(ctx context.Context, activityManager *ActivityManager) error {
+	settings := config.AppSettings.Gmail
+	label, err := template.New("label").Option("missingkey=error").Parse(settings.Label)
+	if err != nil {
+		return NewError("LabelMessages", ErrInvalidConfig, fmt.Sprintf("invalid label %q: %v", settings.Label, err))
+	}
+
+	// A message with a PDF which no password opens is not extracted
+	locked := map[string]bool{}
+	for _, attachment := range activityManager.Attachments() {
+		if attachment.Status == AttachmentStatusPasswordRequired {
+			locked[attachment.EmailID] = true
+		}
+	}
+
+	var labels map[string]string
+	var changes []*mailboxChange
+	changesByKey := map[string]*mailboxChange{}
+	for _, email := range activityManager.Emails() {
+		outcome := mailboxOutcome(email, locked[email.ID])
+		if outcome == "" || outcome == email.Mailbox {
+			continue
+		}
+
+		// The labels are listed once, when a message is to be changed
+		if labels == nil {
+			if labels, err = gs.listLabels(ctx); err != nil {
+				return err
+			}
+		}
+
+		var add, remove []string
+		switch outcome {
+		case MailboxExtracted:
+			if settings.Label != "" {
+				name, err := labelName(label, email)
+				if err != nil {
+					return NewError("LabelMessages", ErrInvalidConfig, fmt.Sprintf("invalid label %q: %v", settings.Label, err))
+				}
+				if name != "" {
+					id, err := gs.labelID(ctx, labels, name)
+					if err != nil {
+						return err
+					}
+					add = append(add, id)
+				}
+			}
+			if settings.FailureLabel != "" && email.Mailbox == MailboxFailed {
+				id, err := gs.labelID(ctx, labels, settings.FailureLabel)
+				if err != nil {
+					return err
+				}
+				remove = append(remove, id)
+			}
+			if settings.Archive {
+				remove = append(remove, gmailLabelInbox)
+			}
+			if settings.MarkRead {
+				remove = append(remove, gmailLabelUnread)
+			}
+		case MailboxFailed:
+			if settings.FailureLabel != "" {
+				id, err := gs.labelID(ctx, labels, settings.FailureLabel)
+				if err != nil {
+					return err
+				}
+				add = append(add, id)
+			}
+		}
+		if len(add) == 0 && len(remove) == 0 {
+			continue
+		}
+
+		key := outcome + "|" + strings.Join(add, ",") + "|" + strings.Join(remove, ",")
+		change, exists := changesByKey[key]
+		if !exists {
+			change = &mailboxChange{outcome: outcome, add: add, remove: remove}
+			changesByKey[key] = change
+			changes = append(changes, change)
+		}
+		change.ids = append(change.ids, email.ID)
+	}
+
+	var labellingErrors []error
+	for _, change := range changes {
+		for start := 0; start < len(change.ids); start += maxBatchModify {
+			if ctx.Err() != nil {
+				break
+			}
+			ids := change.ids[start:min(start+maxBatchModify, len(change.ids))]
+			err := gs.call(ctx, "labelMessages", quotaUnitsMessagesBatchModify, func() error {
+				return gs.service.Users.Messages.BatchModify(gs.user, &gmail.BatchModifyMessagesRequest{
+					Ids:            ids,
+					AddLabelIds:    change.add,
+					RemoveLabelIds: change.remove,
+				}).Context(ctx).Do()
+			})
+			if err != nil {
+				// The messages are changed again on the next run
+				err = NewError("LabelMessages", err, fmt.Sprintf("failed to label %d messages", len(ids)))
+				log.Printf("Error: %v", err)
+				labellingErrors = append(labellingErrors, err)
+				continue
+			}
+			for _, id := range ids {
+				if err := activityManager.UpdateEmailMailbox(id, change.outcome); err != nil {
+					log.Printf("Warning: Error updating mailbox state for %s: %v", id, err)
+				}
+			}
+			fmt.Printf("Labelled %d %s messages.\n", len(ids), change.outcome)
+		}
+	}
+
+	if err := activityManager.Save(); err != nil {
+		return NewError("LabelMessages", err, "failed to save activity data")
+	}
+	if ctx.Err() != nil {
+		return NewError("LabelMessages", ctx.Err(), "interrupted, remaining messages will be labelled on next run")
+	}
+	if len(labellingErrors) > 0 {
+		return NewError("LabelMessages", ErrEmailProcessing, fmt.Sprintf("encountered %d errors while labelling messages", len(labellingErrors)))
+	}
+	return nil
+}
+
+// mailboxOutcome returns the outcome of a message to apply in Gmail, or an
+// empty string while the message is still being processed. locked is set
+// when the message has a PDF which no password opens.
+func mailboxOutcome(email EmailData, locked bool) string {
+	switch {
+	case email.State == MessageStateFailed || locked:
+		return MailboxFailed
+	case email.State == MessageStateProcessed:
+		return MailboxExtracted
+	default:
+		return ""
+	}
+}
+
+// labelName renders the label of an extracted message from its date. It is
+// empty for a message without a valid date, which is not labelled.
+func labelName(label *template.Template, email EmailData) (string, error) {
+	date, err := time.Parse(time.RFC3339, email.Date)
+	if err != nil {
+		log.Printf("Warning: Not labelling message %s, its date %q is invalid", email.ID, email.Date)
+		return "", nil
+	}
+	data := config.LabelData{Year: date.Format("2006"), Month: date.Format("01"), Day: date.Format("02")}
+
+	var name strings.Builder
+	if err := label.Execute(&name, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(name.String()), nil
+}
+
+// listLabels returns the IDs of the labels of the mailbox by name
+func (gs *GmailService) listLabels(ctx context.Context) (map[string]string, error) {
+	var r *gmail.ListLabelsResponse
+	err := gs.call(ctx, "listLabels", quotaUnitsLabelsList, func() (err error) {
+		r, err = gs.service.Users.Labels.List(gs.user).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return nil, NewError("listLabels", err, "failed to retrieve labels from Gmail API")
+	}
+
+	labels := map[string]string{}
+	for _, label := range r.Labels {
+		labels[label.Name] = label.Id
+	}
+	return labels, nil
+}
+
+// labelID returns the ID of the label called name, creating the label if
+// the mailbox has none. Nested labels are separated by "/".
+func (gs *GmailService) labelID(ctx context.Context, labels map[string]string, name string) (string, error) {
+	if id, exists := labels[name]; exists {
+		return id, nil
+	}
+
+	var label *gmail.Label
+	err := gs.call(ctx, "labelID", quotaUnitsLabelsCreate, func() (err error) {
+		label, err = gs.service.Users.Labels.Create(gs.user, &gmail.Label{
+			Name:                  name,
+			LabelListVisibility:   "labelShow",
+			MessageListVisibility: "show",
+		}).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return "", NewError("labelID", err, fmt.Sprintf("failed to create label %s", name))
+	}
+	labels[name] = label.Id
+	return label.Id, nil
+}
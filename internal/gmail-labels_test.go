@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+
+	"extract-email-attachments/internal/config"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestLabelMessages(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "labels-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	originalConfigDir := config.AppConfigDir
+	originalGmail := config.AppSettings.Gmail
+	config.AppConfigDir = tempDir
+	config.AppSettings.Gmail = config.GmailSettings{
+		Modify:       true,
+		Label:        "invoices/{{.Year}}-{{.Month}}",
+		FailureLabel: "extraction-failed",
+		Archive:      true,
+	}
+	defer func() {
+		config.AppConfigDir = originalConfigDir
+		config.AppSettings.Gmail = originalGmail
+	}()
+
+	// Un message extrait, un message en échec, un PDF verrouillé, un message
+	// en cours, et un message extrait sans date, archivé sans libellé
+	am := NewActivityManager()
+	assert.NoError(t, am.Load())
+	states := []struct{ id, state string }{
+		{"extrait", MessageStateProcessed},
+		{"echec", MessageStateFailed},
+		{"verrouille", MessageStateProcessed},
+		{"en-cours", MessageStateDownloaded},
+		{"sans-date", MessageStateProcessed},
+	}
+	for _, s := range states {
+		var headers []*gmail.MessagePartHeader
+		if s.id != "sans-date" {
+			headers = append(headers, &gmail.MessagePartHeader{Name: "Date", Value: "Mon, 02 Jun 2025 10:00:00 +0200"})
+		}
+		assert.NoError(t, am.StoreEmailMeta(s.id, &gmail.Message{Id: s.id, Payload: &gmail.MessagePart{Headers: headers}}))
+		var cause error
+		if s.state == MessageStateFailed {
+			cause = errors.New("quota")
+		}
+		assert.NoError(t, am.UpdateEmailState(s.id, s.state, cause))
+	}
+	assert.NoError(t, am.StoreAttachmentMeta("releve.pdf", "verrouille", "hash"))
+	assert.NoError(t, am.UpdateAttachmentStatus("verrouille", "releve.pdf", AttachmentStatusPasswordRequired))
+	assert.NoError(t, am.Save())
+
+	// Le libellé d'échec existe déjà, le libellé du mois est créé
+	fg := newFakeGmail(0, 0)
+	fg.labels = []*gmail.Label{{Id: "Label_1", Name: "extraction-failed"}}
+	gs := newFakeGmailService(t, fg, http.DefaultTransport)
+	assert.NoError(t, gs.labelMessages(context.Background(), am))
+
+	assert.Len(t, fg.labels, 2)
+	assert.Equal(t, "invoices/2025-06", fg.labels[1].Name)
+	assert.Equal(t, []*gmail.BatchModifyMessagesRequest{
+		{Ids: []string{"extrait"}, AddLabelIds: []string{"Label_2"}, RemoveLabelIds: []string{"INBOX"}},
+		{Ids: []string{"echec", "verrouille"}, AddLabelIds: []string{"Label_1"}},
+		{Ids: []string{"sans-date"}, RemoveLabelIds: []string{"INBOX"}},
+	}, fg.modified)
+
+	am = NewActivityManager()
+	assert.NoError(t, am.Load())
+	for id, mailbox := range map[string]string{"extrait": MailboxExtracted, "echec": MailboxFailed, "verrouille": MailboxFailed, "en-cours": "", "sans-date": MailboxExtracted} {
+		email, err := am.GetEmailByID(id)
+		assert.NoError(t, err)
+		assert.Equal(t, mailbox, email.Mailbox, fmt.Sprintf("message %s", id))
+	}
+
+	// Un message déjà libellé n'est pas modifié une seconde fois
+	requests := fg.requests.Load()
+	assert.NoError(t, gs.labelMessages(context.Background(), am))
+	assert.Len(t, fg.modified, 3)
+	assert.Equal(t, requests, fg.requests.Load())
+
+	// Un message en échec finalement extrait perd le libellé d'échec
+	assert.NoError(t, am.UpdateEmailState("echec", MessageStateProcessed, nil))
+	assert.NoError(t, gs.labelMessages(context.Background(), am))
+	assert.Len(t, fg.modified, 4)
+	assert.Equal(t, &gmail.BatchModifyMessagesRequest{
+		Ids: []string{"echec"}, AddLabelIds: []string{"Label_2"}, RemoveLabelIds: []string{"Label_1", "INBOX"},
+	}, fg.modified[3])
+}
@@ -7,11 +7,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/user"
 	"path/filepath"
 
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/oauth2"
@@ -27,7 +29,13 @@ import (
 // GmailService represents a Gmail service client
 type GmailService struct {
 	service *gmail.Service
+	client  *http.Client // authenticated client, used for batch requests
 	user    string
+	retry   RetryPolicy
+	limiter *quotaLimiter
+	workers int
+	slots   chan struct{} // bounds the number of concurrent API calls
+	journal *Journal      // records the downloads, nil unless in a run
 }
 
 type Credentials struct {
@@ -84,34 +92,70 @@ func getCredentials() (string, string, error) {
 }
 
 // NewGmailService creates a new Gmail service client
-func NewGmailService() (*GmailService, error) {
-	ctx := context.Background()
-
+func NewGmailService(ctx context.Context) (*GmailService, error) {
 	clientID, clientSecret, err := getCredentials()
 	if err != nil {
 		log.Fatal("Impossible d'obtenir les identifiants OAuth2 :", err)
 	}
 
+	// Labelling, archiving or marking the messages as read requires the modify scope
+	scope := gmail.GmailReadonlyScope
+	if config.AppSettings.Gmail.Modify {
+		scope = gmail.GmailModifyScope
+	}
+
 	// Configure OAuth2 for desktop application
 	oauthConfig := &oauth2.Config{
 		ClientID:     clientID,
 		ClientSecret: clientSecret,
-		Scopes:       []string{gmail.GmailReadonlyScope},
+		Scopes:       []string{scope},
 		Endpoint:     google.Endpoint,
 		RedirectURL:  "http://localhost:8080",
 	}
 
-	httpClient := getOAuth2Client(oauthConfig)
+	httpClient := getOAuth2Client(ctx, oauthConfig)
 
 	srv, err := gmail.NewService(ctx, option.WithHTTPClient(httpClient))
 	if err != nil {
 		return nil, fmt.Errorf("unable to retrieve Gmail client: %v", err)
 	}
 
+	return newGmailService(srv, httpClient), nil
+}
+
+// newGmailService wraps a Gmail API client with the retry policy, the quota
+// limiter and the concurrency from the settings.
+func newGmailService(srv *gmail.Service, client *http.Client) *GmailService {
 	return &GmailService{
 		service: srv,
+		client:  client,
 		user:    "me",
-	}, nil
+		retry:   DefaultRetryPolicy,
+		limiter: newQuotaLimiter(config.AppSettings.QuotaUnitsPerSecond),
+		workers: config.AppSettings.Workers,
+		slots:   make(chan struct{}, config.AppSettings.Workers),
+	}
+}
+
+// call performs a Gmail API call costing the given quota units, waiting for
+// the quota limiter and a free slot, and retrying transient failures.
+func (gs *GmailService) call(ctx context.Context, op string, units int, fn func() error) error {
+	return gs.retry.Do(ctx, op, func() error {
+		// A call is never started once ctx is done, whichever select case is ready first
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := gs.limiter.Wait(ctx, units); err != nil {
+			return err
+		}
+		select {
+		case gs.slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		defer func() { <-gs.slots }()
+		return fn()
+	})
 }
 
 // ProcessEmails reads emails from the last fetch time and processes them.
@@ -122,53 +166,174 @@ func NewGmailService() (*GmailService, error) {
 //   - Fetch messages since the last fetch time
 //   - Process each message and download attachments in the attachments directory
 //   - Store the new last fetch time for the next run
-func ProcessEmails() error {
-	gmailService, err := NewGmailService()
+//
+// When ctx is cancelled, the message being written is completed and the
+// activity data is saved; the remaining messages are retried on the next run.
+// The downloads are recorded in journal, unless nil.
+func ProcessEmails(ctx context.Context, journal *Journal) error {
+	gmailService, err := NewGmailService(ctx)
 	if err != nil {
 		return NewError("ProcessEmails", err, "failed to initialize Gmail service")
 	}
+	gmailService.journal = journal
 
 	activityManager := NewActivityManager()
 	if err := activityManager.Load(); err != nil {
 		return NewError("ProcessEmails", err, "failed to load activity data")
 	}
 
+	return gmailService.processEmails(ctx, activityManager, nil)
+}
+
+// processEmails fetches the new messages and downloads their attachments.
+// When plan is not nil, the attachments are kept in memory and recorded in
+// the plan instead, and am is expected to be read-only.
+func (gs *GmailService) processEmails(ctx context.Context, activityManager *ActivityManager, plan *Plan) error {
 	lastFetchTime, err := activityManager.ReadLastFetchTime()
 	if err != nil {
 		log.Printf("Warning: Error reading last fetch time: %v", err)
-		lastFetchTime = time.Now().AddDate(0, 0, -30).Format(config.DefaultDateFormat)
+		lastFetchTime = initialFetchTime()
+	}
+
+	return gs.fetchEmails(ctx, activityManager, plan, lastFetchTime, "", true)
+}
+
+// Backfill fetches the messages received from since to until, both
+// included, and downloads their attachments, like ProcessEmails, without
+// moving the cursor of the regular runs. The messages already downloaded are
+// skipped. The downloads are recorded in journal, unless nil.
+func Backfill(ctx context.Context, since, until time.Time, journal *Journal) error {
+	if until.Before(since) {
+		return NewError("Backfill", ErrInvalidConfig, "the end of the period is before its start")
+	}
+
+	gmailService, err := NewGmailService(ctx)
+	if err != nil {
+		return NewError("Backfill", err, "failed to initialize Gmail service")
+	}
+	gmailService.journal = journal
+
+	activityManager := NewActivityManager()
+	if err := activityManager.Load(); err != nil {
+		return NewError("Backfill", err, "failed to load activity data")
 	}
 
-	messages, err := gmailService.listMessages(lastFetchTime)
+	after := since.Format(config.DefaultDateFormat)
+	before := until.AddDate(0, 0, 1).Format(config.DefaultDateFormat)
+	return gmailService.fetchEmails(ctx, activityManager, nil, after, before, false)
+}
+
+// initialFetchTime is the date from which the first run fetches the messages
+func initialFetchTime() string {
+	return time.Now().AddDate(0, 0, -config.AppSettings.LookbackDays).Format(config.DefaultDateFormat)
+}
+
+// fetchEmails fetches the messages found by the searches of the account and
+// of the rules, received after the date after, and before the date before
+// unless empty, with the messages to retry, and downloads
+// their attachments. moveCursor stores the time of the fetch for the next run.
+func (gs *GmailService) fetchEmails(ctx context.Context, activityManager *ActivityManager, plan *Plan, after, before string, moveCursor bool) error {
+	// The searches of the account and of the rules
+	rules, err := LoadRules()
+	if err != nil {
+		return NewError("ProcessEmails", err, "failed to load rules")
+	}
+
+	messageIDs, err := gs.listMessageIDs(ctx, rules.Queries(), after, before)
 	if err != nil {
 		return NewError("ProcessEmails", err, "failed to list messages")
 	}
 
-	if len(messages) == 0 {
+	// Record new messages before fetching them, so that a message which cannot
+	// be fetched now is retried on a later run even once the cursor has moved
+	for _, id := range messageIDs {
+		if err := activityManager.StoreDiscoveredEmail(id); err != nil {
+			log.Printf("Warning: Error storing discovered message %s: %v", id, err)
+		}
+	}
+
+	// New messages and messages which failed during previous runs
+	messageIDs = activityManager.GetRetryableEmailIDs()
+	if len(messageIDs) == 0 {
 		// No messages found since last fetch
 		return nil
 	}
 
-	message := fmt.Sprintf("Found %d messages with PDF attachments in the last 30 days.", len(messages))
+	// Each run counts as an attempt, even if it is interrupted
+	for _, id := range messageIDs {
+		if err := activityManager.UpdateEmailState(id, MessageStateDownloading, nil); err != nil {
+			log.Printf("Warning: Error updating message state for %s: %v", id, err)
+		}
+	}
+
+	if err := activityManager.Save(); err != nil {
+		return NewError("ProcessEmails", err, "failed to save activity data")
+	}
+
+	period := "since " + after
+	if before != "" {
+		period = fmt.Sprintf("after %s and before %s", after, before)
+	}
+	message := fmt.Sprintf("Found %d messages with PDF attachments %s.", len(messageIDs), period)
 	fmt.Println(message)
-	if err := displayNotification(message); err != nil {
-		log.Printf("Warning: Could not display notification: %v", err)
-		// Ne pas retourner l'erreur car ce n'est pas critique
+	if plan == nil {
+		if err := displayNotification(message); err != nil {
+			log.Printf("Warning: Could not display notification: %v", err)
+			// Ne pas retourner l'erreur car ce n'est pas critique
+		}
 	}
 
+	// Messages are fetched in the background, then committed one at a time in
+	// the listing order, so that activity data and files are updated deterministically
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results, done := gs.fetchMessages(fetchCtx, messageIDs, activityManager)
+
+	process := gs.processMessage
+	if plan != nil {
+		process = plan.recordMessage
+	}
 	var processingErrors []error
-	for _, msg := range messages {
-		if err := gmailService.processMessage(activityManager, msg); err != nil {
-			err = NewError("ProcessEmails", err, fmt.Sprintf("failed to process message %s", msg.Id))
+	for i, id := range messageIDs {
+		// Stop between two messages: the fetches in progress were aborted
+		if ctx.Err() != nil {
+			break
+		}
+		var fetched *fetchedMessage
+		select {
+		case fetched = <-results[i]:
+		case <-ctx.Done():
+		}
+		if fetched == nil {
+			break
+		}
+
+		err := process(activityManager, fetched)
+		done()
+		if err != nil {
+			err = NewError("ProcessEmails", err, fmt.Sprintf("failed to process message %s", id))
 			log.Printf("Error: %v", err)
 			processingErrors = append(processingErrors, err)
-			continue
+		}
+
+		// Checkpoint: commit the message state and its attachments in a single transaction
+		if err := activityManager.Save(); err != nil {
+			return NewError("ProcessEmails", err, "failed to save activity data")
 		}
 	}
 
-	if err := activityManager.StoreLastFetchTime(); err != nil {
-		log.Printf("Warning: Error writing last fetch time: %v", err)
-		// Ne pas retourner l'erreur car ce n'est pas critique
+	if ctx.Err() != nil {
+		if err := activityManager.Save(); err != nil {
+			return NewError("ProcessEmails", err, "failed to save activity data")
+		}
+		return NewError("ProcessEmails", ctx.Err(), "interrupted, remaining messages will be retried on next run")
+	}
+
+	if moveCursor {
+		if err := activityManager.StoreLastFetchTime(); err != nil {
+			log.Printf("Warning: Error writing last fetch time: %v", err)
+			// Ne pas retourner l'erreur car ce n'est pas critique
+		}
 	}
 
 	if err := activityManager.Save(); err != nil {
@@ -183,113 +348,268 @@ func ProcessEmails() error {
 	return nil
 }
 
-// listMessages retrieves messages with PDF attachments after the given time
-func (gs *GmailService) listMessages(afterTime string) ([]*gmail.Message, error) {
-	query := fmt.Sprintf("after:%s has:attachment filename:pdf", afterTime)
-	r, err := gs.service.Users.Messages.List(gs.user).Q(query).Do()
-	if err != nil {
-		return nil, NewError("listMessages", err, "failed to retrieve messages from Gmail API")
+// attachmentQuery selects the messages with PDF or XML attachments
+const attachmentQuery = "has:attachment {filename:pdf filename:xml}"
+
+// searchQuery builds the Gmail search of the messages with attachments
+// matching the query fragment, received after the date after, and before the
+// date before unless empty
+func searchQuery(fragment, after, before string) string {
+	terms := []string{"after:" + after}
+	if before != "" {
+		terms = append(terms, "before:"+before)
+	}
+	terms = append(terms, attachmentQuery)
+	if fragment != "" {
+		// Keep the alternatives of the fragment together
+		if strings.Contains(fragment, " OR ") {
+			fragment = "(" + fragment + ")"
+		}
+		terms = append([]string{fragment}, terms...)
 	}
+	return strings.Join(terms, " ")
+}
 
-	if len(r.Messages) == 0 {
-		return nil, nil
-	}
+// listMessageIDs retrieves the IDs of messages with PDF attachments after the
+// given date, and before the date before unless empty, reading every page of
+// the results. Each query fragment is a search, the messages found by
+// several searches being listed once; no fragment searches the whole mailbox.
+func (gs *GmailService) listMessageIDs(ctx context.Context, fragments []string, after, before string) ([]string, error) {
+	if len(fragments) == 0 {
+		fragments = []string{""}
+	}
+
+	var ids []string
+	seen := map[string]bool{}
+	for _, fragment := range fragments {
+		query := searchQuery(fragment, after, before)
+		pageToken := ""
+		for {
+			var r *gmail.ListMessagesResponse
+			err := gs.call(ctx, "listMessageIDs", quotaUnitsMessagesList, func() (err error) {
+				r, err = gs.service.Users.Messages.List(gs.user).Q(query).PageToken(pageToken).Context(ctx).Do()
+				return err
+			})
+			if err != nil {
+				return nil, NewError("listMessageIDs", err, "failed to retrieve messages from Gmail API")
+			}
 
-	var messages []*gmail.Message
-	var errors []error
-	for _, m := range r.Messages {
-		msg, err := gs.service.Users.Messages.Get(gs.user, m.Id).Do()
-		if err != nil {
-			err = NewError("listMessages", err, fmt.Sprintf("failed to get message %s", m.Id))
-			log.Printf("Error: %v", err)
-			errors = append(errors, err)
-			continue
+			for _, m := range r.Messages {
+				if !seen[m.Id] {
+					seen[m.Id] = true
+					ids = append(ids, m.Id)
+				}
+			}
+			if r.NextPageToken == "" {
+				break
+			}
+			pageToken = r.NextPageToken
 		}
-		messages = append(messages, msg)
 	}
+	return ids, nil
+}
 
-	if len(errors) > 0 {
-		return messages, NewError("listMessages", ErrGmailAPI, fmt.Sprintf("encountered %d errors while retrieving messages", len(errors)))
-	}
+// fetchMessages fetches the messages of ids and downloads their attachments
+// in the background, returning a channel per message in the order of ids.
+// The messages are fetched with batch requests, window by window, and their
+// attachments are downloaded concurrently; at most gs.workers messages are
+// fetched ahead of the consumer, which calls done once it is finished with a
+// message, so that the attachments of a long listing, such as a backfill, are
+// never all held in memory. No message is fetched once ctx is done.
+func (gs *GmailService) fetchMessages(ctx context.Context, ids []string, am *ActivityManager) (results []chan *fetchedMessage, done func()) {
+	results = make([]chan *fetchedMessage, len(ids))
+	for i := range results {
+		results[i] = make(chan *fetchedMessage, 1)
+	}
+	workers := max(gs.workers, 1)
+	ahead := make(chan struct{}, workers)
+	window := workers * maxBatchSize
+
+	go func() {
+		fetched := make([]*fetchedMessage, len(ids))
+		jobs := make(chan int)
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range jobs {
+					if fetched[i].err == nil {
+						fetched[i].attachments = gs.downloadAttachments(ctx, fetched[i].msg, am)
+					}
+					results[i] <- fetched[i]
+				}
+			}()
+		}
+		defer func() {
+			close(jobs)
+			wg.Wait()
+		}()
+
+		for start := 0; start < len(ids); start += window {
+			end := min(start+window, len(ids))
+			copy(fetched[start:end], gs.getMessages(ctx, ids[start:end]))
+			for i := start; i < end; i++ {
+				// Wait for the consumer to be done with a message
+				select {
+				case ahead <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+				jobs <- i
+			}
+		}
+	}()
+
+	return results, func() { <-ahead }
+}
+
+// fetchedMessage holds a message and its PDF attachments retrieved from the
+// Gmail API, before anything is written.
+type fetchedMessage struct {
+	id          string
+	msg         *gmail.Message
+	attachments []fetchedAttachment
+	err         error
+}
 
-	return messages, nil
+// fetchedAttachment holds the content of an attachment, or the error which
+// prevented its download.
+type fetchedAttachment struct {
+	part *gmail.MessagePart
+	data []byte
+	err  error
 }
 
-// processMessage processes a single email message
-func (gs *GmailService) processMessage(am *ActivityManager, msg *gmail.Message) error {
+// processMessage stores a fetched message and writes its attachments,
+// recording the outcome in the message state
+func (gs *GmailService) processMessage(am *ActivityManager, fetched *fetchedMessage) error {
+	if fetched.err != nil {
+		am.UpdateEmailState(fetched.id, MessageStateFailed, fetched.err)
+		return fetched.err
+	}
+
+	msg := fetched.msg
 	fmt.Printf("Message ID: %s, Subject: %s\n", msg.Id, getSubject(msg))
 
 	if msg.Id == "" {
 		return NewError("processMessage", ErrInvalidEmailID, "message ID is empty")
 	}
 
-	if am.HasEmailID(msg.Id) {
-		fmt.Printf("Skipping message %s as it was already processed\n", msg.Id)
-		return nil
-	}
-
 	if err := am.StoreEmailMeta(msg.Id, msg); err != nil {
 		return NewError("processMessage", err, "failed to store email metadata")
 	}
 
-	if err := gs.downloadAttachments(msg, am); err != nil {
-		return NewError("processMessage", err, "failed to download attachments")
+	if err := gs.saveAttachments(msg.Id, fetched.attachments, am); err != nil {
+		err = NewError("processMessage", err, "failed to download attachments")
+		am.UpdateEmailState(msg.Id, MessageStateFailed, err)
+		return err
+	}
+
+	if err := am.UpdateEmailState(msg.Id, MessageStateDownloaded, nil); err != nil {
+		return NewError("processMessage", err, "failed to update message state")
 	}
 
 	return nil
 }
 
-// downloadAttachments downloads PDF attachments from a message
-func (gs *GmailService) downloadAttachments(msg *gmail.Message, am *ActivityManager) error {
-	var errors []error
+// downloadAttachments concurrently downloads the PDF and XML attachments of a
+// message which were not already downloaded by a previous attempt
+func (gs *GmailService) downloadAttachments(ctx context.Context, msg *gmail.Message, am *ActivityManager) []fetchedAttachment {
+	var attachments []fetchedAttachment
 	for _, part := range msg.Payload.Parts {
-		if part.Filename != "" && part.MimeType == "application/pdf" {
-			if err := gs.downloadAttachment(msg.Id, part, am); err != nil {
-				err = NewError("downloadAttachments", err, fmt.Sprintf("failed to download attachment %s", part.Filename))
-				log.Printf("Error: %v", err)
-				errors = append(errors, err)
+		if isDocumentPart(part) {
+			if am.HasAttachment(msg.Id, part.Filename) {
+				fmt.Printf("Skipping attachment %s as it was already downloaded\n", part.Filename)
 				continue
 			}
+			attachments = append(attachments, fetchedAttachment{part: part})
 		}
 	}
 
-	if len(errors) > 0 {
-		return NewError("downloadAttachments", ErrAttachmentProcessing, fmt.Sprintf("encountered %d errors while downloading attachments", len(errors)))
-	}
+	forEachParallel(gs.workers, len(attachments), func(i int) {
+		attachments[i].data, attachments[i].err = gs.downloadAttachment(ctx, msg.Id, attachments[i].part)
+	})
 
-	return nil
+	return attachments
 }
 
-// downloadAttachment downloads a single attachment
-func (gs *GmailService) downloadAttachment(messageID string, part *gmail.MessagePart, am *ActivityManager) error {
+// isDocumentPart checks if a message part is a PDF document or an XML
+// document, such as an e-invoice. XML files are often sent with a generic type.
+func isDocumentPart(part *gmail.MessagePart) bool {
+	if part.Filename == "" {
+		return false
+	}
+	switch strings.ToLower(part.MimeType) {
+	case "application/pdf":
+		return true
+	case "application/xml", "text/xml", "application/octet-stream":
+		return isXMLDocument(part.Filename)
+	}
+	return false
+}
+
+// downloadAttachment downloads the content of a single attachment
+func (gs *GmailService) downloadAttachment(ctx context.Context, messageID string, part *gmail.MessagePart) ([]byte, error) {
 	if messageID == "" {
-		return NewError("downloadAttachment", ErrInvalidEmailID, "message ID is empty")
+		return nil, NewError("downloadAttachment", ErrInvalidEmailID, "message ID is empty")
 	}
 
 	if part.Filename == "" {
-		return NewError("downloadAttachment", ErrInvalidFilename, "attachment filename is empty")
+		return nil, NewError("downloadAttachment", ErrInvalidFilename, "attachment filename is empty")
 	}
 
-	attachment, err := gs.service.Users.Messages.Attachments.Get(gs.user, messageID, part.Body.AttachmentId).Do()
+	var attachment *gmail.MessagePartBody
+	err := gs.call(ctx, "downloadAttachment", quotaUnitsAttachmentsGet, func() (err error) {
+		attachment, err = gs.service.Users.Messages.Attachments.Get(gs.user, messageID, part.Body.AttachmentId).Context(ctx).Do()
+		return err
+	})
 	if err != nil {
-		return NewError("downloadAttachment", err, "failed to get attachment from Gmail API")
+		return nil, NewError("downloadAttachment", err, "failed to get attachment from Gmail API")
 	}
 
 	data, err := base64.URLEncoding.DecodeString(attachment.Data)
 	if err != nil {
-		return NewError("downloadAttachment", err, "failed to decode attachment data")
+		return nil, NewError("downloadAttachment", err, "failed to decode attachment data")
 	}
 
-	if err := os.MkdirAll(config.AppAttachmentsDir, defaultDirPerm); err != nil {
-		return NewError("downloadAttachment", err, "failed to create attachments directory")
+	return data, nil
+}
+
+// saveAttachments writes the downloaded attachments of a message, in order
+func (gs *GmailService) saveAttachments(messageID string, attachments []fetchedAttachment, am *ActivityManager) error {
+	var errors []error
+	for _, attachment := range attachments {
+		err := attachment.err
+		if err == nil {
+			err = saveAttachment(messageID, attachment.part, attachment.data, am, gs.journal)
+		}
+		if err != nil {
+			err = NewError("saveAttachments", err, fmt.Sprintf("failed to download attachment %s", attachment.part.Filename))
+			log.Printf("Error: %v", err)
+			errors = append(errors, err)
+		}
 	}
 
-	filePath := fmt.Sprintf("%s/%s", config.AppAttachmentsDir, part.Filename)
-	if err := os.WriteFile(filePath, data, defaultFilePerm); err != nil {
-		return NewError("downloadAttachment", err, "failed to write attachment file")
+	if len(errors) > 0 {
+		return NewError("saveAttachments", ErrAttachmentProcessing, fmt.Sprintf("encountered %d errors while downloading attachments", len(errors)))
+	}
+
+	return nil
+}
+
+// saveAttachment writes a single attachment to the attachments directory
+func saveAttachment(messageID string, part *gmail.MessagePart, data []byte, am *ActivityManager, journal *Journal) error {
+	if err := os.MkdirAll(config.AppAttachmentsDir, defaultDirPerm); err != nil {
+		return NewError("saveAttachment", err, "failed to create attachments directory")
 	}
 
 	sha256Hash := fmt.Sprintf("%x", sha256.Sum256(data))
+	filePath, _ := attachmentPath(messageID, part.Filename, sha256Hash, os.ReadFile)
+	if err := writeFileAtomic(filePath, data, defaultFilePerm); err != nil {
+		return NewError("saveAttachment", err, "failed to write attachment file")
+	}
+	journal.record(JournalEntry{Op: JournalOpDownload, Path: filePath, EmailID: messageID, Attachment: part.Filename})
 
 	if err := am.StoreAttachmentMeta(part.Filename, messageID, sha256Hash); err != nil {
 		log.Printf("Warning: Error storing attachment metadata: %v", err)
@@ -300,6 +620,36 @@ func (gs *GmailService) downloadAttachment(messageID string, part *gmail.Message
 	return nil
 }
 
+// attachmentPath returns where the attachment filename of message emailID,
+// whose content has the given hash, is kept in the attachments directory:
+// under its own name, unless an attachment of another message already holds
+// that name, then under a name suffixed with the message ID. data is the
+// content of the file if it is already there, nil otherwise. read returns the
+// content of a file.
+func attachmentPath(emailID string, filename string, sha256Hash string, read func(string) ([]byte, error)) (path string, data []byte) {
+	ext := filepath.Ext(filename)
+	paths := []string{
+		filepath.Join(config.AppAttachmentsDir, filename),
+		filepath.Join(config.AppAttachmentsDir, strings.TrimSuffix(filename, ext)+"-"+emailID+ext),
+	}
+	for _, candidate := range paths {
+		data, err := read(candidate)
+		if err != nil {
+			if path == "" {
+				path = candidate
+			}
+			continue
+		}
+		if fmt.Sprintf("%x", sha256.Sum256(data)) == sha256Hash {
+			return candidate, data
+		}
+	}
+	if path == "" {
+		path = paths[len(paths)-1]
+	}
+	return path, nil
+}
+
 // getSubject extracts the subject from a Gmail message
 func getSubject(msg *gmail.Message) string {
 	for _, header := range msg.Payload.Headers {
@@ -0,0 +1,493 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"extract-email-attachments/internal/config"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+// fakeGmail serves messages and attachments like the Gmail API.
+type fakeGmail struct {
+	messages    map[string]*gmail.Message
+	attachments map[string][]byte
+	order       []string
+	latency     time.Duration
+	requests    atomic.Int32
+	// batchFailures is the number of batched calls answered with a rate limit error
+	batchFailures atomic.Int32
+	// pageSize is the number of messages listed per page, all of them if zero
+	pageSize int
+	// queries are the searches of the message listings
+	queries []string
+	// labels are the labels of the mailbox, and modified the label changes
+	labels   []*gmail.Label
+	modified []*gmail.BatchModifyMessagesRequest
+}
+
+// newFakeGmail creates n messages, each with the given number of PDF attachments.
+func newFakeGmail(n int, attachmentsPerMessage int) *fakeGmail {
+	fg := &fakeGmail{
+		messages:    map[string]*gmail.Message{},
+		attachments: map[string][]byte{},
+	}
+	for i := 1; i <= n; i++ {
+		id := fmt.Sprintf("msg-%03d", i)
+		msg := &gmail.Message{
+			Id: id,
+			Payload: &gmail.MessagePart{
+				MimeType: "multipart/mixed",
+				Headers: []*gmail.MessagePartHeader{
+					{Name: "Subject", Value: fmt.Sprintf("Facture %d", i)},
+					{Name: "From", Value: "Vendor <billing@vendor.com>"},
+					{Name: "Date", Value: "Mon, 02 Jun 2025 10:00:00 +0200"},
+				},
+				Parts: []*gmail.MessagePart{{MimeType: "text/plain", Body: &gmail.MessagePartBody{Data: "Bonjour"}}},
+			},
+		}
+		for j := 1; j <= attachmentsPerMessage; j++ {
+			attachmentID := fmt.Sprintf("%s-att-%d", id, j)
+			fg.attachments[attachmentID] = []byte(fmt.Sprintf("%%PDF-1.4 %s", attachmentID))
+			msg.Payload.Parts = append(msg.Payload.Parts, &gmail.MessagePart{
+				Filename: fmt.Sprintf("facture-%03d-%d.pdf", i, j),
+				MimeType: "application/pdf",
+				Body:     &gmail.MessagePartBody{AttachmentId: attachmentID},
+			})
+		}
+		fg.messages[id] = msg
+		fg.order = append(fg.order, id)
+	}
+	return fg
+}
+
+func (fg *fakeGmail) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fg.requests.Add(1)
+	time.Sleep(fg.latency)
+
+	if r.URL.Path == "/batch/gmail/v1" {
+		fg.serveBatch(w, r)
+		return
+	}
+	fg.serveAPI(w, r)
+}
+
+// serveBatch answers each call of a batch request in a multipart response.
+func (fg *fakeGmail) serveBatch(w http.ResponseWriter, r *http.Request) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req, err := http.ReadRequest(bufio.NewReader(part))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		recorder := httptest.NewRecorder()
+		if fg.batchFailures.Add(-1) >= 0 {
+			recorder.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(recorder, `{"error": {"code": 429, "message": "Too many concurrent requests for user"}}`)
+		} else {
+			fg.serveAPI(recorder, req)
+		}
+
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", "application/http")
+		header.Set("Content-ID", "<response-"+strings.Trim(part.Header.Get("Content-ID"), "<>")+">")
+		out, _ := writer.CreatePart(header)
+		recorder.Result().Write(out)
+	}
+	writer.Close()
+
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+writer.Boundary())
+	w.Write(body.Bytes())
+}
+
+// serveAPI answers a single Gmail API call.
+func (fg *fakeGmail) serveAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	path := strings.TrimPrefix(r.URL.Path, "/gmail/v1/users/me/")
+	parts := strings.Split(path, "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "messages":
+		fg.queries = append(fg.queries, r.URL.Query().Get("q"))
+		var list gmail.ListMessagesResponse
+		order := fg.order
+		if start, err := strconv.Atoi(r.URL.Query().Get("pageToken")); err == nil {
+			order = order[start:]
+		}
+		if fg.pageSize > 0 && len(order) > fg.pageSize {
+			list.NextPageToken = strconv.Itoa(len(fg.order) - len(order) + fg.pageSize)
+			order = order[:fg.pageSize]
+		}
+		for _, id := range order {
+			list.Messages = append(list.Messages, &gmail.Message{Id: id})
+		}
+		json.NewEncoder(w).Encode(list)
+	case len(parts) == 1 && parts[0] == "labels" && r.Method == http.MethodPost:
+		var label gmail.Label
+		json.NewDecoder(r.Body).Decode(&label)
+		label.Id = fmt.Sprintf("Label_%d", len(fg.labels)+1)
+		fg.labels = append(fg.labels, &label)
+		json.NewEncoder(w).Encode(label)
+	case len(parts) == 1 && parts[0] == "labels":
+		json.NewEncoder(w).Encode(gmail.ListLabelsResponse{Labels: fg.labels})
+	case len(parts) == 2 && parts[0] == "messages" && parts[1] == "batchModify":
+		var request gmail.BatchModifyMessagesRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		fg.modified = append(fg.modified, &request)
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[0] == "messages" && fg.messages[parts[1]] != nil:
+		json.NewEncoder(w).Encode(fg.messages[parts[1]])
+	case len(parts) == 4 && parts[2] == "attachments" && fg.attachments[parts[3]] != nil:
+		data := fg.attachments[parts[3]]
+		json.NewEncoder(w).Encode(gmail.MessagePartBody{
+			Data: base64.URLEncoding.EncodeToString(data),
+			Size: int64(len(data)),
+		})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error": {"code": 404, "message": "Not Found"}}`)
+	}
+}
+
+// newFakeGmailService returns a Gmail service reaching the fake server
+// through the given transport.
+func newFakeGmailService(t testing.TB, fg *fakeGmail, transport http.RoundTripper) *GmailService {
+	server := httptest.NewServer(fg)
+	t.Cleanup(server.Close)
+
+	srv, err := gmail.NewService(context.Background(),
+		option.WithHTTPClient(&http.Client{Transport: transport}),
+		option.WithEndpoint(server.URL+"/"))
+	assert.NoError(t, err)
+
+	gs := newGmailService(srv, &http.Client{Transport: transport})
+	gs.retry = RetryPolicy{MaxAttempts: 4, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	return gs
+}
+
+func TestFetchMessagesConcurrently(t *testing.T) {
+	// Créer un dossier temporaire pour les tests
+	tempDir, err := os.MkdirTemp("", "gmail-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	// Sauvegarder les valeurs originales
+	originalAttachmentsDir := config.AppAttachmentsDir
+	originalConfigDir := config.AppConfigDir
+	config.AppAttachmentsDir = tempDir
+	config.AppConfigDir = tempDir
+	defer func() {
+		config.AppAttachmentsDir = originalAttachmentsDir
+		config.AppConfigDir = originalConfigDir
+	}()
+
+	fg := newFakeGmail(12, 2)
+	fg.latency = 5 * time.Millisecond
+	gs := newFakeGmailService(t, fg, http.DefaultTransport)
+	gs.workers = 4
+
+	am := NewActivityManager()
+	assert.NoError(t, am.Load())
+
+	ids, err := gs.listMessageIDs(context.Background(), nil, "2025/01/01", "")
+	assert.NoError(t, err)
+	for _, id := range ids {
+		assert.NoError(t, am.StoreDiscoveredEmail(id))
+	}
+	// Un message inconnu de Gmail échoue sans bloquer les autres
+	assert.NoError(t, am.StoreDiscoveredEmail("msg-missing"))
+	ids = am.GetRetryableEmailIDs()
+
+	results, done := gs.fetchMessages(context.Background(), ids, am)
+	for i := range ids {
+		gs.processMessage(am, <-results[i])
+		done()
+	}
+
+	// Les métadonnées sont enregistrées dans l'ordre de la liste
+	assert.Len(t, am.data.Attachments, 24)
+	for i, attachment := range am.data.Attachments {
+		assert.Equal(t, fmt.Sprintf("facture-%03d-%d.pdf", i/2+1, i%2+1), attachment.Filename)
+		content, err := os.ReadFile(filepath.Join(tempDir, attachment.Filename))
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("%%PDF-1.4 msg-%03d-att-%d", i/2+1, i%2+1), string(content))
+	}
+
+	email, err := am.GetEmailByID("msg-005")
+	assert.NoError(t, err)
+	assert.Equal(t, MessageStateDownloaded, email.State)
+	email, err = am.GetEmailByID("msg-missing")
+	assert.NoError(t, err)
+	assert.Equal(t, MessageStateFailed, email.State)
+}
+
+func TestFetchMessagesLookahead(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "gmail-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	originalAttachmentsDir := config.AppAttachmentsDir
+	originalConfigDir := config.AppConfigDir
+	config.AppAttachmentsDir = tempDir
+	config.AppConfigDir = tempDir
+	defer func() {
+		config.AppAttachmentsDir = originalAttachmentsDir
+		config.AppConfigDir = originalConfigDir
+	}()
+
+	fg := newFakeGmail(10, 1)
+	gs := newFakeGmailService(t, fg, http.DefaultTransport)
+	gs.workers = 2
+
+	am := NewActivityManager()
+	assert.NoError(t, am.Load())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results, done := gs.fetchMessages(ctx, fg.order, am)
+
+	// Tant que les messages ne sont pas traités, seuls gs.workers messages sont téléchargés d'avance
+	assert.NotNil(t, <-results[0])
+	assert.NotNil(t, <-results[1])
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, results[2], 0)
+
+	// Chaque message traité libère le téléchargement du suivant
+	done()
+	select {
+	case f := <-results[2]:
+		assert.Len(t, f.attachments, 1)
+	case <-time.After(5 * time.Second):
+		t.Fatal("le message suivant n'a pas été téléchargé")
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, results[3], 0)
+}
+
+func TestBatchGetMessages(t *testing.T) {
+	// Ne pas attendre entre les tentatives
+	originalSleep := sleep
+	sleep = func(context.Context, time.Duration) error { return nil }
+	defer func() { sleep = originalSleep }()
+
+	fg := newFakeGmail(120, 1)
+	gs := newFakeGmailService(t, fg, http.DefaultTransport)
+	gs.workers = 1
+
+	// Quelques appels du lot sont limités par Gmail et doivent être retentés
+	fg.batchFailures.Store(3)
+	ids := append(append([]string{}, fg.order...), "msg-missing")
+	fetched := gs.getMessages(context.Background(), ids)
+
+	for i, f := range fetched[:120] {
+		assert.NoError(t, f.err)
+		assert.Equal(t, fg.order[i], f.msg.Id)
+		assert.Equal(t, "application/pdf", f.msg.Payload.Parts[1].MimeType)
+		assert.Equal(t, fmt.Sprintf("%s-att-1", f.msg.Id), f.msg.Payload.Parts[1].Body.AttachmentId)
+	}
+	assert.Error(t, fetched[120].err)
+	assert.False(t, IsRetryableError(fetched[120].err))
+
+	// 121 messages en 3 lots, plus un lot pour les appels retentés
+	assert.Equal(t, int32(4), fg.requests.Load())
+}
+
+func TestFetchEmailsPeriod(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "gmail-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	originalAttachmentsDir := config.AppAttachmentsDir
+	originalConfigDir := config.AppConfigDir
+	config.AppAttachmentsDir = tempDir
+	config.AppConfigDir = tempDir
+	defer func() {
+		config.AppAttachmentsDir = originalAttachmentsDir
+		config.AppConfigDir = originalConfigDir
+	}()
+
+	fg := newFakeGmail(5, 1)
+	fg.pageSize = 2
+	gs := newFakeGmailService(t, fg, http.DefaultTransport)
+	am := NewActivityManager()
+	assert.NoError(t, am.Load())
+
+	// Un rattrapage lit toutes les pages de la période, sans déplacer le curseur
+	assert.NoError(t, gs.fetchEmails(context.Background(), am, nil, "2023/01/01", "2024/01/01", false))
+	assert.Equal(t, []string{
+		"after:2023/01/01 before:2024/01/01 has:attachment {filename:pdf filename:xml}",
+		"after:2023/01/01 before:2024/01/01 has:attachment {filename:pdf filename:xml}",
+		"after:2023/01/01 before:2024/01/01 has:attachment {filename:pdf filename:xml}",
+	}, fg.queries)
+	assert.Len(t, am.data.Attachments, 5)
+	for _, id := range fg.order {
+		email, err := am.GetEmailByID(id)
+		assert.NoError(t, err)
+		assert.Equal(t, MessageStateDownloaded, email.State)
+	}
+	assert.Empty(t, am.data.LastFetchTime)
+
+	// La première exécution remonte de lookbackDays jours
+	fg.queries = nil
+	assert.NoError(t, gs.processEmails(context.Background(), am, nil))
+	since := time.Now().AddDate(0, 0, -config.AppSettings.LookbackDays).Format(config.DefaultDateFormat)
+	assert.Equal(t, "after:"+since+" has:attachment {filename:pdf filename:xml}", fg.queries[0])
+	// Les messages déjà téléchargés ne le sont pas de nouveau
+	assert.Len(t, am.data.Attachments, 5)
+}
+
+func TestListMessageIDsQueries(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "gmail-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	originalConfigDir := config.AppConfigDir
+	originalQuery := config.AppSettings.Gmail.Query
+	config.AppConfigDir = tempDir
+	config.AppSettings.Gmail.Query = "label:Factures -category:promotions"
+	defer func() {
+		config.AppConfigDir = originalConfigDir
+		config.AppSettings.Gmail.Query = originalQuery
+	}()
+
+	err = os.WriteFile(filepath.Join(tempDir, "rules.json"), []byte(`{"rules": [
+		{"name": "Émises", "match": {"senderEmail": "@moi.fr"}, "filename": "a.pdf", "query": "in:sent"},
+		{"name": "EDF", "match": {"senderEmail": "@edf.fr"}, "filename": "b.pdf", "query": "from:@edf.fr OR from:@edf.com"},
+		{"name": "Autre EDF", "match": {"senderEmail": "@edf.fr"}, "filename": "c.pdf", "query": "from:@edf.fr OR from:@edf.com"}
+	]}`), 0644)
+	assert.NoError(t, err)
+	rules, err := LoadRules()
+	assert.NoError(t, err)
+
+	fg := newFakeGmail(3, 1)
+	gs := newFakeGmailService(t, fg, http.DefaultTransport)
+
+	// Une recherche par requête, les dates ajoutées, chaque message listé une fois
+	ids, err := gs.listMessageIDs(context.Background(), rules.Queries(), "2026/01/01", "")
+	assert.NoError(t, err)
+	assert.Equal(t, fg.order, ids)
+	assert.Equal(t, []string{
+		"label:Factures -category:promotions after:2026/01/01 has:attachment {filename:pdf filename:xml}",
+		"in:sent after:2026/01/01 has:attachment {filename:pdf filename:xml}",
+		"(from:@edf.fr OR from:@edf.com) after:2026/01/01 has:attachment {filename:pdf filename:xml}",
+	}, fg.queries)
+}
+
+// BenchmarkGetMessages compares fetching messages one by one with batch requests,
+// against a fake Gmail server with a fixed latency per HTTP request. The quota
+// limiter is relaxed, as it would otherwise dominate both measures.
+func BenchmarkGetMessages(b *testing.B) {
+	const messages = 200
+
+	b.Run("sequential", func(b *testing.B) {
+		fg := newFakeGmail(messages, 1)
+		fg.latency = 2 * time.Millisecond
+		gs := newFakeGmailService(b, fg, http.DefaultTransport)
+		gs.limiter = newQuotaLimiter(1000000)
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			for _, id := range fg.order {
+				err := gs.call(context.Background(), "get", quotaUnitsMessagesGet, func() error {
+					_, err := gs.service.Users.Messages.Get(gs.user, id).Do()
+					return err
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.ReportMetric(float64(fg.requests.Load())/float64(b.N), "requests/op")
+	})
+
+	b.Run("batch", func(b *testing.B) {
+		fg := newFakeGmail(messages, 1)
+		fg.latency = 2 * time.Millisecond
+		gs := newFakeGmailService(b, fg, http.DefaultTransport)
+		gs.limiter = newQuotaLimiter(1000000)
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			for _, f := range gs.getMessages(context.Background(), fg.order) {
+				if f.err != nil {
+					b.Fatal(f.err)
+				}
+			}
+		}
+		b.ReportMetric(float64(fg.requests.Load())/float64(b.N), "requests/op")
+	})
+}
+
+func TestForEachParallel(t *testing.T) {
+	var running, maxRunning atomic.Int32
+	results := make([]int, 50)
+	forEachParallel(3, len(results), func(i int) {
+		current := running.Add(1)
+		for {
+			observed := maxRunning.Load()
+			if current <= observed || maxRunning.CompareAndSwap(observed, current) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		results[i] = i * i
+		running.Add(-1)
+	})
+
+	assert.LessOrEqual(t, maxRunning.Load(), int32(3))
+	for i, result := range results {
+		assert.Equal(t, i*i, result)
+	}
+}
+
+func TestQuotaLimiter(t *testing.T) {
+	limiter := newQuotaLimiter(100)
+
+	// Le seau initial permet une rafale d'une seconde de quota
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		limiter.Wait(context.Background(), 5)
+	}
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+
+	// Au-delà, le débit est limité
+	start = time.Now()
+	for i := 0; i < 4; i++ {
+		limiter.Wait(context.Background(), 5)
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+}
@@ -0,0 +1,297 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sources of the invoice fields
+const (
+	FieldSourceText    = "text"    // regular expressions on the text layer of the PDF
+	FieldSourceOCR     = "ocr"     // regular expressions on the text recognized by OCR
+	FieldSourceFacturX = "facturx" // XML invoice embedded in a Factur-X or ZUGFeRD document
+	FieldSourceCII     = "cii"     // Cross Industry Invoice sent as an XML attachment
+	FieldSourceUBL     = "ubl"     // UBL invoice sent as an XML attachment
+)
+
+// InvoiceFields holds the fields of an invoice, as extracted from its content.
+// Seller, DueDate, TotalExclVAT, VATTotal and VAT are only known from XML
+// invoices, standalone or embedded in Factur-X documents.
+type InvoiceFields struct {
+	Number       string         `json:"number,omitempty"`
+	IssueDate    string         `json:"issueDate,omitempty"` // 2006-01-02
+	DueDate      string         `json:"dueDate,omitempty"`   // 2006-01-02
+	Seller       string         `json:"seller,omitempty"`
+	Total        string         `json:"total,omitempty"` // decimal with a dot, e.g. 1234.56
+	TotalExclVAT string         `json:"totalExclVat,omitempty"`
+	VATTotal     string         `json:"vatTotal,omitempty"`
+	Currency     string         `json:"currency,omitempty"` // ISO 4217 code
+	VATNumber    string         `json:"vatNumber,omitempty"`
+	VAT          []VATBreakdown `json:"vat,omitempty"`
+	Source       string         `json:"source,omitempty"`
+}
+
+// VATBreakdown is the VAT of an invoice for one rate.
+type VATBreakdown struct {
+	Category string `json:"category,omitempty"` // UNTDID 5305 code, S for the standard rate
+	Rate     string `json:"rate"`               // percentage, e.g. 5.5
+	Base     string `json:"base"`
+	Amount   string `json:"amount"`
+}
+
+// IsEmpty reports whether no field was found.
+func (f InvoiceFields) IsEmpty() bool {
+	return f.Number == "" && f.IssueDate == "" && f.Total == "" && f.VATNumber == ""
+}
+
+// Date returns the issue date of the invoice.
+func (f InvoiceFields) Date() (time.Time, bool) {
+	t, err := time.Parse(time.DateOnly, f.IssueDate)
+	return t, err == nil
+}
+
+const (
+	// invoiceRef is an invoice number: letters, digits and separators, with at least one digit
+	invoiceRef = `([A-Z0-9][A-Z0-9_/.-]*[0-9][A-Z0-9_/-]*|[0-9])`
+	// datePattern is a date written with digits or with the month name, in French or English
+	datePattern = `(\d{4}-\d{2}-\d{2}|\d{1,2}[/.-]\d{1,2}[/.-]\d{2,4}|\d{1,2}(?:er)?\s+\pL+\.?\s+\d{4}|\pL+\.?\s+\d{1,2},?\s+\d{4})`
+	// amountPattern is an amount with cents, with optional thousands separators
+	amountPattern = `(-?\d{1,3}(?:[ .,']\d{3})*[.,]\d{2}|-?\d+[.,]\d{2})`
+	// currencyPattern is a currency symbol or code
+	currencyPattern = `(€|EUR|\$|USD|£|GBP|CHF)?`
+)
+
+// invoiceNumberPatterns lists the labels of the invoice number, most specific first
+var invoiceNumberPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(?:n°|nº|no\b\.?|num[ée]ro|number|r[ée]f(?:[ée]rence)?\.?)\s*(?:de\s+(?:la\s+)?)?(?:facture|invoice)\s*[:#]?\s*` + invoiceRef),
+	regexp.MustCompile(`(?i)(?:facture|invoice)\s*(?:n°|nº|no\b\.?|num[ée]ro|number|nr\.?|#)\s*[:#]?\s*` + invoiceRef),
+	regexp.MustCompile(`(?i)(?:facture|invoice)\s*[:#]\s*` + invoiceRef),
+}
+
+// issueDatePatterns lists the labels of the issue date, most specific first
+var issueDatePatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(?:date\s+(?:de\s+(?:la\s+)?)?(?:facture|facturation)|date\s+d.[ée]mission|invoice\s+date|date\s+of\s+issue|issue\s+date|[ée]mise?\s+le|factur[ée]e?\s+le)\s*[:.]?\s*` + datePattern),
+	regexp.MustCompile(`(?i)(?:facture|invoice)\s+(?:du|dated?)\s*[:.]?\s*` + datePattern),
+	regexp.MustCompile(`(?i)\bdate\s*[:.]?\s*` + datePattern),
+}
+
+var anyDate = regexp.MustCompile(`(?i)` + datePattern)
+
+// totalPatterns lists the labels of the amount to pay, most specific first
+var totalPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(?:net|total|montant|reste)\s+[àa]\s+payer|amount\s+due|balance\s+due|total\s+due`),
+	regexp.MustCompile(`(?i)(?:total|montant)\s*\(?t\.?t\.?c\.?\)?|total\s+tva\s+incluse|total\s+(?:incl\.?|including)\s+(?:vat|tax)|montant\s+total|total\s+amount`),
+	regexp.MustCompile(`(?i)(?:^|[^\pL-])total`),
+}
+
+// totalAmount reads the amount following a label, on the same line
+var totalAmount = regexp.MustCompile(`^([^\d\n]{0,30}?)` + currencyPattern + `\s*` + amountPattern + `\s*` + currencyPattern)
+
+// excludedTotals are the totals before tax, or of the tax alone
+var excludedTotals = regexp.MustCompile(`(?i)\b(?:ht|h\.t\.?|hors|tva|vat|tax|taxes)\b`)
+
+// vatNumberLabel is the label of the VAT number
+var vatNumberLabel = regexp.MustCompile(`(?i)tva\s+intra|n°\s*(?:de\s+)?tva|num[ée]ro\s+de\s+tva|identifiant\s+tva|vat\s*(?:number|no\b|n°|id\b|reg)|ust-?id`)
+
+// vatNumber is a VAT number of the countries invoices usually come from
+var vatNumber = regexp.MustCompile(`\b(?:FR\s?[0-9A-Z]{2}(?:\s?\d{3}){3}|ATU\d{8}|BE\s?[01]\d{3}[.\s]?\d{3}[.\s]?\d{3}|DE\s?\d{9}|ES\s?[A-Z0-9]\d{7}[A-Z0-9]|IT\s?\d{11}|LU\s?\d{8}|NL\s?\d{9}B\d{2}|IE\s?\d[A-Z0-9+*]\d{5}[A-Z]{1,2}|GB\s?\d{9}|CHE[-\s]?\d{3}\.\d{3}\.\d{3})\b`)
+
+// extractInvoiceFields extracts the invoice fields found in the text of a
+// document, source telling where the text comes from.
+func extractInvoiceFields(text, source string) InvoiceFields {
+	fields := InvoiceFields{
+		Number:    extractInvoiceNumber(text),
+		IssueDate: extractIssueDate(text),
+		VATNumber: extractVATNumber(text),
+	}
+	fields.Total, fields.Currency = extractTotal(text)
+	if !fields.IsEmpty() {
+		fields.Source = source
+	}
+	return fields
+}
+
+func extractInvoiceNumber(text string) string {
+	for _, pattern := range invoiceNumberPatterns {
+		if m := pattern.FindStringSubmatch(text); m != nil {
+			return strings.TrimRight(m[1], "./-")
+		}
+	}
+	return ""
+}
+
+// extractIssueDate returns the labelled issue date or, failing that, the
+// first date of the document, formatted as 2006-01-02.
+func extractIssueDate(text string) string {
+	for _, pattern := range issueDatePatterns {
+		for _, m := range pattern.FindAllStringSubmatch(text, -1) {
+			if t, ok := parseDate(m[1]); ok {
+				return t.Format(time.DateOnly)
+			}
+		}
+	}
+	for _, m := range anyDate.FindAllStringSubmatch(text, -1) {
+		if t, ok := parseDate(m[1]); ok {
+			return t.Format(time.DateOnly)
+		}
+	}
+	return ""
+}
+
+// extractTotal returns the amount to pay and its currency. When a label
+// appears several times, the last one wins: it is usually the grand total.
+func extractTotal(text string) (string, string) {
+	for _, pattern := range totalPatterns {
+		var total, currency string
+		for _, loc := range pattern.FindAllStringIndex(text, -1) {
+			m := totalAmount.FindStringSubmatch(text[loc[1]:])
+			if m == nil || excludedTotals.MatchString(m[1]) {
+				continue
+			}
+			amount, ok := parseAmount(m[3])
+			if !ok {
+				continue
+			}
+			total = amount
+			currency = currencyCode(m[1] + m[2] + m[4])
+		}
+		if total != "" {
+			return total, currency
+		}
+	}
+	return "", ""
+}
+
+// extractVATNumber returns the first VAT number following a VAT label or,
+// failing that, the first VAT number of the document.
+func extractVATNumber(text string) string {
+	candidates := vatNumber.FindAllStringIndex(text, -1)
+	if len(candidates) == 0 {
+		return ""
+	}
+
+	chosen := candidates[0]
+	if label := vatNumberLabel.FindStringIndex(text); label != nil {
+		for _, c := range candidates {
+			if c[0] >= label[1] {
+				chosen = c
+				break
+			}
+		}
+	}
+	return strings.NewReplacer(" ", "", ".", "", "-", "").Replace(text[chosen[0]:chosen[1]])
+}
+
+// monthNames maps French and English month names and abbreviations to months
+var monthNames = map[string]time.Month{
+	"janvier": 1, "janv": 1, "january": 1, "jan": 1,
+	"février": 2, "fevrier": 2, "févr": 2, "fevr": 2, "fév": 2, "fev": 2, "february": 2, "feb": 2,
+	"mars": 3, "march": 3, "mar": 3,
+	"avril": 4, "avr": 4, "april": 4, "apr": 4,
+	"mai": 5, "may": 5,
+	"juin": 6, "june": 6, "jun": 6,
+	"juillet": 7, "juil": 7, "july": 7, "jul": 7,
+	"août": 8, "aout": 8, "august": 8, "aug": 8,
+	"septembre": 9, "sept": 9, "september": 9, "sep": 9,
+	"octobre": 10, "october": 10, "oct": 10,
+	"novembre": 11, "november": 11, "nov": 11,
+	"décembre": 12, "decembre": 12, "déc": 12, "december": 12, "dec": 12,
+}
+
+var (
+	isoDate     = regexp.MustCompile(`^(\d{4})-(\d{2})-(\d{2})$`)
+	numericDate = regexp.MustCompile(`^(\d{1,2})[/.-](\d{1,2})[/.-](\d{2,4})$`)
+	dayFirst    = regexp.MustCompile(`^(\d{1,2})(?:er)?\s+(\pL+)\.?\s+(\d{4})$`)
+	monthFirst  = regexp.MustCompile(`^(\pL+)\.?\s+(\d{1,2}),?\s+(\d{4})$`)
+)
+
+// parseDate parses a date matched by datePattern. Numeric dates are read
+// day first, as written in France.
+func parseDate(s string) (time.Time, bool) {
+	var year, day int
+	var month time.Month
+
+	atoi := func(s string) int {
+		v, _ := strconv.Atoi(s)
+		return v
+	}
+
+	switch {
+	case isoDate.MatchString(s):
+		m := isoDate.FindStringSubmatch(s)
+		year, month, day = atoi(m[1]), time.Month(atoi(m[2])), atoi(m[3])
+	case numericDate.MatchString(s):
+		m := numericDate.FindStringSubmatch(s)
+		day, month, year = atoi(m[1]), time.Month(atoi(m[2])), atoi(m[3])
+		if len(m[3]) == 2 {
+			year += 2000
+		} else if len(m[3]) == 3 {
+			return time.Time{}, false
+		}
+	case dayFirst.MatchString(s):
+		m := dayFirst.FindStringSubmatch(s)
+		day, month, year = atoi(m[1]), monthNames[strings.ToLower(m[2])], atoi(m[3])
+	case monthFirst.MatchString(s):
+		m := monthFirst.FindStringSubmatch(s)
+		month, day, year = monthNames[strings.ToLower(m[1])], atoi(m[2]), atoi(m[3])
+	default:
+		return time.Time{}, false
+	}
+
+	if year < 1990 || year > 2100 || month < 1 || month > 12 {
+		return time.Time{}, false
+	}
+	t := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	if t.Day() != day {
+		// Invalid day, such as 31/02
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// parseAmount normalizes an amount such as "1 234,56" or "1,234.56" to "1234.56".
+func parseAmount(s string) (string, bool) {
+	s = strings.NewReplacer(" ", "", "'", "", "\u00a0", "", "\u202f", "").Replace(s)
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+
+	// The last separator, followed by two digits, is the decimal separator
+	i := strings.LastIndexAny(s, ".,")
+	if i < 0 || len(s)-i-1 != 2 {
+		return "", false
+	}
+	units := strings.NewReplacer(".", "", ",", "").Replace(s[:i])
+	if _, err := strconv.ParseUint(units, 10, 64); err != nil {
+		return "", false
+	}
+	units = strings.TrimLeft(units, "0")
+	if units == "" {
+		units = "0"
+	}
+
+	amount := fmt.Sprintf("%s.%s", units, s[i+1:])
+	if negative {
+		amount = "-" + amount
+	}
+	return amount, true
+}
+
+var currencySymbol = regexp.MustCompile(`€|EUR|\$|USD|£|GBP|CHF`)
+
+// currencyCode returns the ISO 4217 code of the first currency symbol or code found in s
+func currencyCode(s string) string {
+	switch currencySymbol.FindString(s) {
+	case "€", "EUR":
+		return "EUR"
+	case "$", "USD":
+		return "USD"
+	case "£", "GBP":
+		return "GBP"
+	case "CHF":
+		return "CHF"
+	}
+	return ""
+}
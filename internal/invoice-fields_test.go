@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractInvoiceFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		expected InvoiceFields
+	}{
+		{
+			name: "facture française",
+			text: `IKUTO SAS - 12 rue des Lilas 75011 Paris
+N° TVA intracommunautaire : FR 40 123 456 789
+Facture N° FA-2026-0042
+Date de facture : 15/03/2026
+Échéance : 14/04/2026
+Total HT 100,00 €
+TVA 20 % 20,00 €
+Total TTC 120,00 €`,
+			expected: InvoiceFields{
+				Number:    "FA-2026-0042",
+				IssueDate: "2026-03-15",
+				Total:     "120.00",
+				Currency:  "EUR",
+				VATNumber: "FR40123456789",
+				Source:    FieldSourceText,
+			},
+		},
+		{
+			name: "english invoice",
+			text: `Google Cloud EMEA Limited
+VAT number: IE 9825613N
+Invoice number: 5301234567
+Invoice date: March 1, 2026
+Subtotal in EUR 1,000.00
+VAT (23%) 230.00
+Total amount due in EUR €1,230.00`,
+			expected: InvoiceFields{
+				Number:    "5301234567",
+				IssueDate: "2026-03-01",
+				Total:     "1230.00",
+				Currency:  "EUR",
+				VATNumber: "IE9825613N",
+				Source:    FieldSourceText,
+			},
+		},
+		{
+			name: "date en toutes lettres et montant avec séparateur de milliers",
+			text: `Numéro de facture : 2026/118
+Émise le 1er février 2026
+Client : FR76 3000 6000 0112 3456 7890 189
+Sous-total 1 000,00
+Net à payer : 1 234,56 EUR`,
+			expected: InvoiceFields{
+				Number:    "2026/118",
+				IssueDate: "2026-02-01",
+				Total:     "1234.56",
+				Currency:  "EUR",
+				Source:    FieldSourceText,
+			},
+		},
+		{
+			name: "sans libellés",
+			text: `Reçu de paiement
+Paris, le 05.01.2026
+Total 49,90`,
+			expected: InvoiceFields{
+				IssueDate: "2026-01-05",
+				Total:     "49.90",
+				Source:    FieldSourceText,
+			},
+		},
+		{
+			name:     "aucun champ",
+			text:     "Conditions générales de vente",
+			expected: InvoiceFields{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, extractInvoiceFields(tt.text, FieldSourceText))
+		})
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	tests := map[string]string{
+		"2026-03-15":     "2026-03-15",
+		"15/03/2026":     "2026-03-15",
+		"15-03-26":       "2026-03-15",
+		"15 mars 2026":   "2026-03-15",
+		"1er Août 2026":  "2026-08-01",
+		"3 déc. 2025":    "2025-12-03",
+		"Jan 7, 2026":    "2026-01-07",
+		"31/02/2026":     "",
+		"12 lundi 2026":  "",
+		"15/13/2026":     "",
+		"01/01/1900":     "",
+		"September 2026": "",
+	}
+
+	for input, expected := range tests {
+		date, ok := parseDate(input)
+		if expected == "" {
+			assert.False(t, ok, input)
+			continue
+		}
+		if assert.True(t, ok, input) {
+			assert.Equal(t, expected, date.Format("2006-01-02"), input)
+		}
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	tests := map[string]string{
+		"120,00":    "120.00",
+		"1 234,56":  "1234.56",
+		"1.234,56":  "1234.56",
+		"1,234.56":  "1234.56",
+		"1'234.56":  "1234.56",
+		"0,99":      "0.99",
+		"-15,00":    "-15.00",
+		"1 234 567": "",
+		"12,5":      "",
+	}
+
+	for input, expected := range tests {
+		amount, ok := parseAmount(input)
+		assert.Equal(t, expected != "", ok, input)
+		assert.Equal(t, expected, amount, input)
+	}
+}
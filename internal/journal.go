@@ -0,0 +1,379 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"extract-email-attachments/internal/config"
+)
+
+// Operations recorded in the journal
+const (
+	JournalOpDownload = "download" // an attachment was written to Path, kept by UndoRun
+	JournalOpMove     = "move"     // a document was moved or renamed from From to Path
+	JournalOpCopy     = "copy"     // a document was copied from From to Path
+	JournalOpLink     = "link"     // a document was hard-linked from From to Path
+	JournalOpCreate   = "create"   // a file derived from a document was written to Path, such as a decrypted copy
+	JournalOpUpdate   = "update"   // a document was modified in place, its previous content kept in Backup
+	JournalOpUndo     = "undo"     // the operations of the run were reverted
+)
+
+// ErrFileChanged is returned by UndoRun when a file written by the run has
+// since been modified, moved or deleted
+var ErrFileChanged = errors.New("file changed since the run")
+
+// JournalEntry is a filesystem operation of a run.
+type JournalEntry struct {
+	Run  string `json:"run"`
+	Time string `json:"time"`
+	Op   string `json:"op"`
+	Path string `json:"path,omitempty"`
+	From string `json:"from,omitempty"`
+	// Sha256 is the hash of the file at Path after the operation
+	Sha256 string `json:"sha256,omitempty"`
+	Backup string `json:"backup,omitempty"`
+	// EmailID and Attachment are the message and the name of the attachment
+	// in the activity data
+	EmailID    string `json:"emailId,omitempty"`
+	Attachment string `json:"attachment,omitempty"`
+}
+
+// Journal records the filesystem operations of a run in journal.jsonl, an
+// append-only file of the configuration directory, so that UndoRun can
+// revert them. A nil journal records nothing.
+type Journal struct {
+	run string
+	mu  sync.Mutex
+}
+
+// NewJournal starts the journal of a new run, identified by its start time.
+// A run started within the same second as a run of the journal is told
+// apart by a numbered suffix.
+func NewJournal() *Journal {
+	start := time.Now().Format("20060102-150405")
+	run := start
+	runs, err := JournalRuns()
+	if err != nil {
+		log.Printf("Warning: Error reading journal: %v", err)
+	}
+	taken := map[string]bool{}
+	for _, r := range runs {
+		taken[r.Run] = true
+	}
+	for i := 2; taken[run]; i++ {
+		run = fmt.Sprintf("%s-%d", start, i)
+	}
+	return &Journal{run: run}
+}
+
+// Run returns the ID of the run
+func (j *Journal) Run() string {
+	return j.run
+}
+
+// journalPath is the path of the journal
+func journalPath() string {
+	return filepath.Join(config.AppConfigDir, "journal.jsonl")
+}
+
+// journalBackupDir is where the previous content of the files modified in
+// place by a run is kept
+func journalBackupDir(run string) string {
+	return filepath.Join(config.AppConfigDir, "journal", run)
+}
+
+// record appends an operation to the journal, with the hash of the file at
+// entry.Path. A failure is logged: the operation itself succeeded.
+func (j *Journal) record(entry JournalEntry) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entry.Run = j.run
+	entry.Time = time.Now().Format(time.RFC3339)
+	if err := appendJournal(entry); err != nil {
+		log.Printf("Warning: Error recording %s of %s in journal: %v", entry.Op, entry.Path, err)
+	}
+}
+
+// appendJournal writes an entry at the end of the journal, computing the
+// hash of the file at entry.Path if not set
+func appendJournal(entry JournalEntry) error {
+	if entry.Sha256 == "" && entry.Path != "" && entry.Op != JournalOpUndo {
+		hash, err := fileSha256(entry.Path)
+		if err != nil {
+			return err
+		}
+		entry.Sha256 = hash
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(journalPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, defaultFilePerm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// backup keeps the content of the file at path before the run modifies it in
+// place, and returns where it is kept.
+func (j *Journal) backup(path string) (string, error) {
+	if j == nil {
+		return "", nil
+	}
+	hash, err := fileSha256(path)
+	if err != nil {
+		return "", err
+	}
+	backupPath := filepath.Join(journalBackupDir(j.run), hash)
+	if err := os.MkdirAll(filepath.Dir(backupPath), defaultDirPerm); err != nil {
+		return "", err
+	}
+	return backupPath, copyFile(path, backupPath)
+}
+
+// fileSha256 returns the SHA-256 hash of the file at path
+func fileSha256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ReadJournal reads the entries of the journal, oldest first
+func ReadJournal() ([]JournalEntry, error) {
+	f, err := os.Open(journalPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading journal: %w", err)
+	}
+	defer f.Close()
+
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("error decoding journal line %d: %w", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading journal: %w", err)
+	}
+	return entries, nil
+}
+
+// JournalRun summarizes the operations recorded for a run.
+type JournalRun struct {
+	Run        string
+	Time       string // time of the first operation
+	Operations int
+	Undone     bool
+}
+
+// JournalRuns returns the runs of the journal, oldest first
+func JournalRuns() ([]JournalRun, error) {
+	entries, err := ReadJournal()
+	if err != nil {
+		return nil, err
+	}
+
+	var runs []JournalRun
+	index := map[string]int{}
+	for _, entry := range entries {
+		i, ok := index[entry.Run]
+		if !ok {
+			i = len(runs)
+			index[entry.Run] = i
+			runs = append(runs, JournalRun{Run: entry.Run, Time: entry.Time})
+		}
+		if entry.Op == JournalOpUndo {
+			runs[i].Undone = true
+		} else {
+			runs[i].Operations++
+		}
+	}
+	return runs, nil
+}
+
+// UndoRun reverts the operations of a run, in reverse order: created files
+// are deleted, moved documents are moved back, copies and links are deleted,
+// and documents modified in place are restored. Downloaded files are kept,
+// their messages being processed: the documents back in the attachments
+// directory are processed again by the next run.
+// Nothing is reverted if a file written by the run has since changed.
+func UndoRun(run string) ([]JournalEntry, error) {
+	entries, err := ReadJournal()
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []JournalEntry
+	recorded := false
+	for _, entry := range entries {
+		if entry.Run != run {
+			continue
+		}
+		if entry.Op == JournalOpUndo {
+			return nil, fmt.Errorf("run %s was already undone on %s", run, entry.Time)
+		}
+		recorded = true
+		if entry.Op != JournalOpDownload {
+			ops = append(ops, entry)
+		}
+	}
+	if !recorded {
+		return nil, fmt.Errorf("no operation recorded for run %s", run)
+	}
+	slices.Reverse(ops)
+
+	// Check every file before changing anything
+	if err := checkUndo(ops); err != nil {
+		return nil, err
+	}
+
+	activityManager := NewActivityManager()
+	if err := activityManager.Load(); err != nil {
+		return nil, NewError("UndoRun", err, "failed to load activity data")
+	}
+
+	for i, op := range ops {
+		if err := undoOperation(op); err != nil {
+			// Keep the state of the documents already reverted
+			if err := activityManager.Save(); err != nil {
+				log.Printf("Warning: Error saving activity data: %v", err)
+			}
+			return ops[:i], fmt.Errorf("error reverting %s of %s: %w", op.Op, op.Path, err)
+		}
+		if op.Op == JournalOpMove || op.Op == JournalOpCopy || op.Op == JournalOpLink {
+			restoreAttachment(activityManager, op)
+		}
+	}
+
+	if err := activityManager.Save(); err != nil {
+		return ops, NewError("UndoRun", err, "failed to save activity data")
+	}
+	if err := appendJournal(JournalEntry{Run: run, Time: time.Now().Format(time.RFC3339), Op: JournalOpUndo}); err != nil {
+		return ops, fmt.Errorf("error recording undo in journal: %w", err)
+	}
+	if err := os.RemoveAll(journalBackupDir(run)); err != nil {
+		log.Printf("Warning: Error removing backups of run %s: %v", run, err)
+	}
+	return ops, nil
+}
+
+// checkUndo checks that the files written by the operations, taken in
+// reverse order, are unchanged, and that the files to restore are not in the way
+func checkUndo(ops []JournalEntry) error {
+	// Hash of each path as it is after undoing the operations checked so far
+	state := map[string]string{}
+	current := func(path string) string {
+		if hash, ok := state[path]; ok {
+			return hash
+		}
+		hash, _ := fileSha256(path)
+		return hash
+	}
+
+	var changed []string
+	for _, op := range ops {
+		if current(op.Path) != op.Sha256 {
+			changed = append(changed, op.Path)
+			continue
+		}
+		switch op.Op {
+		case JournalOpMove:
+			if current(op.From) != "" {
+				changed = append(changed, op.From)
+			}
+			state[op.From] = op.Sha256
+			state[op.Path] = ""
+		case JournalOpUpdate:
+			hash, err := fileSha256(op.Backup)
+			if err != nil {
+				return fmt.Errorf("backup of %s: %w", op.Path, err)
+			}
+			state[op.Path] = hash
+		default:
+			state[op.Path] = ""
+		}
+	}
+
+	if len(changed) > 0 {
+		return fmt.Errorf("%w: %s", ErrFileChanged, strings.Join(changed, ", "))
+	}
+	return nil
+}
+
+// restoreAttachment records where the document of a reverted filing is: back
+// in the attachments directory, it is processed again by the next run;
+// elsewhere, it is where a previous run filed it.
+func restoreAttachment(activityManager *ActivityManager, op JournalEntry) {
+	if filepath.Dir(op.From) != filepath.Clean(config.AppAttachmentsDir) {
+		if err := activityManager.UpdateAttachmentPath(op.EmailID, op.Attachment, op.From); err != nil {
+			log.Printf("Warning: Error recording path of %s: %v", op.Attachment, err)
+		}
+		return
+	}
+	if err := activityManager.UpdateAttachmentStatus(op.EmailID, op.Attachment, ""); err != nil {
+		log.Printf("Warning: Error updating attachment status for %s: %v", op.Attachment, err)
+	}
+	if err := activityManager.UpdateAttachmentPath(op.EmailID, op.Attachment, ""); err != nil {
+		log.Printf("Warning: Error clearing path of %s: %v", op.Attachment, err)
+	}
+
+	// The message is processed again along with its document
+	if email, err := activityManager.GetEmailByID(op.EmailID); err == nil && email.State == MessageStateProcessed {
+		if err := activityManager.UpdateEmailState(op.EmailID, MessageStateDownloaded, nil); err != nil {
+			log.Printf("Warning: Error updating message state for %s: %v", op.EmailID, err)
+		}
+	}
+}
+
+// undoOperation reverts a single operation
+func undoOperation(op JournalEntry) error {
+	switch op.Op {
+	case JournalOpMove:
+		return fileDocument(op.Path, op.From, DestinationModeMove)
+	case JournalOpUpdate:
+		return copyFile(op.Backup, op.Path)
+	case JournalOpCopy, JournalOpLink, JournalOpCreate:
+		return os.Remove(op.Path)
+	}
+	return fmt.Errorf("unknown operation %q", op.Op)
+}
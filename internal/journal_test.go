@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"extract-email-attachments/internal/config"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestUndoRun(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "journal-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+	filingDir := filepath.Join(tempDir, "Compta")
+
+	originalAttachmentsDir := config.AppAttachmentsDir
+	originalConfigDir := config.AppConfigDir
+	originalXMLSummary := config.AppSettings.XMLSummary
+	config.AppAttachmentsDir = filepath.Join(tempDir, "attachments")
+	config.AppConfigDir = tempDir
+	config.AppSettings.XMLSummary = true
+	defer func() {
+		config.AppAttachmentsDir = originalAttachmentsDir
+		config.AppConfigDir = originalConfigDir
+		config.AppSettings.XMLSummary = originalXMLSummary
+	}()
+
+	err = os.WriteFile(filepath.Join(tempDir, "rules.json"), []byte(fmt.Sprintf(`{"rules": [
+		{"name": "Nordlicht", "match": {"vatNumber": "DE123456789"}, "filename": "{{.Year}}-{{.Month}}-{{.InvoiceNumber}}.pdf",
+		 "destination": %q}
+	]}`, filingDir+"/{{.Year}}/")), 0644)
+	assert.NoError(t, err)
+
+	fileContent, err := os.ReadFile(filepath.Join("testdata", "ubl-invoice.xml"))
+	assert.NoError(t, err)
+	emailID := "test-email-undo"
+	am := NewActivityManager()
+	assert.NoError(t, am.Load())
+	assert.NoError(t, am.StoreEmailMeta(emailID, &gmail.Message{
+		Id: emailID,
+		Payload: &gmail.MessagePart{
+			Headers: []*gmail.MessagePartHeader{
+				{Name: "Date", Value: "Thu, 02 Apr 2026 11:00:00 +0200"},
+				{Name: "From", Value: "Nordlicht <billing@nordlicht.example>"},
+			},
+		},
+	}))
+
+	// Une exécution télécharge, classe et résume la facture
+	journal := NewJournal()
+	assert.NoError(t, saveAttachment(emailID, &gmail.MessagePart{Filename: "invoice.xml"}, fileContent, am, journal))
+	assert.NoError(t, am.UpdateEmailState(emailID, MessageStateDownloaded, nil))
+	assert.NoError(t, am.Save())
+	assert.NoError(t, ProcessAttachments(context.Background(), journal))
+
+	downloadPath := filepath.Join(config.AppAttachmentsDir, "invoice.xml")
+	newPath := filepath.Join(filingDir, "2026", "2026-04-INV-2026-0315.xml")
+	summaryPath := filepath.Join(filingDir, "2026", "2026-04-INV-2026-0315.html")
+	assert.FileExists(t, newPath)
+	assert.FileExists(t, summaryPath)
+	assert.NoFileExists(t, downloadPath)
+
+	entries, err := ReadJournal()
+	assert.NoError(t, err)
+	var ops []string
+	for _, entry := range entries {
+		assert.Equal(t, journal.Run(), entry.Run)
+		assert.NotEmpty(t, entry.Sha256)
+		ops = append(ops, entry.Op)
+	}
+	assert.Equal(t, []string{JournalOpDownload, JournalOpMove, JournalOpCreate}, ops)
+
+	// Un fichier modifié ou supprimé depuis l'exécution bloque l'annulation, sans rien changer
+	summary, err := os.ReadFile(summaryPath)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(summaryPath, []byte("modifié"), 0644))
+	_, err = UndoRun(journal.Run())
+	assert.ErrorIs(t, err, ErrFileChanged)
+	assert.FileExists(t, newPath)
+	assert.NoError(t, os.Remove(summaryPath))
+	_, err = UndoRun(journal.Run())
+	assert.ErrorIs(t, err, ErrFileChanged)
+
+	// Le résumé rétabli, les opérations sont annulées dans l'ordre inverse ;
+	// le fichier téléchargé est conservé et le message sera traité de nouveau
+	assert.NoError(t, os.WriteFile(summaryPath, summary, 0644))
+	undone, err := UndoRun(journal.Run())
+	assert.NoError(t, err)
+	assert.Len(t, undone, 2)
+	assert.NoFileExists(t, summaryPath)
+	assert.NoFileExists(t, newPath)
+	assert.FileExists(t, downloadPath)
+
+	am = NewActivityManager()
+	assert.NoError(t, am.Load())
+	attachment, err := am.GetAttachmentByFilename("invoice.xml")
+	assert.NoError(t, err)
+	assert.Empty(t, attachment.Status)
+	assert.Empty(t, attachment.Path)
+	email, err := am.GetEmailByID(emailID)
+	assert.NoError(t, err)
+	assert.Equal(t, MessageStateDownloaded, email.State)
+
+	// Une exécution n'est annulée qu'une fois
+	_, err = UndoRun(journal.Run())
+	assert.Error(t, err)
+	runs, err := JournalRuns()
+	assert.NoError(t, err)
+	assert.Len(t, runs, 1)
+	assert.Equal(t, 3, runs[0].Operations)
+	assert.True(t, runs[0].Undone)
+
+	_, err = UndoRun("inconnue")
+	assert.Error(t, err)
+
+	// L'exécution suivante classe de nouveau la facture
+	next := NewJournal()
+	assert.NoError(t, ProcessAttachments(context.Background(), next))
+	assert.FileExists(t, newPath)
+	assert.NoFileExists(t, downloadPath)
+	am = NewActivityManager()
+	assert.NoError(t, am.Load())
+	email, err = am.GetEmailByID(emailID)
+	assert.NoError(t, err)
+	assert.Equal(t, MessageStateProcessed, email.State)
+
+	// Deux exécutions lancées dans la même seconde ont des identifiants distincts
+	start := time.Now().Format("20060102-150405")
+	assert.NoError(t, appendJournal(JournalEntry{Run: start, Op: JournalOpCreate, Path: newPath}))
+	assert.NoError(t, appendJournal(JournalEntry{Run: start + "-2", Op: JournalOpCreate, Path: newPath}))
+	if run := NewJournal().Run(); strings.HasPrefix(run, start) {
+		assert.Equal(t, start+"-3", run)
+	}
+}
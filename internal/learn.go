@@ -0,0 +1,547 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"extract-email-attachments/internal/config"
+)
+
+const (
+	// learnMinFiles is the number of documents needed to propose a rule
+	learnMinFiles = 2
+	// learnSamples is the number of documents of a group whose content is read
+	learnSamples = 3
+)
+
+// Proposal is a rule proposed by LearnRules, with what it was inferred from.
+type Proposal struct {
+	Rule *Rule `json:"rule"`
+	// Folder is the folder of the documents, relative to the archive root
+	Folder string `json:"folder"`
+	// Files is the number of documents of the vendor in the folder, Matching
+	// the number of documents whose name follows the proposed filename
+	Files    int `json:"files"`
+	Matching int `json:"matching"`
+	// Condition explains where the match condition comes from
+	Condition string `json:"condition"`
+}
+
+// archiveFile is a document found in the archive
+type archiveFile struct {
+	path   string
+	tokens []string // tokens and separators of the name, the date replaced
+	date   string   // template of the date found in the name, such as "{{.Year}}-{{.Month}}"
+	vendor string
+}
+
+// dateLayouts are the dates recognized in filenames, the most precise first.
+// %s is the separator between the parts of the date.
+var dateLayouts = []struct {
+	pattern  string
+	template string
+}{
+	{`((?:19|20)\d\d)%s(0[1-9]|1[0-2])%s(0[1-9]|[12]\d|3[01])`, "{{.Year}}%s{{.Month}}%s{{.Day}}"},
+	{`(0[1-9]|[12]\d|3[01])%s(0[1-9]|1[0-2])%s((?:19|20)\d\d)`, "{{.Day}}%s{{.Month}}%s{{.Year}}"},
+	{`((?:19|20)\d\d)%s(0[1-9]|1[0-2])`, "{{.Year}}%s{{.Month}}"},
+	{`(0[1-9]|1[0-2])%s((?:19|20)\d\d)`, "{{.Month}}%s{{.Year}}"},
+	{`((?:19|20)\d\d)`, "{{.Year}}"},
+}
+
+// filenameDate is a date layout of dateLayouts, for one separator
+type filenameDate struct {
+	re       *regexp.Regexp
+	template string
+}
+
+// filenameDates are the compiled dateLayouts, for each separator
+var filenameDates = func() []filenameDate {
+	var dates []filenameDate
+	for _, layout := range dateLayouts {
+		for _, sep := range []string{"-", "_", ".", ""} {
+			pattern := strings.ReplaceAll(layout.pattern, "%s", regexp.QuoteMeta(sep))
+			dates = append(dates, filenameDate{
+				re:       regexp.MustCompile(`(?:^|\D)(` + pattern + `)(?:\D|$)`),
+				template: strings.ReplaceAll(layout.template, "%s", sep),
+			})
+			if !strings.Contains(layout.pattern, "%s") {
+				break
+			}
+		}
+	}
+	return dates
+}()
+
+// filenameTokens splits a filename into words and separators
+var filenameTokens = regexp.MustCompile(`[^-_ .]+|[-_ .]+`)
+
+// yearFolder and monthFolder are the folders named after a year or a month
+var (
+	yearFolder  = regexp.MustCompile(`^(19|20)\d\d$`)
+	monthFolder = regexp.MustCompile(`^(0[1-9]|1[0-2])$`)
+)
+
+// dateToken is the placeholder of the date in the tokens of a filename
+const dateToken = "\x00date"
+
+// parseArchiveName finds the date and the tokens of a filename.
+func parseArchiveName(path string) archiveFile {
+	name := filepath.Base(path)
+	stem := strings.TrimSuffix(name, filepath.Ext(name))
+	f := archiveFile{path: path}
+
+	before, after := stem, ""
+	for _, d := range filenameDates {
+		if m := d.re.FindStringSubmatchIndex(stem); m != nil {
+			before, after = stem[:m[2]], stem[m[3]:]
+			f.date = d.template
+			break
+		}
+	}
+	f.tokens = filenameTokens.FindAllString(before, -1)
+	if f.date != "" {
+		f.tokens = append(f.tokens, dateToken)
+		f.tokens = append(f.tokens, filenameTokens.FindAllString(after, -1)...)
+	}
+	return f
+}
+
+// isSeparator reports whether a token of a filename is a separator
+func isSeparator(token string) bool {
+	return strings.Trim(token, "-_ .") == ""
+}
+
+// normalizeToken returns a token for comparisons: lowercase letters and digits
+func normalizeToken(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r > 0x7f {
+			return r
+		}
+		return -1
+	}, strings.ToLower(s))
+}
+
+// folderTemplate returns the folder relative to the archive root, with the
+// years and months replaced by placeholders, and the vendor named by the folder.
+func folderTemplate(rel string) (string, string) {
+	if rel == "." {
+		return "", ""
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	vendor := ""
+	for i, part := range parts {
+		switch {
+		case yearFolder.MatchString(part):
+			parts[i] = "{{.Year}}"
+		case monthFolder.MatchString(part) && i > 0 && parts[i-1] == "{{.Year}}":
+			parts[i] = "{{.Month}}"
+		default:
+			vendor = part
+		}
+	}
+	// Only the innermost folder names a vendor, such as Factures/{{.Year}}/EDF
+	if last := parts[len(parts)-1]; last == "{{.Year}}" || last == "{{.Month}}" {
+		vendor = ""
+	}
+	return strings.Join(parts, "/"), vendor
+}
+
+// LearnRules scans the documents of the archive root and proposes a rule for
+// each vendor folder: the destination folder, with the years and months as
+// placeholders, the most common naming scheme of its documents, and a match
+// condition found in the history (the sender of the documents downloaded by
+// this application) or in their content (VAT number or vendor name).
+// Vendors already named by a rule are skipped.
+func LearnRules(ctx context.Context, archiveRoot string, rules *RuleSet, am *ActivityManager) ([]Proposal, error) {
+	root, err := expandHome(archiveRoot)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("error reading archive root: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("archive root %s is not a directory", root)
+	}
+
+	// Group the documents by destination folder
+	folders := map[string][]archiveFile{}
+	folderVendors := map[string]string{}
+	frequency := map[string]int{}
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != root {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || (!isPDFDocument(path) && !isXMLDocument(path)) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		folder, vendor := folderTemplate(rel)
+		f := parseArchiveName(path)
+		folders[folder] = append(folders[folder], f)
+		folderVendors[folder] = vendor
+		seen := map[string]bool{}
+		for _, word := range f.words() {
+			if !seen[word] {
+				seen[word] = true
+				frequency[word]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error scanning archive: %w", err)
+	}
+
+	known := map[string]bool{}
+	for _, rule := range rules.Rules {
+		known[normalizeToken(rule.Name)] = true
+		known[normalizeToken(rule.Vendor)] = true
+	}
+
+	var proposals []Proposal
+	for _, folder := range sortedKeys(folders) {
+		for _, group := range vendorGroups(folders[folder], folderVendors[folder], frequency) {
+			vendor := group[0].vendor
+			if len(group) < learnMinFiles || known[normalizeToken(vendor)] {
+				continue
+			}
+			proposal, ok := proposeRule(ctx, archiveRoot, folder, group, am)
+			if ok {
+				proposals = append(proposals, proposal)
+				known[normalizeToken(vendor)] = true
+			}
+		}
+	}
+	return proposals, nil
+}
+
+// vendorGroups splits the documents of a folder by vendor. The vendor named
+// by a filename is its rarest word in the archive, words such as "facture"
+// being in most names. A folder named after a vendor, such as Factures/EDF,
+// holds the documents of this vendor unless its name is not in the filenames
+// and they name vendors found nowhere else, as in Telecom/Orange_2025.pdf.
+func vendorGroups(files []archiveFile, folderVendor string, frequency map[string]int) [][]archiveFile {
+	local := map[string]int{}
+	for _, f := range files {
+		for _, word := range slices.Compact(slices.Sorted(slices.Values(f.words()))) {
+			local[word]++
+		}
+	}
+
+	inNames, localVendors := false, false
+	for i, f := range files {
+		files[i].vendor = rarestWord(f, frequency)
+		if word := normalizeToken(files[i].vendor); word != "" && local[word] == frequency[word] {
+			localVendors = true
+		}
+		if folderVendor != "" && slices.Contains(f.words(), normalizeToken(folderVendor)) {
+			inNames = true
+		}
+	}
+	if folderVendor != "" && (inNames || !localVendors) {
+		for i := range files {
+			files[i].vendor = folderVendor
+		}
+	}
+
+	groups := map[string][]archiveFile{}
+	for _, f := range files {
+		if f.vendor != "" {
+			key := normalizeToken(f.vendor)
+			groups[key] = append(groups[key], f)
+		}
+	}
+	var result [][]archiveFile
+	for _, key := range sortedKeys(groups) {
+		result = append(result, groups[key])
+	}
+	return result
+}
+
+// words returns the words of a filename, without digits, normalized
+func (f archiveFile) words() []string {
+	var words []string
+	for _, token := range f.tokens {
+		if token != dateToken && !isSeparator(token) && !strings.ContainsAny(token, "0123456789") {
+			if key := normalizeToken(token); key != "" {
+				words = append(words, key)
+			}
+		}
+	}
+	return words
+}
+
+// rarestWord returns the word of a filename found in the fewest names of the archive
+func rarestWord(f archiveFile, frequency map[string]int) string {
+	vendor, best := "", 0
+	for _, token := range f.tokens {
+		if token == dateToken || isSeparator(token) || strings.ContainsAny(token, "0123456789") {
+			continue
+		}
+		if n := frequency[normalizeToken(token)]; n > 0 && (vendor == "" || n < best) {
+			vendor, best = token, n
+		}
+	}
+	return vendor
+}
+
+// commonTokens returns the words found in more than half of the filenames.
+func commonTokens(files []archiveFile) map[string]bool {
+	counts := map[string]int{}
+	for _, f := range files {
+		seen := map[string]bool{}
+		for _, token := range f.tokens {
+			if key := normalizeToken(token); key != "" && !seen[key] {
+				seen[key] = true
+				counts[key]++
+			}
+		}
+	}
+	common := map[string]bool{}
+	for key, n := range counts {
+		if 2*n > len(files) {
+			common[key] = true
+		}
+	}
+	return common
+}
+
+// filenameTemplate returns the filename template matching the name of a
+// document: the date, the vendor and the invoice number, a word containing
+// digits that is not common to the group, are replaced by placeholders.
+func filenameTemplate(f archiveFile, common map[string]bool) string {
+	var b strings.Builder
+	for _, token := range f.tokens {
+		key := normalizeToken(token)
+		switch {
+		case token == dateToken:
+			b.WriteString(f.date)
+		case isSeparator(token):
+			b.WriteString(token)
+		case key == normalizeToken(f.vendor):
+			b.WriteString("{{.Vendor}}")
+		case !common[key] && strings.ContainsAny(token, "0123456789"):
+			b.WriteString("{{.InvoiceNumber}}")
+		default:
+			b.WriteString(token)
+		}
+	}
+	return b.String()
+}
+
+// proposeRule proposes the rule filing the documents of a vendor.
+func proposeRule(ctx context.Context, root, folder string, group []archiveFile, am *ActivityManager) (Proposal, bool) {
+	vendor := group[0].vendor
+	common := commonTokens(group)
+
+	// The most common naming scheme, which must tell the documents apart
+	counts := map[string]int{}
+	for _, f := range group {
+		counts[filenameTemplate(f, common)]++
+	}
+	filename, matching := "", 0
+	for _, tmpl := range sortedKeys(counts) {
+		if counts[tmpl] > matching {
+			filename, matching = tmpl, counts[tmpl]
+		}
+	}
+	if !strings.Contains(filename, "{{.") || filename == "{{.Vendor}}" {
+		return Proposal{}, false
+	}
+
+	match, condition, ok := learnCondition(ctx, group, am)
+	if !ok {
+		return Proposal{}, false
+	}
+
+	destination := strings.TrimSuffix(filepath.ToSlash(root), "/")
+	if folder != "" {
+		destination += "/" + folder
+	}
+	rule := &Rule{
+		Name:        vendor,
+		Vendor:      vendor,
+		Match:       match,
+		Filename:    filename + ".pdf",
+		Destination: destination + "/",
+	}
+	if err := (&RuleSet{Rules: []*Rule{rule}}).compile(); err != nil {
+		return Proposal{}, false
+	}
+
+	displayFolder := folder
+	if displayFolder == "" {
+		displayFolder = "."
+	}
+	return Proposal{Rule: rule, Folder: displayFolder, Files: len(group), Matching: matching, Condition: condition}, true
+}
+
+// learnCondition finds the match condition of a group of documents: the
+// sender of the documents downloaded by this application, or else the VAT
+// number or the vendor name found in the content of all the samples.
+func learnCondition(ctx context.Context, group []archiveFile, am *ActivityManager) (RuleMatch, string, bool) {
+	vendor := group[0].vendor
+
+	var senders []string
+	for _, f := range group {
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			continue
+		}
+		attachment, err := am.GetAttachment(fmt.Sprintf("%x", sha256.Sum256(data)))
+		if err != nil {
+			continue
+		}
+		if email, err := am.GetEmailByID(attachment.EmailID); err == nil && email.SenderEmail != "" {
+			senders = append(senders, strings.ToLower(email.SenderEmail))
+		}
+	}
+	if sender := commonSender(senders); sender != "" {
+		return RuleMatch{SenderEmail: sender}, fmt.Sprintf("sender of %d downloaded documents", len(senders)), true
+	}
+
+	reader := &documentReader{}
+	vatNumber, vatCount, vendorCount, samples := "", 0, 0, 0
+	for _, f := range group {
+		if samples == learnSamples {
+			break
+		}
+		doc := reader.read(ctx, f.path, AttachmentData{Filename: filepath.Base(f.path)}, EmailData{})
+		if doc.Text == "" {
+			continue
+		}
+		samples++
+		if v := doc.Invoice.VATNumber; v != "" && (vatNumber == "" || v == vatNumber) {
+			vatNumber = v
+			vatCount++
+		}
+		if strings.Contains(strings.ToLower(doc.Text), strings.ToLower(vendor)) {
+			vendorCount++
+		}
+	}
+	switch {
+	case samples == 0:
+		return RuleMatch{}, "", false
+	case vatCount == samples:
+		return RuleMatch{VATNumber: vatNumber}, fmt.Sprintf("VAT number found in %d documents", samples), true
+	case vendorCount == samples:
+		return RuleMatch{TextContains: vendor}, fmt.Sprintf("vendor name found in %d documents", samples), true
+	}
+	return RuleMatch{}, "", false
+}
+
+// commonSender returns the address shared by all the senders or, if they
+// differ, their common domain, such as "@edf.fr".
+func commonSender(senders []string) string {
+	if len(senders) == 0 {
+		return ""
+	}
+	address, domain := senders[0], senders[0][strings.LastIndex(senders[0], "@"):]
+	for _, sender := range senders[1:] {
+		if sender != address {
+			address = ""
+		}
+		if !strings.HasSuffix(sender, domain) {
+			return ""
+		}
+	}
+	if address != "" {
+		return address
+	}
+	return domain
+}
+
+// sortedKeys returns the keys of a map, sorted
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// proposalsPath is the file where the proposed rules are kept for review
+func proposalsPath() string {
+	return filepath.Join(config.AppConfigDir, "rules-proposed.json")
+}
+
+// SaveProposals writes the proposed rules, for the user to review and edit
+// before accepting them.
+func SaveProposals(proposals []Proposal) error {
+	data, err := json.MarshalIndent(struct {
+		Proposals []Proposal `json:"proposals"`
+	}{proposals}, "", "    ")
+	if err != nil {
+		return fmt.Errorf("error encoding proposals: %w", err)
+	}
+	return writeFileAtomic(proposalsPath(), append(data, '\n'), defaultFilePerm)
+}
+
+// AcceptProposals adds the reviewed proposed rules to rules.json, after the
+// existing rules, and removes the proposals. It returns the added rules.
+func AcceptProposals() ([]*Rule, error) {
+	data, err := os.ReadFile(proposalsPath())
+	if err != nil {
+		return nil, fmt.Errorf("error reading proposals: %w", err)
+	}
+	var file struct {
+		Proposals []Proposal `json:"proposals"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("error decoding proposals: %w", err)
+	}
+
+	rules, err := LoadRules()
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, rule := range rules.Rules {
+		names[rule.Name] = true
+	}
+
+	var added []*Rule
+	for _, proposal := range file.Proposals {
+		if proposal.Rule == nil || names[proposal.Rule.Name] {
+			continue
+		}
+		names[proposal.Rule.Name] = true
+		rules.Rules = append(rules.Rules, proposal.Rule)
+		added = append(added, proposal.Rule)
+	}
+	if err := rules.compile(); err != nil {
+		return nil, err
+	}
+	if err := SaveRules(rules); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(proposalsPath()); err != nil {
+		return nil, fmt.Errorf("error removing proposals: %w", err)
+	}
+	return added, nil
+}
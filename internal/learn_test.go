@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"extract-email-attachments/internal/config"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestParseArchiveName(t *testing.T) {
+	tests := []struct {
+		name     string
+		vendor   string
+		date     string
+		expected string
+	}{
+		{"2025-03-facture-EDF-FA001.pdf", "EDF", "{{.Year}}-{{.Month}}", "{{.Year}}-{{.Month}}-facture-{{.Vendor}}-{{.InvoiceNumber}}"},
+		{"Orange_20250314.pdf", "Orange", "{{.Year}}{{.Month}}{{.Day}}", "{{.Vendor}}_{{.Year}}{{.Month}}{{.Day}}"},
+		{"Relevé EDF 14.03.2025.pdf", "EDF", "{{.Day}}.{{.Month}}.{{.Year}}", "Relevé {{.Vendor}} {{.Day}}.{{.Month}}.{{.Year}}"},
+		{"EDF 2025 n°12.pdf", "EDF", "{{.Year}}", "{{.Vendor}} {{.Year}} {{.InvoiceNumber}}"},
+		{"contrat EDF.pdf", "EDF", "", "contrat {{.Vendor}}"},
+	}
+
+	for _, tt := range tests {
+		f := parseArchiveName(filepath.Join("archive", tt.name))
+		f.vendor = tt.vendor
+		assert.Equal(t, tt.date, f.date, tt.name)
+		assert.Equal(t, tt.expected, filenameTemplate(f, map[string]bool{"facture": true, "releve": true, "contrat": true}), tt.name)
+	}
+}
+
+func TestLearnRules(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "learn-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	originalConfigDir := config.AppConfigDir
+	config.AppConfigDir = tempDir
+	defer func() {
+		config.AppConfigDir = originalConfigDir
+	}()
+
+	facturX, err := os.ReadFile(filepath.Join("testdata", "facturx.pdf"))
+	assert.NoError(t, err)
+
+	// Arborescence existante, dont une partie des documents a été téléchargée par l'application
+	root := filepath.Join(tempDir, "Compta")
+	am := NewActivityManager()
+	assert.NoError(t, am.Load())
+	files := []struct {
+		path   string
+		sender string
+	}{
+		{"Factures/2025/EDF/2025-03-facture-EDF-FA001.pdf", "factures@edf.fr"},
+		{"Factures/2025/EDF/2025-04-facture-EDF-FA002.pdf", "factures@edf.fr"},
+		{"Factures/2026/EDF/2026-01-facture-EDF-FA003.pdf", ""},
+		{"Factures/2025/IKUTO/2025-03-facture-IKUTO.pdf", "contact@ikuto.fr"},
+		{"Factures/2025/IKUTO/2025-04-facture-IKUTO.pdf", "contact@ikuto.fr"},
+		{"Banques/2025-01-releve-BNP.pdf", "releves@bnp.fr"},
+		{"Banques/2025-02-releve-BNP.pdf", "alertes@bnp.fr"},
+		{"Banques/2025-01-releve-LCL.pdf", ""},
+		{"Banques/2025-02-releve-LCL.pdf", ""},
+		{"Telecom/Orange_20250314.pdf", ""},
+		{"Telecom/Orange_20250414.pdf", ""},
+		{"Divers/notes.pdf", ""},
+		{".Trash/2025-01-facture-EDF-FA000.pdf", ""},
+	}
+	for i, f := range files {
+		path := filepath.Join(root, f.path)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		content := []byte(fmt.Sprintf("document %d", i))
+		if filepath.Dir(f.path) == "Telecom" {
+			content = facturX
+		}
+		assert.NoError(t, os.WriteFile(path, content, 0644))
+
+		if f.sender != "" {
+			emailID := fmt.Sprintf("email-%d", i)
+			err := am.StoreEmailMeta(emailID, &gmail.Message{
+				Id:      emailID,
+				Payload: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{{Name: "From", Value: "<" + f.sender + ">"}}},
+			})
+			assert.NoError(t, err)
+			assert.NoError(t, am.StoreAttachmentMeta(filepath.Base(f.path), emailID, fmt.Sprintf("%x", sha256.Sum256(content))))
+		}
+	}
+
+	proposals, err := LearnRules(context.Background(), root, DefaultRules(), am)
+	assert.NoError(t, err)
+	rootSlash := filepath.ToSlash(root)
+	assert.Equal(t, []Proposal{
+		{
+			Rule: &Rule{
+				Name:        "BNP",
+				Vendor:      "BNP",
+				Match:       RuleMatch{SenderEmail: "@bnp.fr"},
+				Filename:    "{{.Year}}-{{.Month}}-releve-{{.Vendor}}.pdf",
+				Destination: rootSlash + "/Banques/",
+			},
+			Folder: "Banques", Files: 2, Matching: 2, Condition: "sender of 2 downloaded documents",
+		},
+		{
+			Rule: &Rule{
+				Name:        "EDF",
+				Vendor:      "EDF",
+				Match:       RuleMatch{SenderEmail: "factures@edf.fr"},
+				Filename:    "{{.Year}}-{{.Month}}-facture-{{.Vendor}}-{{.InvoiceNumber}}.pdf",
+				Destination: rootSlash + "/Factures/{{.Year}}/EDF/",
+			},
+			Folder: "Factures/{{.Year}}/EDF", Files: 3, Matching: 3, Condition: "sender of 2 downloaded documents",
+		},
+		{
+			Rule: &Rule{
+				Name:        "Orange",
+				Vendor:      "Orange",
+				Match:       RuleMatch{VATNumber: "FR12345678901"},
+				Filename:    "{{.Vendor}}_{{.Year}}{{.Month}}{{.Day}}.pdf",
+				Destination: rootSlash + "/Telecom/",
+			},
+			Folder: "Telecom", Files: 2, Matching: 2, Condition: "VAT number found in 2 documents",
+		},
+	}, stripCompiled(proposals))
+
+	// Les règles proposées sont relues puis ajoutées à rules.json
+	assert.NoError(t, SaveProposals(proposals))
+	added, err := AcceptProposals()
+	assert.NoError(t, err)
+	assert.Len(t, added, 3)
+	rules, err := LoadRules()
+	assert.NoError(t, err)
+	var names []string
+	for _, rule := range rules.Rules {
+		names = append(names, rule.Name)
+	}
+	assert.Equal(t, []string{"IKUTO", "BNP", "EDF", "Orange"}, names)
+	assert.NoFileExists(t, proposalsPath())
+
+	// Les fournisseurs déjà classés ne sont plus proposés
+	proposals, err = LearnRules(context.Background(), root, rules, am)
+	assert.NoError(t, err)
+	assert.Empty(t, proposals)
+}
+
+// stripCompiled retire les modèles compilés des règles proposées, pour les comparer.
+func stripCompiled(proposals []Proposal) []Proposal {
+	for _, p := range proposals {
+		p.Rule.filename, p.Rule.destination, p.Rule.textRegex = nil, nil, nil
+	}
+	return proposals
+}
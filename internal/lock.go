@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"extract-email-attachments/internal/config"
+)
+
+const (
+	// lockPollInterval is the delay between two attempts to acquire a busy lock
+	lockPollInterval = 500 * time.Millisecond
+	// lockStaleAfter is the age after which a lock taken on another host,
+	// whose owner cannot be checked, is considered abandoned
+	lockStaleAfter = 2 * time.Hour
+)
+
+// LockInfo describes the process holding the lock file.
+type LockInfo struct {
+	PID       int    `json:"pid"`
+	Hostname  string `json:"hostname"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// FileLock is an inter-process lock backed by a file created exclusively.
+type FileLock struct {
+	path string
+	info LockInfo
+}
+
+// NewRunLock returns the lock guarding a whole run of the application.
+func NewRunLock() *FileLock {
+	return &FileLock{path: filepath.Join(config.AppConfigDir, "run.lock")}
+}
+
+// Acquire takes the lock, waiting up to wait for the current holder to release it.
+// A lock left by a dead process or older than lockStaleAfter is removed.
+// It returns ErrAlreadyRunning if the lock is still held after wait.
+func (l *FileLock) Acquire(wait time.Duration) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	l.info = LockInfo{
+		PID:       os.Getpid(),
+		Hostname:  hostname,
+		CreatedAt: time.Now().Format(time.RFC3339),
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		err := l.tryCreate()
+		if err == nil {
+			return nil
+		}
+		if !os.IsExist(err) {
+			return NewError("Acquire", err, "failed to create lock file")
+		}
+
+		holder, err := readLockInfo(l.path)
+		switch {
+		case os.IsNotExist(err):
+			// Released in the meantime
+			continue
+		case err != nil:
+			// An unreadable lock is most likely being written right now,
+			// or was left truncated by a crash: only its age can tell
+			if stat, statErr := os.Stat(l.path); statErr == nil && time.Since(stat.ModTime()) > lockStaleAfter {
+				log.Printf("Warning: removing unreadable stale lock %s", l.path)
+				l.breakStaleLock(nil)
+				continue
+			}
+		case l.isStale(holder):
+			log.Printf("Warning: removing stale lock held by PID %d on %s since %s", holder.PID, holder.Hostname, holder.CreatedAt)
+			l.breakStaleLock(holder)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			if holder != nil {
+				return NewError("Acquire", ErrAlreadyRunning, fmt.Sprintf("PID %d on %s since %s", holder.PID, holder.Hostname, holder.CreatedAt))
+			}
+			return NewError("Acquire", ErrAlreadyRunning, "")
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// Release removes the lock file if it is still owned by the current process.
+func (l *FileLock) Release() error {
+	holder, err := readLockInfo(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return NewError("Release", err, "failed to read lock file")
+	}
+	if *holder != l.info {
+		return NewError("Release", ErrCritical, "lock file is owned by another process")
+	}
+	if err := os.Remove(l.path); err != nil {
+		return NewError("Release", err, "failed to remove lock file")
+	}
+	return nil
+}
+
+// tryCreate creates the lock file, failing if it already exists.
+func (l *FileLock) tryCreate() error {
+	data, err := json.Marshal(l.info)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, defaultFilePerm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(l.path)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(l.path)
+		return err
+	}
+	return f.Close()
+}
+
+// isStale reports whether the lock holder is gone. On the same host, it is
+// decided by the holder process alone, whatever the age of the lock, since a
+// run such as a backfill has no deadline; the age is only used for holders
+// on other hosts, which cannot be checked.
+func (l *FileLock) isStale(holder *LockInfo) bool {
+	if holder.Hostname == l.info.Hostname {
+		return !processAlive(holder.PID)
+	}
+
+	createdAt, err := time.Parse(time.RFC3339, holder.CreatedAt)
+	return err != nil || time.Since(createdAt) > lockStaleAfter
+}
+
+// breakStaleLock removes a stale lock, stale being nil when it could not be read. The lock file is first moved to a
+// private name, so that if another process replaced it in the meantime,
+// the fresh lock can be put back instead of being deleted.
+func (l *FileLock) breakStaleLock(stale *LockInfo) {
+	tmpPath := fmt.Sprintf("%s.stale-%d", l.path, os.Getpid())
+	if err := os.Rename(l.path, tmpPath); err != nil {
+		return
+	}
+	defer os.Remove(tmpPath)
+
+	moved, err := readLockInfo(tmpPath)
+	if err == nil && (stale == nil || *moved != *stale) {
+		// Restore without overwriting a lock created since
+		os.Link(tmpPath, l.path)
+	}
+}
+
+// readLockInfo reads the content of a lock file.
+func readLockInfo(path string) (*LockInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var info LockInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, errors.New("invalid lock file content")
+	}
+	return &info, nil
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package internal
+
+// processAlive cannot check processes on this platform: the lock is only
+// considered stale once it is older than lockStaleAfter.
+func processAlive(pid int) bool {
+	return pid > 0
+}
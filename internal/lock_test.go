@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"encoding/json"
+	"extract-email-attachments/internal/config"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileLock(t *testing.T) {
+	// Créer un dossier temporaire pour les tests
+	tempDir, err := os.MkdirTemp("", "lock-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	// Sauvegarder les valeurs originales
+	originalConfigDir := config.AppConfigDir
+	config.AppConfigDir = tempDir
+	defer func() {
+		config.AppConfigDir = originalConfigDir
+	}()
+
+	// Premier verrou
+	first := NewRunLock()
+	assert.NoError(t, first.Acquire(0))
+
+	// Un second verrou ne peut pas être pris
+	second := NewRunLock()
+	err = second.Acquire(0)
+	assert.ErrorIs(t, err, ErrAlreadyRunning)
+
+	// Ni en attendant moins longtemps que le premier
+	err = second.Acquire(2 * lockPollInterval)
+	assert.ErrorIs(t, err, ErrAlreadyRunning)
+
+	// Après libération, le second verrou peut être pris
+	assert.NoError(t, first.Release())
+	assert.NoError(t, second.Acquire(0))
+	assert.NoError(t, second.Release())
+
+	_, err = os.Stat(filepath.Join(tempDir, "run.lock"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFileLockStale(t *testing.T) {
+	// Créer un dossier temporaire pour les tests
+	tempDir, err := os.MkdirTemp("", "lock-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	// Sauvegarder les valeurs originales
+	originalConfigDir := config.AppConfigDir
+	config.AppConfigDir = tempDir
+	defer func() {
+		config.AppConfigDir = originalConfigDir
+	}()
+
+	hostname, err := os.Hostname()
+	assert.NoError(t, err)
+	lockPath := filepath.Join(tempDir, "run.lock")
+
+	writeLock := func(info LockInfo) {
+		data, err := json.Marshal(info)
+		assert.NoError(t, err)
+		assert.NoError(t, os.WriteFile(lockPath, data, 0644))
+	}
+
+	// Verrou laissé par un processus terminé sur cette machine
+	writeLock(LockInfo{PID: 999999999, Hostname: hostname, CreatedAt: time.Now().Format(time.RFC3339)})
+	lock := NewRunLock()
+	assert.NoError(t, lock.Acquire(0))
+	assert.NoError(t, lock.Release())
+
+	// Verrou trop ancien pris sur une autre machine
+	writeLock(LockInfo{PID: 1, Hostname: "other-host", CreatedAt: time.Now().Add(-2 * lockStaleAfter).Format(time.RFC3339)})
+	assert.NoError(t, lock.Acquire(0))
+	assert.NoError(t, lock.Release())
+
+	// Verrou récent pris sur une autre machine : toujours valide
+	writeLock(LockInfo{PID: 1, Hostname: "other-host", CreatedAt: time.Now().Format(time.RFC3339)})
+	assert.ErrorIs(t, lock.Acquire(0), ErrAlreadyRunning)
+
+	// Verrou tenu par un processus vivant sur cette machine
+	writeLock(LockInfo{PID: os.Getpid(), Hostname: hostname, CreatedAt: time.Now().Format(time.RFC3339)})
+	assert.ErrorIs(t, lock.Acquire(0), ErrAlreadyRunning)
+
+	// Verrou ancien tenu par un processus vivant sur cette machine, comme un long rattrapage
+	writeLock(LockInfo{PID: os.Getpid(), Hostname: hostname, CreatedAt: time.Now().Add(-2 * lockStaleAfter).Format(time.RFC3339)})
+	assert.ErrorIs(t, lock.Acquire(0), ErrAlreadyRunning)
+}
@@ -10,26 +10,62 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strings"
 	"time"
 
 	"extract-email-attachments/internal/config"
 
 	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
 )
 
+// storedToken is the token cached in token.json, with the scopes it was
+// granted. The tokens cached before the scopes were stored have the
+// gmail.readonly scope.
+type storedToken struct {
+	oauth2.Token
+	Scopes []string `json:"scopes,omitempty"`
+}
+
 // getOAuth2Client retrieves a token, saves the token, then returns the generated client.
-func getOAuth2Client(oauth2Config *oauth2.Config) *http.Client {
+// The consent is asked again when the scopes of the configuration changed,
+// such as when the gmail.modify setting is turned on.
+func getOAuth2Client(ctx context.Context, oauth2Config *oauth2.Config) *http.Client {
 	tokenFilePath := filepath.Join(config.AppCacheDir, "token.json")
 	token, err := tokenFromFile(tokenFilePath)
+	if err == nil && !sameScopes(token.Scopes, oauth2Config.Scopes) {
+		fmt.Printf("The Gmail permissions changed from %s to %s, please authorize the application again.\n",
+			strings.Join(token.Scopes, " "), strings.Join(oauth2Config.Scopes, " "))
+		err = fmt.Errorf("token scopes changed")
+	}
 	if err != nil {
-		token = getTokenFromWeb(oauth2Config)
+		tok := getTokenFromWeb(ctx, oauth2Config)
+		token = &storedToken{Token: *tok, Scopes: grantedScopes(tok, oauth2Config.Scopes)}
 		saveToken(tokenFilePath, token)
 	}
-	return oauth2Config.Client(context.Background(), token)
+	return oauth2Config.Client(ctx, &token.Token)
+}
+
+// grantedScopes returns the scopes granted with a new token, which may be
+// fewer than the requested ones when the user unchecks some of them
+func grantedScopes(tok *oauth2.Token, requested []string) []string {
+	if scope, ok := tok.Extra("scope").(string); ok && scope != "" {
+		return strings.Fields(scope)
+	}
+	return requested
+}
+
+// sameScopes reports whether the scopes of a stored token are the requested ones
+func sameScopes(stored, requested []string) bool {
+	if len(stored) == 0 {
+		stored = []string{gmail.GmailReadonlyScope}
+	}
+	return slices.Equal(slices.Sorted(slices.Values(stored)), slices.Sorted(slices.Values(requested)))
 }
 
 // getTokenFromWeb requests a token from the web using a local server with a custom redirect URI.
-func getTokenFromWeb(oauth2Config *oauth2.Config) *oauth2.Token {
+func getTokenFromWeb(ctx context.Context, oauth2Config *oauth2.Config) *oauth2.Token {
 	ch := make(chan string)
 	randState := fmt.Sprintf("st%d", time.Now().UnixNano())
 
@@ -38,7 +74,7 @@ func getTokenFromWeb(oauth2Config *oauth2.Config) *oauth2.Token {
 	challenge := oauth2.S256ChallengeOption(verifier)
 
 	// Create a context that we can cancel
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	// Create a channel to signal server shutdown
@@ -116,6 +152,8 @@ func getTokenFromWeb(oauth2Config *oauth2.Config) *oauth2.Token {
 	case code = <-ch:
 	case <-time.After(5 * time.Minute):
 		log.Fatal("Timeout waiting for authorization code")
+	case <-ctx.Done():
+		log.Fatalf("Interrupted while waiting for authorization code: %v", ctx.Err())
 	}
 
 	tok, err := oauth2Config.Exchange(ctx, code, oauth2.VerifierOption(verifier))
@@ -126,19 +164,19 @@ func getTokenFromWeb(oauth2Config *oauth2.Config) *oauth2.Token {
 }
 
 // tokenFromFile retrieves a token from a local file.
-func tokenFromFile(file string) (*oauth2.Token, error) {
+func tokenFromFile(file string) (*storedToken, error) {
 	f, err := os.Open(file)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	tok := &oauth2.Token{}
+	tok := &storedToken{}
 	err = json.NewDecoder(f).Decode(tok)
 	return tok, err
 }
 
 // saveToken saves a token to a file path.
-func saveToken(path string, token *oauth2.Token) {
+func saveToken(path string, token *storedToken) {
 	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		log.Fatalf("Unable to cache oauth token: %v", err)
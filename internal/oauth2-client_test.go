@@ -0,0 +1,16 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestSameScopes(t *testing.T) {
+	// Un token enregistré sans ses autorisations est en lecture seule
+	assert.True(t, sameScopes(nil, []string{gmail.GmailReadonlyScope}))
+	assert.False(t, sameScopes(nil, []string{gmail.GmailModifyScope}))
+	assert.True(t, sameScopes([]string{gmail.GmailModifyScope}, []string{gmail.GmailModifyScope}))
+	assert.False(t, sameScopes([]string{gmail.GmailModifyScope}, []string{gmail.GmailReadonlyScope}))
+}
@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"extract-email-attachments/internal/config"
+)
+
+// ocrMinTextLength is the number of letters and digits below which a PDF is
+// considered to have no text layer: scans often carry a page number or a stamp.
+const ocrMinTextLength = 20
+
+// toolDirs are searched for the OCR tools when they are not in the PATH,
+// which is minimal when the application is run by cron or launchd
+var toolDirs = []string{"/opt/homebrew/bin", "/usr/local/bin"}
+
+// ocrEngine recognizes the text of scanned PDFs: the pages are rendered to
+// images by pdftoppm, then recognized by tesseract. The recognized text is
+// cached by the SHA-256 hash of the document, so a file is never recognized twice.
+type ocrEngine struct {
+	tesseract string
+	pdftoppm  string
+	settings  config.OCRSettings
+}
+
+// newOCREngine returns an error if tesseract or pdftoppm is not installed.
+func newOCREngine(settings config.OCRSettings) (*ocrEngine, error) {
+	tesseract, err := findTool(settings.TesseractPath, "tesseract")
+	if err != nil {
+		return nil, err
+	}
+	pdftoppm, err := findTool(settings.PdftoppmPath, "pdftoppm")
+	if err != nil {
+		return nil, err
+	}
+	return &ocrEngine{tesseract: tesseract, pdftoppm: pdftoppm, settings: settings}, nil
+}
+
+// findTool returns path if set, or looks for the command in the PATH and in toolDirs.
+func findTool(path, name string) (string, error) {
+	if path != "" {
+		return exec.LookPath(path)
+	}
+	if found, err := exec.LookPath(name); err == nil {
+		return found, nil
+	}
+	for _, dir := range toolDirs {
+		if found, err := exec.LookPath(filepath.Join(dir, name)); err == nil {
+			return found, nil
+		}
+	}
+	return "", fmt.Errorf("%s is not installed", name)
+}
+
+// hasTextLayer reports whether the text extracted from a PDF is meaningful
+func hasTextLayer(text string) bool {
+	n := 0
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			n++
+			if n >= ocrMinTextLength {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Recognize returns the text of a PDF document, pages being separated by
+// form feeds like pdf.ExtractText. hash is the SHA-256 hash of data, computed
+// if empty. The text is cached unless readOnly.
+func (o *ocrEngine) Recognize(ctx context.Context, data []byte, hash string, readOnly bool) (string, error) {
+	if hash == "" {
+		sum := sha256.Sum256(data)
+		hash = hex.EncodeToString(sum[:])
+	}
+	cachePath := filepath.Join(config.AppCacheDir, "ocr", hash+".txt")
+	if text, err := os.ReadFile(cachePath); err == nil {
+		return string(text), nil
+	}
+
+	text, err := o.recognize(ctx, data)
+	if err != nil || readOnly {
+		return text, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cachePath), defaultDirPerm); err != nil {
+		return "", fmt.Errorf("error creating OCR cache directory: %v", err)
+	}
+	if err := writeFileAtomic(cachePath, []byte(text), defaultFilePerm); err != nil {
+		return "", fmt.Errorf("error writing OCR cache: %v", err)
+	}
+	return text, nil
+}
+
+func (o *ocrEngine) recognize(ctx context.Context, data []byte) (string, error) {
+	tempDir, err := os.MkdirTemp("", "ocr-")
+	if err != nil {
+		return "", fmt.Errorf("error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	input := filepath.Join(tempDir, "document.pdf")
+	if err := os.WriteFile(input, data, 0600); err != nil {
+		return "", fmt.Errorf("error writing temporary file: %v", err)
+	}
+
+	// Render the first pages to grayscale images: page-1.png, page-2.png...
+	prefix := filepath.Join(tempDir, "page")
+	if _, err := runTool(ctx, o.pdftoppm,
+		"-r", strconv.Itoa(o.settings.DPI), "-gray", "-png",
+		"-f", "1", "-l", strconv.Itoa(o.settings.MaxPages),
+		input, prefix); err != nil {
+		return "", err
+	}
+
+	images, err := filepath.Glob(prefix + "-*.png")
+	if err != nil {
+		return "", err
+	}
+	if len(images) == 0 {
+		return "", fmt.Errorf("pdftoppm rendered no pages")
+	}
+	// The page numbers are zero-padded to the same width
+	sort.Strings(images)
+
+	pages := make([]string, 0, len(images))
+	for _, image := range images {
+		text, err := runTool(ctx, o.tesseract, image, "stdout", "-l", o.settings.Languages)
+		if err != nil {
+			return "", err
+		}
+		pages = append(pages, strings.TrimSpace(text))
+	}
+	return strings.Join(pages, "\f"), nil
+}
+
+// runTool runs a command and returns its standard output
+func runTool(ctx context.Context, name string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return "", fmt.Errorf("%s failed: %v: %s", filepath.Base(name), err, strings.TrimSpace(stderr.String()))
+		}
+		return "", fmt.Errorf("error running %s: %v", filepath.Base(name), err)
+	}
+	return string(out), nil
+}
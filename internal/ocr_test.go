@@ -0,0 +1,105 @@
+//go:build !windows
+
+package internal
+
+import (
+	"context"
+	"extract-email-attachments/internal/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeOCRTools installs scripts imitating pdftoppm and tesseract in dir.
+// tesseract records its arguments in calls.log.
+func fakeOCRTools(t *testing.T, dir string) config.OCRSettings {
+	pdftoppm := `#!/bin/sh
+for arg; do prefix=$arg; done
+printf 'image 1' > "$prefix-1.png"
+printf 'image 2' > "$prefix-2.png"
+`
+	tesseract := `#!/bin/sh
+echo "$@" >> "` + filepath.Join(dir, "calls.log") + `"
+case "$1" in
+*-1.png) printf 'ACME Fournitures SAS\nFacture N° SCAN-2026-7\nDate : 02/01/2026\n' ;;
+*) printf 'Total TTC 10,00 €\n' ;;
+esac
+`
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "pdftoppm"), []byte(pdftoppm), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "tesseract"), []byte(tesseract), 0755))
+
+	settings := config.DefaultSettings().OCR
+	settings.TesseractPath = filepath.Join(dir, "tesseract")
+	settings.PdftoppmPath = filepath.Join(dir, "pdftoppm")
+	return settings
+}
+
+func TestDocumentReaderOCR(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "ocr-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	originalCacheDir := config.AppCacheDir
+	config.AppCacheDir = tempDir
+	defer func() {
+		config.AppCacheDir = originalCacheDir
+	}()
+
+	ocr, err := newOCREngine(fakeOCRTools(t, tempDir))
+	assert.NoError(t, err)
+	reader := &documentReader{ocr: ocr}
+	callsPath := filepath.Join(tempDir, "calls.log")
+
+	// En simulation, le texte reconnu n'est pas mis en cache
+	attachment := AttachmentData{Filename: "scan.pdf", Sha256Hash: "0123abcd"}
+	doc := (&documentReader{ocr: ocr, readOnly: true}).read(context.Background(), "testdata/scan.pdf", attachment, EmailData{})
+	assert.Equal(t, "SCAN-2026-7", doc.Invoice.Number)
+	assert.NoFileExists(t, filepath.Join(tempDir, "ocr", "0123abcd.txt"))
+	assert.NoError(t, os.Remove(callsPath))
+
+	// Un document scanné, sans couche texte, est reconnu page par page
+	doc = reader.read(context.Background(), "testdata/scan.pdf", attachment, EmailData{})
+	assert.Equal(t, "ACME Fournitures SAS\nFacture N° SCAN-2026-7\nDate : 02/01/2026\fTotal TTC 10,00 €", doc.Text)
+	assert.Equal(t, InvoiceFields{
+		Number:    "SCAN-2026-7",
+		IssueDate: "2026-01-02",
+		Total:     "10.00",
+		Currency:  "EUR",
+		Source:    FieldSourceOCR,
+	}, doc.Invoice)
+
+	calls, err := os.ReadFile(callsPath)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(calls)), "\n")
+	assert.Len(t, lines, 2)
+	assert.True(t, strings.HasSuffix(lines[0], "stdout -l fra+eng"), lines[0])
+	assert.FileExists(t, filepath.Join(tempDir, "ocr", "0123abcd.txt"))
+
+	// Le même fichier n'est jamais reconnu deux fois
+	doc = reader.read(context.Background(), "testdata/scan.pdf", attachment, EmailData{})
+	assert.Equal(t, "SCAN-2026-7", doc.Invoice.Number)
+	calls, err = os.ReadFile(callsPath)
+	assert.NoError(t, err)
+	assert.Len(t, strings.Split(strings.TrimSpace(string(calls)), "\n"), 2)
+
+	// Un document avec une couche texte n'est pas reconnu
+	doc = reader.read(context.Background(), "testdata/invoice.pdf", AttachmentData{Filename: "invoice.pdf"}, EmailData{})
+	assert.Equal(t, FieldSourceText, doc.Invoice.Source)
+	calls, err = os.ReadFile(callsPath)
+	assert.NoError(t, err)
+	assert.Len(t, strings.Split(strings.TrimSpace(string(calls)), "\n"), 2)
+
+	// Sans OCR, un document scanné n'a pas de champs
+	doc = (&documentReader{}).read(context.Background(), "testdata/scan.pdf", attachment, EmailData{})
+	assert.True(t, doc.Invoice.IsEmpty())
+}
+
+func TestNewOCREngineMissingTools(t *testing.T) {
+	settings := config.DefaultSettings().OCR
+	settings.TesseractPath = filepath.Join(t.TempDir(), "tesseract")
+	_, err := newOCREngine(settings)
+	assert.Error(t, err)
+}
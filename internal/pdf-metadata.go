@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"extract-email-attachments/internal/pdf"
+)
+
+// documentMetadata returns the metadata written into a PDF renamed by a
+// rule: its new name as title, the vendor as author, and the invoice number,
+// period, email and original filename, so that desktop search finds it.
+func documentMetadata(doc *Document, rule *Rule, path string) (pdf.Metadata, error) {
+	data, err := rule.filenameData(doc)
+	if err != nil {
+		return pdf.Metadata{}, err
+	}
+	vendor := rule.vendor(doc)
+	period := data.Year + "-" + data.Month
+
+	subject := "Invoice"
+	if doc.Invoice.Number != "" {
+		subject += " " + doc.Invoice.Number
+	}
+	if vendor != "" {
+		subject += " from " + vendor
+	}
+	subject += ", " + period
+
+	var keywords []string
+	for _, keyword := range []string{
+		vendor,
+		doc.Invoice.Number,
+		period,
+		"email:" + doc.Email.ID,
+		"original:" + doc.Attachment.Filename,
+	} {
+		if keyword != "" && !strings.HasSuffix(keyword, ":") {
+			keywords = append(keywords, keyword)
+		}
+	}
+
+	return pdf.Metadata{
+		Title:    strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)),
+		Author:   vendor,
+		Subject:  subject,
+		Keywords: keywords,
+	}, nil
+}
+
+// writePDFMetadata writes the metadata of the document renamed by rule into
+// the PDF at path, with an incremental update that keeps the page content.
+func writePDFMetadata(doc *Document, rule *Rule, path string) error {
+	if doc.pdf == nil || doc.Encrypted {
+		return fmt.Errorf("not a readable unencrypted PDF document")
+	}
+	metadata, err := documentMetadata(doc, rule, path)
+	if err != nil {
+		return err
+	}
+	data, err := doc.pdf.UpdateMetadata(metadata)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, defaultFilePerm)
+}
@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"extract-email-attachments/internal/config"
+)
+
+// PasswordEntry gives the passwords of the encrypted PDFs sent by a sender,
+// or of the documents renamed by a rule.
+type PasswordEntry struct {
+	SenderEmail string   `json:"senderEmail,omitempty"` // address, or domain such as "@banque.fr"
+	Rule        string   `json:"rule,omitempty"`        // name of a rule of rules.json
+	Passwords   []string `json:"passwords,omitempty"`
+	// Keychain is the service of a generic password of the macOS keychain,
+	// so that the password is not stored in clear text
+	Keychain string `json:"keychain,omitempty"`
+	// Env is an environment variable holding the password
+	Env string `json:"env,omitempty"`
+}
+
+// PasswordList is the list of the passwords of encrypted PDFs, read from
+// passwords.json in the configuration directory.
+type PasswordList struct {
+	Entries []PasswordEntry `json:"passwords"`
+
+	// secrets caches the passwords read from the keychain during a run
+	secrets map[string]string
+}
+
+// keychainPassword reads a generic password of the macOS keychain
+var keychainPassword = func(ctx context.Context, service string) (string, error) {
+	out, err := exec.CommandContext(ctx, "security", "find-generic-password", "-s", service, "-w").Output()
+	if err != nil {
+		return "", fmt.Errorf("error reading keychain password %s: %w", service, err)
+	}
+	return strings.TrimRight(string(out), "\n"), nil
+}
+
+// LoadPasswords reads passwords.json from the configuration directory, or
+// returns an empty list if the file does not exist. The file must only be
+// readable by its owner.
+func LoadPasswords() (*PasswordList, error) {
+	path := filepath.Join(config.AppConfigDir, "passwords.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &PasswordList{}, nil
+		}
+		return nil, fmt.Errorf("error reading passwords: %w", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading passwords: %w", err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%w: %s must only be readable by its owner (chmod 600)", ErrInvalidConfig, path)
+	}
+
+	var passwords PasswordList
+	if err := json.Unmarshal(data, &passwords); err != nil {
+		return nil, fmt.Errorf("error decoding passwords: %w", err)
+	}
+	for i, entry := range passwords.Entries {
+		if entry.SenderEmail == "" && entry.Rule == "" {
+			return nil, fmt.Errorf("%w: password %d has neither senderEmail nor rule", ErrInvalidConfig, i+1)
+		}
+		if len(entry.Passwords) == 0 && entry.Keychain == "" && entry.Env == "" {
+			return nil, fmt.Errorf("%w: password %d has no passwords, keychain or env", ErrInvalidConfig, i+1)
+		}
+	}
+	return &passwords, nil
+}
+
+// Candidates returns the passwords to try on an encrypted document: those
+// of its sender first, then those of the rules matching its email.
+func (pl *PasswordList) Candidates(ctx context.Context, doc *Document, rules *RuleSet) []string {
+	var senders, byRule []PasswordEntry
+	for _, entry := range pl.Entries {
+		if entry.SenderEmail != "" && matchSenderEmail(doc.Email.SenderEmail, entry.SenderEmail) {
+			senders = append(senders, entry)
+		} else if entry.Rule != "" && rules != nil && rules.matchesEmail(entry.Rule, doc) {
+			byRule = append(byRule, entry)
+		}
+	}
+
+	var candidates []string
+	for _, entry := range append(senders, byRule...) {
+		for _, password := range pl.passwords(ctx, entry) {
+			if !slices.Contains(candidates, password) {
+				candidates = append(candidates, password)
+			}
+		}
+	}
+	return candidates
+}
+
+// passwords returns the passwords of an entry, reading its secrets.
+func (pl *PasswordList) passwords(ctx context.Context, entry PasswordEntry) []string {
+	passwords := slices.Clone(entry.Passwords)
+	if entry.Env != "" {
+		if password := os.Getenv(entry.Env); password != "" {
+			passwords = append(passwords, password)
+		} else {
+			log.Printf("Warning: Environment variable %s of PDF password is not set", entry.Env)
+		}
+	}
+	if entry.Keychain != "" {
+		password, ok := pl.secrets[entry.Keychain]
+		if !ok {
+			var err error
+			password, err = keychainPassword(ctx, entry.Keychain)
+			if err != nil {
+				log.Printf("Warning: %v", err)
+			}
+			if pl.secrets == nil {
+				pl.secrets = map[string]string{}
+			}
+			pl.secrets[entry.Keychain] = password
+		}
+		if password != "" {
+			passwords = append(passwords, password)
+		}
+	}
+	return passwords
+}
+
+// matchesEmail reports whether the named rule matches the email of the
+// document, ignoring its conditions on the content, which is not readable yet.
+func (rs *RuleSet) matchesEmail(name string, doc *Document) bool {
+	for _, rule := range rs.Rules {
+		if rule.Name != name {
+			continue
+		}
+		m := rule.Match
+		emailOnly := &Rule{Match: RuleMatch{SenderName: m.SenderName, SenderEmail: m.SenderEmail, SubjectContains: m.SubjectContains}}
+		if emailOnly.Match == (RuleMatch{}) {
+			return false
+		}
+		return emailOnly.Matches(doc)
+	}
+	return false
+}
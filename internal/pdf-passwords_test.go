@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"extract-email-attachments/internal/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadPasswords(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "passwords-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	originalConfigDir := config.AppConfigDir
+	config.AppConfigDir = tempDir
+	defer func() { config.AppConfigDir = originalConfigDir }()
+	path := filepath.Join(tempDir, "passwords.json")
+
+	// Fichier absent
+	passwords, err := LoadPasswords()
+	assert.NoError(t, err)
+	assert.Empty(t, passwords.Entries)
+
+	// Fichier lisible par les autres utilisateurs
+	content := `{"passwords": [{"senderEmail": "@banque.fr", "passwords": ["0042137"]}]}`
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	_, err = LoadPasswords()
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+
+	assert.NoError(t, os.Chmod(path, 0600))
+	passwords, err = LoadPasswords()
+	assert.NoError(t, err)
+	assert.Equal(t, []PasswordEntry{{SenderEmail: "@banque.fr", Passwords: []string{"0042137"}}}, passwords.Entries)
+
+	// Entrées incomplètes
+	for _, content := range []string{
+		`{"passwords": [{"passwords": ["0042137"]}]}`,
+		`{"passwords": [{"rule": "Banque"}]}`,
+	} {
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		_, err = LoadPasswords()
+		assert.ErrorIs(t, err, ErrInvalidConfig, content)
+	}
+}
+
+func TestPasswordCandidates(t *testing.T) {
+	keychainCalls := 0
+	originalKeychainPassword := keychainPassword
+	keychainPassword = func(ctx context.Context, service string) (string, error) {
+		keychainCalls++
+		if service == "absent" {
+			return "", errors.New("not found")
+		}
+		return "secret-" + service, nil
+	}
+	defer func() { keychainPassword = originalKeychainPassword }()
+	t.Setenv("PDF_PASSWORD_TEST", "depuis-env")
+
+	rules := &RuleSet{Rules: []*Rule{
+		{Name: "Opérateur", Match: RuleMatch{SenderName: "Télécom", TextContains: "facture"}, Filename: "telecom.pdf"},
+		{Name: "Contenu", Match: RuleMatch{TextContains: "relevé"}, Filename: "releve.pdf"},
+	}}
+	assert.NoError(t, rules.compile())
+
+	passwords := &PasswordList{Entries: []PasswordEntry{
+		{Rule: "Opérateur", Passwords: []string{"ligne-1"}},
+		{Rule: "Contenu", Passwords: []string{"jamais"}},
+		{SenderEmail: "@banque.fr", Passwords: []string{"0042137"}, Keychain: "banque"},
+		{SenderEmail: "releves@banque.fr", Passwords: []string{"0042137", "ancien"}, Env: "PDF_PASSWORD_TEST"},
+		{SenderEmail: "@autre.fr", Keychain: "absent"},
+	}}
+
+	// Les mots de passe de l'expéditeur d'abord, puis ceux des règles
+	doc := &Document{Email: EmailData{SenderName: "Télécom", SenderEmail: "releves@BANQUE.fr"}}
+	expected := []string{"0042137", "secret-banque", "ancien", "depuis-env", "ligne-1"}
+	assert.Equal(t, expected, passwords.Candidates(context.Background(), doc, rules))
+	assert.Equal(t, expected, passwords.Candidates(context.Background(), doc, rules))
+	assert.Equal(t, 1, keychainCalls)
+
+	doc = &Document{Email: EmailData{SenderEmail: "factures@autre.fr"}}
+	assert.Empty(t, passwords.Candidates(context.Background(), doc, rules))
+}
+
+func TestDocumentReaderEncrypted(t *testing.T) {
+	email := EmailData{SenderName: "Ma Banque", SenderEmail: "releves@banque.fr"}
+	attachment := AttachmentData{Filename: "releve.pdf"}
+
+	// Aucun mot de passe ne convient
+	reader := newDocumentReader(DefaultRules(), &PasswordList{Entries: []PasswordEntry{
+		{SenderEmail: "@banque.fr", Passwords: []string{"1234567"}},
+	}}, nil)
+	doc := reader.read(context.Background(), "testdata/encrypted.pdf", attachment, email)
+	assert.True(t, doc.Encrypted)
+	assert.True(t, doc.Locked)
+	assert.Empty(t, doc.Text)
+
+	reader = newDocumentReader(DefaultRules(), &PasswordList{Entries: []PasswordEntry{
+		{SenderEmail: "@banque.fr", Passwords: []string{"1234567", "0042137"}},
+	}}, nil)
+	doc = reader.read(context.Background(), "testdata/encrypted.pdf", attachment, email)
+	assert.True(t, doc.Encrypted)
+	assert.False(t, doc.Locked)
+	assert.Equal(t, "Relevé de compte", doc.Text)
+
+	// Copie déchiffrée, conservée si elle existe déjà
+	tempDir, err := os.MkdirTemp("", "decrypted-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+	path := filepath.Join(tempDir, "releve.pdf")
+	copyPath, err := writeDecryptedCopy(doc, path)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(tempDir, "releve-decrypted.pdf"), copyPath)
+	copyDoc := (&documentReader{}).read(context.Background(), filepath.Join(tempDir, "releve-decrypted.pdf"), attachment, email)
+	assert.False(t, copyDoc.Encrypted)
+	assert.Equal(t, "Relevé de compte", copyDoc.Text)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(tempDir, "releve-decrypted.pdf"), []byte("copie"), 0644))
+	copyPath, err = writeDecryptedCopy(doc, path)
+	assert.NoError(t, err)
+	assert.Empty(t, copyPath)
+	data, err := os.ReadFile(filepath.Join(tempDir, "releve-decrypted.pdf"))
+	assert.NoError(t, err)
+	assert.Equal(t, "copie", string(data))
+}
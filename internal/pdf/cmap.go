@@ -0,0 +1,237 @@
+package pdf
+
+import (
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// cmap is a character map, read from a ToUnicode stream or from the
+// encoding of a composite font. It splits strings into character codes
+// and maps codes to text or to CIDs.
+type cmap struct {
+	codespace []codespaceRange
+	text      map[int]string
+	textRange []textRange
+	cid       map[int]int
+	cidRange  []cidRange
+}
+
+type codespaceRange struct {
+	lo, hi []byte
+}
+
+// textRange maps the codes from lo to hi to consecutive characters starting
+// at text, or to the elements of texts.
+type textRange struct {
+	lo, hi int
+	text   string
+	texts  []string
+}
+
+type cidRange struct {
+	lo, hi, cid int
+}
+
+// code is a character code, read from n bytes.
+type code struct {
+	value int
+	n     int
+}
+
+// parseCMap reads the parts of a CMap used for text extraction.
+func parseCMap(data []byte) *cmap {
+	m := &cmap{text: map[int]string{}, cid: map[int]int{}}
+	l := newLexer(data, 0)
+	var operands []Object
+	for {
+		obj, err := l.object()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			operands = operands[:0]
+			continue
+		}
+		op, ok := obj.(keyword)
+		if !ok {
+			operands = append(operands, obj)
+			continue
+		}
+
+		switch op {
+		case "endcodespacerange":
+			for i := 0; i+1 < len(operands); i += 2 {
+				lo, ok1 := operands[i].(String)
+				hi, ok2 := operands[i+1].(String)
+				if ok1 && ok2 && len(lo) == len(hi) && len(lo) > 0 {
+					m.codespace = append(m.codespace, codespaceRange{lo: []byte(lo), hi: []byte(hi)})
+				}
+			}
+		case "endbfchar":
+			for i := 0; i+1 < len(operands); i += 2 {
+				src, ok := operands[i].(String)
+				if !ok {
+					continue
+				}
+				switch dst := operands[i+1].(type) {
+				case String:
+					m.text[codeValue(src)] = utf16Text(dst)
+				case Name:
+					if text, ok := glyphText(string(dst)); ok {
+						m.text[codeValue(src)] = text
+					}
+				}
+			}
+		case "endbfrange":
+			for i := 0; i+2 < len(operands); i += 3 {
+				lo, ok1 := operands[i].(String)
+				hi, ok2 := operands[i+1].(String)
+				if !ok1 || !ok2 {
+					continue
+				}
+				r := textRange{lo: codeValue(lo), hi: codeValue(hi)}
+				switch dst := operands[i+2].(type) {
+				case String:
+					r.text = utf16Text(dst)
+				case Array:
+					for _, t := range dst {
+						s, _ := t.(String)
+						r.texts = append(r.texts, utf16Text(s))
+					}
+				}
+				if r.hi >= r.lo {
+					m.textRange = append(m.textRange, r)
+				}
+			}
+		case "endcidchar":
+			for i := 0; i+1 < len(operands); i += 2 {
+				src, ok1 := operands[i].(String)
+				cid, ok2 := integer(operands[i+1])
+				if ok1 && ok2 {
+					m.cid[codeValue(src)] = cid
+				}
+			}
+		case "endcidrange":
+			for i := 0; i+2 < len(operands); i += 3 {
+				lo, ok1 := operands[i].(String)
+				hi, ok2 := operands[i+1].(String)
+				cid, ok3 := integer(operands[i+2])
+				if ok1 && ok2 && ok3 {
+					m.cidRange = append(m.cidRange, cidRange{lo: codeValue(lo), hi: codeValue(hi), cid: cid})
+				}
+			}
+		}
+		operands = operands[:0]
+	}
+	return m
+}
+
+func codeValue(s String) int {
+	v := 0
+	for i := 0; i < len(s) && i < 4; i++ {
+		v = v<<8 | int(s[i])
+	}
+	return v
+}
+
+func utf16Units(s String) []uint16 {
+	units := make([]uint16, 0, len(s)/2)
+	for i := 0; i+1 < len(s); i += 2 {
+		units = append(units, uint16(s[i])<<8|uint16(s[i+1]))
+	}
+	if len(s)%2 == 1 {
+		units = append(units, uint16(s[len(s)-1]))
+	}
+	return units
+}
+
+func utf16Text(s String) string {
+	return string(utf16.Decode(utf16Units(s)))
+}
+
+// codes splits a string into character codes, following the code space
+// ranges. Bytes outside of the ranges are read as one-byte codes.
+func (m *cmap) codes(s String) []code {
+	var codes []code
+	for i := 0; i < len(s); {
+		n := m.codeLength(s[i:])
+		v := 0
+		for _, c := range []byte(s[i : i+n]) {
+			v = v<<8 | int(c)
+		}
+		codes = append(codes, code{value: v, n: n})
+		i += n
+	}
+	return codes
+}
+
+func (m *cmap) codeLength(s String) int {
+	for n := 1; n <= 4 && n <= len(s); n++ {
+		for _, r := range m.codespace {
+			if len(r.lo) != n {
+				continue
+			}
+			inside := true
+			for i := 0; i < n; i++ {
+				if s[i] < r.lo[i] || s[i] > r.hi[i] {
+					inside = false
+					break
+				}
+			}
+			if inside {
+				return n
+			}
+		}
+	}
+	return 1
+}
+
+// lookupText returns the text of a character code.
+func (m *cmap) lookupText(c int) (string, bool) {
+	if text, ok := m.text[c]; ok {
+		return text, true
+	}
+	for _, r := range m.textRange {
+		if c < r.lo || c > r.hi {
+			continue
+		}
+		if r.texts != nil {
+			if i := c - r.lo; i < len(r.texts) {
+				return r.texts[i], true
+			}
+			return "", false
+		}
+		if r.text == "" {
+			return "", false
+		}
+		// The last character is incremented
+		text := []rune(r.text)
+		text[len(text)-1] += rune(c - r.lo)
+		return string(text), true
+	}
+	return "", false
+}
+
+// lookupCID returns the CID of a character code.
+func (m *cmap) lookupCID(c int) int {
+	if cid, ok := m.cid[c]; ok {
+		return cid
+	}
+	for _, r := range m.cidRange {
+		if c >= r.lo && c <= r.hi {
+			return r.cid + c - r.lo
+		}
+	}
+	return c
+}
+
+// cleanText removes the control characters that some fonts map glyphs to.
+func cleanText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0xfffd || (r >= 0x7f && r < 0xa0) {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,137 @@
+package pdf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxNameTreeDepth limits the depth of the name trees
+const maxNameTreeDepth = 32
+
+// EmbeddedFile is a file attached to a PDF document, such as the XML
+// invoice of a Factur-X or ZUGFeRD document.
+type EmbeddedFile struct {
+	Name string
+	// MIMEType is the subtype of the file, such as "text/xml", if given
+	MIMEType string
+	// Relationship is the relationship of an associated file with the
+	// document, such as "Data" or "Alternative", if given (PDF/A-3)
+	Relationship string
+	Data         []byte
+}
+
+// ExtractEmbeddedFiles returns the files embedded in the PDF document held in data.
+func ExtractEmbeddedFiles(data []byte) ([]EmbeddedFile, error) {
+	doc, err := Open(data)
+	if err != nil {
+		return nil, err
+	}
+	return doc.EmbeddedFiles()
+}
+
+// EmbeddedFiles returns the files embedded in the document: those of the
+// EmbeddedFiles name tree and the associated files of the catalog. A file
+// whose content cannot be decoded is skipped.
+func (d *Document) EmbeddedFiles() (files []EmbeddedFile, err error) {
+	// Malformed files must not crash the caller
+	defer func() {
+		if r := recover(); r != nil {
+			files, err = nil, fmt.Errorf("malformed PDF document: %v", r)
+		}
+	}()
+
+	var specs []Object
+	catalog := d.catalog()
+	if names, ok := d.Resolve(catalog["Names"]).(Dict); ok {
+		specs = d.nameTreeValues(names["EmbeddedFiles"], map[Ref]bool{}, 0)
+	}
+	if af, ok := d.Resolve(catalog["AF"]).(Array); ok {
+		specs = append(specs, af...)
+	}
+
+	// The same file is usually listed both in the name tree and as an
+	// associated file
+	seen := map[Object]bool{}
+	for _, spec := range specs {
+		dict, ok := d.Resolve(spec).(Dict)
+		if !ok {
+			continue
+		}
+		ef, ok := d.Resolve(dict["EF"]).(Dict)
+		if !ok {
+			continue
+		}
+		ref := ef["UF"]
+		if ref == nil {
+			ref = ef["F"]
+		}
+		if r, isRef := ref.(Ref); isRef {
+			if seen[r] {
+				continue
+			}
+			seen[r] = true
+		}
+		stream, ok := d.Resolve(ref).(*Stream)
+		if !ok {
+			continue
+		}
+		data, err := d.Decode(stream)
+		if err != nil {
+			continue
+		}
+
+		file := EmbeddedFile{Name: d.fileSpecName(dict), Data: data}
+		if subtype, ok := d.Resolve(stream.Dict["Subtype"]).(Name); ok {
+			file.MIMEType = string(subtype)
+		}
+		if relationship, ok := d.Resolve(dict["AFRelationship"]).(Name); ok {
+			file.Relationship = string(relationship)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// nameTreeValues returns the values of a name tree, in key order.
+func (d *Document) nameTreeValues(node Object, visited map[Ref]bool, depth int) []Object {
+	if ref, ok := node.(Ref); ok {
+		if visited[ref] {
+			return nil
+		}
+		visited[ref] = true
+	}
+	dict, ok := d.Resolve(node).(Dict)
+	if !ok || depth > maxNameTreeDepth {
+		return nil
+	}
+
+	var values []Object
+	if names, ok := d.Resolve(dict["Names"]).(Array); ok {
+		// Keys and values alternate
+		for i := 1; i < len(names); i += 2 {
+			values = append(values, names[i])
+		}
+	}
+	if kids, ok := d.Resolve(dict["Kids"]).(Array); ok {
+		for _, kid := range kids {
+			values = append(values, d.nameTreeValues(kid, visited, depth+1)...)
+		}
+	}
+	return values
+}
+
+// fileSpecName returns the name of a file specification, preferring the
+// Unicode name. Only the last component of the path is kept.
+func (d *Document) fileSpecName(spec Dict) string {
+	var name string
+	for _, key := range []Name{"UF", "F"} {
+		if s, ok := d.Resolve(spec[key]).(String); ok && s != "" {
+			name = s.Text()
+			break
+		}
+	}
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
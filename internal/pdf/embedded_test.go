@@ -0,0 +1,50 @@
+package pdf
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmbeddedFiles(t *testing.T) {
+	xml := []byte(`<?xml version="1.0" encoding="UTF-8"?><rsm:CrossIndustryInvoice/>`)
+
+	for _, compressed := range []bool{false, true} {
+		p := &testPDF{}
+		page := p.page("<< >>", "", false)
+		file := p.stream("/Type /EmbeddedFile /Subtype /text#2Fxml", xml, true)
+		spec := p.add(fmt.Sprintf("<< /Type /Filespec /F (factur-x.xml) /UF <FEFF006600610063007400750072002D0078002E0078006D006C> /EF << /F %d 0 R /UF %d 0 R >> /AFRelationship /Data >>", file, file))
+		other := p.stream("/Type /EmbeddedFile", []byte("notes"), false)
+		otherSpec := p.add(fmt.Sprintf("<< /Type /Filespec /F (C:\\\\docs\\\\notes.txt) /EF << /F %d 0 R >> >>", other))
+		// Arbre de noms avec un nœud intermédiaire
+		leaf := p.add(fmt.Sprintf("<< /Limits [(factur-x.xml) (notes.txt)] /Names [(factur-x.xml) %d 0 R (notes.txt) %d 0 R] >>", spec, otherSpec))
+		names := p.add(fmt.Sprintf("<< /EmbeddedFiles << /Kids [%d 0 R] >> >>", leaf))
+		root := p.catalog(page)
+		p.objects[root-1] = fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R /Names %d 0 R /AF [%d 0 R] >>", root-1, names, spec)
+
+		data := p.bytes(root, "")
+		if compressed {
+			data = p.compressedBytes(root)
+		}
+		files, err := ExtractEmbeddedFiles(data)
+		assert.NoError(t, err)
+		if assert.Len(t, files, 2) {
+			assert.Equal(t, EmbeddedFile{Name: "factur-x.xml", MIMEType: "text/xml", Relationship: "Data", Data: xml}, files[0])
+			assert.Equal(t, EmbeddedFile{Name: "notes.txt", Data: []byte("notes")}, files[1])
+		}
+	}
+
+	// Document sans fichier joint
+	p := &testPDF{}
+	root := p.catalog(p.page("<< >>", "", false))
+	files, err := ExtractEmbeddedFiles(p.bytes(root, ""))
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestStringText(t *testing.T) {
+	assert.Equal(t, "facture-é.xml", String("\xfe\xff\x00f\x00a\x00c\x00t\x00u\x00r\x00e\x00-\x00\xe9\x00.\x00x\x00m\x00l").Text())
+	assert.Equal(t, "facture-é.xml", String("\xef\xbb\xbffacture-é.xml").Text())
+	assert.Equal(t, "facture-é.xml", String("facture-\xe9.xml").Text())
+}
@@ -0,0 +1,160 @@
+package pdf
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// asciiGlyphNames lists the glyph names of the printable ASCII characters,
+// from 0x20 to 0x7e.
+var asciiGlyphNames = strings.Fields(`space exclam quotedbl numbersign dollar
+	percent ampersand quotesingle parenleft parenright asterisk plus comma hyphen
+	period slash zero one two three four five six seven eight nine colon semicolon
+	less equal greater question at A B C D E F G H I J K L M N O P Q R S T U V W X
+	Y Z bracketleft backslash bracketright asciicircum underscore grave a b c d e f
+	g h i j k l m n o p q r s t u v w x y z braceleft bar braceright asciitilde`)
+
+// latin1GlyphNames lists the glyph names of the Latin-1 characters, from 0xa0 to 0xff.
+var latin1GlyphNames = strings.Fields(`nbspace exclamdown cent sterling currency
+	yen brokenbar section dieresis copyright ordfeminine guillemotleft logicalnot
+	sfthyphen registered macron degree plusminus twosuperior threesuperior acute mu
+	paragraph periodcentered cedilla onesuperior ordmasculine guillemotright
+	onequarter onehalf threequarters questiondown Agrave Aacute Acircumflex Atilde
+	Adieresis Aring AE Ccedilla Egrave Eacute Ecircumflex Edieresis Igrave Iacute
+	Icircumflex Idieresis Eth Ntilde Ograve Oacute Ocircumflex Otilde Odieresis
+	multiply Oslash Ugrave Uacute Ucircumflex Udieresis Yacute Thorn germandbls
+	agrave aacute acircumflex atilde adieresis aring ae ccedilla egrave eacute
+	ecircumflex edieresis igrave iacute icircumflex idieresis eth ntilde ograve
+	oacute ocircumflex otilde odieresis divide oslash ugrave uacute ucircumflex
+	udieresis yacute thorn ydieresis`)
+
+// otherGlyphNames maps the other common glyph names to their text.
+var otherGlyphNames = map[string]string{
+	"Euro": "€", "quotesinglbase": "‚", "florin": "ƒ", "quotedblbase": "„",
+	"ellipsis": "…", "dagger": "†", "daggerdbl": "‡", "circumflex": "ˆ",
+	"perthousand": "‰", "Scaron": "Š", "guilsinglleft": "‹", "OE": "Œ",
+	"Zcaron": "Ž", "quoteleft": "‘", "quoteright": "’", "quotedblleft": "“",
+	"quotedblright": "”", "bullet": "•", "endash": "–", "emdash": "—",
+	"tilde": "˜", "trademark": "™", "scaron": "š", "guilsinglright": "›",
+	"oe": "œ", "zcaron": "ž", "Ydieresis": "Ÿ", "fraction": "⁄",
+	"breve": "˘", "dotaccent": "˙", "ring": "˚", "hungarumlaut": "˝",
+	"ogonek": "˛", "caron": "ˇ", "Lslash": "Ł", "lslash": "ł", "dotlessi": "ı",
+	"minus": "−", "fi": "fi", "fl": "fl", "ff": "ff", "ffi": "ffi", "ffl": "ffl",
+	"space": " ", "nbspace": " ", "sfthyphen": "-", "hyphen": "-", "mu": "µ",
+	"Omega": "Ω", "Delta": "∆", "pi": "π", "approxequal": "≈", "notequal": "≠",
+	"lessequal": "≤", "greaterequal": "≥", "infinity": "∞", "partialdiff": "∂",
+	"summation": "∑", "product": "∏", "integral": "∫", "radical": "√",
+	"lozenge": "◊", "commaaccent": ",", "afii61352": "№",
+}
+
+// glyphNames maps glyph names to their text.
+var glyphNames = func() map[string]string {
+	names := map[string]string{}
+	for i, name := range asciiGlyphNames {
+		names[name] = string(rune(0x20 + i))
+	}
+	for i, name := range latin1GlyphNames {
+		names[name] = string(rune(0xa0 + i))
+	}
+	for name, text := range otherGlyphNames {
+		names[name] = text
+	}
+	return names
+}()
+
+// glyphText returns the text of a glyph name, such as "eacute", "uni20AC",
+// "u1F600" or "f_i".
+func glyphText(name string) (string, bool) {
+	if text, ok := glyphNames[name]; ok {
+		return text, true
+	}
+
+	// Variants such as "a.sc" or "one.oldstyle"
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		return glyphText(name[:i])
+	}
+	// Ligatures such as "f_f_i"
+	if strings.Contains(name, "_") {
+		var text strings.Builder
+		for _, part := range strings.Split(name, "_") {
+			t, ok := glyphText(part)
+			if !ok {
+				return "", false
+			}
+			text.WriteString(t)
+		}
+		return text.String(), true
+	}
+
+	switch {
+	case strings.HasPrefix(name, "uni") && len(name) >= 7 && (len(name)-3)%4 == 0:
+		var text strings.Builder
+		for i := 3; i < len(name); i += 4 {
+			v, err := strconv.ParseUint(name[i:i+4], 16, 16)
+			if err != nil {
+				return "", false
+			}
+			text.WriteRune(rune(v))
+		}
+		return text.String(), true
+	case strings.HasPrefix(name, "u") && len(name) >= 5 && len(name) <= 7:
+		v, err := strconv.ParseUint(name[1:], 16, 32)
+		if err != nil {
+			return "", false
+		}
+		return string(rune(v)), true
+	}
+	return "", false
+}
+
+// standardEncoding lists the characters of the Adobe standard encoding
+// that differ from ASCII.
+var standardEncoding = map[byte]string{
+	0x27: "quoteright", 0x60: "quoteleft",
+	0xa1: "exclamdown", 0xa2: "cent", 0xa3: "sterling", 0xa4: "fraction",
+	0xa5: "yen", 0xa6: "florin", 0xa7: "section", 0xa8: "currency",
+	0xa9: "quotesingle", 0xaa: "quotedblleft", 0xab: "guillemotleft",
+	0xac: "guilsinglleft", 0xad: "guilsinglright", 0xae: "fi", 0xaf: "fl",
+	0xb1: "endash", 0xb2: "dagger", 0xb3: "daggerdbl", 0xb4: "periodcentered",
+	0xb6: "paragraph", 0xb7: "bullet", 0xb8: "quotesinglbase",
+	0xb9: "quotedblbase", 0xba: "quotedblright", 0xbb: "guillemotright",
+	0xbc: "ellipsis", 0xbd: "perthousand", 0xbf: "questiondown", 0xc1: "grave",
+	0xc2: "acute", 0xc3: "circumflex", 0xc4: "tilde", 0xc5: "macron",
+	0xc6: "breve", 0xc7: "dotaccent", 0xc8: "dieresis", 0xca: "ring",
+	0xcb: "cedilla", 0xcd: "hungarumlaut", 0xce: "ogonek", 0xcf: "caron",
+	0xd0: "emdash", 0xe1: "AE", 0xe3: "ordfeminine", 0xe8: "Lslash",
+	0xe9: "Oslash", 0xea: "OE", 0xeb: "ordmasculine", 0xf1: "ae",
+	0xf5: "dotlessi", 0xf8: "lslash", 0xf9: "oslash", 0xfa: "oe",
+	0xfb: "germandbls",
+}
+
+// baseEncoding returns the text of the 256 codes of a simple font encoding.
+func baseEncoding(name Name) [256]string {
+	var table [256]string
+	switch name {
+	case "WinAnsiEncoding":
+		for c := 0x20; c < 0x100; c++ {
+			if r := charmap.Windows1252.DecodeByte(byte(c)); r != utf8.RuneError {
+				table[c] = string(r)
+			}
+		}
+	case "MacRomanEncoding":
+		for c := 0x20; c < 0x100; c++ {
+			if r := charmap.Macintosh.DecodeByte(byte(c)); r != utf8.RuneError {
+				table[c] = string(r)
+			}
+		}
+	default:
+		// StandardEncoding
+		for c := 0x20; c < 0x7f; c++ {
+			table[c] = string(rune(c))
+		}
+		for c, glyph := range standardEncoding {
+			table[c], _ = glyphText(glyph)
+		}
+	}
+	return table
+}
@@ -0,0 +1,219 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"fmt"
+	"io"
+)
+
+// maxStreamSize limits the size of a decoded stream, against decompression bombs
+const maxStreamSize = 64 << 20
+
+// Decode applies the filters of a stream to its data.
+func (d *Document) Decode(s *Stream) ([]byte, error) {
+	var filters, params Array
+	switch f := d.Resolve(s.Dict["Filter"]).(type) {
+	case Name:
+		filters = Array{f}
+		params = Array{d.Resolve(s.Dict["DecodeParms"])}
+	case Array:
+		filters = f
+		params, _ = d.Resolve(s.Dict["DecodeParms"]).(Array)
+	}
+
+	data := s.Data
+	for i, f := range filters {
+		var param Dict
+		if i < len(params) {
+			param, _ = d.Resolve(params[i]).(Dict)
+		}
+
+		name, _ := d.Resolve(f).(Name)
+		var err error
+		switch name {
+		case "FlateDecode", "Fl":
+			data, err = inflate(data)
+			if err == nil {
+				data, err = d.unpredict(data, param)
+			}
+		case "ASCIIHexDecode", "AHx":
+			data = asciiHexDecode(data)
+		case "ASCII85Decode", "A85":
+			data, err = ascii85Decode(data)
+		default:
+			err = fmt.Errorf("unsupported filter %s", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// inflate decompresses zlib data. Many producers write truncated or
+// slightly damaged streams: the data read before an error is kept.
+func inflate(data []byte) ([]byte, error) {
+	var r io.ReadCloser
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		// Raw deflate data, without the zlib header
+		r = flate.NewReader(bytes.NewReader(data))
+	}
+	defer r.Close()
+
+	out, err := io.ReadAll(io.LimitReader(r, maxStreamSize+1))
+	if len(out) > maxStreamSize {
+		return nil, fmt.Errorf("decoded stream too large")
+	}
+	if err != nil && len(out) == 0 {
+		return nil, fmt.Errorf("error decompressing stream: %v", err)
+	}
+	return out, nil
+}
+
+// unpredict reverses the PNG predictors used by FlateDecode.
+func (d *Document) unpredict(data []byte, param Dict) ([]byte, error) {
+	predictor, _ := integer(d.Resolve(param["Predictor"]))
+	if predictor < 10 {
+		if predictor == 2 {
+			return nil, fmt.Errorf("unsupported TIFF predictor")
+		}
+		return data, nil
+	}
+
+	colors, columns, bits := 1, 1, 8
+	if v, ok := integer(d.Resolve(param["Colors"])); ok && v > 0 {
+		colors = v
+	}
+	if v, ok := integer(d.Resolve(param["Columns"])); ok && v > 0 {
+		columns = v
+	}
+	if v, ok := integer(d.Resolve(param["BitsPerComponent"])); ok && v > 0 {
+		bits = v
+	}
+	bpp := (colors*bits + 7) / 8
+	rowSize := (colors*bits*columns + 7) / 8
+
+	out := make([]byte, 0, len(data))
+	prev := make([]byte, rowSize)
+	for len(data) > 0 {
+		filter := data[0]
+		data = data[1:]
+		n := min(rowSize, len(data))
+		row := make([]byte, rowSize)
+		copy(row, data[:n])
+		data = data[n:]
+
+		for i := range row {
+			var left, upLeft byte
+			if i >= bpp {
+				left = row[i-bpp]
+				upLeft = prev[i-bpp]
+			}
+			up := prev[i]
+			switch filter {
+			case 1:
+				row[i] += left
+			case 2:
+				row[i] += up
+			case 3:
+				row[i] += byte((int(left) + int(up)) / 2)
+			case 4:
+				row[i] += paeth(left, up, upLeft)
+			}
+		}
+		out = append(out, row[:n]...)
+		prev = row
+	}
+	return out, nil
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	}
+	return c
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func asciiHexDecode(data []byte) []byte {
+	var out []byte
+	var hi byte
+	odd := false
+	for _, c := range data {
+		if c == '>' {
+			break
+		}
+		v, ok := unhex(c)
+		if !ok {
+			continue
+		}
+		if odd {
+			out = append(out, hi<<4|v)
+		} else {
+			hi = v
+		}
+		odd = !odd
+	}
+	if odd {
+		out = append(out, hi<<4)
+	}
+	return out
+}
+
+func ascii85Decode(data []byte) ([]byte, error) {
+	data = bytes.TrimPrefix(bytes.TrimSpace(data), []byte("<~"))
+	var out []byte
+	var group [5]byte
+	n := 0
+	flush := func(count int) {
+		var v uint32
+		for i := 0; i < 5; i++ {
+			v = v*85 + uint32(group[i])
+		}
+		b := []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+		out = append(out, b[:count]...)
+	}
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case isSpace(c):
+			continue
+		case c == '~':
+			i = len(data)
+			continue
+		case c == 'z' && n == 0:
+			out = append(out, 0, 0, 0, 0)
+			continue
+		case c < '!' || c > 'u':
+			return nil, fmt.Errorf("invalid ASCII85 data")
+		}
+		group[n] = c - '!'
+		n++
+		if n == 5 {
+			flush(4)
+			n = 0
+		}
+	}
+	if n > 0 {
+		for i := n; i < 5; i++ {
+			group[i] = 'u' - '!'
+		}
+		flush(n - 1)
+	}
+	return out, nil
+}
@@ -0,0 +1,218 @@
+package pdf
+
+import (
+	"strings"
+)
+
+// font decodes the strings shown with a font into text and glyph widths.
+type font struct {
+	composite bool
+	encoding  [256]string // simple fonts
+	toUnicode *cmap
+	cmap      *cmap // encoding of composite fonts, nil for Identity-H and Identity-V
+
+	widths       map[int]float64 // by character code for simple fonts, by CID for composite fonts
+	defaultWidth float64
+	scale        float64 // from glyph space to text space
+}
+
+// glyph is a character shown by a string.
+type glyph struct {
+	text  string
+	width float64 // in text space, for a font size of 1
+	space bool    // single-byte code 32, subject to word spacing
+}
+
+// loadFont reads a font dictionary.
+func (d *Document) loadFont(dict Dict) *font {
+	f := &font{
+		widths:       map[int]float64{},
+		defaultWidth: 1000,
+		scale:        0.001,
+	}
+
+	if stream, ok := d.Resolve(dict["ToUnicode"]).(*Stream); ok {
+		if data, err := d.Decode(stream); err == nil {
+			f.toUnicode = parseCMap(data)
+		}
+	}
+
+	subtype, _ := d.Resolve(dict["Subtype"]).(Name)
+	if subtype == "Type0" {
+		d.loadCompositeFont(f, dict)
+		return f
+	}
+
+	if subtype == "Type3" {
+		if m, ok := d.Resolve(dict["FontMatrix"]).(Array); ok && len(m) == 6 {
+			if v, ok := number(d.Resolve(m[0])); ok && v != 0 {
+				f.scale = v
+			}
+		}
+	}
+
+	// Widths
+	base, _ := d.Resolve(dict["BaseFont"]).(Name)
+	f.defaultWidth = standardFontWidth(string(base))
+	descriptor, _ := d.Resolve(dict["FontDescriptor"]).(Dict)
+	if w, ok := number(d.Resolve(descriptor["MissingWidth"])); ok && w > 0 {
+		f.defaultWidth = w
+	}
+	first, _ := integer(d.Resolve(dict["FirstChar"]))
+	if widths, ok := d.Resolve(dict["Widths"]).(Array); ok {
+		for i, w := range widths {
+			if v, ok := number(d.Resolve(w)); ok {
+				f.widths[first+i] = v
+			}
+		}
+	}
+
+	// Encoding
+	defaultEncoding := Name("StandardEncoding")
+	if subtype == "TrueType" {
+		defaultEncoding = "WinAnsiEncoding"
+	}
+	switch enc := d.Resolve(dict["Encoding"]).(type) {
+	case Name:
+		f.encoding = baseEncoding(enc)
+	case Dict:
+		baseName, ok := d.Resolve(enc["BaseEncoding"]).(Name)
+		if !ok {
+			baseName = defaultEncoding
+		}
+		f.encoding = baseEncoding(baseName)
+		differences, _ := d.Resolve(enc["Differences"]).(Array)
+		c := 0
+		for _, item := range differences {
+			switch v := d.Resolve(item).(type) {
+			case int64:
+				c = int(v)
+			case Name:
+				if c >= 0 && c < 256 {
+					f.encoding[c], _ = glyphText(string(v))
+				}
+				c++
+			}
+		}
+	default:
+		f.encoding = baseEncoding(defaultEncoding)
+	}
+	return f
+}
+
+func (d *Document) loadCompositeFont(f *font, dict Dict) {
+	f.composite = true
+
+	switch enc := d.Resolve(dict["Encoding"]).(type) {
+	case Name:
+		if !strings.HasPrefix(string(enc), "Identity-") {
+			// Predefined CMaps are mostly two-byte encodings of CJK fonts:
+			// their text is only available through ToUnicode
+			f.cmap = &cmap{codespace: []codespaceRange{{lo: []byte{0, 0}, hi: []byte{0xff, 0xff}}}}
+		}
+	case *Stream:
+		if data, err := d.Decode(enc); err == nil {
+			f.cmap = parseCMap(data)
+		}
+	}
+
+	descendants, _ := d.Resolve(dict["DescendantFonts"]).(Array)
+	if len(descendants) == 0 {
+		return
+	}
+	cidFont, _ := d.Resolve(descendants[0]).(Dict)
+	if w, ok := number(d.Resolve(cidFont["DW"])); ok {
+		f.defaultWidth = w
+	}
+
+	// W lists widths as "c [w1 w2 ...]" or "cfirst clast w"
+	widths, _ := d.Resolve(cidFont["W"]).(Array)
+	for i := 0; i < len(widths); {
+		first, ok := integer(d.Resolve(widths[i]))
+		if !ok || i+1 >= len(widths) {
+			break
+		}
+		if list, ok := d.Resolve(widths[i+1]).(Array); ok {
+			for j, w := range list {
+				if v, ok := number(d.Resolve(w)); ok {
+					f.widths[first+j] = v
+				}
+			}
+			i += 2
+			continue
+		}
+		last, ok1 := integer(d.Resolve(widths[i+1]))
+		if i+2 >= len(widths) || !ok1 {
+			break
+		}
+		w, ok2 := number(d.Resolve(widths[i+2]))
+		if ok2 && last-first < 1<<16 {
+			for c := first; c <= last; c++ {
+				f.widths[c] = w
+			}
+		}
+		i += 3
+	}
+}
+
+// standardFontWidth returns an average glyph width for the standard fonts,
+// which usually come without widths.
+func standardFontWidth(base string) float64 {
+	switch {
+	case strings.Contains(base, "Courier"):
+		return 600
+	case strings.Contains(base, "Times"):
+		return 450
+	}
+	return 500
+}
+
+// decode splits a string shown with the font into glyphs.
+func (f *font) decode(s String) []glyph {
+	var codes []code
+	switch {
+	case f.cmap != nil:
+		codes = f.cmap.codes(s)
+	case f.composite:
+		// Identity encoding: two-byte codes
+		for i := 0; i+1 < len(s); i += 2 {
+			codes = append(codes, code{value: int(s[i])<<8 | int(s[i+1]), n: 2})
+		}
+	default:
+		for i := 0; i < len(s); i++ {
+			codes = append(codes, code{value: int(s[i]), n: 1})
+		}
+	}
+
+	glyphs := make([]glyph, 0, len(codes))
+	for _, c := range codes {
+		g := glyph{space: c.n == 1 && c.value == 32}
+
+		key := c.value
+		if f.cmap != nil {
+			key = f.cmap.lookupCID(c.value)
+		}
+		w, ok := f.widths[key]
+		if !ok {
+			w = f.defaultWidth
+			if g.space && !f.composite {
+				w = f.defaultWidth / 2
+			}
+		}
+		g.width = w * f.scale
+
+		text, ok := "", false
+		if f.toUnicode != nil {
+			text, ok = f.toUnicode.lookupText(c.value)
+		}
+		if !ok && !f.composite && c.value < 256 {
+			text = f.encoding[c.value]
+		}
+		g.text = cleanText(text)
+		if g.space && g.text == "" {
+			g.text = " "
+		}
+		glyphs = append(glyphs, g)
+	}
+	return glyphs
+}
@@ -0,0 +1,354 @@
+package pdf
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// maxNesting limits the depth of nested arrays and dictionaries
+const maxNesting = 64
+
+var errSyntax = errors.New("PDF syntax error")
+
+// lexer reads tokens and objects from PDF data.
+type lexer struct {
+	data []byte
+	pos  int
+}
+
+func newLexer(data []byte, pos int) *lexer {
+	return &lexer{data: data, pos: pos}
+}
+
+func isSpace(c byte) bool {
+	switch c {
+	case 0, '\t', '\n', '\f', '\r', ' ':
+		return true
+	}
+	return false
+}
+
+func isDelimiter(c byte) bool {
+	switch c {
+	case '(', ')', '<', '>', '[', ']', '{', '}', '/', '%':
+		return true
+	}
+	return false
+}
+
+func isRegular(c byte) bool {
+	return !isSpace(c) && !isDelimiter(c)
+}
+
+// skipSpace skips white space and comments.
+func (l *lexer) skipSpace() {
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		switch {
+		case isSpace(c):
+			l.pos++
+		case c == '%':
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// token reads the next token: a number, a String, a Name or a keyword.
+// It returns io.EOF at the end of the data.
+func (l *lexer) token() (any, error) {
+	l.skipSpace()
+	if l.pos >= len(l.data) {
+		return nil, io.EOF
+	}
+
+	c := l.data[l.pos]
+	switch c {
+	case '(':
+		l.pos++
+		return l.literalString(), nil
+	case '<':
+		if l.pos+1 < len(l.data) && l.data[l.pos+1] == '<' {
+			l.pos += 2
+			return keyword("<<"), nil
+		}
+		l.pos++
+		return l.hexString(), nil
+	case '>':
+		if l.pos+1 < len(l.data) && l.data[l.pos+1] == '>' {
+			l.pos += 2
+			return keyword(">>"), nil
+		}
+		l.pos++
+		return nil, errSyntax
+	case '[', ']', '{', '}':
+		l.pos++
+		return keyword(c), nil
+	case ')':
+		l.pos++
+		return nil, errSyntax
+	case '/':
+		l.pos++
+		return l.name(), nil
+	}
+
+	start := l.pos
+	for l.pos < len(l.data) && isRegular(l.data[l.pos]) {
+		l.pos++
+	}
+	word := l.data[start:l.pos]
+	if isNumber(word) {
+		return parseNumber(word), nil
+	}
+	return keyword(word), nil
+}
+
+func isNumber(word []byte) bool {
+	digits := false
+	for _, c := range word {
+		switch {
+		case c >= '0' && c <= '9':
+			digits = true
+		case c == '+' || c == '-' || c == '.':
+		default:
+			return false
+		}
+	}
+	return digits
+}
+
+// parseNumber parses an integer or a real, tolerating malformed numbers
+// such as "--1" or "1.2.3" written by some producers.
+func parseNumber(word []byte) Object {
+	s := string(word)
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i
+	}
+
+	neg := false
+	for len(s) > 0 && (s[0] == '-' || s[0] == '+') {
+		neg = neg || s[0] == '-'
+		s = s[1:]
+	}
+	if dot := bytes.IndexByte([]byte(s), '.'); dot >= 0 {
+		if second := bytes.IndexByte([]byte(s[dot+1:]), '.'); second >= 0 {
+			s = s[:dot+1+second]
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		f = 0
+	}
+	if neg {
+		f = -f
+	}
+	return f
+}
+
+func (l *lexer) literalString() String {
+	var buf []byte
+	depth := 1
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return String(buf)
+			}
+		case '\r':
+			// End of line markers are read as a single line feed
+			if l.pos < len(l.data) && l.data[l.pos] == '\n' {
+				l.pos++
+			}
+			c = '\n'
+		case '\\':
+			if l.pos >= len(l.data) {
+				continue
+			}
+			c = l.data[l.pos]
+			l.pos++
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				// Line continuation
+				if l.pos < len(l.data) && l.data[l.pos] == '\n' {
+					l.pos++
+				}
+				continue
+			case '\n':
+				continue
+			case '0', '1', '2', '3', '4', '5', '6', '7':
+				v := int(c - '0')
+				for i := 0; i < 2 && l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '7'; i++ {
+					v = v*8 + int(l.data[l.pos]-'0')
+					l.pos++
+				}
+				c = byte(v)
+			}
+		}
+		buf = append(buf, c)
+	}
+	return String(buf)
+}
+
+func (l *lexer) hexString() String {
+	var buf []byte
+	var hi byte
+	odd := false
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		if c == '>' {
+			break
+		}
+		v, ok := unhex(c)
+		if !ok {
+			continue
+		}
+		if odd {
+			buf = append(buf, hi<<4|v)
+		} else {
+			hi = v
+		}
+		odd = !odd
+	}
+	if odd {
+		buf = append(buf, hi<<4)
+	}
+	return String(buf)
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10, true
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+func (l *lexer) name() Name {
+	var buf []byte
+	for l.pos < len(l.data) && isRegular(l.data[l.pos]) {
+		c := l.data[l.pos]
+		l.pos++
+		if c == '#' && l.pos+1 < len(l.data) {
+			hi, ok1 := unhex(l.data[l.pos])
+			lo, ok2 := unhex(l.data[l.pos+1])
+			if ok1 && ok2 {
+				c = hi<<4 | lo
+				l.pos += 2
+			}
+		}
+		buf = append(buf, c)
+	}
+	return Name(buf)
+}
+
+// object reads a direct object. Keywords other than true, false and null are
+// returned as is, so that content stream operators can be read as objects.
+func (l *lexer) object() (Object, error) {
+	return l.nestedObject(0)
+}
+
+func (l *lexer) nestedObject(depth int) (Object, error) {
+	if depth > maxNesting {
+		return nil, errSyntax
+	}
+
+	tok, err := l.token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := tok.(type) {
+	case keyword:
+		switch t {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		case "[":
+			var array Array
+			for {
+				obj, err := l.nestedObject(depth + 1)
+				if err != nil {
+					return array, err
+				}
+				if k, ok := obj.(keyword); ok {
+					if k == "]" {
+						return array, nil
+					}
+					return array, errSyntax
+				}
+				array = append(array, obj)
+			}
+		case "<<":
+			dict := Dict{}
+			for {
+				tok, err := l.token()
+				if err != nil {
+					return dict, err
+				}
+				if tok == keyword(">>") {
+					return dict, nil
+				}
+				key, ok := tok.(Name)
+				if !ok {
+					return dict, errSyntax
+				}
+				value, err := l.nestedObject(depth + 1)
+				if err != nil {
+					return dict, err
+				}
+				if k, ok := value.(keyword); ok {
+					if k == ">>" {
+						// Key without a value
+						return dict, nil
+					}
+					return dict, errSyntax
+				}
+				if value != nil {
+					dict[key] = value
+				}
+			}
+		}
+		return t, nil
+	case int64:
+		// An integer may start a reference: "12 0 R"
+		save := l.pos
+		if gen, err := l.token(); err == nil {
+			if g, ok := gen.(int64); ok {
+				if r, err := l.token(); err == nil && r == keyword("R") {
+					return Ref{Num: int(t), Gen: int(g)}, nil
+				}
+			}
+		}
+		l.pos = save
+		return t, nil
+	}
+	return tok, nil
+}
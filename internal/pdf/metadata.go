@@ -0,0 +1,357 @@
+package pdf
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// XMP namespaces of the properties written by UpdateMetadata
+const (
+	nsRDF = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	nsDC  = "http://purl.org/dc/elements/1.1/"
+	nsPDF = "http://ns.adobe.com/pdf/1.3/"
+	nsXMP = "http://ns.adobe.com/xap/1.0/"
+)
+
+// Metadata is the document information written by UpdateMetadata. Empty
+// fields leave the current values unchanged.
+type Metadata struct {
+	Title    string
+	Author   string
+	Subject  string
+	Keywords []string
+	// ModDate is the modification date, the current time if zero
+	ModDate time.Time
+}
+
+// UpdateMetadata returns the document with the metadata written both in its
+// document information dictionary and in its XMP metadata stream, as an
+// incremental update: the original bytes, and so the page content and any
+// signature, are kept. The other properties of an existing XMP packet, such
+// as the PDF/A identification of Factur-X invoices, are kept.
+func (d *Document) UpdateMetadata(m Metadata) (data []byte, err error) {
+	// Malformed files must not crash the caller
+	defer func() {
+		if r := recover(); r != nil {
+			data, err = nil, fmt.Errorf("malformed PDF document: %v", r)
+		}
+	}()
+
+	if d.security != nil {
+		return nil, fmt.Errorf("cannot update the metadata of an encrypted document")
+	}
+	// An update needs a valid cross-reference table to refer to
+	if d.startxref < 0 {
+		data, err := d.Rewrite()
+		if err != nil {
+			return nil, err
+		}
+		doc, err := Open(data)
+		if err != nil {
+			return nil, err
+		}
+		return doc.UpdateMetadata(m)
+	}
+
+	root, ok := d.trailer["Root"].(Ref)
+	catalog := d.catalog()
+	if !ok || catalog == nil {
+		return nil, fmt.Errorf("document catalog not found")
+	}
+	if m.ModDate.IsZero() {
+		m.ModDate = time.Now()
+	}
+
+	size, _ := integer(d.trailer["Size"])
+	for num := range d.xref {
+		size = max(size, num+1)
+	}
+	// allocate returns the number of the object referred to by obj, or a new number
+	allocate := func(obj Object) int {
+		if ref, ok := obj.(Ref); ok {
+			return ref.Num
+		}
+		size++
+		return size - 1
+	}
+
+	// Document information dictionary
+	info := Dict{}
+	if existing, ok := d.Resolve(d.trailer["Info"]).(Dict); ok {
+		for key, value := range existing {
+			info[key] = d.Resolve(value)
+		}
+	}
+	for key, value := range map[Name]string{
+		"Title":    m.Title,
+		"Author":   m.Author,
+		"Subject":  m.Subject,
+		"Keywords": strings.Join(m.Keywords, ", "),
+	} {
+		if value != "" {
+			info[key] = TextString(value)
+		}
+	}
+	info["ModDate"] = String(pdfDate(m.ModDate))
+	infoNum := allocate(d.trailer["Info"])
+
+	// XMP metadata stream, merged with the existing one
+	var packet []byte
+	if existing, ok := d.Resolve(catalog["Metadata"]).(*Stream); ok {
+		if decoded, err := d.Decode(existing); err == nil {
+			packet = decoded
+		}
+	}
+	metadata := &Stream{
+		Dict: Dict{"Type": Name("Metadata"), "Subtype": Name("XML")},
+		Data: updateXMP(packet, m),
+	}
+	metadataNum := allocate(catalog["Metadata"])
+
+	updates := map[int]Object{infoNum: info, metadataNum: metadata}
+	if ref, ok := catalog["Metadata"].(Ref); !ok || ref.Num != metadataNum {
+		updated := make(Dict, len(catalog)+1)
+		for key, value := range catalog {
+			updated[key] = value
+		}
+		updated["Metadata"] = Ref{Num: metadataNum}
+		updates[root.Num] = updated
+	}
+
+	trailer := Dict{"Root": root, "Info": Ref{Num: infoNum}, "Prev": d.startxref}
+	if id, ok := d.trailer["ID"]; ok {
+		trailer["ID"] = id
+	}
+	return d.appendUpdate(updates, trailer, size), nil
+}
+
+// appendUpdate appends the updated objects, and a cross-reference section of
+// the same kind as the previous one, to the document.
+func (d *Document) appendUpdate(updates map[int]Object, trailer Dict, size int) []byte {
+	buf := append([]byte{}, d.data...)
+	if len(buf) > 0 && buf[len(buf)-1] != '\n' {
+		buf = append(buf, '\n')
+	}
+
+	nums := make([]int, 0, len(updates)+1)
+	for num := range updates {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+
+	offsets := map[int]int{}
+	gens := map[int]int{}
+	for _, num := range nums {
+		gen := 0
+		if entry, ok := d.xref[num]; ok && !entry.inStream && entry.offset >= 0 {
+			gen = entry.gen
+		}
+		offsets[num], gens[num] = len(buf)-d.header, gen
+		buf = appendIndirectObject(buf, num, gen, updates[num])
+	}
+
+	xref := len(buf) - d.header
+	if d.xrefStream {
+		// The cross-reference stream lists itself
+		num := size
+		size++
+		nums = append(nums, num)
+		offsets[num] = xref
+
+		var index Array
+		var entries []byte
+		for _, n := range nums {
+			index = append(index, int64(n), int64(1))
+			offset := offsets[n]
+			entries = append(entries, 1, byte(offset>>24), byte(offset>>16), byte(offset>>8), byte(offset), byte(gens[n]>>8), byte(gens[n]))
+		}
+		dict := Dict{"Type": Name("XRef"), "Size": int64(size), "W": Array{int64(1), int64(4), int64(2)}, "Index": index}
+		for key, value := range trailer {
+			dict[key] = value
+		}
+		buf = appendIndirectObject(buf, num, 0, &Stream{Dict: dict, Data: entries})
+	} else {
+		buf = append(buf, "xref\n"...)
+		for _, n := range nums {
+			buf = fmt.Appendf(buf, "%d 1\n%010d %05d n \n", n, offsets[n], gens[n])
+		}
+		trailer["Size"] = int64(size)
+		buf = append(buf, "trailer\n"...)
+		buf = appendObject(buf, trailer)
+		buf = append(buf, '\n')
+	}
+	return fmt.Appendf(buf, "startxref\n%d\n%%%%EOF\n", xref)
+}
+
+// pdfDate formats a date as a PDF date string, such as D:20260405093000+02'00'
+func pdfDate(t time.Time) string {
+	_, offset := t.Zone()
+	sign := '+'
+	if offset < 0 {
+		sign, offset = '-', -offset
+	}
+	return fmt.Sprintf("D:%s%c%02d'%02d'", t.Format("20060102150405"), sign, offset/3600, offset/60%60)
+}
+
+// xmpProperty is a property of the XMP packet
+type xmpProperty struct {
+	name  xml.Name
+	value string // XML of the value, inside the property element
+}
+
+// xmpProperties returns the XMP properties matching the metadata.
+func xmpProperties(m Metadata) []xmpProperty {
+	var props []xmpProperty
+	escape := func(s string) string {
+		var buf bytes.Buffer
+		xml.EscapeText(&buf, []byte(s))
+		return buf.String()
+	}
+	if m.Title != "" {
+		props = append(props, xmpProperty{xml.Name{Space: nsDC, Local: "title"},
+			`<rdf:Alt><rdf:li xml:lang="x-default">` + escape(m.Title) + `</rdf:li></rdf:Alt>`})
+	}
+	if m.Author != "" {
+		props = append(props, xmpProperty{xml.Name{Space: nsDC, Local: "creator"},
+			`<rdf:Seq><rdf:li>` + escape(m.Author) + `</rdf:li></rdf:Seq>`})
+	}
+	if m.Subject != "" {
+		props = append(props, xmpProperty{xml.Name{Space: nsDC, Local: "description"},
+			`<rdf:Alt><rdf:li xml:lang="x-default">` + escape(m.Subject) + `</rdf:li></rdf:Alt>`})
+	}
+	if len(m.Keywords) > 0 {
+		var items strings.Builder
+		for _, keyword := range m.Keywords {
+			items.WriteString(`<rdf:li>` + escape(keyword) + `</rdf:li>`)
+		}
+		props = append(props,
+			xmpProperty{xml.Name{Space: nsDC, Local: "subject"}, `<rdf:Bag>` + items.String() + `</rdf:Bag>`},
+			xmpProperty{xml.Name{Space: nsPDF, Local: "Keywords"}, escape(strings.Join(m.Keywords, ", "))})
+	}
+	date := m.ModDate.Format(time.RFC3339)
+	props = append(props,
+		xmpProperty{xml.Name{Space: nsXMP, Local: "ModifyDate"}, date},
+		xmpProperty{xml.Name{Space: nsXMP, Local: "MetadataDate"}, date})
+	return props
+}
+
+// xmpPrefixes are the prefixes of the namespaces of the written properties
+var xmpPrefixes = map[string]string{nsDC: "dc", nsPDF: "pdf", nsXMP: "xmp"}
+
+// xmpDescription returns an rdf:Description element holding the properties.
+func xmpDescription(about string, props []xmpProperty) string {
+	var b strings.Builder
+	b.WriteString(`<rdf:Description rdf:about="`)
+	xml.EscapeText(&b, []byte(about))
+	fmt.Fprintf(&b, `" xmlns:rdf="%s" xmlns:dc="%s" xmlns:pdf="%s" xmlns:xmp="%s">`, nsRDF, nsDC, nsPDF, nsXMP)
+	b.WriteString("\n")
+	for _, p := range props {
+		prefix := xmpPrefixes[p.name.Space]
+		fmt.Fprintf(&b, "<%s:%s>%s</%s:%s>\n", prefix, p.name.Local, p.value, prefix, p.name.Local)
+	}
+	b.WriteString("</rdf:Description>\n")
+	return b.String()
+}
+
+// updateXMP returns the XMP packet with the properties of the metadata
+// replaced, or a new packet if packet is empty or cannot be read. The
+// replaced properties are removed from the existing descriptions, in element
+// or attribute form, and written in a new description; the rest of the
+// packet is kept byte for byte.
+func updateXMP(packet []byte, m Metadata) []byte {
+	props := xmpProperties(m)
+	replaced := map[xml.Name]bool{}
+	for _, p := range props {
+		replaced[p.name] = true
+	}
+
+	type span struct{ start, end int }
+	var removed []span
+	about := ""
+	insert := -1
+
+	decoder := xml.NewDecoder(bytes.NewReader(packet))
+	var stack []xml.Name
+	propStart, propDepth := -1, 0
+	for {
+		start := int(decoder.InputOffset())
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		end := int(decoder.InputOffset())
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			parent := xml.Name{}
+			if len(stack) > 0 {
+				parent = stack[len(stack)-1]
+			}
+			stack = append(stack, t.Name)
+
+			if t.Name == (xml.Name{Space: nsRDF, Local: "Description"}) {
+				for _, attr := range t.Attr {
+					switch {
+					case attr.Name == xml.Name{Space: nsRDF, Local: "about"} && about == "":
+						about = attr.Value
+					case replaced[attr.Name]:
+						tag := packet[start:end]
+						re := regexp.MustCompile(`\s+[^\s=/>]+:` + regexp.QuoteMeta(attr.Name.Local) + `\s*=\s*("[^"]*"|'[^']*')`)
+						for _, loc := range re.FindAllIndex(tag, -1) {
+							removed = append(removed, span{start + loc[0], start + loc[1]})
+						}
+					}
+				}
+			} else if parent == (xml.Name{Space: nsRDF, Local: "Description"}) && replaced[t.Name] && propDepth == 0 {
+				propStart, propDepth = start, len(stack)
+			}
+		case xml.EndElement:
+			if len(stack) == 0 {
+				return newXMP(props)
+			}
+			if len(stack) == propDepth {
+				removed = append(removed, span{propStart, end})
+				propDepth = 0
+			}
+			stack = stack[:len(stack)-1]
+			if t.Name == (xml.Name{Space: nsRDF, Local: "RDF"}) {
+				insert = start
+			}
+		}
+	}
+	if insert < 0 {
+		return newXMP(props)
+	}
+
+	sort.Slice(removed, func(i, j int) bool { return removed[i].start < removed[j].start })
+	var buf bytes.Buffer
+	pos := 0
+	for _, s := range removed {
+		if s.start < pos {
+			continue
+		}
+		buf.Write(packet[pos:s.start])
+		pos = s.end
+	}
+	buf.Write(packet[pos:insert])
+	buf.WriteString(xmpDescription(about, props))
+	buf.Write(packet[insert:])
+	return buf.Bytes()
+}
+
+// newXMP returns a new XMP packet holding the properties.
+func newXMP(props []xmpProperty) []byte {
+	var b strings.Builder
+	b.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	b.WriteString(`<x:xmpmeta xmlns:x="adobe:ns:meta/">` + "\n")
+	fmt.Fprintf(&b, `<rdf:RDF xmlns:rdf="%s">`+"\n", nsRDF)
+	b.WriteString(xmpDescription("", props))
+	b.WriteString("</rdf:RDF>\n</x:xmpmeta>\n")
+	b.WriteString(`<?xpacket end="w"?>`)
+	return []byte(b.String())
+}
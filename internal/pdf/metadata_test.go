@@ -0,0 +1,127 @@
+package pdf
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testMetadata = Metadata{
+	Title:    "2026-03-facture-Société Générale",
+	Author:   "Société Générale",
+	Subject:  "Invoice FX-7 from Société Générale, 2026-03",
+	Keywords: []string{"FX-7", "2026-03", "R&D"},
+	ModDate:  time.Date(2026, 4, 5, 9, 30, 0, 0, time.FixedZone("CEST", 2*3600)),
+}
+
+// metadataText retourne le paquet XMP du document.
+func metadataText(t *testing.T, doc *Document) string {
+	stream, ok := doc.Resolve(doc.catalog()["Metadata"]).(*Stream)
+	if !assert.True(t, ok) {
+		return ""
+	}
+	data, err := doc.Decode(stream)
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func TestUpdateMetadata(t *testing.T) {
+	p := &testPDF{}
+	font := p.add(helvetica)
+	page := p.page(fmt.Sprintf("<< /Font << /F1 %d 0 R >> >>", font), "BT /F1 12 Tf 72 700 Td (Facture FX-7) Tj ET", true)
+	root := p.catalog(page)
+	info := p.add("<< /Title (scan0042) /Producer (Logiciel) >>")
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"classic", p.bytes(root, fmt.Sprintf("/Info %d 0 R /ID [<01> <02>]", info))},
+		{"xref stream", p.compressedBytes(root)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := mustOpen(t, tt.data).UpdateMetadata(testMetadata)
+			assert.NoError(t, err)
+			// Mise à jour incrémentale : le document d'origine est conservé
+			assert.True(t, bytes.HasPrefix(data, tt.data))
+			assert.Equal(t, !strings.Contains(tt.name, "stream"), strings.Contains(string(data[len(tt.data):]), "\ntrailer\n"))
+
+			doc := mustOpen(t, data)
+			text, err := doc.Text()
+			assert.NoError(t, err)
+			assert.Equal(t, "Facture FX-7", text)
+
+			dict, _ := doc.Resolve(doc.Trailer()["Info"]).(Dict)
+			assert.Equal(t, "2026-03-facture-Société Générale", dict["Title"].(String).Text())
+			assert.Equal(t, "Société Générale", dict["Author"].(String).Text())
+			assert.Equal(t, String("FX-7, 2026-03, R&D"), dict["Keywords"])
+			assert.Equal(t, String("D:20260405093000+02'00'"), dict["ModDate"])
+			if tt.name == "classic" {
+				assert.Equal(t, String("Logiciel"), dict["Producer"])
+				assert.Equal(t, Array{String("\x01"), String("\x02")}, doc.Trailer()["ID"])
+			}
+
+			xmp := metadataText(t, doc)
+			assert.Contains(t, xmp, `<dc:title><rdf:Alt><rdf:li xml:lang="x-default">2026-03-facture-Société Générale</rdf:li></rdf:Alt></dc:title>`)
+			assert.Contains(t, xmp, `<rdf:Bag><rdf:li>FX-7</rdf:li><rdf:li>2026-03</rdf:li><rdf:li>R&amp;D</rdf:li></rdf:Bag>`)
+			assert.Contains(t, xmp, `<xmp:ModifyDate>2026-04-05T09:30:00+02:00</xmp:ModifyDate>`)
+			assert.NoError(t, xml.Unmarshal([]byte(xmp), new(any)))
+
+			// Une seconde mise à jour remplace la première
+			update := testMetadata
+			update.Title = "Nouveau titre"
+			data, err = doc.UpdateMetadata(update)
+			assert.NoError(t, err)
+			doc = mustOpen(t, data)
+			dict, _ = doc.Resolve(doc.Trailer()["Info"]).(Dict)
+			assert.Equal(t, String("Nouveau titre"), dict["Title"])
+			xmp = metadataText(t, doc)
+			assert.Equal(t, 1, strings.Count(xmp, "<dc:title>"))
+			assert.Contains(t, xmp, "Nouveau titre")
+		})
+	}
+}
+
+func TestUpdateMetadataEncrypted(t *testing.T) {
+	data := encryptedTestPDF(newTestEncryption(4, cryptAESV2, "", "propriétaire"))
+	_, err := mustOpen(t, data).UpdateMetadata(testMetadata)
+	assert.Error(t, err)
+}
+
+func TestUpdateXMP(t *testing.T) {
+	// Paquet PDF/A d'une facture Factur-X, avec des propriétés sous forme d'attributs
+	packet := "<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n" + `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description rdf:about="uuid:1234" xmlns:pdfaid="http://www.aiim.org/pdfa/ns/id/" pdfaid:part="3" pdfaid:conformance="B"/>
+<rdf:Description rdf:about="uuid:1234" xmlns:dc="http://purl.org/dc/elements/1.1/">
+<dc:title><rdf:Alt><rdf:li xml:lang="x-default">Ancien titre</rdf:li></rdf:Alt></dc:title>
+<dc:format>application/pdf</dc:format>
+</rdf:Description>
+<rdf:Description rdf:about="uuid:1234" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmp:CreateDate="2026-03-20T10:00:00+01:00" xmp:ModifyDate='2026-03-20T10:00:00+01:00'/>
+</rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`
+
+	xmp := string(updateXMP([]byte(packet), testMetadata))
+	assert.NoError(t, xml.Unmarshal([]byte(xmp), new(any)))
+	assert.Contains(t, xmp, `pdfaid:part="3" pdfaid:conformance="B"/>`)
+	assert.Contains(t, xmp, "<dc:format>application/pdf</dc:format>")
+	assert.Contains(t, xmp, `xmp:CreateDate="2026-03-20T10:00:00+01:00"/>`)
+	assert.NotContains(t, xmp, "Ancien titre")
+	assert.NotContains(t, xmp, "xmp:ModifyDate='")
+	assert.Contains(t, xmp, `<rdf:Description rdf:about="uuid:1234" xmlns:rdf=`)
+	assert.Contains(t, xmp, "<xmp:ModifyDate>2026-04-05T09:30:00+02:00</xmp:ModifyDate>")
+	assert.True(t, strings.HasSuffix(xmp, "</rdf:Description>\n</rdf:RDF>\n</x:xmpmeta>\n<?xpacket end=\"w\"?>"))
+
+	// Paquet illisible remplacé
+	xmp = string(updateXMP([]byte("<x:xmpmeta>"), testMetadata))
+	assert.True(t, strings.HasPrefix(xmp, "<?xpacket begin="))
+	assert.Contains(t, xmp, "<pdf:Keywords>FX-7, 2026-03, R&amp;D</pdf:Keywords>")
+}
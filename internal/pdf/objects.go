@@ -0,0 +1,123 @@
+// Package pdf reads PDF documents: it parses the cross-reference tables and
+// objects of a file, extracts the text of its pages and the embedded files,
+// decrypts documents protected by a password and updates their metadata.
+//
+// It supports the constructs found in the documents sent as email
+// attachments (compressed object and cross-reference streams, embedded and
+// standard fonts, ToUnicode maps) and tolerates damaged files by rebuilding
+// the cross-reference table when it cannot be read.
+package pdf
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+var (
+	// ErrNotPDF is returned when the data does not look like a PDF document
+	ErrNotPDF = errors.New("not a PDF document")
+	// ErrEncrypted is returned when the document is encrypted and the
+	// password does not open it
+	ErrEncrypted = errors.New("encrypted PDF document")
+	// ErrUnsupportedEncryption is returned when the encryption of the
+	// document is not supported, such as public-key encryption
+	ErrUnsupportedEncryption = errors.New("unsupported PDF encryption")
+)
+
+// Object is a PDF object: nil, bool, int64, float64, String, Name, Array,
+// Dict, *Stream or Ref.
+type Object any
+
+// Name is a PDF name, without the leading slash.
+type Name string
+
+// String is a PDF string, holding raw bytes.
+type String string
+
+// Text decodes a text string, such as a file name or a document title:
+// UTF-16BE or UTF-8 with a byte order mark, or PDFDocEncoding, whose
+// printable characters are those of Latin-1.
+func (s String) Text() string {
+	switch {
+	case strings.HasPrefix(string(s), "\xfe\xff"):
+		return utf16Text(s[2:])
+	case strings.HasPrefix(string(s), "\xef\xbb\xbf"):
+		return string(s[3:])
+	}
+	runes := make([]rune, len(s))
+	for i := 0; i < len(s); i++ {
+		runes[i] = rune(s[i])
+	}
+	return string(runes)
+}
+
+// TextString encodes a text string: as is if it only holds printable ASCII
+// characters, in UTF-16BE with a byte order mark otherwise.
+func TextString(s string) String {
+	ascii := true
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] >= 0x7f {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return String(s)
+	}
+
+	buf := []byte{0xfe, 0xff}
+	for _, u := range utf16.Encode([]rune(s)) {
+		buf = append(buf, byte(u>>8), byte(u))
+	}
+	return String(buf)
+}
+
+// Array is a PDF array.
+type Array []Object
+
+// Dict is a PDF dictionary.
+type Dict map[Name]Object
+
+// Stream is a PDF stream. Data holds the raw, still encoded, bytes.
+type Stream struct {
+	Dict Dict
+	Data []byte
+}
+
+// Ref is a reference to an indirect object.
+type Ref struct {
+	Num int
+	Gen int
+}
+
+func (r Ref) String() string {
+	return fmt.Sprintf("%d %d R", r.Num, r.Gen)
+}
+
+// keyword is a bare word: true, false, null, R, obj, stream or a content
+// stream operator. Delimiters of arrays and dictionaries are keywords too.
+type keyword string
+
+// number returns the value of a numeric object.
+func number(obj Object) (float64, bool) {
+	switch v := obj.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// integer returns the value of an integer object.
+func integer(obj Object) (int, bool) {
+	switch v := obj.(type) {
+	case int64:
+		return int(v), true
+	case float64:
+		return int(v), true
+	}
+	return 0, false
+}
@@ -0,0 +1,539 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// maxResolveDepth limits chains of references to references
+const maxResolveDepth = 32
+
+// xrefEntry locates an indirect object: at an offset in the file, or in an
+// object stream.
+type xrefEntry struct {
+	offset   int64
+	gen      int
+	inStream bool
+	stream   int // object number of the object stream
+}
+
+// objectStream is a decoded object stream.
+type objectStream struct {
+	data    []byte
+	offsets map[int]int // object number -> offset in data
+}
+
+// Document is a parsed PDF document.
+type Document struct {
+	data    []byte
+	header  int // offset of the %PDF- header, offsets are relative to it
+	xref    map[int]xrefEntry
+	trailer Dict
+	objects map[int]Object
+	streams map[int]*objectStream
+	loading map[int]bool
+	// startxref is the offset of the last cross-reference section, -1 if the
+	// table was rebuilt; xrefStream is set if it is a cross-reference stream
+	startxref  int64
+	xrefStream bool
+	// security decrypts the objects of encrypted documents
+	security *securityHandler
+}
+
+// Open parses the PDF document held in data. Encrypted documents are
+// opened if their user password is empty, as when only the owner password
+// restricts printing or copying; otherwise ErrEncrypted is returned.
+func Open(data []byte) (*Document, error) {
+	return OpenWithPassword(data, "")
+}
+
+// OpenWithPassword parses the PDF document held in data, decrypting it with
+// password, either the user or the owner password, if it is encrypted.
+// It returns ErrEncrypted if the password is wrong.
+func OpenWithPassword(data []byte, password string) (doc *Document, err error) {
+	// Malformed files must not crash the caller
+	defer func() {
+		if r := recover(); r != nil {
+			doc, err = nil, fmt.Errorf("malformed PDF document: %v", r)
+		}
+	}()
+
+	start := bytes.Index(data, []byte("%PDF-"))
+	if start < 0 {
+		return nil, ErrNotPDF
+	}
+
+	doc = &Document{
+		data:    data,
+		header:  start,
+		xref:    map[int]xrefEntry{},
+		objects: map[int]Object{},
+		streams: map[int]*objectStream{},
+		loading: map[int]bool{},
+	}
+
+	if err := doc.readXref(); err != nil || doc.catalog() == nil {
+		doc.xref = map[int]xrefEntry{}
+		doc.objects = map[int]Object{}
+		doc.streams = map[int]*objectStream{}
+		doc.trailer = nil
+		doc.startxref = -1
+		if err := doc.rebuildXref(); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, ok := doc.trailer["Encrypt"]; ok {
+		security, err := doc.newSecurityHandler(password)
+		if err != nil {
+			return nil, err
+		}
+		// Objects read so far were not decrypted
+		doc.security = security
+		doc.objects = map[int]Object{}
+		doc.streams = map[int]*objectStream{}
+	}
+	return doc, nil
+}
+
+// Encrypted reports whether the document is encrypted.
+func (d *Document) Encrypted() bool {
+	return d.security != nil
+}
+
+// Trailer returns the trailer dictionary.
+func (d *Document) Trailer() Dict {
+	return d.trailer
+}
+
+// catalog returns the document catalog, or nil if it cannot be read.
+func (d *Document) catalog() Dict {
+	catalog, _ := d.Resolve(d.trailer["Root"]).(Dict)
+	return catalog
+}
+
+// readXref reads the cross-reference sections, starting with the last one.
+func (d *Document) readXref() error {
+	i := bytes.LastIndex(d.data, []byte("startxref"))
+	if i < 0 {
+		return fmt.Errorf("startxref not found")
+	}
+	tok, err := newLexer(d.data, i+len("startxref")).token()
+	if err != nil {
+		return fmt.Errorf("invalid startxref: %v", err)
+	}
+	offset, ok := tok.(int64)
+	if !ok {
+		return fmt.Errorf("invalid startxref")
+	}
+
+	visited := map[int64]bool{}
+	for {
+		if visited[offset] {
+			return nil
+		}
+		visited[offset] = true
+
+		pos := int(offset) + d.header
+		if pos < 0 || pos >= len(d.data) {
+			return fmt.Errorf("invalid cross-reference offset %d", offset)
+		}
+
+		var trailer Dict
+		if l := newLexer(d.data, pos); isKeyword(l, "xref") {
+			trailer, err = d.readXrefTable(l)
+		} else {
+			trailer, err = d.readXrefStream(pos)
+		}
+		if err != nil {
+			return err
+		}
+
+		if d.trailer == nil {
+			d.trailer = trailer
+			d.startxref = offset
+			d.xrefStream = trailer["Type"] == Name("XRef")
+		}
+
+		// Hybrid files list some objects in a cross-reference stream
+		if stm, ok := trailer["XRefStm"].(int64); ok {
+			if _, err := d.readXrefStream(int(stm) + d.header); err != nil {
+				return err
+			}
+		}
+
+		prev, ok := trailer["Prev"].(int64)
+		if !ok {
+			return nil
+		}
+		offset = prev
+	}
+}
+
+func isKeyword(l *lexer, word keyword) bool {
+	save := l.pos
+	tok, err := l.token()
+	if err == nil && tok == word {
+		return true
+	}
+	l.pos = save
+	return false
+}
+
+// readXrefTable reads a cross-reference table and its trailer. Entries
+// already known come from a more recent section and are kept.
+func (d *Document) readXrefTable(l *lexer) (Dict, error) {
+	for {
+		if isKeyword(l, "trailer") {
+			obj, err := l.object()
+			if err != nil {
+				return nil, fmt.Errorf("invalid trailer: %v", err)
+			}
+			trailer, ok := obj.(Dict)
+			if !ok {
+				return nil, fmt.Errorf("invalid trailer")
+			}
+			return trailer, nil
+		}
+
+		first, err1 := l.token()
+		count, err2 := l.token()
+		start, ok1 := first.(int64)
+		n, ok2 := count.(int64)
+		if err1 != nil || err2 != nil || !ok1 || !ok2 || n < 0 {
+			return nil, fmt.Errorf("invalid cross-reference table")
+		}
+
+		for num := int(start); num < int(start+n); num++ {
+			offset, err1 := l.token()
+			gen, err2 := l.token()
+			kind, err3 := l.token()
+			if err1 != nil || err2 != nil || err3 != nil {
+				return nil, fmt.Errorf("invalid cross-reference entry")
+			}
+			o, ok1 := offset.(int64)
+			g, ok2 := gen.(int64)
+			if !ok1 || !ok2 {
+				return nil, fmt.Errorf("invalid cross-reference entry")
+			}
+			if _, known := d.xref[num]; known {
+				continue
+			}
+			switch kind {
+			case keyword("n"):
+				d.xref[num] = xrefEntry{offset: o, gen: int(g)}
+			case keyword("f"):
+				d.xref[num] = xrefEntry{offset: -1}
+			default:
+				return nil, fmt.Errorf("invalid cross-reference entry")
+			}
+		}
+	}
+}
+
+// readXrefStream reads the cross-reference stream at pos and returns its
+// dictionary, which is also the trailer.
+func (d *Document) readXrefStream(pos int) (Dict, error) {
+	_, obj, err := d.readIndirectObject(pos)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cross-reference stream: %v", err)
+	}
+	stream, ok := obj.(*Stream)
+	if !ok || stream.Dict["Type"] != Name("XRef") {
+		return nil, fmt.Errorf("invalid cross-reference stream")
+	}
+
+	data, err := d.Decode(stream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cross-reference stream: %v", err)
+	}
+
+	var widths [3]int
+	w, _ := stream.Dict["W"].(Array)
+	if len(w) != 3 {
+		return nil, fmt.Errorf("invalid cross-reference stream widths")
+	}
+	for i := range widths {
+		widths[i], _ = integer(w[i])
+		if widths[i] < 0 || widths[i] > 8 {
+			return nil, fmt.Errorf("invalid cross-reference stream widths")
+		}
+	}
+	entrySize := widths[0] + widths[1] + widths[2]
+	if entrySize == 0 {
+		return nil, fmt.Errorf("invalid cross-reference stream widths")
+	}
+
+	index, _ := stream.Dict["Index"].(Array)
+	if index == nil {
+		size, _ := integer(stream.Dict["Size"])
+		index = Array{int64(0), int64(size)}
+	}
+
+	field := func(b []byte, def int64) int64 {
+		if len(b) == 0 {
+			return def
+		}
+		var v int64
+		for _, c := range b {
+			v = v<<8 | int64(c)
+		}
+		return v
+	}
+
+	pos = 0
+	for i := 0; i+1 < len(index); i += 2 {
+		start, _ := integer(index[i])
+		count, _ := integer(index[i+1])
+		for num := start; num < start+count; num++ {
+			if pos+entrySize > len(data) {
+				return stream.Dict, nil
+			}
+			entry := data[pos : pos+entrySize]
+			pos += entrySize
+
+			kind := field(entry[:widths[0]], 1)
+			f2 := field(entry[widths[0]:widths[0]+widths[1]], 0)
+			f3 := field(entry[widths[0]+widths[1]:], 0)
+
+			if _, known := d.xref[num]; known {
+				continue
+			}
+			switch kind {
+			case 0:
+				d.xref[num] = xrefEntry{offset: -1}
+			case 1:
+				d.xref[num] = xrefEntry{offset: f2, gen: int(f3)}
+			case 2:
+				d.xref[num] = xrefEntry{inStream: true, stream: int(f2)}
+			}
+		}
+	}
+	return stream.Dict, nil
+}
+
+var objectHeader = regexp.MustCompile(`(?m)(?:^|[^0-9])(\d+)[ \t\r\n\f\x00]+(\d+)[ \t\r\n\f\x00]+obj\b`)
+
+// rebuildXref scans the whole file for objects, for documents whose
+// cross-reference table is missing or damaged. The last definition of an
+// object wins, as with incremental updates.
+func (d *Document) rebuildXref() error {
+	for _, m := range objectHeader.FindAllSubmatchIndex(d.data, -1) {
+		num, err1 := strconv.Atoi(string(d.data[m[2]:m[3]]))
+		gen, err2 := strconv.Atoi(string(d.data[m[4]:m[5]]))
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		d.xref[num] = xrefEntry{offset: int64(m[2] - d.header), gen: gen}
+	}
+
+	// Objects stored in object streams, unless also defined directly
+	var streams []int
+	for num := range d.xref {
+		if s, ok := d.Resolve(Ref{Num: num}).(*Stream); ok && s.Dict["Type"] == Name("ObjStm") {
+			streams = append(streams, num)
+		}
+	}
+	for _, num := range streams {
+		objs, err := d.objectStream(num)
+		if err != nil {
+			continue
+		}
+		for obj := range objs.offsets {
+			if _, known := d.xref[obj]; !known {
+				d.xref[obj] = xrefEntry{inStream: true, stream: num}
+			}
+		}
+	}
+
+	// Use the last trailer pointing to a catalog, or look for the catalog
+	for i := len(d.data); ; {
+		i = bytes.LastIndex(d.data[:i], []byte("trailer"))
+		if i < 0 {
+			break
+		}
+		obj, err := newLexer(d.data, i+len("trailer")).object()
+		if trailer, ok := obj.(Dict); err == nil && ok {
+			if _, ok := d.Resolve(trailer["Root"]).(Dict); ok {
+				d.trailer = trailer
+				return nil
+			}
+		}
+	}
+	for num := range d.xref {
+		obj := d.Resolve(Ref{Num: num})
+		if s, ok := obj.(*Stream); ok && s.Dict["Type"] == Name("XRef") {
+			if _, ok := d.Resolve(s.Dict["Root"]).(Dict); ok {
+				d.trailer = s.Dict
+				return nil
+			}
+		}
+	}
+	for num := range d.xref {
+		if dict, ok := d.Resolve(Ref{Num: num}).(Dict); ok && dict["Type"] == Name("Catalog") {
+			d.trailer = Dict{"Root": Ref{Num: num, Gen: d.xref[num].gen}}
+			return nil
+		}
+	}
+	return fmt.Errorf("document catalog not found")
+}
+
+// Resolve follows references until it reaches a direct object.
+// Missing or unreadable objects resolve to nil.
+func (d *Document) Resolve(obj Object) Object {
+	for i := 0; i < maxResolveDepth; i++ {
+		ref, ok := obj.(Ref)
+		if !ok {
+			return obj
+		}
+		obj = d.object(ref.Num)
+	}
+	return nil
+}
+
+// object returns the indirect object with the given number.
+func (d *Document) object(num int) Object {
+	if obj, ok := d.objects[num]; ok {
+		return obj
+	}
+	// A reference cycle, e.g. a stream length referring to the stream itself
+	if d.loading[num] {
+		return nil
+	}
+	d.loading[num] = true
+	defer delete(d.loading, num)
+
+	var obj Object
+	entry, ok := d.xref[num]
+	switch {
+	case !ok || (!entry.inStream && entry.offset < 0):
+	case entry.inStream:
+		obj = d.objectInStream(num, entry)
+	default:
+		n, o, err := d.readIndirectObject(int(entry.offset) + d.header)
+		if err == nil && n == num {
+			obj = o
+			// Objects in object streams are decrypted with their stream
+			if d.security != nil && num != d.security.encrypt {
+				obj = d.security.decryptObject(num, entry.gen, obj)
+			}
+		}
+	}
+
+	d.objects[num] = obj
+	return obj
+}
+
+// readIndirectObject reads "num gen obj ... endobj" at pos.
+func (d *Document) readIndirectObject(pos int) (int, Object, error) {
+	l := newLexer(d.data, pos)
+	num, err1 := l.token()
+	gen, err2 := l.token()
+	if err1 != nil || err2 != nil || !isKeyword(l, "obj") {
+		return 0, nil, fmt.Errorf("object not found at offset %d", pos)
+	}
+	n, ok1 := num.(int64)
+	_, ok2 := gen.(int64)
+	if !ok1 || !ok2 {
+		return 0, nil, fmt.Errorf("object not found at offset %d", pos)
+	}
+
+	obj, err := l.object()
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid object %d: %v", n, err)
+	}
+
+	dict, ok := obj.(Dict)
+	if !ok || !isKeyword(l, "stream") {
+		return int(n), obj, nil
+	}
+
+	// The stream keyword is followed by an end of line
+	start := l.pos
+	if start < len(d.data) && d.data[start] == '\r' {
+		start++
+	}
+	if start < len(d.data) && d.data[start] == '\n' {
+		start++
+	}
+
+	end := -1
+	if length, ok := integer(d.Resolve(dict["Length"])); ok && length >= 0 && start+length <= len(d.data) {
+		// Check that the length is right
+		after := newLexer(d.data, start+length)
+		if isKeyword(after, "endstream") {
+			end = start + length
+		}
+	}
+	if end < 0 {
+		i := bytes.Index(d.data[start:], []byte("endstream"))
+		if i < 0 {
+			return 0, nil, fmt.Errorf("invalid stream %d: endstream not found", n)
+		}
+		end = start + i
+		if end > start && d.data[end-1] == '\n' {
+			end--
+		}
+		if end > start && d.data[end-1] == '\r' {
+			end--
+		}
+	}
+
+	return int(n), &Stream{Dict: dict, Data: d.data[start:end]}, nil
+}
+
+// objectInStream reads an object stored in an object stream.
+func (d *Document) objectInStream(num int, entry xrefEntry) Object {
+	objs, err := d.objectStream(entry.stream)
+	if err != nil {
+		return nil
+	}
+	offset, ok := objs.offsets[num]
+	if !ok {
+		return nil
+	}
+	obj, err := newLexer(objs.data, offset).object()
+	if err != nil {
+		return nil
+	}
+	return obj
+}
+
+// objectStream decodes the object stream with the given object number.
+func (d *Document) objectStream(num int) (*objectStream, error) {
+	if objs, ok := d.streams[num]; ok {
+		return objs, nil
+	}
+
+	stream, ok := d.Resolve(Ref{Num: num}).(*Stream)
+	if !ok {
+		return nil, fmt.Errorf("object stream %d not found", num)
+	}
+	data, err := d.Decode(stream)
+	if err != nil {
+		return nil, err
+	}
+	n, _ := integer(stream.Dict["N"])
+	first, _ := integer(stream.Dict["First"])
+	if first < 0 || first > len(data) {
+		return nil, fmt.Errorf("invalid object stream %d", num)
+	}
+
+	objs := &objectStream{data: data, offsets: map[int]int{}}
+	l := newLexer(data[:first], 0)
+	for i := 0; i < n; i++ {
+		obj, err1 := l.token()
+		offset, err2 := l.token()
+		o, ok1 := obj.(int64)
+		off, ok2 := offset.(int64)
+		if err1 != nil || err2 != nil || !ok1 || !ok2 {
+			break
+		}
+		objs.offsets[int(o)] = first + int(off)
+	}
+
+	d.streams[num] = objs
+	return objs, nil
+}
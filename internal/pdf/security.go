@@ -0,0 +1,393 @@
+package pdf
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rc4"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash"
+)
+
+// passwordPadding pads passwords to 32 bytes (revisions 2 to 4)
+var passwordPadding = []byte{
+	0x28, 0xbf, 0x4e, 0x5e, 0x4e, 0x75, 0x8a, 0x41, 0x64, 0x00, 0x4e, 0x56, 0xff, 0xfa, 0x01, 0x08,
+	0x2e, 0x2e, 0x00, 0xb6, 0xd0, 0x68, 0x3e, 0x80, 0x2f, 0x0c, 0xa9, 0xfe, 0x64, 0x53, 0x69, 0x7a,
+}
+
+// cryptMethod is the algorithm of a crypt filter
+type cryptMethod int
+
+const (
+	cryptNone cryptMethod = iota
+	cryptRC4
+	cryptAESV2 // AES-128
+	cryptAESV3 // AES-256
+)
+
+// securityHandler decrypts the strings and streams of a document encrypted
+// with the standard security handler, whose key is computed from a password.
+type securityHandler struct {
+	key             []byte
+	streams         cryptMethod
+	strings         cryptMethod
+	encryptMetadata bool
+	// encrypt is the object number of the encryption dictionary, which is not encrypted
+	encrypt int
+}
+
+// newSecurityHandler authenticates password, as the user or the owner
+// password, against the encryption dictionary of the document. It returns
+// ErrEncrypted if the password is wrong.
+func (d *Document) newSecurityHandler(password string) (*securityHandler, error) {
+	dict, ok := d.Resolve(d.trailer["Encrypt"]).(Dict)
+	if !ok {
+		return nil, fmt.Errorf("%w: invalid encryption dictionary", ErrUnsupportedEncryption)
+	}
+	if filter, _ := dict["Filter"].(Name); filter != "Standard" {
+		return nil, fmt.Errorf("%w: %s security handler", ErrUnsupportedEncryption, filter)
+	}
+
+	v, _ := integer(dict["V"])
+	r, _ := integer(dict["R"])
+	o, _ := dict["O"].(String)
+	u, _ := dict["U"].(String)
+	p, _ := integer(dict["P"])
+	h := &securityHandler{encryptMetadata: true}
+	if ref, ok := d.trailer["Encrypt"].(Ref); ok {
+		h.encrypt = ref.Num
+	}
+	if b, ok := dict["EncryptMetadata"].(bool); ok {
+		h.encryptMetadata = b
+	}
+
+	length := 40
+	switch v {
+	case 1:
+		h.streams, h.strings = cryptRC4, cryptRC4
+	case 2:
+		h.streams, h.strings = cryptRC4, cryptRC4
+		if l, ok := integer(dict["Length"]); ok {
+			length = l
+		}
+	case 4, 5:
+		var err error
+		if h.streams, length, err = cryptFilter(dict, "StmF"); err != nil {
+			return nil, err
+		}
+		var strLength int
+		if h.strings, strLength, err = cryptFilter(dict, "StrF"); err != nil {
+			return nil, err
+		}
+		length = max(length, strLength)
+	default:
+		return nil, fmt.Errorf("%w: encryption version %d", ErrUnsupportedEncryption, v)
+	}
+	if length < 40 || length > 256 || length%8 != 0 {
+		return nil, fmt.Errorf("%w: key length %d", ErrUnsupportedEncryption, length)
+	}
+
+	switch {
+	case r >= 2 && r <= 4:
+		if len(o) < 32 || len(u) < 32 {
+			return nil, fmt.Errorf("%w: invalid O or U entry", ErrUnsupportedEncryption)
+		}
+		var id []byte
+		if ids, ok := d.trailer["ID"].(Array); ok && len(ids) > 0 {
+			first, _ := ids[0].(String)
+			id = []byte(first)
+		}
+		n := length / 8
+		if r == 2 {
+			n = 5
+		}
+		user := []byte(password)
+		key := userKey(user, []byte(o[:32]), uint32(p), id, r, n, h.encryptMetadata)
+		if !checkUserKey(key, []byte(u), id, r) {
+			// The owner password gives the user password
+			user = ownerToUser([]byte(password), []byte(o[:32]), r, n)
+			key = userKey(user, []byte(o[:32]), uint32(p), id, r, n, h.encryptMetadata)
+			if !checkUserKey(key, []byte(u), id, r) {
+				return nil, ErrEncrypted
+			}
+		}
+		h.key = key
+	case r == 5 || r == 6:
+		oe, _ := dict["OE"].(String)
+		ue, _ := dict["UE"].(String)
+		if len(o) < 48 || len(u) < 48 || len(oe) < 32 || len(ue) < 32 {
+			return nil, fmt.Errorf("%w: invalid O, U, OE or UE entry", ErrUnsupportedEncryption)
+		}
+		pw := []byte(password)
+		if len(pw) > 127 {
+			pw = pw[:127]
+		}
+		var encryptedKey, intermediate []byte
+		switch {
+		case bytes.Equal(hashR6(pw, []byte(u[32:40]), nil, r), []byte(u[:32])):
+			encryptedKey, intermediate = []byte(ue[:32]), hashR6(pw, []byte(u[40:48]), nil, r)
+		case bytes.Equal(hashR6(pw, []byte(o[32:40]), []byte(u[:48]), r), []byte(o[:32])):
+			encryptedKey, intermediate = []byte(oe[:32]), hashR6(pw, []byte(o[40:48]), []byte(u[:48]), r)
+		default:
+			return nil, ErrEncrypted
+		}
+		block, err := aes.NewCipher(intermediate)
+		if err != nil {
+			return nil, err
+		}
+		h.key = make([]byte, 32)
+		cipher.NewCBCDecrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(h.key, encryptedKey)
+	default:
+		return nil, fmt.Errorf("%w: revision %d", ErrUnsupportedEncryption, r)
+	}
+	return h, nil
+}
+
+// cryptFilter returns the method and key length, in bits, of the crypt
+// filter named by the given entry of the encryption dictionary.
+func cryptFilter(dict Dict, entry Name) (cryptMethod, int, error) {
+	name, _ := dict[entry].(Name)
+	if name == "" || name == "Identity" {
+		return cryptNone, 0, nil
+	}
+	filters, _ := dict["CF"].(Dict)
+	filter, ok := filters[name].(Dict)
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: crypt filter %s not found", ErrUnsupportedEncryption, name)
+	}
+	length, _ := integer(filter["Length"])
+	// The length is given in bytes, although some producers give it in bits
+	if length > 0 && length <= 32 {
+		length *= 8
+	}
+	switch method, _ := filter["CFM"].(Name); method {
+	case "None", "":
+		return cryptNone, 0, nil
+	case "V2":
+		if length == 0 {
+			length = 128
+		}
+		return cryptRC4, length, nil
+	case "AESV2":
+		return cryptAESV2, 128, nil
+	case "AESV3":
+		return cryptAESV3, 256, nil
+	default:
+		return 0, 0, fmt.Errorf("%w: crypt filter method %s", ErrUnsupportedEncryption, method)
+	}
+}
+
+// padPassword pads or truncates a password to 32 bytes
+func padPassword(password []byte) []byte {
+	padded := make([]byte, 32)
+	n := copy(padded, password)
+	copy(padded[n:], passwordPadding)
+	return padded
+}
+
+// userKey computes the encryption key from the user password (algorithm 2).
+func userKey(password, o []byte, p uint32, id []byte, r, n int, encryptMetadata bool) []byte {
+	h := md5.New()
+	h.Write(padPassword(password))
+	h.Write(o)
+	binary.Write(h, binary.LittleEndian, p)
+	h.Write(id)
+	if r >= 4 && !encryptMetadata {
+		h.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	}
+	key := h.Sum(nil)
+	if r >= 3 {
+		for i := 0; i < 50; i++ {
+			sum := md5.Sum(key[:n])
+			key = sum[:]
+		}
+	}
+	return key[:n]
+}
+
+// checkUserKey checks a key computed from the user password against the U
+// entry (algorithms 4 and 5).
+func checkUserKey(key, u []byte, id []byte, r int) bool {
+	if r == 2 {
+		return bytes.Equal(rc4Crypt(key, passwordPadding), u[:32])
+	}
+	h := md5.New()
+	h.Write(passwordPadding)
+	h.Write(id)
+	data := rc4Crypt(key, h.Sum(nil))
+	for i := 1; i <= 19; i++ {
+		data = rc4Crypt(xorKey(key, byte(i)), data)
+	}
+	return bytes.Equal(data, u[:16])
+}
+
+// ownerToUser decrypts the user password from the O entry with the owner
+// password (algorithm 7).
+func ownerToUser(password, o []byte, r, n int) []byte {
+	sum := md5.Sum(padPassword(password))
+	key := sum[:]
+	if r >= 3 {
+		for i := 0; i < 50; i++ {
+			sum = md5.Sum(key)
+			key = sum[:]
+		}
+	}
+	key = key[:n]
+
+	if r == 2 {
+		return rc4Crypt(key, o)
+	}
+	user := o
+	for i := 19; i >= 0; i-- {
+		user = rc4Crypt(xorKey(key, byte(i)), user)
+	}
+	return user
+}
+
+func xorKey(key []byte, b byte) []byte {
+	k := make([]byte, len(key))
+	for i := range key {
+		k[i] = key[i] ^ b
+	}
+	return k
+}
+
+func rc4Crypt(key, data []byte) []byte {
+	c, err := rc4.NewCipher(key)
+	if err != nil {
+		return nil
+	}
+	out := make([]byte, len(data))
+	c.XORKeyStream(out, data)
+	return out
+}
+
+// hashR6 computes the password hash of revision 5, a single SHA-256, or of
+// revision 6 (algorithm 2.B). udata is the U entry for owner passwords.
+func hashR6(password, salt, udata []byte, r int) []byte {
+	h := sha256.New()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(udata)
+	k := h.Sum(nil)
+	if r == 5 {
+		return k
+	}
+
+	for i := 0; ; i++ {
+		k1 := bytes.Repeat(append(append(append([]byte{}, password...), k...), udata...), 64)
+		block, _ := aes.NewCipher(k[:16])
+		e := make([]byte, len(k1))
+		cipher.NewCBCEncrypter(block, k[16:32]).CryptBlocks(e, k1)
+
+		var sum int
+		for _, b := range e[:16] {
+			sum += int(b)
+		}
+		var next hash.Hash
+		switch sum % 3 {
+		case 0:
+			next = sha256.New()
+		case 1:
+			next = sha512.New384()
+		default:
+			next = sha512.New()
+		}
+		next.Write(e)
+		k = next.Sum(nil)
+
+		if i >= 63 && int(e[len(e)-1]) <= i-31 {
+			break
+		}
+	}
+	return k[:32]
+}
+
+// objectKey computes the key of an indirect object (algorithm 1).
+func (h *securityHandler) objectKey(method cryptMethod, num, gen int) []byte {
+	if method == cryptAESV3 {
+		return h.key
+	}
+	m := md5.New()
+	m.Write(h.key)
+	m.Write([]byte{byte(num), byte(num >> 8), byte(num >> 16), byte(gen), byte(gen >> 8)})
+	if method == cryptAESV2 {
+		m.Write([]byte("sAlT"))
+	}
+	return m.Sum(nil)[:min(len(h.key)+5, 16)]
+}
+
+// decrypt decrypts data of the given object with the given method.
+func (h *securityHandler) decrypt(method cryptMethod, num, gen int, data []byte) ([]byte, error) {
+	switch method {
+	case cryptNone:
+		return data, nil
+	case cryptRC4:
+		return rc4Crypt(h.objectKey(method, num, gen), data), nil
+	}
+
+	// AES in CBC mode, the initialization vector preceding the data
+	if len(data) < 2*aes.BlockSize || len(data)%aes.BlockSize != 0 {
+		if len(data) == 0 {
+			return data, nil
+		}
+		return nil, fmt.Errorf("invalid AES data length %d", len(data))
+	}
+	block, err := aes.NewCipher(h.objectKey(method, num, gen))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(data)-aes.BlockSize)
+	cipher.NewCBCDecrypter(block, data[:aes.BlockSize]).CryptBlocks(out, data[aes.BlockSize:])
+
+	// PKCS#5 padding
+	pad := int(out[len(out)-1])
+	if pad < 1 || pad > aes.BlockSize {
+		return nil, fmt.Errorf("invalid AES padding")
+	}
+	return out[:len(out)-pad], nil
+}
+
+// decryptObject decrypts the strings and streams of an indirect object.
+func (h *securityHandler) decryptObject(num, gen int, obj Object) Object {
+	switch v := obj.(type) {
+	case String:
+		data, err := h.decrypt(h.strings, num, gen, []byte(v))
+		if err != nil {
+			return v
+		}
+		return String(data)
+	case Array:
+		a := make(Array, len(v))
+		for i, item := range v {
+			a[i] = h.decryptObject(num, gen, item)
+		}
+		return a
+	case Dict:
+		d := make(Dict, len(v))
+		for key, value := range v {
+			d[key] = h.decryptObject(num, gen, value)
+		}
+		return d
+	case *Stream:
+		s := &Stream{Dict: h.decryptObject(num, gen, v.Dict).(Dict), Data: v.Data}
+		switch v.Dict["Type"] {
+		case Name("XRef"):
+			// Cross-reference streams are not encrypted
+			return s
+		case Name("Metadata"):
+			if !h.encryptMetadata {
+				return s
+			}
+		}
+		if data, err := h.decrypt(h.streams, num, gen, v.Data); err == nil {
+			s.Data = data
+		}
+		return s
+	}
+	return obj
+}
@@ -0,0 +1,235 @@
+package pdf
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testEncryption chiffre les documents de test avec le gestionnaire de
+// sécurité standard, en suivant les algorithmes de la norme ISO 32000.
+type testEncryption struct {
+	method  cryptMethod
+	key     []byte
+	id      []byte
+	encrypt string // dictionnaire de chiffrement
+}
+
+const testPermissions = -3904
+
+func newTestEncryption(r int, method cryptMethod, user, owner string) *testEncryption {
+	e := &testEncryption{method: method, id: []byte("0123456789abcdef")}
+
+	if r == 6 {
+		e.key = bytes.Repeat([]byte{0x42}, 32)
+		validationSalt, keySalt := []byte("uvsalt01"), []byte("uksalt01")
+		u := append(append(hashR6([]byte(user), validationSalt, nil, 6), validationSalt...), keySalt...)
+		ue := aesNoIV(hashR6([]byte(user), keySalt, nil, 6), e.key)
+		ownerValidationSalt, ownerKeySalt := []byte("ovsalt01"), []byte("oksalt01")
+		o := append(append(hashR6([]byte(owner), ownerValidationSalt, u, 6), ownerValidationSalt...), ownerKeySalt...)
+		oe := aesNoIV(hashR6([]byte(owner), ownerKeySalt, u, 6), e.key)
+		e.encrypt = fmt.Sprintf("<< /Filter /Standard /V 5 /R 6 /Length 256 /P %d /O <%x> /U <%x> /OE <%x> /UE <%x> /Perms <%x> "+
+			"/CF << /StdCF << /CFM /AESV3 /AuthEvent /DocOpen /Length 32 >> >> /StmF /StdCF /StrF /StdCF >>",
+			testPermissions, o, u, oe, ue, make([]byte, 16))
+		return e
+	}
+
+	n := 16
+	if r == 2 {
+		n = 5
+	}
+
+	// Algorithme 3 : entrée O
+	sum := md5.Sum(padPassword([]byte(owner)))
+	ownerKey := sum[:]
+	if r >= 3 {
+		for i := 0; i < 50; i++ {
+			sum = md5.Sum(ownerKey)
+			ownerKey = sum[:]
+		}
+	}
+	ownerKey = ownerKey[:n]
+	o := rc4Crypt(ownerKey, padPassword([]byte(user)))
+	if r >= 3 {
+		for i := 1; i <= 19; i++ {
+			o = rc4Crypt(xorKey(ownerKey, byte(i)), o)
+		}
+	}
+
+	// Algorithme 2 : clé du document, algorithmes 4 et 5 : entrée U
+	permissions := int32(testPermissions)
+	e.key = userKey([]byte(user), o, uint32(permissions), e.id, r, n, true)
+	var u []byte
+	if r == 2 {
+		u = rc4Crypt(e.key, passwordPadding)
+	} else {
+		h := md5.Sum(append(append([]byte{}, passwordPadding...), e.id...))
+		u = rc4Crypt(e.key, h[:])
+		for i := 1; i <= 19; i++ {
+			u = rc4Crypt(xorKey(e.key, byte(i)), u)
+		}
+		u = append(u, bytes.Repeat([]byte{0}, 16)...)
+	}
+
+	switch r {
+	case 2:
+		e.encrypt = fmt.Sprintf("<< /Filter /Standard /V 1 /R 2 /P %d /O <%x> /U <%x> >>", testPermissions, o, u)
+	case 3:
+		e.encrypt = fmt.Sprintf("<< /Filter /Standard /V 2 /R 3 /Length 128 /P %d /O <%x> /U <%x> >>", testPermissions, o, u)
+	case 4:
+		e.encrypt = fmt.Sprintf("<< /Filter /Standard /V 4 /R 4 /Length 128 /P %d /O <%x> /U <%x> "+
+			"/CF << /StdCF << /CFM /AESV2 /AuthEvent /DocOpen /Length 16 >> >> /StmF /StdCF /StrF /StdCF >>",
+			testPermissions, o, u)
+	}
+	return e
+}
+
+// aesNoIV chiffre data en AES-256 CBC avec un vecteur d'initialisation nul
+func aesNoIV(key, data []byte) []byte {
+	block, _ := aes.NewCipher(key)
+	out := make([]byte, len(data))
+	cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(out, data)
+	return out
+}
+
+// encryptData chiffre les données de l'objet num.
+func (e *testEncryption) encryptData(num int, data []byte) []byte {
+	h := &securityHandler{key: e.key}
+	key := h.objectKey(e.method, num, 0)
+	if e.method == cryptRC4 {
+		return rc4Crypt(key, data)
+	}
+
+	pad := aes.BlockSize - len(data)%aes.BlockSize
+	data = append(append([]byte{}, data...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	iv := []byte("initialisation16")
+	block, _ := aes.NewCipher(key)
+	out := make([]byte, len(data))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, data)
+	return append(iv, out...)
+}
+
+// apply chiffre les flux du document et retourne les entrées du trailer.
+func (e *testEncryption) apply(p *testPDF) string {
+	for num := range p.streams {
+		body := p.objects[num-1]
+		start := strings.Index(body, "\nstream\n") + len("\nstream\n")
+		end := strings.LastIndex(body, "\nendstream")
+		data := e.encryptData(num, []byte(body[start:end]))
+		dict := body[:strings.LastIndex(body[:start], "/Length")]
+		p.objects[num-1] = fmt.Sprintf("%s/Length %d >>\nstream\n%s\nendstream", dict, len(data), data)
+	}
+	encrypt := p.add(e.encrypt)
+	return fmt.Sprintf("/Encrypt %d 0 R /ID [<%x> <%x>]", encrypt, e.id, e.id)
+}
+
+// encryptedTestPDF construit un document chiffré avec un titre et une page de texte.
+func encryptedTestPDF(e *testEncryption) []byte {
+	p := &testPDF{}
+	font := p.add(helvetica)
+	page := p.page(fmt.Sprintf("<< /Font << /F1 %d 0 R >> >>", font), "BT /F1 12 Tf 72 700 Td (Relev\\351 de compte) Tj ET", true)
+	root := p.catalog(page)
+	info := p.add("")
+	p.objects[info-1] = fmt.Sprintf("<< /Title <%x> >>", e.encryptData(info, []byte("Relevé")))
+	trailer := e.apply(p)
+	return p.bytes(root, fmt.Sprintf("%s /Info %d 0 R", trailer, info))
+}
+
+func TestOpenWithPassword(t *testing.T) {
+	tests := []struct {
+		name   string
+		r      int
+		method cryptMethod
+	}{
+		{"RC4 40 bits", 2, cryptRC4},
+		{"RC4 128 bits", 3, cryptRC4},
+		{"AES 128 bits", 4, cryptAESV2},
+		{"AES 256 bits", 6, cryptAESV3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := encryptedTestPDF(newTestEncryption(tt.r, tt.method, "12345678", "propriétaire"))
+
+			_, err := Open(data)
+			assert.ErrorIs(t, err, ErrEncrypted)
+			_, err = OpenWithPassword(data, "87654321")
+			assert.ErrorIs(t, err, ErrEncrypted)
+
+			// Mot de passe utilisateur ou propriétaire
+			for _, password := range []string{"12345678", "propriétaire"} {
+				doc, err := OpenWithPassword(data, password)
+				if !assert.NoError(t, err, password) {
+					continue
+				}
+				assert.True(t, doc.Encrypted())
+				text, err := doc.Text()
+				assert.NoError(t, err)
+				assert.Equal(t, "Relevé de compte", text)
+				info, _ := doc.Resolve(doc.Trailer()["Info"]).(Dict)
+				assert.Equal(t, String("Relevé"), info["Title"])
+			}
+
+			// Copie déchiffrée
+			doc, err := OpenWithPassword(data, "12345678")
+			assert.NoError(t, err)
+			decrypted, err := doc.Rewrite()
+			assert.NoError(t, err)
+			assert.NotContains(t, string(decrypted), "/Encrypt")
+			plain, err := Open(decrypted)
+			if assert.NoError(t, err) {
+				assert.False(t, plain.Encrypted())
+				text, err := plain.Text()
+				assert.NoError(t, err)
+				assert.Equal(t, "Relevé de compte", text)
+			}
+		})
+	}
+}
+
+func TestOpenWithEmptyUserPassword(t *testing.T) {
+	// Seul le mot de passe propriétaire restreint l'impression ou la copie
+	data := encryptedTestPDF(newTestEncryption(4, cryptAESV2, "", "propriétaire"))
+	doc, err := Open(data)
+	if assert.NoError(t, err) {
+		assert.True(t, doc.Encrypted())
+		text, err := doc.Text()
+		assert.NoError(t, err)
+		assert.Equal(t, "Relevé de compte", text)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	p := &testPDF{}
+	font := p.add(helvetica)
+	page := p.page(fmt.Sprintf("<< /Font << /F1 %d 0 R >> >>", font), "BT /F1 12 Tf 72 700 Td (Texte \\(1\\)) Tj ET", true)
+	root := p.catalog(page)
+	info := p.add("<< /Title (Facture \\(copie\\)) /Keywords <00ff> /Author /Nom#20compos#c3#a9 >>")
+	p.objects[root-1] = strings.Replace(p.objects[root-1], ">>", fmt.Sprintf("/Info %d 0 R >>", info), 1)
+
+	// Les objets des flux d'objets sont écrits directement
+	data, err := mustOpen(t, p.compressedBytes(root)).Rewrite()
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "/ObjStm")
+	doc := mustOpen(t, data)
+	text, err := doc.Text()
+	assert.NoError(t, err)
+	assert.Equal(t, "Texte (1)", text)
+	catalog := doc.catalog()
+	dict, _ := doc.Resolve(catalog["Info"]).(Dict)
+	assert.Equal(t, Dict{"Title": String("Facture (copie)"), "Keywords": String("\x00\xff"), "Author": Name("Nom composé")}, dict)
+}
+
+func mustOpen(t *testing.T, data []byte) *Document {
+	doc, err := Open(data)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return doc
+}
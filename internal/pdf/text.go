@@ -0,0 +1,462 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+const (
+	// maxFormDepth limits the nesting of form XObjects
+	maxFormDepth = 8
+	// maxPageDepth limits the depth of the page tree
+	maxPageDepth = 32
+)
+
+// ExtractText returns the text of the PDF document held in data.
+func ExtractText(data []byte) (string, error) {
+	doc, err := Open(data)
+	if err != nil {
+		return "", err
+	}
+	return doc.Text()
+}
+
+// page is a page object, with its inherited resources.
+type page struct {
+	dict      Dict
+	resources Dict
+}
+
+// pages returns the pages of the document, in order.
+func (d *Document) pages() []page {
+	var pages []page
+	visited := map[Ref]bool{}
+
+	var walk func(node Object, resources Dict, depth int)
+	walk = func(node Object, resources Dict, depth int) {
+		if ref, ok := node.(Ref); ok {
+			if visited[ref] {
+				return
+			}
+			visited[ref] = true
+		}
+		dict, ok := d.Resolve(node).(Dict)
+		if !ok || depth > maxPageDepth {
+			return
+		}
+		if r, ok := d.Resolve(dict["Resources"]).(Dict); ok {
+			resources = r
+		}
+
+		kids, isNode := d.Resolve(dict["Kids"]).(Array)
+		if !isNode || dict["Type"] == Name("Page") {
+			pages = append(pages, page{dict: dict, resources: resources})
+			return
+		}
+		for _, kid := range kids {
+			walk(kid, resources, depth+1)
+		}
+	}
+
+	walk(d.catalog()["Pages"], nil, 0)
+	return pages
+}
+
+// NumPages returns the number of pages of the document.
+func (d *Document) NumPages() int {
+	return len(d.pages())
+}
+
+// Text returns the text of the document. Text is laid out in lines, as read
+// from top to bottom and from left to right; pages are separated by form feeds.
+func (d *Document) Text() (text string, err error) {
+	// Malformed files must not crash the caller
+	defer func() {
+		if r := recover(); r != nil {
+			text, err = "", fmt.Errorf("malformed PDF document: %v", r)
+		}
+	}()
+
+	pages := d.pages()
+	if len(pages) == 0 {
+		return "", fmt.Errorf("document has no pages")
+	}
+
+	fonts := map[Ref]*font{}
+	texts := make([]string, 0, len(pages))
+	for _, p := range pages {
+		e := &textExtractor{doc: d, fonts: fonts}
+		e.gs.ctm = identity
+		e.gs.scale = 1
+		e.run(d.contents(p.dict), p.resources, 0)
+		texts = append(texts, layout(e.runs))
+	}
+	return strings.Join(texts, "\f"), nil
+}
+
+// contents returns the decoded content streams of a page.
+func (d *Document) contents(dict Dict) []byte {
+	var streams []Object
+	switch c := d.Resolve(dict["Contents"]).(type) {
+	case *Stream:
+		streams = []Object{c}
+	case Array:
+		streams = c
+	}
+
+	var buf bytes.Buffer
+	for _, s := range streams {
+		stream, ok := d.Resolve(s).(*Stream)
+		if !ok {
+			continue
+		}
+		data, err := d.Decode(stream)
+		if err != nil {
+			continue
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// matrix is a transformation matrix [a b c d e f].
+type matrix [6]float64
+
+var identity = matrix{1, 0, 0, 1, 0, 0}
+
+// mul returns the product m × n.
+func (m matrix) mul(n matrix) matrix {
+	return matrix{
+		m[0]*n[0] + m[1]*n[2],
+		m[0]*n[1] + m[1]*n[3],
+		m[2]*n[0] + m[3]*n[2],
+		m[2]*n[1] + m[3]*n[3],
+		m[4]*n[0] + m[5]*n[2] + n[4],
+		m[4]*n[1] + m[5]*n[3] + n[5],
+	}
+}
+
+func toMatrix(operands []Object) (matrix, bool) {
+	var m matrix
+	if len(operands) < 6 {
+		return m, false
+	}
+	for i, op := range operands[len(operands)-6:] {
+		v, ok := number(op)
+		if !ok {
+			return m, false
+		}
+		m[i] = v
+	}
+	return m, true
+}
+
+// graphicsState holds the parts of the graphics state used to place text.
+type graphicsState struct {
+	ctm         matrix
+	font        *font
+	fontSize    float64
+	charSpacing float64
+	wordSpacing float64
+	scale       float64 // horizontal scaling, 1 for 100%
+	leading     float64
+	rise        float64
+}
+
+// textRun is a piece of text shown by a single operator.
+type textRun struct {
+	x, y, endX float64
+	size       float64
+	text       string
+}
+
+// textExtractor interprets content streams and records the text they show.
+type textExtractor struct {
+	doc   *Document
+	fonts map[Ref]*font
+	gs    graphicsState
+	stack []graphicsState
+	tm    matrix
+	tlm   matrix
+	runs  []textRun
+}
+
+func (e *textExtractor) run(content []byte, resources Dict, depth int) {
+	l := newLexer(content, 0)
+	var operands []Object
+	for {
+		obj, err := l.object()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			operands = operands[:0]
+			continue
+		}
+		op, ok := obj.(keyword)
+		if !ok {
+			operands = append(operands, obj)
+			continue
+		}
+		if op == "BI" {
+			skipInlineImage(l)
+		} else {
+			e.operator(op, operands, resources, depth)
+		}
+		operands = operands[:0]
+	}
+}
+
+// skipInlineImage skips the dictionary and the data of an inline image.
+func skipInlineImage(l *lexer) {
+	for {
+		tok, err := l.token()
+		if err != nil {
+			return
+		}
+		if tok == keyword("ID") {
+			break
+		}
+	}
+	for i := l.pos + 1; i+1 < len(l.data); i++ {
+		if l.data[i] == 'E' && l.data[i+1] == 'I' && isSpace(l.data[i-1]) &&
+			(i+2 == len(l.data) || isSpace(l.data[i+2])) {
+			l.pos = i + 2
+			return
+		}
+	}
+	l.pos = len(l.data)
+}
+
+func (e *textExtractor) operator(op keyword, operands []Object, resources Dict, depth int) {
+	arg := func(i int) float64 {
+		if i >= len(operands) {
+			return 0
+		}
+		v, _ := number(operands[i])
+		return v
+	}
+
+	switch op {
+	case "q":
+		e.stack = append(e.stack, e.gs)
+	case "Q":
+		if n := len(e.stack); n > 0 {
+			e.gs = e.stack[n-1]
+			e.stack = e.stack[:n-1]
+		}
+	case "cm":
+		if m, ok := toMatrix(operands); ok {
+			e.gs.ctm = m.mul(e.gs.ctm)
+		}
+	case "BT":
+		e.tm, e.tlm = identity, identity
+	case "Tf":
+		if len(operands) >= 2 {
+			name, _ := operands[len(operands)-2].(Name)
+			e.gs.font = e.font(resources, name)
+			e.gs.fontSize = arg(len(operands) - 1)
+		}
+	case "Tc":
+		e.gs.charSpacing = arg(0)
+	case "Tw":
+		e.gs.wordSpacing = arg(0)
+	case "Tz":
+		e.gs.scale = arg(0) / 100
+	case "TL":
+		e.gs.leading = arg(0)
+	case "Ts":
+		e.gs.rise = arg(0)
+	case "Td":
+		e.moveLine(arg(0), arg(1))
+	case "TD":
+		e.gs.leading = -arg(1)
+		e.moveLine(arg(0), arg(1))
+	case "Tm":
+		if m, ok := toMatrix(operands); ok {
+			e.tm, e.tlm = m, m
+		}
+	case "T*":
+		e.moveLine(0, -e.gs.leading)
+	case "Tj":
+		if len(operands) > 0 {
+			e.show(operands[len(operands)-1])
+		}
+	case "'":
+		e.moveLine(0, -e.gs.leading)
+		if len(operands) > 0 {
+			e.show(operands[len(operands)-1])
+		}
+	case "\"":
+		if len(operands) >= 3 {
+			e.gs.wordSpacing = arg(0)
+			e.gs.charSpacing = arg(1)
+			e.moveLine(0, -e.gs.leading)
+			e.show(operands[2])
+		}
+	case "TJ":
+		if len(operands) == 0 {
+			return
+		}
+		array, _ := operands[len(operands)-1].(Array)
+		for _, item := range array {
+			if v, ok := number(item); ok {
+				tx := -v / 1000 * e.gs.fontSize * e.gs.scale
+				e.tm = matrix{1, 0, 0, 1, tx, 0}.mul(e.tm)
+				continue
+			}
+			e.show(item)
+		}
+	case "Do":
+		if len(operands) > 0 && depth < maxFormDepth {
+			name, _ := operands[len(operands)-1].(Name)
+			e.form(resources, name, depth)
+		}
+	}
+}
+
+func (e *textExtractor) moveLine(tx, ty float64) {
+	e.tlm = matrix{1, 0, 0, 1, tx, ty}.mul(e.tlm)
+	e.tm = e.tlm
+}
+
+// font returns the font with the given name in the resources.
+func (e *textExtractor) font(resources Dict, name Name) *font {
+	fonts, _ := e.doc.Resolve(resources["Font"]).(Dict)
+	obj := fonts[name]
+	ref, isRef := obj.(Ref)
+	if isRef {
+		if f, ok := e.fonts[ref]; ok {
+			return f
+		}
+	}
+
+	dict, ok := e.doc.Resolve(obj).(Dict)
+	if !ok {
+		return nil
+	}
+	f := e.doc.loadFont(dict)
+	if isRef {
+		e.fonts[ref] = f
+	}
+	return f
+}
+
+// show records the text shown by a string and moves the text matrix.
+func (e *textExtractor) show(obj Object) {
+	s, ok := obj.(String)
+	if !ok || e.gs.font == nil {
+		return
+	}
+
+	gs := &e.gs
+	start := matrix{gs.fontSize * gs.scale, 0, 0, gs.fontSize, 0, gs.rise}.mul(e.tm).mul(gs.ctm)
+
+	var text strings.Builder
+	for _, g := range gs.font.decode(s) {
+		text.WriteString(g.text)
+		tx := g.width*gs.fontSize + gs.charSpacing
+		if g.space {
+			tx += gs.wordSpacing
+		}
+		e.tm = matrix{1, 0, 0, 1, tx * gs.scale, 0}.mul(e.tm)
+	}
+
+	if text.Len() == 0 {
+		return
+	}
+	end := matrix{1, 0, 0, 1, 0, gs.rise}.mul(e.tm).mul(gs.ctm)
+	e.runs = append(e.runs, textRun{
+		x:    start[4],
+		y:    start[5],
+		endX: end[4],
+		size: math.Hypot(start[2], start[3]),
+		text: text.String(),
+	})
+}
+
+// form shows the content of a form XObject.
+func (e *textExtractor) form(resources Dict, name Name, depth int) {
+	xobjects, _ := e.doc.Resolve(resources["XObject"]).(Dict)
+	stream, ok := e.doc.Resolve(xobjects[name]).(*Stream)
+	if !ok || stream.Dict["Subtype"] != Name("Form") {
+		return
+	}
+	data, err := e.doc.Decode(stream)
+	if err != nil {
+		return
+	}
+
+	formResources, ok := e.doc.Resolve(stream.Dict["Resources"]).(Dict)
+	if !ok {
+		formResources = resources
+	}
+
+	saved, tm, tlm := e.gs, e.tm, e.tlm
+	if m, ok := e.doc.Resolve(stream.Dict["Matrix"]).(Array); ok {
+		if fm, ok := toMatrix(m); ok {
+			e.gs.ctm = fm.mul(e.gs.ctm)
+		}
+	}
+	e.run(data, formResources, depth+1)
+	e.gs, e.tm, e.tlm = saved, tm, tlm
+}
+
+// layout groups the runs into lines, from top to bottom, and orders the
+// runs of a line from left to right. Spaces are added between runs that
+// are apart.
+func layout(runs []textRun) string {
+	sort.SliceStable(runs, func(i, j int) bool {
+		return runs[i].y > runs[j].y
+	})
+
+	var lines []string
+	for i := 0; i < len(runs); {
+		// Runs on the same baseline, give or take superscripts
+		top := runs[i]
+		tolerance := math.Max(top.size, 1) * 0.5
+		j := i + 1
+		for j < len(runs) && top.y-runs[j].y <= tolerance {
+			j++
+		}
+		line := runs[i:j]
+		i = j
+
+		sort.SliceStable(line, func(a, b int) bool {
+			return line[a].x < line[b].x
+		})
+		var text strings.Builder
+		for k, run := range line {
+			if k > 0 {
+				prev := line[k-1]
+				gap := run.x - prev.endX
+				size := math.Max(run.size, 1)
+				if (gap > size*0.2 || gap < -size) &&
+					!strings.HasSuffix(prev.text, " ") && !strings.HasPrefix(run.text, " ") {
+					text.WriteByte(' ')
+				}
+			}
+			text.WriteString(run.text)
+		}
+		lines = append(lines, normalizeSpaces(text.String()))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// normalizeSpaces replaces no-break and thin spaces, used as thousands
+// separators in French, with regular spaces and trims the line.
+func normalizeSpaces(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch r {
+		case '\u00a0', '\u2007', '\u2009', '\u202f':
+			return ' '
+		}
+		return r
+	}, s)
+	return strings.TrimSpace(s)
+}
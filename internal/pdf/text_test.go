@@ -0,0 +1,283 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testPDF construit des documents PDF pour les tests.
+// Les objets sont numérotés à partir de 1, dans l'ordre d'ajout.
+type testPDF struct {
+	objects []string
+	streams map[int]bool
+}
+
+func (p *testPDF) add(body string) int {
+	p.objects = append(p.objects, body)
+	return len(p.objects)
+}
+
+func (p *testPDF) stream(dict string, data []byte, compress bool) int {
+	if compress {
+		var buf bytes.Buffer
+		w := zlib.NewWriter(&buf)
+		w.Write(data)
+		w.Close()
+		data = buf.Bytes()
+		dict += " /Filter /FlateDecode"
+	}
+	if p.streams == nil {
+		p.streams = map[int]bool{}
+	}
+	num := p.add(fmt.Sprintf("<< %s /Length %d >>\nstream\n%s\nendstream", dict, len(data), data))
+	p.streams[num] = true
+	return num
+}
+
+// page ajoute une page affichant content avec les ressources resources.
+func (p *testPDF) page(resources string, content string, compress bool) int {
+	contents := p.stream("", []byte(content), compress)
+	return p.add(fmt.Sprintf("<< /Type /Page /MediaBox [0 0 595 842] /Resources %s /Contents %d 0 R >>", resources, contents))
+}
+
+// catalog ajoute l'arbre des pages et le catalogue.
+func (p *testPDF) catalog(pages ...int) int {
+	var kids []string
+	for _, page := range pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", page))
+	}
+	tree := p.add(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	for _, page := range pages {
+		p.objects[page-1] = strings.Replace(p.objects[page-1], "/Type /Page ", fmt.Sprintf("/Type /Page /Parent %d 0 R ", tree), 1)
+	}
+	return p.add(fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", tree))
+}
+
+// bytes écrit le document avec une table de références croisées classique.
+func (p *testPDF) bytes(root int, trailer string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(p.objects))
+	for i, body := range p.objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, body)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(p.objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root %d 0 R %s >>\nstartxref\n%d\n%%%%EOF\n", len(p.objects)+1, root, trailer, xref)
+	return buf.Bytes()
+}
+
+// compressedBytes écrit le document avec un flux de références croisées,
+// les objets autres que les flux étant regroupés dans un flux d'objets.
+func (p *testPDF) compressedBytes(root int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.5\n")
+
+	size := len(p.objects) + 3 // objets, flux d'objets, flux de références croisées
+	objStm := len(p.objects) + 1
+	xrefStm := len(p.objects) + 2
+
+	var header, body bytes.Buffer
+	entries := make([][]byte, size)
+	entries[0] = []byte{0, 0, 0, 0, 0, 0xff, 0xff}
+	index := 0
+	for i, obj := range p.objects {
+		num := i + 1
+		if p.streams[num] {
+			offset := buf.Len()
+			fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", num, obj)
+			entries[num] = []byte{1, byte(offset >> 24), byte(offset >> 16), byte(offset >> 8), byte(offset), 0, 0}
+			continue
+		}
+		fmt.Fprintf(&header, "%d %d ", num, body.Len())
+		body.WriteString(obj + "\n")
+		entries[num] = []byte{2, 0, 0, byte(objStm >> 8), byte(objStm), 0, byte(index)}
+		index++
+	}
+
+	var data bytes.Buffer
+	w := zlib.NewWriter(&data)
+	w.Write(header.Bytes())
+	w.Write(body.Bytes())
+	w.Close()
+	offset := buf.Len()
+	fmt.Fprintf(&buf, "%d 0 obj\n<< /Type /ObjStm /N %d /First %d /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream\nendobj\n",
+		objStm, index, header.Len(), data.Len(), data.Bytes())
+	entries[objStm] = []byte{1, byte(offset >> 24), byte(offset >> 16), byte(offset >> 8), byte(offset), 0, 0}
+
+	// Flux de références croisées avec le prédicteur PNG "Up"
+	offset = buf.Len()
+	entries[xrefStm] = []byte{1, byte(offset >> 24), byte(offset >> 16), byte(offset >> 8), byte(offset), 0, 0}
+	var rows bytes.Buffer
+	prev := make([]byte, 7)
+	for _, entry := range entries {
+		rows.WriteByte(2)
+		for i, b := range entry {
+			rows.WriteByte(b - prev[i])
+		}
+		prev = entry
+	}
+	data.Reset()
+	w = zlib.NewWriter(&data)
+	w.Write(rows.Bytes())
+	w.Close()
+	fmt.Fprintf(&buf, "%d 0 obj\n<< /Type /XRef /Size %d /Root %d 0 R /W [1 4 2] /Length %d /Filter /FlateDecode /DecodeParms << /Predictor 12 /Columns 7 >> >>\nstream\n%s\nendstream\nendobj\n",
+		xrefStm, size, root, data.Len(), data.Bytes())
+	fmt.Fprintf(&buf, "startxref\n%d\n%%%%EOF\n", offset)
+	return buf.Bytes()
+}
+
+const helvetica = "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>"
+
+func TestExtractText(t *testing.T) {
+	p := &testPDF{}
+	font := p.add(helvetica)
+	page := p.page(fmt.Sprintf("<< /Font << /F1 %d 0 R >> >>", font), `BT
+/F1 12 Tf
+72 760 Td
+(Facture N\260 FA-2026-001) Tj
+0 -20 Td
+(Total TTC : 1 234,56 \200) Tj
+ET`, false)
+	root := p.catalog(page)
+
+	text, err := ExtractText(p.bytes(root, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, "Facture N° FA-2026-001\nTotal TTC : 1 234,56 €", text)
+}
+
+func TestExtractTextLayout(t *testing.T) {
+	p := &testPDF{}
+	font := p.add(helvetica)
+	// La deuxième ligne est écrite en premier, la première ligne en deux
+	// morceaux placés de droite à gauche, et les mots de la troisième sont
+	// séparés par un décalage dans TJ plutôt que par des espaces
+	page := p.page(fmt.Sprintf("<< /Font << /F1 %d 0 R >> >>", font), `BT
+/F1 10 Tf
+1 0 0 1 72 700 Tm
+(Ligne deux) Tj
+1 0 0 1 200 720 Tm
+(droite) Tj
+1 0 0 1 72 720 Tm
+(gauche) Tj
+1 0 0 1 72 680 Tm
+[(Fac) 20 (ture) -400 (IKUTO)] TJ
+ET`, false)
+	root := p.catalog(page)
+
+	text, err := ExtractText(p.bytes(root, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, "gauche droite\nLigne deux\nFacture IKUTO", text)
+}
+
+func TestExtractTextCompositeFont(t *testing.T) {
+	p := &testPDF{}
+	toUnicode := p.stream("", []byte(`/CIDInit /ProcSet findresource begin
+12 dict begin
+begincmap
+1 begincodespacerange
+<0000> <FFFF>
+endcodespacerange
+2 beginbfchar
+<0001> <00E9>
+<0002> <20AC>
+endbfchar
+1 beginbfrange
+<0010> <0029> <0041>
+endbfrange
+endcmap
+CMapName currentdict /CMap defineresource pop
+end
+end`), true)
+	descendant := p.add("<< /Type /Font /Subtype /CIDFontType2 /BaseFont /ABCDEF+Arial /CIDSystemInfo << /Registry (Adobe) /Ordering (Identity) /Supplement 0 >> /DW 600 /W [1 [556 700] 16 41 667] >>")
+	font := p.add(fmt.Sprintf("<< /Type /Font /Subtype /Type0 /BaseFont /ABCDEF+Arial /Encoding /Identity-H /DescendantFonts [%d 0 R] /ToUnicode %d 0 R >>", descendant, toUnicode))
+	// "DR" + "é" + "CI" + "€€"
+	page := p.page(fmt.Sprintf("<< /Font << /F1 %d 0 R >> >>", font), `BT
+/F1 12 Tf
+100 700 Td
+<0013002100010012001800020002> Tj
+ET`, true)
+	root := p.catalog(page)
+
+	doc, err := Open(p.compressedBytes(root))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, doc.NumPages())
+
+	text, err := doc.Text()
+	assert.NoError(t, err)
+	assert.Equal(t, "DRéCI€€", text)
+}
+
+func TestExtractTextEncodingDifferences(t *testing.T) {
+	p := &testPDF{}
+	font := p.add("<< /Type /Font /Subtype /Type1 /BaseFont /ABCDEF+Garamond /FirstChar 32 /LastChar 34 /Widths [250 500 500] /Encoding << /Type /Encoding /Differences [33 /eacute /uni20AC] >> >>")
+	form := p.stream(fmt.Sprintf("/Type /XObject /Subtype /Form /BBox [0 0 595 842] /Resources << /Font << /F1 %d 0 R >> >>", font), []byte(`BT
+/F1 11 Tf
+50 50 Td
+(Montant pay! : 10 ") Tj
+ET`), true)
+	page := p.page(fmt.Sprintf("<< /XObject << /X1 %d 0 R >> >>", form), "q 1 0 0 1 0 600 cm /X1 Do Q", true)
+	root := p.catalog(page)
+
+	text, err := ExtractText(p.bytes(root, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, "Montant payé : 10 €", text)
+}
+
+func TestExtractTextPages(t *testing.T) {
+	p := &testPDF{}
+	font := p.add(helvetica)
+	resources := fmt.Sprintf("<< /Font << /F1 %d 0 R >> >>", font)
+	page1 := p.page(resources, "BT /F1 12 Tf 72 700 Td (Page 1) Tj ET", true)
+	page2 := p.page(resources, "BT /F1 12 Tf 72 700 Td (Page 2) Tj ET", true)
+	root := p.catalog(page1, page2)
+
+	text, err := ExtractText(p.bytes(root, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, "Page 1\fPage 2", text)
+}
+
+func TestOpenDamagedDocument(t *testing.T) {
+	p := &testPDF{}
+	font := p.add(helvetica)
+	page := p.page(fmt.Sprintf("<< /Font << /F1 %d 0 R >> >>", font), "BT /F1 12 Tf 72 700 Td (Texte) Tj ET", true)
+	root := p.catalog(page)
+	data := p.bytes(root, "")
+
+	// Décalage de startxref erroné : la table est reconstruite
+	i := bytes.LastIndex(data, []byte("startxref"))
+	damaged := append(append([]byte{}, data[:i]...), []byte("startxref\n12\n%%EOF\n")...)
+	text, err := ExtractText(damaged)
+	assert.NoError(t, err)
+	assert.Equal(t, "Texte", text)
+
+	// Fichier tronqué, sans table de références croisées
+	truncated := data[:bytes.Index(data, []byte("xref"))]
+	text, err = ExtractText(truncated)
+	assert.NoError(t, err)
+	assert.Equal(t, "Texte", text)
+}
+
+func TestOpenErrors(t *testing.T) {
+	_, err := Open([]byte("test content"))
+	assert.ErrorIs(t, err, ErrNotPDF)
+
+	p := &testPDF{}
+	page := p.page("<< >>", "", false)
+	root := p.catalog(page)
+	encrypt := p.add("<< /Filter /Adobe.PubSec /V 4 /R 4 /SubFilter /adbe.pkcs7.s5 >>")
+	_, err = Open(p.bytes(root, fmt.Sprintf("/Encrypt %d 0 R", encrypt)))
+	assert.ErrorIs(t, err, ErrUnsupportedEncryption)
+
+	_, err = ExtractText([]byte("%PDF-1.4\n1 0 obj\n<< /Type /Font >>\nendobj\n"))
+	assert.Error(t, err)
+}
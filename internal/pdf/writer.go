@@ -0,0 +1,192 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// pdfVersion reads the version of the %PDF- header
+var pdfVersion = regexp.MustCompile(`^%PDF-(\d\.\d)`)
+
+// Rewrite writes the document as a new file, with a single cross-reference
+// table: the objects of object streams are written directly, and encrypted
+// documents are written decrypted.
+func (d *Document) Rewrite() (data []byte, err error) {
+	// Malformed files must not crash the caller
+	defer func() {
+		if r := recover(); r != nil {
+			data, err = nil, fmt.Errorf("malformed PDF document: %v", r)
+		}
+	}()
+
+	version := "1.7"
+	if m := pdfVersion.FindSubmatch(d.data[d.header:]); m != nil {
+		version = string(m[1])
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%%PDF-%s\n%%\xe2\xe3\xcf\xd3\n", version)
+
+	nums := make([]int, 0, len(d.xref))
+	for num := range d.xref {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+
+	offsets := map[int]int{}
+	gens := map[int]int{}
+	size := 1
+	for _, num := range nums {
+		if num <= 0 || (d.security != nil && num == d.security.encrypt) {
+			continue
+		}
+		obj := d.object(num)
+		if obj == nil {
+			continue
+		}
+		// Object and cross-reference streams are replaced by the new table
+		if s, ok := obj.(*Stream); ok && (s.Dict["Type"] == Name("ObjStm") || s.Dict["Type"] == Name("XRef")) {
+			continue
+		}
+
+		gen := 0
+		if entry := d.xref[num]; !entry.inStream {
+			gen = entry.gen
+		}
+		offsets[num], gens[num] = buf.Len(), gen
+		size = max(size, num+1)
+		buf.Write(appendIndirectObject(nil, num, gen, obj))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", size)
+	for num := 1; num < size; num++ {
+		if offset, ok := offsets[num]; ok {
+			fmt.Fprintf(&buf, "%010d %05d n \n", offset, gens[num])
+		} else {
+			buf.WriteString("0000000000 65535 f \n")
+		}
+	}
+
+	trailer := Dict{"Size": int64(size), "Root": d.trailer["Root"]}
+	for _, key := range []Name{"Info", "ID"} {
+		if value, ok := d.trailer[key]; ok {
+			trailer[key] = value
+		}
+	}
+	buf.WriteString("trailer\n")
+	buf.Write(appendObject(nil, trailer))
+	fmt.Fprintf(&buf, "\nstartxref\n%d\n%%%%EOF\n", xref)
+	return buf.Bytes(), nil
+}
+
+// appendIndirectObject appends "num gen obj ... endobj".
+func appendIndirectObject(buf []byte, num, gen int, obj Object) []byte {
+	buf = fmt.Appendf(buf, "%d %d obj\n", num, gen)
+	buf = appendObject(buf, obj)
+	return append(buf, "\nendobj\n"...)
+}
+
+// appendObject appends the PDF syntax of an object. Dictionary keys are
+// sorted, so that the output is deterministic.
+func appendObject(buf []byte, obj Object) []byte {
+	switch v := obj.(type) {
+	case nil:
+		return append(buf, "null"...)
+	case bool:
+		return strconv.AppendBool(buf, v)
+	case int64:
+		return strconv.AppendInt(buf, v, 10)
+	case int:
+		return strconv.AppendInt(buf, int64(v), 10)
+	case float64:
+		return strconv.AppendFloat(buf, v, 'f', -1, 64)
+	case String:
+		return appendString(buf, v)
+	case Name:
+		return appendName(buf, v)
+	case Ref:
+		return fmt.Appendf(buf, "%d %d R", v.Num, v.Gen)
+	case keyword:
+		return append(buf, v...)
+	case Array:
+		buf = append(buf, '[')
+		for i, item := range v {
+			if i > 0 {
+				buf = append(buf, ' ')
+			}
+			buf = appendObject(buf, item)
+		}
+		return append(buf, ']')
+	case Dict:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, string(key))
+		}
+		sort.Strings(keys)
+		buf = append(buf, "<<"...)
+		for _, key := range keys {
+			buf = append(buf, ' ')
+			buf = appendName(buf, Name(key))
+			buf = append(buf, ' ')
+			buf = appendObject(buf, v[Name(key)])
+		}
+		return append(buf, " >>"...)
+	case *Stream:
+		dict := make(Dict, len(v.Dict)+1)
+		for key, value := range v.Dict {
+			dict[key] = value
+		}
+		dict["Length"] = int64(len(v.Data))
+		buf = appendObject(buf, dict)
+		buf = append(buf, "\nstream\n"...)
+		buf = append(buf, v.Data...)
+		return append(buf, "\nendstream"...)
+	}
+	panic(fmt.Sprintf("cannot write object of type %T", obj))
+}
+
+// appendString appends a literal string, or a hexadecimal string if it
+// holds binary data.
+func appendString(buf []byte, s String) []byte {
+	binary := false
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < 0x20 && c != '\n' && c != '\r' && c != '\t') || c >= 0x7f {
+			binary = true
+			break
+		}
+	}
+	if binary {
+		return fmt.Appendf(buf, "<%x>", string(s))
+	}
+
+	buf = append(buf, '(')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '(', ')', '\\':
+			buf = append(buf, '\\', c)
+		case '\r':
+			buf = append(buf, '\\', 'r')
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return append(buf, ')')
+}
+
+// appendName appends a name, escaping the delimiters and non-printable characters.
+func appendName(buf []byte, name Name) []byte {
+	buf = append(buf, '/')
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c == '#' || c <= 0x20 || c >= 0x7f || isDelimiter(c) {
+			buf = fmt.Appendf(buf, "#%02x", c)
+			continue
+		}
+		buf = append(buf, c)
+	}
+	return buf
+}
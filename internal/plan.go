@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Actions of a dry run plan
+const (
+	PlanActionDownload         = "download"          // an attachment would be downloaded
+	PlanActionRename           = "rename"            // a document would be renamed in the attachments directory
+	PlanActionFile             = "file"              // a document would be moved, copied or linked to a destination
+	PlanActionNoRule           = "no-rule"           // no rule matches a document, which would be left as is
+	PlanActionPasswordRequired = "password-required" // no password opens an encrypted document
+	PlanActionError            = "error"             // a message or a document could not be processed
+)
+
+// Plan lists what a run would do, recorded by a dry run instead of writing
+// anything: downloads, renames and filings, with the rule that matched and
+// the conflicts found.
+type Plan struct {
+	Actions []PlanAction `json:"actions"`
+	// NotExtracted is the number of documents which a run would send to the
+	// extraction provider: the plan applies the rules without their fields
+	NotExtracted int `json:"notExtracted,omitempty"`
+
+	// documents holds the content of the attachments which would be
+	// downloaded, so that the rules apply to them, by path
+	documents map[string][]byte
+	// targets maps the paths that would be written to the name of the
+	// attachment which would be written there
+	targets map[string]string
+}
+
+// PlanAction is an action of a plan.
+type PlanAction struct {
+	Action  string `json:"action"`
+	EmailID string `json:"emailId,omitempty"`
+	Subject string `json:"subject,omitempty"`
+	// File is the name of the attachment
+	File string `json:"file"`
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+	Rule string `json:"rule,omitempty"`
+	Mode string `json:"mode,omitempty"`
+	// Conflict explains why the action would overwrite another file
+	Conflict string `json:"conflict,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// NewPlan returns an empty plan
+func NewPlan() *Plan {
+	return &Plan{
+		Actions:   []PlanAction{},
+		documents: map[string][]byte{},
+		targets:   map[string]string{},
+	}
+}
+
+// DryRun fetches the new emails and applies the rules to their attachments
+// and to the attachments already downloaded, like a run, without writing
+// anything to disk or to the activity database, caches included. No
+// document is sent to the extraction provider. It returns the plan of what
+// the run would do.
+func DryRun(ctx context.Context) (*Plan, error) {
+	gmailService, err := NewGmailService(ctx)
+	if err != nil {
+		return nil, NewError("DryRun", err, "failed to initialize Gmail service")
+	}
+
+	activityManager := NewActivityManager()
+	if err := activityManager.LoadReadOnly(); err != nil {
+		return nil, NewError("DryRun", err, "failed to load activity data")
+	}
+
+	// The messages and documents which cannot be processed are in the plan
+	plan := NewPlan()
+	err = gmailService.processEmails(ctx, activityManager, plan)
+	if err != nil && !errors.Is(err, ErrEmailProcessing) {
+		return plan, err
+	}
+	err = processAttachments(ctx, activityManager, plan, nil)
+	if err != nil && !errors.Is(err, ErrAttachmentProcessing) {
+		return plan, err
+	}
+	return plan, nil
+}
+
+// recordMessage records the downloads that processMessage would make, and
+// stores the message and its attachments in the read-only activity data, for
+// the rules to apply to them.
+func (p *Plan) recordMessage(am *ActivityManager, fetched *fetchedMessage) error {
+	if fetched.err != nil {
+		p.add(PlanAction{Action: PlanActionError, EmailID: fetched.id, Error: fetched.err.Error()}, "")
+		return fetched.err
+	}
+
+	msg := fetched.msg
+	if err := am.StoreEmailMeta(msg.Id, msg); err != nil {
+		return NewError("recordMessage", err, "failed to store email metadata")
+	}
+
+	var failed error
+	for _, attachment := range fetched.attachments {
+		action := PlanAction{EmailID: msg.Id, Subject: getSubject(msg), File: attachment.part.Filename}
+		if attachment.err != nil {
+			action.Action, action.Error = PlanActionError, attachment.err.Error()
+			p.add(action, "")
+			failed = attachment.err
+			continue
+		}
+
+		sha256Hash := fmt.Sprintf("%x", sha256.Sum256(attachment.data))
+		action.Action = PlanActionDownload
+		action.To, _ = attachmentPath(msg.Id, attachment.part.Filename, sha256Hash, p.readDocument)
+		p.add(action, action.To)
+		p.documents[action.To] = attachment.data
+		if err := am.StoreAttachmentMeta(attachment.part.Filename, msg.Id, sha256Hash); err != nil {
+			log.Printf("Warning: Error storing attachment metadata: %v", err)
+		}
+	}
+	if failed != nil {
+		return NewError("recordMessage", failed, "failed to download attachments")
+	}
+
+	return am.UpdateEmailState(msg.Id, MessageStateDownloaded, nil)
+}
+
+// readDocument returns the content of the file at path, as a run would
+// have left it
+func (p *Plan) readDocument(path string) ([]byte, error) {
+	if data, exists := p.documents[path]; exists {
+		return data, nil
+	}
+	return os.ReadFile(path)
+}
+
+// add records an action, with the conflict of the path it would write
+func (p *Plan) add(action PlanAction, target string) {
+	if target != "" {
+		action.Conflict = p.claim(target, action)
+	}
+	p.Actions = append(p.Actions, action)
+}
+
+// claim reserves the path written by an action, and returns why it would
+// overwrite another file, if it would.
+func (p *Plan) claim(path string, action PlanAction) string {
+	if other, ok := p.targets[path]; ok {
+		return fmt.Sprintf("%s would be written by %s too", path, other)
+	}
+	p.targets[path] = action.File
+	if path == action.From {
+		return ""
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Sprintf("%s already exists", path)
+	}
+	return ""
+}
+
+// Conflicts returns the number of actions which would overwrite a file
+func (p *Plan) Conflicts() int {
+	n := 0
+	for _, action := range p.Actions {
+		if action.Conflict != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// Print writes the plan in a human-readable form
+func (p *Plan) Print(w io.Writer) {
+	for _, a := range p.Actions {
+		switch a.Action {
+		case PlanActionDownload:
+			fmt.Fprintf(w, "Would download %s to %s (message %s: %s)", a.File, a.To, a.EmailID, a.Subject)
+		case PlanActionRename:
+			fmt.Fprintf(w, "Would rename %s to %s (rule %s)", a.File, filepath.Base(a.To), a.Rule)
+		case PlanActionFile:
+			fmt.Fprintf(w, "Would %s %s to %s (rule %s)", a.Mode, a.File, a.To, a.Rule)
+		case PlanActionNoRule:
+			fmt.Fprintf(w, "No rule matches %s", a.File)
+		case PlanActionPasswordRequired:
+			fmt.Fprintf(w, "%s is encrypted, no password of passwords.json opens it", a.File)
+		case PlanActionError:
+			name := a.File
+			if name == "" {
+				name = "message " + a.EmailID
+			}
+			fmt.Fprintf(w, "Error on %s: %s", name, a.Error)
+		}
+		if a.Conflict != "" {
+			fmt.Fprintf(w, " - CONFLICT: %s", a.Conflict)
+		}
+		fmt.Fprintln(w)
+	}
+	if p.NotExtracted > 0 {
+		fmt.Fprintf(w, "%d documents not sent to the extraction provider, the rules were applied without their extracted fields\n", p.NotExtracted)
+	}
+	fmt.Fprintf(w, "%d actions, %d conflicts, nothing was written\n", len(p.Actions), p.Conflicts())
+}
@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"extract-email-attachments/internal/config"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestDryRun(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "plan-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	attachmentsDir := filepath.Join(tempDir, "attachments")
+	assert.NoError(t, os.MkdirAll(attachmentsDir, 0755))
+	originalAttachmentsDir := config.AppAttachmentsDir
+	originalConfigDir := config.AppConfigDir
+	originalCacheDir := config.AppCacheDir
+	config.AppAttachmentsDir = attachmentsDir
+	config.AppConfigDir = tempDir
+	config.AppCacheDir = tempDir
+	defer func() {
+		config.AppAttachmentsDir = originalAttachmentsDir
+		config.AppConfigDir = originalConfigDir
+		config.AppCacheDir = originalCacheDir
+	}()
+
+	rules := `{"rules": [{"name": "Vendor", "vendor": "Vendor", "match": {"senderEmail": "@vendor.com"}, "filename": "{{.Year}}-{{.Month}}-facture-{{.Vendor}}.pdf"}]}`
+	assert.NoError(t, os.WriteFile(filepath.Join(tempDir, "rules.json"), []byte(rules), 0644))
+
+	// Une pièce jointe déjà téléchargée qu'aucune règle ne renomme
+	am := NewActivityManager()
+	assert.NoError(t, am.Load())
+	assert.NoError(t, am.StoreEmailMeta("old", &gmail.Message{
+		Id:      "old",
+		Payload: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{{Name: "From", Value: "Autre <contact@autre.fr>"}}},
+	}))
+	assert.NoError(t, am.UpdateEmailState("old", MessageStateProcessed, nil))
+	assert.NoError(t, am.StoreAttachmentMeta("ancien.pdf", "old", fmt.Sprintf("%x", sha256.Sum256([]byte("ancien")))))
+	assert.NoError(t, am.Save())
+	assert.NoError(t, os.WriteFile(filepath.Join(attachmentsDir, "ancien.pdf"), []byte("ancien"), 0644))
+	// Un fichier portant le nom d'une pièce jointe à télécharger, qui n'est pas écrasé
+	assert.NoError(t, os.WriteFile(filepath.Join(attachmentsDir, "facture-002-1.pdf"), []byte("autre"), 0644))
+	db, err := os.ReadFile(filepath.Join(tempDir, "activity.db"))
+	assert.NoError(t, err)
+
+	gs := newFakeGmailService(t, newFakeGmail(2, 1), http.DefaultTransport)
+	am = NewActivityManager()
+	assert.NoError(t, am.LoadReadOnly())
+	plan := NewPlan()
+	assert.NoError(t, gs.processEmails(context.Background(), am, plan))
+	assert.NoError(t, processAttachments(context.Background(), am, plan, nil))
+
+	renamed := filepath.Join(attachmentsDir, "2025-06-facture-Vendor.pdf")
+	assert.Equal(t, []PlanAction{
+		{Action: PlanActionDownload, EmailID: "msg-001", Subject: "Facture 1", File: "facture-001-1.pdf", To: filepath.Join(attachmentsDir, "facture-001-1.pdf")},
+		{Action: PlanActionDownload, EmailID: "msg-002", Subject: "Facture 2", File: "facture-002-1.pdf", To: filepath.Join(attachmentsDir, "facture-002-1-msg-002.pdf")},
+		{Action: PlanActionNoRule, EmailID: "old", File: "ancien.pdf", From: filepath.Join(attachmentsDir, "ancien.pdf")},
+		{Action: PlanActionRename, EmailID: "msg-001", File: "facture-001-1.pdf", From: filepath.Join(attachmentsDir, "facture-001-1.pdf"), To: renamed, Rule: "Vendor"},
+		{Action: PlanActionRename, EmailID: "msg-002", File: "facture-002-1.pdf", From: filepath.Join(attachmentsDir, "facture-002-1-msg-002.pdf"), To: renamed, Rule: "Vendor",
+			Conflict: renamed + " would be written by facture-001-1.pdf too"},
+	}, plan.Actions)
+	assert.Equal(t, 1, plan.Conflicts())
+
+	var out bytes.Buffer
+	plan.Print(&out)
+	assert.Contains(t, out.String(), "Would rename facture-001-1.pdf to 2025-06-facture-Vendor.pdf (rule Vendor)\n")
+	assert.Contains(t, out.String(), "5 actions, 1 conflicts, nothing was written\n")
+
+	// Rien n'a été écrit : ni les fichiers, ni l'historique
+	entries, err := os.ReadDir(attachmentsDir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	content, err := os.ReadFile(filepath.Join(attachmentsDir, "facture-002-1.pdf"))
+	assert.NoError(t, err)
+	assert.Equal(t, "autre", string(content))
+	dbAfter, err := os.ReadFile(filepath.Join(tempDir, "activity.db"))
+	assert.NoError(t, err)
+	assert.Equal(t, db, dbAfter)
+}
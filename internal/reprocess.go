@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"extract-email-attachments/internal/config"
+)
+
+// AttachmentStatusPending selects, in an AttachmentFilter, the attachments
+// which no rule has filed yet
+const AttachmentStatusPending = "pending"
+
+// AttachmentFilter selects stored attachments. The zero value selects all of them.
+type AttachmentFilter struct {
+	// Sender is contained in the sender name or address, ignoring case
+	Sender string
+	// Since and Until bound the date of the email, both included, unless zero
+	Since time.Time
+	Until time.Time
+	// Status is "processed", "password-required", "pending", or empty for any status
+	Status string
+}
+
+// Matches reports whether the attachment of email is selected by the filter
+func (f AttachmentFilter) Matches(attachment AttachmentData, email EmailData) bool {
+	if f.Sender != "" {
+		sender := strings.ToLower(email.SenderName + " " + email.SenderEmail)
+		if !strings.Contains(sender, strings.ToLower(f.Sender)) {
+			return false
+		}
+	}
+	if !f.Since.IsZero() || !f.Until.IsZero() {
+		date, err := time.Parse(time.RFC3339, email.Date)
+		if err != nil {
+			return false
+		}
+		day := date.Format(time.DateOnly)
+		if !f.Since.IsZero() && day < f.Since.Format(time.DateOnly) {
+			return false
+		}
+		if !f.Until.IsZero() && day > f.Until.Format(time.DateOnly) {
+			return false
+		}
+	}
+	switch f.Status {
+	case "":
+	case AttachmentStatusPending:
+		return attachment.Status == ""
+	default:
+		return attachment.Status == f.Status
+	}
+	return true
+}
+
+// Reprocess applies the current rules again to the stored attachments
+// selected by filter, such as after a rule changed: each document is renamed
+// and filed from where it is, in the attachments directory or where a
+// previous run filed it. It returns the number of attachments reprocessed.
+// The files written are recorded in journal, unless nil.
+func Reprocess(ctx context.Context, filter AttachmentFilter, journal *Journal) (int, error) {
+	activityManager := NewActivityManager()
+	if err := activityManager.Load(); err != nil {
+		return 0, NewError("Reprocess", err, "failed to load activity data")
+	}
+
+	rules, err := LoadRules()
+	if err != nil {
+		return 0, NewError("Reprocess", err, "failed to load rules")
+	}
+	passwords, err := LoadPasswords()
+	if err != nil {
+		return 0, NewError("Reprocess", err, "failed to load PDF passwords")
+	}
+	classifier, err := LoadClassifier()
+	if err != nil {
+		return 0, NewError("Reprocess", err, "failed to load document classifier")
+	}
+
+	p := &attachmentProcessor{
+		activityManager: activityManager,
+		rules:           rules,
+		reader:          newDocumentReader(rules, passwords, classifier),
+		journal:         journal,
+	}
+
+	count := 0
+	for _, attachment := range activityManager.Attachments() {
+		if ctx.Err() != nil {
+			break
+		}
+		if !isPDFDocument(attachment.Filename) && !isXMLDocument(attachment.Filename) {
+			continue
+		}
+		email, err := activityManager.GetEmailByID(attachment.EmailID)
+		if err != nil || !filter.Matches(attachment, *email) {
+			continue
+		}
+
+		path := reprocessSource(attachment)
+		if path == "" {
+			p.fail(attachment.Filename, NewError("Reprocess", os.ErrNotExist, fmt.Sprintf("file of %s not found", attachment.Filename)))
+			continue
+		}
+		p.processAttachment(ctx, path, nil, attachment)
+		count++
+	}
+
+	if err := activityManager.Save(); err != nil {
+		return count, NewError("Reprocess", err, "failed to save activity data")
+	}
+	if ctx.Err() != nil {
+		return count, NewError("Reprocess", ctx.Err(), "interrupted")
+	}
+	if len(p.errors) > 0 {
+		return count, NewError("Reprocess", ErrAttachmentProcessing, fmt.Sprintf("encountered %d errors while reprocessing attachments", len(p.errors)))
+	}
+	return count, nil
+}
+
+// reprocessSource returns the file to rename and file again: the downloaded
+// file, still in the attachments directory if it was copied or linked, or
+// else where it was filed. The downloaded file is recognised by its content,
+// since an attachment of the same name of another message may be there. It
+// is empty if neither exists.
+func reprocessSource(attachment AttachmentData) string {
+	downloaded := filepath.Join(config.AppAttachmentsDir, attachment.Filename)
+	if attachment.Sha256Hash != "" {
+		path, data := attachmentPath(attachment.EmailID, attachment.Filename, attachment.Sha256Hash, os.ReadFile)
+		if data != nil {
+			return path
+		}
+		downloaded = ""
+	}
+
+	for _, path := range []string{downloaded, attachment.Path} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
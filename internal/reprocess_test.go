@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"extract-email-attachments/internal/config"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestAttachmentFilter(t *testing.T) {
+	email := EmailData{SenderName: "Nordlicht", SenderEmail: "billing@nordlicht.example", Date: "2026-04-02T11:00:00+02:00"}
+	processed := AttachmentData{Filename: "invoice.xml", Status: AttachmentStatusProcessed}
+	date := func(s string) time.Time {
+		d, err := time.Parse(time.DateOnly, s)
+		assert.NoError(t, err)
+		return d
+	}
+
+	tests := []struct {
+		name       string
+		filter     AttachmentFilter
+		attachment AttachmentData
+		expected   bool
+	}{
+		{"tout", AttachmentFilter{}, processed, true},
+		{"expéditeur par adresse", AttachmentFilter{Sender: "@NORDLICHT"}, processed, true},
+		{"autre expéditeur", AttachmentFilter{Sender: "edf"}, processed, false},
+		{"période incluse", AttachmentFilter{Since: date("2026-04-02"), Until: date("2026-04-02")}, processed, true},
+		{"avant la période", AttachmentFilter{Since: date("2026-04-03")}, processed, false},
+		{"après la période", AttachmentFilter{Until: date("2026-04-01")}, processed, false},
+		{"statut", AttachmentFilter{Status: AttachmentStatusProcessed}, processed, true},
+		{"en attente", AttachmentFilter{Status: AttachmentStatusPending}, processed, false},
+		{"en attente sans statut", AttachmentFilter{Status: AttachmentStatusPending}, AttachmentData{Filename: "invoice.xml"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.filter.Matches(tt.attachment, email))
+		})
+	}
+}
+
+func TestReprocess(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "reprocess-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+	filingDir := filepath.Join(tempDir, "Compta")
+
+	originalAttachmentsDir := config.AppAttachmentsDir
+	originalConfigDir := config.AppConfigDir
+	config.AppAttachmentsDir = filepath.Join(tempDir, "attachments")
+	config.AppConfigDir = tempDir
+	defer func() {
+		config.AppAttachmentsDir = originalAttachmentsDir
+		config.AppConfigDir = originalConfigDir
+	}()
+	assert.NoError(t, os.MkdirAll(config.AppAttachmentsDir, 0755))
+
+	writeRules := func(destination string) {
+		err := os.WriteFile(filepath.Join(tempDir, "rules.json"), []byte(fmt.Sprintf(`{"rules": [
+			{"name": "Nordlicht", "match": {"vatNumber": "DE123456789"}, "filename": "{{.Year}}-{{.Month}}-{{.InvoiceNumber}}.xml", "destination": %q}
+		]}`, destination)), 0644)
+		assert.NoError(t, err)
+	}
+	writeRules(filingDir + "/Factures/")
+
+	fileContent, err := os.ReadFile(filepath.Join("testdata", "ubl-invoice.xml"))
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(config.AppAttachmentsDir, "invoice.xml"), fileContent, 0644))
+	am := NewActivityManager()
+	assert.NoError(t, am.Load())
+	assert.NoError(t, am.StoreEmailMeta("nordlicht", &gmail.Message{Id: "nordlicht", Payload: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{
+		{Name: "Date", Value: "Thu, 02 Apr 2026 11:00:00 +0200"},
+		{Name: "From", Value: "Nordlicht <billing@nordlicht.example>"},
+	}}}))
+	assert.NoError(t, am.StoreAttachmentMeta("invoice.xml", "nordlicht", fmt.Sprintf("%x", sha256.Sum256(fileContent))))
+	assert.NoError(t, am.Save())
+	assert.NoError(t, ProcessAttachments(context.Background(), nil))
+	firstPath := filepath.Join(filingDir, "Factures", "2026-04-INV-2026-0315.xml")
+	assert.FileExists(t, firstPath)
+
+	// Un autre expéditeur ne sélectionne rien
+	writeRules(filingDir + "/Factures/{{.Year}}/")
+	count, err := Reprocess(context.Background(), AttachmentFilter{Sender: "edf"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+	assert.FileExists(t, firstPath)
+
+	// Après modification de la règle, le document classé est déplacé vers la nouvelle destination
+	journal := NewJournal()
+	count, err = Reprocess(context.Background(), AttachmentFilter{Sender: "nordlicht", Status: AttachmentStatusProcessed}, journal)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	newPath := filepath.Join(filingDir, "Factures", "2026", "2026-04-INV-2026-0315.xml")
+	assert.NoFileExists(t, firstPath)
+	assert.FileExists(t, newPath)
+
+	am = NewActivityManager()
+	assert.NoError(t, am.Load())
+	attachment, err := am.GetAttachmentByFilename("invoice.xml")
+	assert.NoError(t, err)
+	assert.Equal(t, AttachmentStatusProcessed, attachment.Status)
+	assert.Equal(t, newPath, attachment.Path)
+
+	// Le déplacement est annulable
+	_, err = UndoRun(journal.Run())
+	assert.NoError(t, err)
+	assert.FileExists(t, firstPath)
+	am = NewActivityManager()
+	assert.NoError(t, am.Load())
+	attachment, err = am.GetAttachmentByFilename("invoice.xml")
+	assert.NoError(t, err)
+	assert.Equal(t, AttachmentStatusProcessed, attachment.Status)
+	assert.Equal(t, firstPath, attachment.Path)
+
+	// Un document déjà à sa place n'est pas déplacé
+	writeRules(filingDir + "/Factures/")
+	_, err = Reprocess(context.Background(), AttachmentFilter{}, nil)
+	assert.NoError(t, err)
+	assert.FileExists(t, firstPath)
+
+	// Une pièce jointe du même nom d'un autre message n'est pas prise pour le document classé
+	otherContent := []byte("<Invoice>autre</Invoice>")
+	assert.NoError(t, os.WriteFile(filepath.Join(config.AppAttachmentsDir, "invoice.xml"), otherContent, 0644))
+	writeRules(filingDir + "/Factures/{{.Year}}/")
+	count, err = Reprocess(context.Background(), AttachmentFilter{Sender: "nordlicht"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.FileExists(t, newPath)
+	kept, err := os.ReadFile(filepath.Join(config.AppAttachmentsDir, "invoice.xml"))
+	assert.NoError(t, err)
+	assert.Equal(t, otherContent, kept)
+}
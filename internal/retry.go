@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// RetryPolicy describes how failed Gmail API calls are retried, with an
+// exponential backoff and jitter between attempts.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// maxRetryAfter caps the delay requested by the server with a Retry-After header
+const maxRetryAfter = 5 * time.Minute
+
+// DefaultRetryPolicy is the retry policy of Gmail API calls
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    30 * time.Second,
+}
+
+// sleep waits between two attempts, unless ctx is cancelled; tests replace it to avoid waiting
+var sleep = func(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Do calls fn until it succeeds, fails with a permanent error or the maximum
+// number of attempts is reached. Errors are classified with classifyGmailError.
+func (p RetryPolicy) Do(ctx context.Context, op string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := classifyGmailError(op, fn())
+		if err == nil {
+			return nil
+		}
+		if !IsRetryableError(err) || attempt >= p.MaxAttempts {
+			return err
+		}
+
+		delay := p.delay(attempt, err)
+		log.Printf("Warning: %v, retrying in %s (attempt %d/%d)", err, delay.Round(time.Millisecond), attempt, p.MaxAttempts)
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// delay returns the time to wait after the given failed attempt. The delay
+// requested by the server takes precedence over the exponential backoff.
+func (p RetryPolicy) delay(attempt int, err error) time.Duration {
+	if retryAfter, ok := retryAfterDelay(err); ok {
+		return retryAfter
+	}
+
+	backoff := p.BaseDelay << (attempt - 1)
+	if backoff <= 0 || backoff > p.MaxDelay {
+		backoff = p.MaxDelay
+	}
+	// Jitter between half and the full backoff, so that concurrent clients spread out
+	return backoff/2 + rand.N(backoff/2+1)
+}
+
+// retryAfterDelay extracts the delay of a Retry-After header, given either in
+// seconds or as an HTTP date.
+func retryAfterDelay(err error) (time.Duration, bool) {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Header == nil {
+		return 0, false
+	}
+
+	value := apiErr.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		delay = time.Until(date)
+	} else {
+		return 0, false
+	}
+
+	return min(max(delay, 0), maxRetryAfter), true
+}
+
+// classifyGmailError wraps an error returned by the Gmail API. Transient
+// errors (rate limits, server errors, network failures) wrap ErrGmailAPI so
+// that IsRetryableError reports them; other errors are permanent.
+func classifyGmailError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if isTransientGmailError(err) {
+		return NewError(op, fmt.Errorf("%w: %w", ErrGmailAPI, err), "")
+	}
+	return NewError(op, err, "")
+}
+
+// isTransientGmailError checks if a Gmail API call may succeed when retried.
+func isTransientGmailError(err error) bool {
+	// A cancelled call must not be retried
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true
+		case http.StatusForbidden:
+			// Quota errors are reported as 403 with a rate limit reason
+			for _, item := range apiErr.Errors {
+				if item.Reason == "rateLimitExceeded" || item.Reason == "userRateLimitExceeded" {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// faultyTransport fails the first requests with the given responses,
+// then forwards requests to the underlying transport.
+type faultyTransport struct {
+	mu       sync.Mutex
+	failures []*http.Response
+	requests int
+}
+
+func (ft *faultyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ft.mu.Lock()
+	ft.requests++
+	var failure *http.Response
+	if len(ft.failures) > 0 {
+		failure, ft.failures = ft.failures[0], ft.failures[1:]
+	}
+	ft.mu.Unlock()
+
+	if failure != nil {
+		if failure.StatusCode == 0 {
+			return nil, errors.New("connection reset by peer")
+		}
+		failure.Request = req
+		return failure, nil
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// errorResponse builds a Gmail API error response.
+func errorResponse(code int, reason string, header http.Header) *http.Response {
+	body, _ := json.Marshal(map[string]any{
+		"error": map[string]any{
+			"code":    code,
+			"message": http.StatusText(code),
+			"errors":  []map[string]string{{"reason": reason, "message": http.StatusText(code)}},
+		},
+	})
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Type", "application/json")
+	return &http.Response{
+		StatusCode: code,
+		Status:     http.StatusText(code),
+		Header:     header,
+		Body:       httpBody(body),
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	// Enregistrer les délais au lieu d'attendre
+	var delays []time.Duration
+	originalSleep := sleep
+	sleep = func(_ context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+	defer func() { sleep = originalSleep }()
+
+	t.Run("transient errors", func(t *testing.T) {
+		delays = nil
+		transport := &faultyTransport{failures: []*http.Response{
+			errorResponse(http.StatusServiceUnavailable, "backendError", nil),
+			{StatusCode: 0},
+			errorResponse(http.StatusForbidden, "userRateLimitExceeded", nil),
+		}}
+		gs := newFakeGmailService(t, newFakeGmail(2, 0), transport)
+
+		ids, err := gs.listMessageIDs(context.Background(), nil, "2025/01/01", "")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"msg-001", "msg-002"}, ids)
+		assert.Equal(t, 4, transport.requests)
+
+		// Backoff exponentiel avec gigue
+		assert.Len(t, delays, 3)
+		for i, d := range delays {
+			backoff := 100 * time.Millisecond << i
+			assert.GreaterOrEqual(t, d, backoff/2)
+			assert.LessOrEqual(t, d, backoff)
+		}
+	})
+
+	t.Run("retry after", func(t *testing.T) {
+		delays = nil
+		transport := &faultyTransport{failures: []*http.Response{
+			errorResponse(http.StatusTooManyRequests, "rateLimitExceeded", http.Header{"Retry-After": []string{"7"}}),
+		}}
+		gs := newFakeGmailService(t, newFakeGmail(2, 0), transport)
+
+		_, err := gs.listMessageIDs(context.Background(), nil, "2025/01/01", "")
+		assert.NoError(t, err)
+		assert.Equal(t, []time.Duration{7 * time.Second}, delays)
+	})
+
+	t.Run("permanent error", func(t *testing.T) {
+		delays = nil
+		transport := &faultyTransport{failures: []*http.Response{
+			errorResponse(http.StatusNotFound, "notFound", nil),
+		}}
+		gs := newFakeGmailService(t, newFakeGmail(2, 0), transport)
+
+		_, err := gs.listMessageIDs(context.Background(), nil, "2025/01/01", "")
+		assert.Error(t, err)
+		assert.False(t, IsRetryableError(err))
+		assert.Equal(t, 1, transport.requests)
+		assert.Empty(t, delays)
+	})
+
+	t.Run("max attempts", func(t *testing.T) {
+		delays = nil
+		transport := &faultyTransport{}
+		for i := 0; i < 10; i++ {
+			transport.failures = append(transport.failures, errorResponse(http.StatusInternalServerError, "backendError", nil))
+		}
+		gs := newFakeGmailService(t, newFakeGmail(2, 0), transport)
+
+		_, err := gs.listMessageIDs(context.Background(), nil, "2025/01/01", "")
+		assert.Error(t, err)
+		assert.True(t, IsRetryableError(err))
+		assert.Equal(t, 4, transport.requests)
+		assert.Len(t, delays, 3)
+	})
+}
+
+func TestRetryPolicyCancelled(t *testing.T) {
+	transport := &faultyTransport{failures: []*http.Response{
+		errorResponse(http.StatusServiceUnavailable, "backendError", nil),
+		errorResponse(http.StatusServiceUnavailable, "backendError", nil),
+	}}
+	gs := newFakeGmailService(t, newFakeGmail(2, 0), transport)
+	gs.retry.BaseDelay = time.Minute
+	gs.retry.MaxDelay = time.Minute
+
+	// L'annulation interrompt l'attente entre deux tentatives
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := gs.listMessageIDs(ctx, nil, "2025/01/01", "")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, 1, transport.requests)
+
+	// Un appel annulé n'est pas retenté
+	_, err = gs.listMessageIDs(ctx, nil, "2025/01/01", "")
+	assert.Error(t, err)
+	assert.False(t, IsRetryableError(err))
+	assert.Equal(t, 1, transport.requests)
+}
+
+func TestClassifyGmailError(t *testing.T) {
+	assert.NoError(t, classifyGmailError("op", nil))
+	assert.False(t, IsRetryableError(classifyGmailError("op", errors.New("invalid request"))))
+	assert.False(t, IsRetryableError(classifyGmailError("op", context.Canceled)))
+}
+
+// httpBody wraps a byte slice as a response body.
+func httpBody(b []byte) io.ReadCloser {
+	return io.NopCloser(bytes.NewReader(b))
+}
@@ -0,0 +1,296 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RuleReport lists what the rules would do with past attachments and with
+// the attachments of fixture emails, and the rules which match none of them.
+type RuleReport struct {
+	Results []RuleResult `json:"results"`
+	// Unmatched lists the rules which matched no attachment
+	Unmatched []string `json:"unmatched"`
+}
+
+// RuleResult is the outcome of the rules on an attachment.
+type RuleResult struct {
+	File string `json:"file"`
+	// Source is "history", or the path of the fixture email
+	Source  string `json:"source"`
+	Sender  string `json:"sender,omitempty"`
+	Subject string `json:"subject,omitempty"`
+	// MetadataOnly is set when the file is gone: the rules only see the
+	// email and the invoice fields stored in the activity data
+	MetadataOnly bool   `json:"metadataOnly,omitempty"`
+	Locked       bool   `json:"locked,omitempty"`
+	Rule         string `json:"rule,omitempty"`
+	NewName      string `json:"newName,omitempty"`
+	Destination  string `json:"destination,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// EvaluateRules applies the rules to the attachments of the activity data,
+// read from where they were filed or downloaded, and to the PDF and XML
+// attachments of the .eml files of fixtures, files or directories. Nothing is
+// written, caches included, and the AI extraction provider is not called.
+func EvaluateRules(ctx context.Context, rules *RuleSet, am *ActivityManager, fixtures []string) (*RuleReport, error) {
+	passwords, err := LoadPasswords()
+	if err != nil {
+		return nil, NewError("EvaluateRules", err, "failed to load PDF passwords")
+	}
+	classifier, err := LoadClassifier()
+	if err != nil {
+		return nil, NewError("EvaluateRules", err, "failed to load document classifier")
+	}
+	reader := newDocumentReader(rules, passwords, classifier)
+	reader.extractor = nil
+	reader.readOnly = true
+
+	report := &RuleReport{Results: []RuleResult{}, Unmatched: []string{}}
+	matched := map[*Rule]bool{}
+	evaluate := func(doc *Document, result RuleResult) {
+		result.File = doc.Attachment.Filename
+		result.Sender = formatSender(doc.Email)
+		result.Subject = doc.Email.Subject
+		result.Locked = doc.Locked
+		if rule := rules.Match(doc); rule != nil {
+			matched[rule] = true
+			result.Rule = rule.Name
+			newName, err := rule.NewFilename(doc)
+			if err == nil {
+				result.NewName = newName
+				result.Destination, err = rule.DestinationDir(doc)
+			}
+			if err != nil {
+				result.Error = err.Error()
+			}
+		}
+		report.Results = append(report.Results, result)
+	}
+
+	for _, attachment := range am.Attachments() {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !isPDFDocument(attachment.Filename) && !isXMLDocument(attachment.Filename) {
+			continue
+		}
+		email, err := am.GetEmailByID(attachment.EmailID)
+		if err != nil {
+			continue
+		}
+
+		doc, result := readHistoryDocument(ctx, reader, attachment, *email)
+		evaluate(doc, result)
+	}
+
+	for _, fixture := range fixtures {
+		err := filepath.WalkDir(fixture, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if d.IsDir() || !strings.EqualFold(filepath.Ext(path), ".eml") {
+				return nil
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			email, attachments, err := parseEML(data)
+			if err != nil {
+				report.Results = append(report.Results, RuleResult{Source: path, Error: err.Error()})
+				return nil
+			}
+			email.ID = "fixture:" + filepath.Base(path)
+			for _, a := range attachments {
+				attachment := AttachmentData{Filename: a.filename, EmailID: email.ID}
+				evaluate(reader.readData(ctx, a.data, attachment, email), RuleResult{Source: path})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, NewError("EvaluateRules", err, fmt.Sprintf("failed to read fixtures %s", fixture))
+		}
+	}
+
+	for _, rule := range rules.Rules {
+		if !matched[rule] {
+			report.Unmatched = append(report.Unmatched, rule.Name)
+		}
+	}
+	return report, nil
+}
+
+// Print writes the report in a human-readable form
+func (r *RuleReport) Print(w io.Writer) {
+	matched := 0
+	for _, result := range r.Results {
+		name := result.File
+		if result.Source != "history" {
+			name = result.Source + ": " + name
+		}
+		fmt.Fprintf(w, "%s (%s, %q)", name, result.Sender, result.Subject)
+		switch {
+		case result.Rule != "" && result.Error == "":
+			matched++
+			fmt.Fprintf(w, ": rule %s -> %s", result.Rule, filepath.Join(result.Destination, result.NewName))
+		case result.Rule != "":
+			matched++
+			fmt.Fprintf(w, ": rule %s, error: %s", result.Rule, result.Error)
+		case result.Error != "":
+			fmt.Fprintf(w, ": error: %s", result.Error)
+		default:
+			fmt.Fprint(w, ": no rule")
+		}
+		if result.Locked {
+			fmt.Fprint(w, " (encrypted, no password opens it)")
+		}
+		if result.MetadataOnly {
+			fmt.Fprint(w, " (file not found, stored fields only)")
+		}
+		fmt.Fprintln(w)
+	}
+	if len(r.Unmatched) > 0 {
+		fmt.Fprintf(w, "Rules never matched: %s\n", strings.Join(r.Unmatched, ", "))
+	}
+	fmt.Fprintf(w, "%d attachments, %d matched by a rule\n", len(r.Results), matched)
+}
+
+// readHistoryDocument reads a past attachment from where reprocess would:
+// the attachments directory, or where it was filed. When the file is gone,
+// the document has only the email and the stored invoice fields.
+func readHistoryDocument(ctx context.Context, reader *documentReader, attachment AttachmentData, email EmailData) (*Document, RuleResult) {
+	result := RuleResult{Source: "history"}
+	if path := reprocessSource(attachment); path != "" {
+		doc := reader.read(ctx, path, attachment, email)
+		if doc.Invoice.IsEmpty() && attachment.Invoice != nil {
+			doc.Invoice = *attachment.Invoice
+		}
+		return doc, result
+	}
+
+	result.MetadataOnly = true
+	doc := &Document{Attachment: attachment, Email: email}
+	if attachment.Invoice != nil {
+		doc.Invoice = *attachment.Invoice
+	}
+	return doc, result
+}
+
+// formatSender formats the sender of an email as in a From header
+func formatSender(email EmailData) string {
+	if email.SenderName == "" {
+		return email.SenderEmail
+	}
+	return fmt.Sprintf("%s <%s>", email.SenderName, email.SenderEmail)
+}
+
+// emlAttachment is a PDF or XML attachment of an .eml file
+type emlAttachment struct {
+	filename string
+	data     []byte
+}
+
+// parseEML reads an email in the RFC 5322 format, as saved by mail clients,
+// and returns its headers and its PDF and XML attachments.
+func parseEML(data []byte) (EmailData, []emlAttachment, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return EmailData{}, nil, fmt.Errorf("error reading email: %v", err)
+	}
+
+	decoder := new(mime.WordDecoder)
+	decode := func(value string) string {
+		if decoded, err := decoder.DecodeHeader(value); err == nil {
+			return decoded
+		}
+		return value
+	}
+
+	var email EmailData
+	email.Subject = decode(msg.Header.Get("Subject"))
+	if from, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+		email.SenderName, email.SenderEmail = from.Name, from.Address
+	} else {
+		email.SenderName, email.SenderEmail = extractSenderInfo(decode(msg.Header.Get("From")))
+	}
+	if date, err := msg.Header.Date(); err == nil {
+		email.Date = date.Format(time.RFC3339)
+	}
+
+	var attachments []emlAttachment
+	err = walkMIMEPart(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), "", msg.Body, &attachments)
+	if err != nil {
+		return EmailData{}, nil, err
+	}
+	return email, attachments, nil
+}
+
+// walkMIMEPart collects the PDF and XML attachments of a MIME part and of its
+// sub-parts.
+func walkMIMEPart(contentType, encoding, disposition string, body io.Reader, attachments *[]emlAttachment) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("error reading email part: %v", err)
+			}
+			err = walkMIMEPart(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"),
+				part.Header.Get("Content-Disposition"), part, attachments)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	filename := params["name"]
+	if _, dispositionParams, err := mime.ParseMediaType(disposition); err == nil && dispositionParams["filename"] != "" {
+		filename = dispositionParams["filename"]
+	}
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(filename); err == nil {
+		filename = decoded
+	}
+	filename = filepath.Base(filename)
+	if filename == "." || !isPDFDocument(filename) && !isXMLDocument(filename) {
+		return nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("error decoding attachment %s: %v", filename, err)
+	}
+	*attachments = append(*attachments, emlAttachment{filename: filename, data: data})
+	return nil
+}
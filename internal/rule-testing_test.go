@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"extract-email-attachments/internal/config"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestEvaluateRules(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "rules-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	originalAttachmentsDir := config.AppAttachmentsDir
+	originalConfigDir := config.AppConfigDir
+	originalCacheDir := config.AppCacheDir
+	config.AppAttachmentsDir = filepath.Join(tempDir, "attachments")
+	config.AppConfigDir = tempDir
+	config.AppCacheDir = tempDir
+	defer func() {
+		config.AppAttachmentsDir = originalAttachmentsDir
+		config.AppConfigDir = originalConfigDir
+		config.AppCacheDir = originalCacheDir
+	}()
+	assert.NoError(t, os.MkdirAll(config.AppAttachmentsDir, 0755))
+
+	rulesPath := filepath.Join(tempDir, "rules-draft.json")
+	assert.NoError(t, os.WriteFile(rulesPath, []byte(`{"rules": [
+		{"name": "Nordlicht", "match": {"vatNumber": "DE123456789"}, "filename": "{{.Year}}-{{.Month}}-{{.InvoiceNumber}}.xml", "destination": "Factures/{{.Year}}/"},
+		{"name": "Vendor", "vendor": "Vendor", "match": {"senderEmail": "@vendor.com"}, "filename": "{{.Year}}-{{.Month}}-facture-{{.Vendor}}.pdf"},
+		{"name": "Jamais", "match": {"senderEmail": "@ailleurs.fr"}, "filename": "{{.Name}}.pdf"}
+	]}`), 0644))
+	rules, err := LoadRulesFile(rulesPath)
+	assert.NoError(t, err)
+
+	// Historique : une facture XML encore téléchargée, une facture dont le fichier a disparu
+	am := NewActivityManager()
+	assert.NoError(t, am.Load())
+	assert.NoError(t, am.StoreEmailMeta("nordlicht", &gmail.Message{Id: "nordlicht", Payload: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{
+		{Name: "Date", Value: "Thu, 02 Apr 2026 11:00:00 +0200"},
+		{Name: "From", Value: "Nordlicht <billing@nordlicht.example>"},
+		{Name: "Subject", Value: "Invoice"},
+	}}}))
+	xmlContent, err := os.ReadFile(filepath.Join("testdata", "ubl-invoice.xml"))
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(config.AppAttachmentsDir, "invoice.xml"), xmlContent, 0644))
+	assert.NoError(t, am.StoreAttachmentMeta("invoice.xml", "nordlicht", fmt.Sprintf("%x", sha256.Sum256(xmlContent))))
+
+	assert.NoError(t, am.StoreEmailMeta("autre", &gmail.Message{Id: "autre", Payload: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{
+		{Name: "Date", Value: "Mon, 02 Mar 2026 09:00:00 +0100"},
+		{Name: "From", Value: "Autre <contact@autre.fr>"},
+		{Name: "Subject", Value: "Relevé"},
+	}}}))
+	assert.NoError(t, am.StoreAttachmentMeta("releve.pdf", "autre", "hash-pdf"))
+	assert.NoError(t, am.UpdateAttachmentInvoice("autre", "releve.pdf", InvoiceFields{Number: "R-1", VATNumber: "DE123456789", IssueDate: "2026-02-28"}))
+	assert.NoError(t, am.Save())
+
+	// Un email enregistré par un client de messagerie, avec une pièce jointe PDF
+	pdfContent, err := os.ReadFile(filepath.Join("testdata", "invoice.pdf"))
+	assert.NoError(t, err)
+	// Le relevé d'un autre message, du même nom, n'est pas pris pour celui de l'historique
+	assert.NoError(t, os.WriteFile(filepath.Join(config.AppAttachmentsDir, "releve.pdf"), pdfContent, 0644))
+	fixturesDir := filepath.Join(tempDir, "fixtures")
+	assert.NoError(t, os.MkdirAll(fixturesDir, 0755))
+	eml := strings.Join([]string{
+		"From: =?UTF-8?Q?Vendor_Facturation?= <billing@vendor.com>",
+		"Subject: =?UTF-8?Q?Votre_facture_de_f=C3=A9vrier?=",
+		"Date: Tue, 03 Feb 2026 08:00:00 +0100",
+		"MIME-Version: 1.0",
+		`Content-Type: multipart/mixed; boundary="frontiere"`,
+		"",
+		"--frontiere",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		"Bonjour, voici votre facture.",
+		"--frontiere",
+		`Content-Type: application/pdf; name="facture.pdf"`,
+		`Content-Disposition: attachment; filename="facture.pdf"`,
+		"Content-Transfer-Encoding: base64",
+		"",
+		wrapBase64(pdfContent),
+		"--frontiere--",
+		"",
+	}, "\r\n")
+	assert.NoError(t, os.WriteFile(filepath.Join(fixturesDir, "vendor.eml"), []byte(eml), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(fixturesDir, "notes.txt"), []byte("ignoré"), 0644))
+
+	am = NewActivityManager()
+	assert.NoError(t, am.LoadReadOnly())
+	report, err := EvaluateRules(context.Background(), rules, am, []string{fixturesDir})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []RuleResult{
+		{File: "invoice.xml", Source: "history", Sender: "Nordlicht <billing@nordlicht.example>", Subject: "Invoice",
+			Rule: "Nordlicht", NewName: "2026-04-INV-2026-0315.xml", Destination: filepath.Join(config.AppAttachmentsDir, "Factures", "2026")},
+		{File: "releve.pdf", Source: "history", Sender: "Autre <contact@autre.fr>", Subject: "Relevé", MetadataOnly: true,
+			Rule: "Nordlicht", NewName: "2026-02-R-1.xml", Destination: filepath.Join(config.AppAttachmentsDir, "Factures", "2026")},
+		{File: "facture.pdf", Source: filepath.Join(fixturesDir, "vendor.eml"), Sender: "Vendor Facturation <billing@vendor.com>", Subject: "Votre facture de février",
+			Rule: "Vendor", NewName: "2026-03-facture-Vendor.pdf", Destination: config.AppAttachmentsDir},
+	}, report.Results)
+	assert.Equal(t, []string{"Jamais"}, report.Unmatched)
+
+	var out bytes.Buffer
+	report.Print(&out)
+	assert.Contains(t, out.String(), "Rules never matched: Jamais\n")
+	assert.Contains(t, out.String(), "3 attachments, 3 matched by a rule\n")
+
+	// Rien n'a été écrit
+	entries, err := os.ReadDir(config.AppAttachmentsDir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestEvaluateRulesWritesNoCache(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "rules-cache-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	originalAttachmentsDir := config.AppAttachmentsDir
+	originalConfigDir := config.AppConfigDir
+	originalCacheDir := config.AppCacheDir
+	originalOCR := config.AppSettings.OCR
+	config.AppAttachmentsDir = filepath.Join(tempDir, "attachments")
+	config.AppConfigDir = tempDir
+	config.AppCacheDir = filepath.Join(tempDir, "caches")
+	config.AppSettings.OCR = fakeOCRTools(t, tempDir)
+	config.AppSettings.OCR.Enabled = true
+	defer func() {
+		config.AppAttachmentsDir = originalAttachmentsDir
+		config.AppConfigDir = originalConfigDir
+		config.AppCacheDir = originalCacheDir
+		config.AppSettings.OCR = originalOCR
+	}()
+	assert.NoError(t, os.MkdirAll(config.AppAttachmentsDir, 0755))
+
+	// Un document scanné de l'historique est reconnu par OCR
+	scanContent, err := os.ReadFile(filepath.Join("testdata", "scan.pdf"))
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(config.AppAttachmentsDir, "scan.pdf"), scanContent, 0644))
+	am := NewActivityManager()
+	assert.NoError(t, am.Load())
+	assert.NoError(t, am.StoreEmailMeta("acme", &gmail.Message{Id: "acme", Payload: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{
+		{Name: "Date", Value: "Fri, 02 Jan 2026 10:00:00 +0100"},
+		{Name: "From", Value: "ACME <factures@acme.fr>"},
+	}}}))
+	assert.NoError(t, am.StoreAttachmentMeta("scan.pdf", "acme", fmt.Sprintf("%x", sha256.Sum256(scanContent))))
+	assert.NoError(t, am.Save())
+
+	am = NewActivityManager()
+	assert.NoError(t, am.LoadReadOnly())
+	report, err := EvaluateRules(context.Background(), DefaultRules(), am, nil)
+	assert.NoError(t, err)
+	assert.Len(t, report.Results, 1)
+	assert.FileExists(t, filepath.Join(tempDir, "calls.log"))
+
+	// Le texte reconnu n'est pas mis en cache
+	assert.NoDirExists(t, config.AppCacheDir)
+}
+
+// wrapBase64 encode le contenu en base64 par lignes de 76 caractères, comme les clients de messagerie
+func wrapBase64(data []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var lines []string
+	for len(encoded) > 76 {
+		lines = append(lines, encoded[:76])
+		encoded = encoded[76:]
+	}
+	return strings.Join(append(lines, encoded), "\r\n")
+}
@@ -0,0 +1,340 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"extract-email-attachments/internal/config"
+	"extract-email-attachments/internal/pdf"
+)
+
+// Rule renames the attachments matching its conditions.
+type Rule struct {
+	Name   string    `json:"name"`
+	Vendor string    `json:"vendor,omitempty"`
+	Match  RuleMatch `json:"match"`
+	// Filename is a text/template producing the new name, see filenameData
+	Filename string `json:"filename"`
+	// Destination is a text/template producing the directory where the
+	// document is filed, such as "Factures/{{.Year}}/{{.Vendor}}/"
+	Destination string `json:"destination,omitempty"`
+	// Mode is how the document is filed: "move" (default), "copy" or "link"
+	Mode string `json:"mode,omitempty"`
+	// Query is a Gmail search fragment, such as "in:sent" or "from:@edf.fr",
+	// whose messages are fetched in addition to those of the account query.
+	// The conditions of Match still select the documents of the rule.
+	Query string `json:"query,omitempty"`
+
+	filename    *template.Template
+	destination *template.Template
+	textRegex   *regexp.Regexp
+}
+
+// RuleMatch lists the conditions of a rule. All the conditions set must be
+// satisfied; comparisons are case-insensitive.
+type RuleMatch struct {
+	SenderName      string `json:"senderName,omitempty"`
+	SenderEmail     string `json:"senderEmail,omitempty"` // address, or domain such as "@ikuto.fr"
+	SubjectContains string `json:"subjectContains,omitempty"`
+	TextContains    string `json:"textContains,omitempty"` // in the text of the document
+	TextRegex       string `json:"textRegex,omitempty"`
+	VATNumber       string `json:"vatNumber,omitempty"` // VAT number of the seller, such as "FR40123456789"
+	// DocumentType is the type predicted by the classifier, such as "Devis",
+	// with at least MinConfidence (0.6 if not set)
+	DocumentType  string  `json:"documentType,omitempty"`
+	MinConfidence float64 `json:"minConfidence,omitempty"`
+}
+
+// RuleSet is the ordered list of rules: the first matching rule applies.
+type RuleSet struct {
+	Rules []*Rule `json:"rules"`
+}
+
+// Document is an attachment being processed, with what is known about its content.
+type Document struct {
+	Attachment AttachmentData
+	Email      EmailData
+	Text       string
+	Invoice    InvoiceFields
+	// Encrypted is set for password-protected PDFs, Locked if no password opened it
+	Encrypted bool
+	Locked    bool
+	// Type is the type predicted by the classifier, TypeConfidence its probability
+	Type           string
+	TypeConfidence float64
+
+	pdf *pdf.Document // the PDF document, nil for other documents
+}
+
+// filenameData is the data available to the filename templates of the rules.
+// Year, Month and Day come from the invoice issue date, or from the email date.
+// Vendor is the vendor of the rule or, if not set, the seller of the invoice.
+type filenameData struct {
+	Vendor        string
+	Year          string
+	Month         string
+	Day           string
+	InvoiceNumber string
+	Name          string // original filename, without extension
+	Ext           string // original extension, such as ".pdf"
+	Email         EmailData
+	Invoice       InvoiceFields
+}
+
+// DefaultRules returns the rules used when rules.json is missing
+func DefaultRules() *RuleSet {
+	rules := &RuleSet{Rules: []*Rule{{
+		Name:   "IKUTO",
+		Vendor: "IKUTO",
+		Match: RuleMatch{
+			SenderName:      "IKUTO",
+			SubjectContains: "facture",
+		},
+		Filename: "{{.Year}}-{{.Month}}-facture-{{.Vendor}}.pdf",
+	}}}
+	if err := rules.compile(); err != nil {
+		panic(err)
+	}
+	return rules
+}
+
+// LoadRules reads the rules from rules.json in the configuration directory,
+// or returns the default rules if the file does not exist
+func LoadRules() (*RuleSet, error) {
+	rules, err := LoadRulesFile(filepath.Join(config.AppConfigDir, "rules.json"))
+	if os.IsNotExist(err) {
+		return DefaultRules(), nil
+	}
+	return rules, err
+}
+
+// LoadRulesFile reads and validates the rules of the file at path, such as a
+// rules file being written
+func LoadRulesFile(path string) (*RuleSet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error reading rules: %w", err)
+	}
+
+	var rules RuleSet
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("error decoding rules: %w", err)
+	}
+	if err := rules.compile(); err != nil {
+		return nil, err
+	}
+	return &rules, nil
+}
+
+// SaveRules writes the rules to rules.json in the configuration directory
+func SaveRules(rules *RuleSet) error {
+	data, err := json.MarshalIndent(rules, "", "    ")
+	if err != nil {
+		return fmt.Errorf("error encoding rules: %w", err)
+	}
+	return writeFileAtomic(filepath.Join(config.AppConfigDir, "rules.json"), append(data, '\n'), defaultFilePerm)
+}
+
+// compile validates the rules and prepares their templates and regular expressions.
+func (rs *RuleSet) compile() error {
+	for i, rule := range rs.Rules {
+		if rule.Name == "" {
+			return fmt.Errorf("%w: rule %d has no name", ErrInvalidConfig, i+1)
+		}
+		if rule.Match == (RuleMatch{}) {
+			return fmt.Errorf("%w: rule %s has no conditions", ErrInvalidConfig, rule.Name)
+		}
+		if rule.Filename == "" {
+			return fmt.Errorf("%w: rule %s has no filename", ErrInvalidConfig, rule.Name)
+		}
+
+		tmpl, err := template.New(rule.Name).Option("missingkey=error").Parse(rule.Filename)
+		if err != nil {
+			return fmt.Errorf("%w: rule %s: invalid filename: %v", ErrInvalidConfig, rule.Name, err)
+		}
+		rule.filename = tmpl
+
+		if rule.Destination != "" {
+			tmpl, err := template.New(rule.Name).Option("missingkey=error").Parse(rule.Destination)
+			if err != nil {
+				return fmt.Errorf("%w: rule %s: invalid destination: %v", ErrInvalidConfig, rule.Name, err)
+			}
+			rule.destination = tmpl
+		}
+		switch rule.Mode {
+		case "", DestinationModeMove, DestinationModeCopy, DestinationModeLink:
+		default:
+			return fmt.Errorf("%w: rule %s: mode must be move, copy or link", ErrInvalidConfig, rule.Name)
+		}
+
+		if err := config.CheckGmailQuery(rule.Query); err != nil {
+			return fmt.Errorf("%w: rule %s: query %v", ErrInvalidConfig, rule.Name, err)
+		}
+
+		if rule.Match.MinConfidence < 0 || rule.Match.MinConfidence > 1 {
+			return fmt.Errorf("%w: rule %s: minConfidence must be between 0 and 1", ErrInvalidConfig, rule.Name)
+		}
+		if rule.Match.MinConfidence != 0 && rule.Match.DocumentType == "" {
+			return fmt.Errorf("%w: rule %s: minConfidence requires documentType", ErrInvalidConfig, rule.Name)
+		}
+
+		if rule.Match.TextRegex != "" {
+			re, err := regexp.Compile(rule.Match.TextRegex)
+			if err != nil {
+				return fmt.Errorf("%w: rule %s: invalid textRegex: %v", ErrInvalidConfig, rule.Name, err)
+			}
+			rule.textRegex = re
+		}
+	}
+	return nil
+}
+
+// Queries returns the Gmail searches of the messages to fetch: the account
+// query, then the distinct queries of the rules.
+func (rs *RuleSet) Queries() []string {
+	queries := []string{config.AppSettings.Gmail.Query}
+	for _, rule := range rs.Rules {
+		if rule.Query != "" && !slices.Contains(queries, rule.Query) {
+			queries = append(queries, rule.Query)
+		}
+	}
+	return queries
+}
+
+// Match returns the first rule matching the document, or nil.
+func (rs *RuleSet) Match(doc *Document) *Rule {
+	for _, rule := range rs.Rules {
+		if rule.Matches(doc) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Matches checks if the document satisfies all the conditions of the rule.
+func (r *Rule) Matches(doc *Document) bool {
+	m := r.Match
+	if m.SenderName != "" && !strings.EqualFold(doc.Email.SenderName, m.SenderName) {
+		return false
+	}
+	if m.SenderEmail != "" && !matchSenderEmail(doc.Email.SenderEmail, m.SenderEmail) {
+		return false
+	}
+	if m.SubjectContains != "" && !strings.Contains(strings.ToLower(doc.Email.Subject), strings.ToLower(m.SubjectContains)) {
+		return false
+	}
+	if m.TextContains != "" && !strings.Contains(strings.ToLower(doc.Text), strings.ToLower(m.TextContains)) {
+		return false
+	}
+	if r.textRegex != nil && !r.textRegex.MatchString(doc.Text) {
+		return false
+	}
+	if m.VATNumber != "" && !strings.EqualFold(doc.Invoice.VATNumber, strings.Join(strings.Fields(m.VATNumber), "")) {
+		return false
+	}
+	if m.DocumentType != "" && !matchDocumentType(doc, m) {
+		return false
+	}
+	return true
+}
+
+// matchDocumentType checks if the document was classified as the expected
+// type with enough confidence.
+func matchDocumentType(doc *Document, m RuleMatch) bool {
+	minConfidence := m.MinConfidence
+	if minConfidence == 0 {
+		minConfidence = defaultMinConfidence
+	}
+	return strings.EqualFold(doc.Type, m.DocumentType) && doc.TypeConfidence >= minConfidence
+}
+
+// matchSenderEmail checks if email is the expected address, or belongs to
+// the expected domain such as "@ikuto.fr".
+func matchSenderEmail(email, expected string) bool {
+	email, expected = strings.ToLower(email), strings.ToLower(expected)
+	if strings.HasPrefix(expected, "@") {
+		return strings.HasSuffix(email, expected)
+	}
+	return email == expected
+}
+
+// NewFilename computes the new name of the document.
+func (r *Rule) NewFilename(doc *Document) (string, error) {
+	data, err := r.filenameData(doc)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := r.filename.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("error executing filename template of rule %s: %v", r.Name, err)
+	}
+
+	name := strings.TrimSpace(buf.String())
+	// Names ending with .pdf keep the extension of other documents, such as XML invoices
+	if nameExt := filepath.Ext(name); strings.EqualFold(nameExt, ".pdf") && data.Ext != "" && !strings.EqualFold(nameExt, data.Ext) {
+		name = strings.TrimSuffix(name, nameExt) + data.Ext
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("%w: rule %s produced %q", ErrInvalidFilename, r.Name, name)
+	}
+	return name, nil
+}
+
+// filenameData returns the data of the filename template for the document.
+func (r *Rule) filenameData(doc *Document) (filenameData, error) {
+	date, ok := doc.Invoice.Date()
+	if !ok {
+		emailDate, err := time.Parse(time.RFC3339, doc.Email.Date)
+		if err != nil {
+			return filenameData{}, fmt.Errorf("no invoice date and invalid email date: %v", err)
+		}
+		date = emailDate
+	}
+
+	ext := filepath.Ext(doc.Attachment.Filename)
+	return filenameData{
+		Vendor:        sanitizeFilename(r.vendor(doc)),
+		Year:          date.Format("2006"),
+		Month:         date.Format("01"),
+		Day:           date.Format("02"),
+		InvoiceNumber: sanitizeFilename(doc.Invoice.Number),
+		Name:          strings.TrimSuffix(doc.Attachment.Filename, ext),
+		Ext:           ext,
+		Email:         doc.Email,
+		Invoice:       doc.Invoice,
+	}, nil
+}
+
+// vendor returns the vendor of the rule or, if not set, the seller of the invoice.
+func (r *Rule) vendor(doc *Document) string {
+	if r.Vendor != "" {
+		return r.Vendor
+	}
+	return doc.Invoice.Seller
+}
+
+// sanitizeFilename replaces the characters not allowed in filenames.
+func sanitizeFilename(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r < 0x20:
+			return -1
+		case strings.ContainsRune(`/\:*?"<>|`, r):
+			return '-'
+		}
+		return r
+	}, s)
+	return strings.Trim(s, " .")
+}
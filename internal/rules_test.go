@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"extract-email-attachments/internal/config"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadRules(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "rules-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	originalConfigDir := config.AppConfigDir
+	config.AppConfigDir = tempDir
+	defer func() {
+		config.AppConfigDir = originalConfigDir
+	}()
+
+	// Sans fichier, les règles par défaut s'appliquent
+	rules, err := LoadRules()
+	assert.NoError(t, err)
+	assert.Len(t, rules.Rules, 1)
+	assert.Equal(t, "IKUTO", rules.Rules[0].Name)
+
+	rulesPath := filepath.Join(tempDir, "rules.json")
+	err = os.WriteFile(rulesPath, []byte(`{"rules": [
+		{"name": "ACME", "vendor": "ACME", "match": {"textRegex": "(?i)acme\\s+fournitures"}, "filename": "{{.Year}}-{{.Month}}-facture-{{.Vendor}}.pdf"}
+	]}`), 0644)
+	assert.NoError(t, err)
+	rules, err = LoadRules()
+	assert.NoError(t, err)
+	assert.Len(t, rules.Rules, 1)
+	assert.Equal(t, "ACME", rules.Rules[0].Vendor)
+
+	// Règles invalides
+	for _, content := range []string{
+		`{"rules": [`,
+		`{"rules": [{"name": "sans condition", "filename": "a.pdf"}]}`,
+		`{"rules": [{"name": "sans nom de fichier", "match": {"senderName": "ACME"}}]}`,
+		`{"rules": [{"match": {"senderName": "ACME"}, "filename": "a.pdf"}]}`,
+		`{"rules": [{"name": "regex", "match": {"textRegex": "("}, "filename": "a.pdf"}]}`,
+		`{"rules": [{"name": "template", "match": {"senderName": "ACME"}, "filename": "{{.Year"}]}`,
+		`{"rules": [{"name": "destination", "match": {"senderName": "ACME"}, "filename": "a.pdf", "destination": "{{.Year"}]}`,
+		`{"rules": [{"name": "mode", "match": {"senderName": "ACME"}, "filename": "a.pdf", "mode": "symlink"}]}`,
+		`{"rules": [{"name": "confiance", "match": {"documentType": "Devis", "minConfidence": 1.5}, "filename": "a.pdf"}]}`,
+		`{"rules": [{"name": "confiance seule", "match": {"minConfidence": 0.8}, "filename": "a.pdf"}]}`,
+		`{"rules": [{"name": "requête datée", "match": {"senderName": "ACME"}, "filename": "a.pdf", "query": "in:sent after:2025/01/01"}]}`,
+		`{"rules": [{"name": "requête", "match": {"senderName": "ACME"}, "filename": "a.pdf", "query": "(from:acme"}]}`,
+	} {
+		err = os.WriteFile(rulesPath, []byte(content), 0644)
+		assert.NoError(t, err)
+		_, err = LoadRules()
+		assert.Error(t, err, content)
+	}
+}
+
+func TestRuleMatch(t *testing.T) {
+	rules := &RuleSet{Rules: []*Rule{
+		{Name: "domaine", Match: RuleMatch{SenderEmail: "@edf.fr", SubjectContains: "facture"}, Filename: "edf.pdf"},
+		{Name: "texte", Match: RuleMatch{TextContains: "Orange SA"}, Filename: "orange.pdf"},
+		{Name: "regex", Match: RuleMatch{TextRegex: `Contrat n° \d+`}, Filename: "contrat.pdf"},
+		{Name: "tva", Match: RuleMatch{VATNumber: "FR 12 345678901"}, Filename: "martin.pdf"},
+		{Name: "devis", Match: RuleMatch{SenderEmail: "@martin.fr", DocumentType: "devis", MinConfidence: 0.9}, Filename: "devis.pdf"},
+		{Name: "attestation", Match: RuleMatch{DocumentType: "Attestations"}, Filename: "attestation.pdf"},
+	}}
+	assert.NoError(t, rules.compile())
+
+	tests := []struct {
+		doc      Document
+		expected string
+	}{
+		{Document{Email: EmailData{SenderEmail: "Factures@EDF.fr", Subject: "Votre FACTURE"}}, "domaine"},
+		{Document{Email: EmailData{SenderEmail: "factures@edf.fr", Subject: "Relevé"}}, ""},
+		{Document{Email: EmailData{SenderEmail: "factures@notedf.fr.example"}, Text: "Facture ORANGE SA"}, "texte"},
+		{Document{Text: "Contrat n° 12345"}, "regex"},
+		{Document{Text: "Contrat n° XX"}, ""},
+		{Document{Invoice: InvoiceFields{VATNumber: "FR12345678901"}}, "tva"},
+		{Document{Invoice: InvoiceFields{VATNumber: "FR99345678901"}}, ""},
+		{Document{Email: EmailData{SenderEmail: "contact@martin.fr"}, Type: "Devis", TypeConfidence: 0.95}, "devis"},
+		{Document{Email: EmailData{SenderEmail: "contact@martin.fr"}, Type: "Devis", TypeConfidence: 0.8}, ""},
+		{Document{Type: "Attestations", TypeConfidence: 0.7}, "attestation"},
+		{Document{Type: "Attestations", TypeConfidence: 0.5}, ""},
+	}
+
+	for _, tt := range tests {
+		rule := rules.Match(&tt.doc)
+		if tt.expected == "" {
+			assert.Nil(t, rule)
+			continue
+		}
+		if assert.NotNil(t, rule) {
+			assert.Equal(t, tt.expected, rule.Name)
+		}
+	}
+}
+
+func TestRuleNewFilename(t *testing.T) {
+	rule := &Rule{
+		Name:     "ACME",
+		Vendor:   "ACME",
+		Match:    RuleMatch{SenderName: "ACME"},
+		Filename: "{{.Year}}-{{.Month}}-facture-{{.Vendor}}{{with .InvoiceNumber}}-{{.}}{{end}}{{.Ext}}",
+	}
+	assert.NoError(t, (&RuleSet{Rules: []*Rule{rule}}).compile())
+
+	doc := &Document{
+		Attachment: AttachmentData{Filename: "facture.pdf"},
+		Email:      EmailData{Date: "2026-04-02T10:00:00+02:00"},
+	}
+
+	// Sans champs extraits, la date de l'email est utilisée
+	name, err := rule.NewFilename(doc)
+	assert.NoError(t, err)
+	assert.Equal(t, "2026-04-facture-ACME.pdf", name)
+
+	// La date et le numéro de la facture sont utilisés, les caractères interdits remplacés
+	doc.Invoice = InvoiceFields{Number: "FA/2026/118", IssueDate: "2026-03-31"}
+	name, err = rule.NewFilename(doc)
+	assert.NoError(t, err)
+	assert.Equal(t, "2026-03-facture-ACME-FA-2026-118.pdf", name)
+
+	// Sans fournisseur dans la règle, le vendeur de la facture est utilisé
+	rule.Vendor = ""
+	doc.Invoice.Seller = "Papeterie Martin SARL"
+	name, err = rule.NewFilename(doc)
+	assert.NoError(t, err)
+	assert.Equal(t, "2026-03-facture-Papeterie Martin SARL-FA-2026-118.pdf", name)
+
+	// Un document XML garde son extension
+	doc.Attachment.Filename = "facture.xml"
+	rule.Filename = "{{.Year}}-{{.Month}}-facture-{{.Vendor}}.pdf"
+	assert.NoError(t, (&RuleSet{Rules: []*Rule{rule}}).compile())
+	name, err = rule.NewFilename(doc)
+	assert.NoError(t, err)
+	assert.Equal(t, "2026-03-facture-Papeterie Martin SARL.xml", name)
+
+	// Ni date de facture, ni date d'email
+	doc = &Document{Attachment: AttachmentData{Filename: "facture.pdf"}}
+	_, err = rule.NewFilename(doc)
+	assert.Error(t, err)
+
+	// Un nom de fichier ne peut pas contenir de dossier
+	rule.Filename = "{{.Year}}/{{.Vendor}}.pdf"
+	assert.NoError(t, (&RuleSet{Rules: []*Rule{rule}}).compile())
+	doc.Invoice.IssueDate = "2026-03-31"
+	_, err = rule.NewFilename(doc)
+	assert.ErrorIs(t, err, ErrInvalidFilename)
+}
+
+func TestRuleDestinationDir(t *testing.T) {
+	originalAttachmentsDir := config.AppAttachmentsDir
+	config.AppAttachmentsDir = "/tmp/attachments"
+	defer func() {
+		config.AppAttachmentsDir = originalAttachmentsDir
+	}()
+	home, err := os.UserHomeDir()
+	assert.NoError(t, err)
+
+	doc := &Document{
+		Attachment: AttachmentData{Filename: "facture.pdf"},
+		Invoice:    InvoiceFields{IssueDate: "2026-03-31", Seller: "Papeterie Martin SARL"},
+	}
+
+	tests := []struct {
+		destination string
+		expected    string
+	}{
+		{"", "/tmp/attachments"},
+		{"Factures/{{.Year}}/{{.Vendor}}/", "/tmp/attachments/Factures/2026/Papeterie Martin SARL"},
+		{"/srv/compta/{{.Year}}-{{.Month}}", "/srv/compta/2026-03"},
+		{"~/Documents/Factures", filepath.Join(home, "Documents/Factures")},
+	}
+	for _, tt := range tests {
+		rule := &Rule{Name: "Papeterie", Match: RuleMatch{SenderName: "Martin"}, Filename: "a.pdf", Destination: tt.destination}
+		assert.NoError(t, (&RuleSet{Rules: []*Rule{rule}}).compile())
+		dir, err := rule.DestinationDir(doc)
+		assert.NoError(t, err, tt.destination)
+		assert.Equal(t, tt.expected, dir, tt.destination)
+	}
+
+	// Une destination ne peut pas remonter dans l'arborescence
+	rule := &Rule{Name: "Papeterie", Match: RuleMatch{SenderName: "Martin"}, Filename: "a.pdf", Destination: "Factures/../../{{.Year}}"}
+	assert.NoError(t, (&RuleSet{Rules: []*Rule{rule}}).compile())
+	_, err = rule.DestinationDir(doc)
+	assert.ErrorIs(t, err, ErrInvalidFilename)
+}
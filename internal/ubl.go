@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ublInvoice is the part of a UBL 2.1 invoice or credit note used to fill
+// the invoice fields. Elements are matched by local name, whatever their
+// namespace prefix.
+type ublInvoice struct {
+	ID        string `xml:"ID"`
+	IssueDate string `xml:"IssueDate"`
+	// DueDate is only defined for invoices, credit notes give the due date
+	// of the payment means
+	DueDate         string   `xml:"DueDate"`
+	PaymentDueDates []string `xml:"PaymentMeans>PaymentDueDate"`
+	Currency        string   `xml:"DocumentCurrencyCode"`
+	Supplier        struct {
+		Name             string `xml:"PartyName>Name"`
+		RegistrationName string `xml:"PartyLegalEntity>RegistrationName"`
+		TaxSchemes       []struct {
+			CompanyID string `xml:"CompanyID"`
+			Scheme    string `xml:"TaxScheme>ID"`
+		} `xml:"PartyTaxScheme"`
+	} `xml:"AccountingSupplierParty>Party"`
+	TaxTotals []struct {
+		Amount    ublAmount `xml:"TaxAmount"`
+		Subtotals []struct {
+			Base     ublAmount `xml:"TaxableAmount"`
+			Amount   ublAmount `xml:"TaxAmount"`
+			Category string    `xml:"TaxCategory>ID"`
+			Percent  string    `xml:"TaxCategory>Percent"`
+			Scheme   string    `xml:"TaxCategory>TaxScheme>ID"`
+		} `xml:"TaxSubtotal"`
+	} `xml:"TaxTotal"`
+	MonetaryTotal struct {
+		TaxExclusive ublAmount `xml:"TaxExclusiveAmount"`
+		TaxInclusive ublAmount `xml:"TaxInclusiveAmount"`
+		Payable      ublAmount `xml:"PayableAmount"`
+	} `xml:"LegalMonetaryTotal"`
+}
+
+type ublAmount struct {
+	Value    string `xml:",chardata"`
+	Currency string `xml:"currencyID,attr"`
+}
+
+// parseUBL reads the fields of a UBL invoice or credit note.
+func parseUBL(data []byte) (InvoiceFields, error) {
+	var invoice ublInvoice
+	if err := newXMLDecoder(data).Decode(&invoice); err != nil {
+		return InvoiceFields{}, err
+	}
+
+	supplier := invoice.Supplier
+	fields := InvoiceFields{
+		Number:    strings.TrimSpace(invoice.ID),
+		IssueDate: ublDate(invoice.IssueDate),
+		DueDate:   ublDate(invoice.DueDate),
+		Seller:    strings.Join(strings.Fields(supplier.RegistrationName), " "),
+		Currency:  strings.ToUpper(strings.TrimSpace(invoice.Currency)),
+		Source:    FieldSourceUBL,
+	}
+	if fields.Number == "" {
+		return InvoiceFields{}, fmt.Errorf("invoice has no number")
+	}
+	if fields.Seller == "" {
+		fields.Seller = strings.Join(strings.Fields(supplier.Name), " ")
+	}
+	for _, date := range invoice.PaymentDueDates {
+		if fields.DueDate != "" {
+			break
+		}
+		fields.DueDate = ublDate(date)
+	}
+
+	for _, scheme := range supplier.TaxSchemes {
+		if strings.TrimSpace(scheme.Scheme) == "VAT" {
+			fields.VATNumber = strings.ToUpper(strings.Join(strings.Fields(scheme.CompanyID), ""))
+			break
+		}
+	}
+
+	total := invoice.MonetaryTotal
+	fields.Total = xmlDecimal(total.TaxInclusive.Value, 2)
+	if fields.Total == "" {
+		fields.Total = xmlDecimal(total.Payable.Value, 2)
+	}
+	fields.TotalExclVAT = xmlDecimal(total.TaxExclusive.Value, 2)
+
+	// A second tax total may be given in the accounting currency, without subtotals
+	for _, taxTotal := range invoice.TaxTotals {
+		if taxTotal.Amount.Currency != "" && taxTotal.Amount.Currency != fields.Currency {
+			continue
+		}
+		fields.VATTotal = xmlDecimal(taxTotal.Amount.Value, 2)
+		for _, subtotal := range taxTotal.Subtotals {
+			if scheme := strings.TrimSpace(subtotal.Scheme); scheme != "" && scheme != "VAT" {
+				continue
+			}
+			fields.VAT = append(fields.VAT, VATBreakdown{
+				Category: strings.TrimSpace(subtotal.Category),
+				Rate:     xmlDecimal(subtotal.Percent, -1),
+				Base:     xmlDecimal(subtotal.Base.Value, 2),
+				Amount:   xmlDecimal(subtotal.Amount.Value, 2),
+			})
+		}
+		break
+	}
+	return fields, nil
+}
+
+// ublDate returns a date formatted as 2006-01-02, or an empty string
+func ublDate(s string) string {
+	t, err := time.Parse(time.DateOnly, strings.TrimSpace(s))
+	if err != nil {
+		return ""
+	}
+	return t.Format(time.DateOnly)
+}
@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// forEachParallel calls fn for each index in [0, n) with at most workers
+// concurrent goroutines, indexes being started in increasing order. Callers
+// store results by index to keep a deterministic ordering.
+func forEachParallel(workers int, n int, fn func(i int)) {
+	if workers < 1 {
+		workers = 1
+	}
+	workers = min(workers, n)
+
+	var wg sync.WaitGroup
+	next := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fn(i)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+// quotaLimiter is a token bucket limiting the rate of Gmail API quota units.
+// The bucket holds at most one second worth of units.
+type quotaLimiter struct {
+	mu       sync.Mutex
+	rate     float64 // units per second
+	tokens   float64
+	lastFill time.Time
+}
+
+// Gmail API quota units per method
+const (
+	quotaUnitsMessagesList        = 5
+	quotaUnitsMessagesGet         = 5
+	quotaUnitsAttachmentsGet      = 5
+	quotaUnitsMessagesBatchModify = 50
+	quotaUnitsLabelsList          = 1
+	quotaUnitsLabelsCreate        = 5
+)
+
+func newQuotaLimiter(unitsPerSecond int) *quotaLimiter {
+	return &quotaLimiter{
+		rate:     float64(unitsPerSecond),
+		tokens:   float64(unitsPerSecond),
+		lastFill: time.Now(),
+	}
+}
+
+// Wait blocks until the given number of units is available, then consumes them.
+// It returns early if ctx is cancelled.
+func (l *quotaLimiter) Wait(ctx context.Context, units int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.lastFill).Seconds()*l.rate)
+	l.lastFill = now
+
+	// Tokens may go negative: the debt is paid by waiting, and the lock
+	// keeps the other callers queued behind in order
+	l.tokens -= float64(units)
+	if l.tokens < 0 {
+		wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+		if err := sleep(ctx, wait); err != nil {
+			// Give back the units which were not used
+			l.tokens += float64(units)
+			return err
+		}
+		l.tokens = 0
+		l.lastFill = time.Now()
+	}
+	return nil
+}
@@ -1,23 +1,479 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"maps"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
 
 	"extract-email-attachments/internal"
 	"extract-email-attachments/internal/config"
 )
 
 func main() {
+	wait := flag.Duration("wait", 0, "wait up to this duration for a running instance to finish (0 exits immediately)")
+	timeout := flag.Duration("timeout", 9*time.Minute, "maximum duration of a run (0 disables the deadline)")
+	dryRun := flag.Bool("dry-run", false, "fetch emails and apply the rules without writing anything or sending documents to the extraction provider, and print the plan (not with a command)")
+	jsonPlan := flag.Bool("json", false, "with -dry-run, print the plan as JSON")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\nCommands:\n", config.AppName)
+		fmt.Fprintf(flag.CommandLine.Output(), "  (none)\tfetch the attachments of new emails, then rename and file them\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  learn\tpropose rules from the existing filing tree (learn -h for its flags)\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  train\tretrain the document type classifier from the filing tree (train -h for its flags)\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  backfill\tfetch the attachments of the emails of a past period, then rename and file them (backfill -h for its flags)\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  reprocess\tapply the rules again to stored attachments, such as after a rule changed (reprocess -h for its flags)\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  rules test\tapply the rules to past attachments and fixture emails, offline (rules test -h for its flags)\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  undo\trevert the file operations of a run, or list the runs (undo -h for its flags)\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// The commands write as a run does: a dry run of a command would not be one
+	if *dryRun && flag.Arg(0) != "" {
+		log.Fatalf("-dry-run cannot be used with the %s command", flag.Arg(0))
+	}
+
 	// Initialize application paths
 	if err := config.InitAppPaths(); err != nil {
 		log.Fatalf("Error initializing application paths: %v", err)
 	}
-	// Process emails and attachments
-	if err := internal.ProcessEmails(); err != nil {
-		log.Fatalf("Error processing emails: %v", err)
+	if err := config.LoadSettings(); err != nil {
+		log.Fatalf("Error loading settings: %v", err)
+	}
+
+	switch command := flag.Arg(0); command {
+	case "":
+	case "learn":
+		if err := learn(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "train":
+		if err := train(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "backfill":
+		if err := backfill(flag.Args()[1:], *wait); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "reprocess":
+		if err := reprocess(flag.Args()[1:], *wait); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "rules":
+		if flag.Arg(1) != "test" {
+			flag.Usage()
+			os.Exit(2)
+		}
+		if err := testRules(flag.Args()[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "undo":
+		if err := undo(flag.Args()[1:], *wait); err != nil {
+			log.Fatal(err)
+		}
+		return
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *dryRun {
+		if err := planRun(*timeout, *jsonPlan); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Prevent overlapping runs (e.g. a slow run still going when cron starts the next one)
+	lock, err := acquireRunLock(*wait)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if lock == nil {
+		return
 	}
 
-	if err := internal.ProcessAttachments(); err != nil {
-		log.Fatalf("Error processing attachments: %v", err)
+	// Stop gracefully on Ctrl-C, on termination (e.g. by cron) or after the deadline
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	if err := run(ctx); err != nil {
+		lock.Release()
+		log.Fatal(err)
+	}
+
+	if err := lock.Release(); err != nil {
+		log.Printf("Warning: Error releasing run lock: %v", err)
+	}
+}
+
+// run processes emails and attachments, recording the files written in the journal
+func run(ctx context.Context) (err error) {
+	backupActivityData()
+	journal := internal.NewJournal()
+	fmt.Printf("Run %s\n", journal.Run())
+	defer labelMessages(ctx, &err)
+
+	if err := internal.ProcessEmails(ctx, journal); err != nil {
+		return fmt.Errorf("Error processing emails: %w", err)
+	}
+
+	if err := internal.ProcessAttachments(ctx, journal); err != nil {
+		return fmt.Errorf("Error processing attachments: %w", err)
+	}
+
+	return nil
+}
+
+// acquireRunLock takes the run lock, waiting up to wait for a running
+// instance. The lock is nil, without error, if another run still holds it:
+// scheduled runs overlap, and exit quietly.
+func acquireRunLock(wait time.Duration) (*internal.FileLock, error) {
+	lock := internal.NewRunLock()
+	if err := lock.Acquire(wait); err != nil {
+		if errors.Is(err, internal.ErrAlreadyRunning) {
+			log.Printf("Already running, exiting: %v", err)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Error acquiring run lock: %w", err)
+	}
+	return lock, nil
+}
+
+// backupActivityData keeps a snapshot of the activity data before a run
+// modifies it. A run goes on without a snapshot.
+func backupActivityData() {
+	if err := internal.NewActivityManager().Backup(); err != nil {
+		log.Printf("Warning: Error backing up activity data: %v", err)
+	}
+}
+
+// labelMessages applies the outcome of the messages to the mailbox at the
+// end of a run, even a failed one so that the failures are labelled, unless
+// the run was interrupted. Its error is joined to *err.
+func labelMessages(ctx context.Context, err *error) {
+	if ctx.Err() != nil {
+		return
+	}
+	if labelErr := internal.LabelMessages(ctx); labelErr != nil {
+		*err = errors.Join(*err, fmt.Errorf("Error labelling messages: %w", labelErr))
+	}
+}
+
+// planRun prints what a run would do, without writing anything. A dry run
+// takes no run lock, since it changes nothing.
+func planRun(timeout time.Duration, asJSON bool) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// Keep the standard output for the JSON plan, progress going to the standard error
+	stdout := os.Stdout
+	if asJSON {
+		os.Stdout = os.Stderr
+		defer func() { os.Stdout = stdout }()
+	}
+
+	plan, err := internal.DryRun(ctx)
+	if plan != nil {
+		if asJSON {
+			encoder := json.NewEncoder(stdout)
+			encoder.SetIndent("", "    ")
+			if err := encoder.Encode(plan); err != nil {
+				return fmt.Errorf("Error encoding plan: %w", err)
+			}
+		} else {
+			plan.Print(stdout)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Error planning run: %w", err)
+	}
+	return nil
+}
+
+// learn proposes rules from the existing filing tree, or accepts the reviewed proposals
+func learn(args []string) error {
+	flags := flag.NewFlagSet("learn", flag.ExitOnError)
+	root := flags.String("root", config.AppSettings.ArchiveRoot, "root of the existing filing tree (archiveRoot setting)")
+	accept := flags.Bool("accept", false, "add the reviewed proposed rules to rules.json")
+	flags.Parse(args)
+
+	if *accept {
+		added, err := internal.AcceptProposals()
+		if err != nil {
+			return fmt.Errorf("Error accepting proposed rules: %w", err)
+		}
+		for _, rule := range added {
+			fmt.Printf("Added rule %s\n", rule.Name)
+		}
+		return nil
+	}
+
+	if *root == "" {
+		return fmt.Errorf("No archive root: set archiveRoot in settings.json or use -root")
+	}
+	rules, err := internal.LoadRules()
+	if err != nil {
+		return fmt.Errorf("Error loading rules: %w", err)
+	}
+	// Proposing rules changes no activity data, which a run may be writing
+	activityManager := internal.NewActivityManager()
+	if err := activityManager.LoadReadOnly(); err != nil {
+		return fmt.Errorf("Error loading activity data: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	proposals, err := internal.LearnRules(ctx, *root, rules, activityManager)
+	if err != nil {
+		return fmt.Errorf("Error learning rules: %w", err)
+	}
+	if len(proposals) == 0 {
+		fmt.Println("No new rule to propose")
+		return nil
+	}
+	for _, p := range proposals {
+		fmt.Printf("%s: %s -> %s%s (%d/%d documents, %s)\n", p.Rule.Name, p.Folder, p.Rule.Destination, p.Rule.Filename, p.Matching, p.Files, p.Condition)
+	}
+	if err := internal.SaveProposals(proposals); err != nil {
+		return fmt.Errorf("Error saving proposed rules: %w", err)
+	}
+	fmt.Printf("Review and edit %s, then run: %s learn -accept\n", filepath.Join(config.AppConfigDir, "rules-proposed.json"), config.AppName)
+	return nil
+}
+
+// train retrains the document type classifier from the filing tree
+func train(args []string) error {
+	flags := flag.NewFlagSet("train", flag.ExitOnError)
+	root := flags.String("root", config.AppSettings.ArchiveRoot, "root of the filing tree, one top-level folder per document type (archiveRoot setting)")
+	flags.Parse(args)
+
+	if *root == "" {
+		return fmt.Errorf("No archive root: set archiveRoot in settings.json or use -root")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	classifier, err := internal.TrainClassifier(ctx, *root)
+	if err != nil {
+		return fmt.Errorf("Error training classifier: %w", err)
+	}
+	if err := classifier.Save(); err != nil {
+		return fmt.Errorf("Error saving classifier: %w", err)
+	}
+	for _, docType := range slices.Sorted(maps.Keys(classifier.Types)) {
+		fmt.Printf("%s: %d documents\n", docType, classifier.Types[docType].Documents)
+	}
+	return nil
+}
+
+// backfill fetches the emails of a past period, then processes the attachments
+func backfill(args []string, wait time.Duration) (err error) {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	since := flags.String("since", "", "first day of the period, such as 2023-01-01 (required)")
+	until := flags.String("until", time.Now().Format(time.DateOnly), "last day of the period")
+	flags.Parse(args)
+
+	if *since == "" {
+		return fmt.Errorf("No period: use -since")
+	}
+	sinceDate, err := time.Parse(time.DateOnly, *since)
+	if err != nil {
+		return fmt.Errorf("Invalid -since date: %w", err)
+	}
+	untilDate, err := time.Parse(time.DateOnly, *until)
+	if err != nil {
+		return fmt.Errorf("Invalid -until date: %w", err)
+	}
+
+	lock, err := acquireRunLock(wait)
+	if err != nil || lock == nil {
+		return err
+	}
+	defer lock.Release()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	backupActivityData()
+	journal := internal.NewJournal()
+	fmt.Printf("Run %s\n", journal.Run())
+	defer labelMessages(ctx, &err)
+
+	if err := internal.Backfill(ctx, sinceDate, untilDate, journal); err != nil {
+		return fmt.Errorf("Error backfilling emails: %w", err)
+	}
+	if err := internal.ProcessAttachments(ctx, journal); err != nil {
+		return fmt.Errorf("Error processing attachments: %w", err)
+	}
+	return nil
+}
+
+// reprocess applies the rules again to the stored attachments selected by the flags
+func reprocess(args []string, wait time.Duration) (err error) {
+	flags := flag.NewFlagSet("reprocess", flag.ExitOnError)
+	var filter internal.AttachmentFilter
+	flags.StringVar(&filter.Sender, "sender", "", "part of the sender name or address")
+	since := flags.String("since", "", "first day of the emails, such as 2023-01-01")
+	until := flags.String("until", "", "last day of the emails")
+	flags.StringVar(&filter.Status, "status", "", "status of the attachments: processed, password-required or pending")
+	flags.Parse(args)
+
+	if *since != "" {
+		if filter.Since, err = time.Parse(time.DateOnly, *since); err != nil {
+			return fmt.Errorf("Invalid -since date: %w", err)
+		}
+	}
+	if *until != "" {
+		if filter.Until, err = time.Parse(time.DateOnly, *until); err != nil {
+			return fmt.Errorf("Invalid -until date: %w", err)
+		}
+	}
+	switch filter.Status {
+	case "", internal.AttachmentStatusProcessed, internal.AttachmentStatusPasswordRequired, internal.AttachmentStatusPending:
+	default:
+		return fmt.Errorf("Invalid -status: must be processed, password-required or pending")
+	}
+
+	lock, err := acquireRunLock(wait)
+	if err != nil || lock == nil {
+		return err
+	}
+	defer lock.Release()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	backupActivityData()
+	journal := internal.NewJournal()
+	fmt.Printf("Run %s\n", journal.Run())
+	defer labelMessages(ctx, &err)
+
+	count, err := internal.Reprocess(ctx, filter, journal)
+	fmt.Printf("Reprocessed %d attachments\n", count)
+	if err != nil {
+		return fmt.Errorf("Error reprocessing attachments: %w", err)
+	}
+	return nil
+}
+
+// testRules applies the rules to the attachments of the activity data and of
+// fixture emails, without writing anything
+func testRules(args []string) error {
+	flags := flag.NewFlagSet("rules test", flag.ExitOnError)
+	rulesPath := flags.String("rules", filepath.Join(config.AppConfigDir, "rules.json"), "rules file to test, such as a copy being edited")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s rules test [flags] [fixture.eml or directory...]\n\nFlags:\n", config.AppName)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	rules, err := internal.LoadRulesFile(*rulesPath)
+	if os.IsNotExist(err) && *rulesPath == filepath.Join(config.AppConfigDir, "rules.json") {
+		rules, err = internal.DefaultRules(), nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error loading rules: %w", err)
+	}
+	activityManager := internal.NewActivityManager()
+	if err := activityManager.LoadReadOnly(); err != nil {
+		return fmt.Errorf("Error loading activity data: %w", err)
+	}
+
+	// Keep the standard output for the report, warnings going to the standard error
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	defer func() { os.Stdout = stdout }()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	report, err := internal.EvaluateRules(ctx, rules, activityManager, flags.Args())
+	if err != nil {
+		return fmt.Errorf("Error testing rules: %w", err)
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "    ")
+		if err := encoder.Encode(report); err != nil {
+			return fmt.Errorf("Error encoding report: %w", err)
+		}
+		return nil
+	}
+	report.Print(stdout)
+	return nil
+}
+
+// undo reverts the file operations of a run, or lists the runs of the journal
+func undo(args []string, wait time.Duration) error {
+	flags := flag.NewFlagSet("undo", flag.ExitOnError)
+	runID := flags.String("run", "", "ID of the run to revert, as printed by the run")
+	flags.Parse(args)
+
+	if *runID == "" {
+		runs, err := internal.JournalRuns()
+		if err != nil {
+			return fmt.Errorf("Error reading journal: %w", err)
+		}
+		if len(runs) == 0 {
+			fmt.Println("No run recorded")
+			return nil
+		}
+		for _, r := range runs {
+			state := ""
+			if r.Undone {
+				state = ", undone"
+			}
+			fmt.Printf("%s: %d operations%s\n", r.Run, r.Operations, state)
+		}
+		fmt.Printf("Revert a run with: %s undo -run <id>\n", config.AppName)
+		return nil
+	}
+
+	// Do not move files under a running instance
+	lock := internal.NewRunLock()
+	if err := lock.Acquire(wait); err != nil {
+		return fmt.Errorf("Error acquiring run lock: %w", err)
+	}
+	defer lock.Release()
+
+	backupActivityData()
+	ops, err := internal.UndoRun(*runID)
+	for _, op := range ops {
+		switch op.Op {
+		case internal.JournalOpMove:
+			fmt.Printf("Moved %s back to %s\n", op.Path, op.From)
+		case internal.JournalOpUpdate:
+			fmt.Printf("Restored %s\n", op.Path)
+		default:
+			fmt.Printf("Deleted %s\n", op.Path)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Error undoing run %s: %w", *runID, err)
 	}
+	return nil
 }